@@ -0,0 +1,268 @@
+package water
+
+import (
+	"errors"
+	"sync"
+)
+
+// DefaultBufferSize is the packet capacity of buffers from a BufferPool whose
+// BufferConfig.Size is zero. It fits any IP packet.
+const DefaultBufferSize = 65535
+
+var errBufferRoom = errors.New("not enough room in packet buffer")
+
+// BufferConfig defines the layout of the buffers handed out by a BufferPool.
+// A zero-value BufferConfig is valid.
+type BufferConfig struct {
+	// Headroom is the space reserved in front of each packet, so that headers
+	// can be prepended with Push without copying the packet.
+	Headroom int
+
+	// Size is the largest packet read into a buffer. Defaults to
+	// DefaultBufferSize.
+	Size int
+
+	// Tailroom is the space reserved behind Size, so that trailers can be
+	// appended with Put even to the largest packet.
+	Tailroom int
+}
+
+// BufferPool hands out reusable PacketBuffers of a fixed layout, backed by a
+// sync.Pool. It is safe for concurrent use.
+type BufferPool struct {
+	config BufferConfig
+	pool   sync.Pool
+}
+
+// NewBufferPool creates a BufferPool for buffers laid out as described by
+// config.
+func NewBufferPool(config BufferConfig) *BufferPool {
+	if config.Size <= 0 {
+		config.Size = DefaultBufferSize
+	}
+	config.Headroom = max(config.Headroom, 0)
+	config.Tailroom = max(config.Tailroom, 0)
+	p := &BufferPool{config: config}
+	p.pool.New = func() any {
+		return &PacketBuffer{
+			buf:  make([]byte, config.Headroom+config.Size+config.Tailroom),
+			pool: p,
+		}
+	}
+	return p
+}
+
+// Get returns an empty buffer with the configured headroom.
+func (p *BufferPool) Get() *PacketBuffer {
+	b := p.pool.Get().(*PacketBuffer)
+	b.Reset()
+	return b
+}
+
+// GetBatch returns a batch of n empty buffers.
+func (p *BufferPool) GetBatch(n int) *Batch {
+	b := &Batch{Buffers: make([]*PacketBuffer, n), pool: p}
+	for i := range b.Buffers {
+		b.Buffers[i] = p.Get()
+	}
+	return b
+}
+
+// PacketBuffer holds a single packet with headroom in front of it and
+// tailroom behind it, similar to a socket buffer. The packet can grow into
+// both without being copied.
+type PacketBuffer struct {
+	buf        []byte
+	start, end int
+	pool       *BufferPool
+}
+
+// Bytes returns the packet. It aliases the buffer and is only valid until the
+// buffer is modified or released.
+func (b *PacketBuffer) Bytes() []byte {
+	return b.buf[b.start:b.end]
+}
+
+// Len returns the length of the packet.
+func (b *PacketBuffer) Len() int {
+	return b.end - b.start
+}
+
+// Headroom returns the space available in front of the packet.
+func (b *PacketBuffer) Headroom() int {
+	return b.start
+}
+
+// Tailroom returns the space available behind the packet.
+func (b *PacketBuffer) Tailroom() int {
+	return len(b.buf) - b.end
+}
+
+// Push grows the packet by n bytes at the front and returns them, e.g. to
+// write an encapsulation header. It panics if the headroom is too small.
+func (b *PacketBuffer) Push(n int) []byte {
+	if n < 0 || n > b.start {
+		panic(errBufferRoom)
+	}
+	b.start -= n
+	return b.buf[b.start : b.start+n]
+}
+
+// Pull removes n bytes from the front of the packet and returns them, e.g. to
+// strip a header. It panics if the packet is shorter than n bytes.
+func (b *PacketBuffer) Pull(n int) []byte {
+	if n < 0 || n > b.Len() {
+		panic(errBufferRoom)
+	}
+	b.start += n
+	return b.buf[b.start-n : b.start]
+}
+
+// Put grows the packet by n bytes at the end and returns them. It panics if
+// the tailroom is too small.
+func (b *PacketBuffer) Put(n int) []byte {
+	if n < 0 || n > b.Tailroom() {
+		panic(errBufferRoom)
+	}
+	b.end += n
+	return b.buf[b.end-n : b.end]
+}
+
+// Truncate shortens the packet to n bytes. It panics if n is negative or
+// larger than the packet.
+func (b *PacketBuffer) Truncate(n int) {
+	if n < 0 || n > b.Len() {
+		panic(errBufferRoom)
+	}
+	b.end = b.start + n
+}
+
+// Reset empties the buffer and restores the configured headroom.
+func (b *PacketBuffer) Reset() {
+	b.start = b.pool.config.Headroom
+	b.end = b.start
+}
+
+// Release returns the buffer to its pool. It must not be used afterwards.
+func (b *PacketBuffer) Release() {
+	b.pool.pool.Put(b)
+}
+
+// readSpace returns the space a packet is read into, from the current start
+// of the packet up to the configured size.
+func (b *PacketBuffer) readSpace() []byte {
+	return b.buf[b.start : b.pool.config.Headroom+b.pool.config.Size]
+}
+
+// Batch is a set of PacketBuffers read or written in a single vector call.
+type Batch struct {
+	// Buffers holds the packets. After ReadBatch, only the first n buffers
+	// hold packets; the rest are empty.
+	Buffers []*PacketBuffer
+
+	pool  *BufferPool
+	bufs  [][]byte
+	sizes []int
+}
+
+// Release returns all buffers to the pool. The batch must not be used
+// afterwards.
+func (b *Batch) Release() {
+	for _, buf := range b.Buffers {
+		buf.Release()
+	}
+	b.Buffers = nil
+}
+
+// shiftedPool holds the slices ReadOffset and WriteOffset use to pass buffers
+// without their offset to the vector calls.
+var shiftedPool = sync.Pool{
+	New: func() any {
+		return new([][]byte)
+	},
+}
+
+// shift returns bufs with offset bytes removed from the front of each buffer,
+// in a slice from shiftedPool.
+func shift(bufs [][]byte, offset int) *[][]byte {
+	shifted := shiftedPool.Get().(*[][]byte)
+	*shifted = (*shifted)[:0]
+	for _, buf := range bufs {
+		*shifted = append(*shifted, buf[offset:])
+	}
+	return shifted
+}
+
+// unshift clears shifted, so that it does not keep the buffers alive, and
+// returns it to shiftedPool.
+func unshift(shifted *[][]byte) {
+	clear(*shifted)
+	shiftedPool.Put(shifted)
+}
+
+// ReadOffset reads one or more packets into bufs, starting at offset in each
+// buffer, and stores their lengths in sizes. len(sizes) must be at least
+// len(bufs). It returns the number of packets read, which is at most one if
+// the interface is not vector native. This matches the Read method of
+// wireguard-go's tun.Device.
+func (ifce *Interface) ReadOffset(bufs [][]byte, sizes []int, offset int) (int, error) {
+	if !ifce.IsVectorNative() && len(bufs) > 1 {
+		bufs = bufs[:1]
+	}
+	if offset == 0 {
+		return ifce.ReadVector(bufs, sizes)
+	}
+	shifted := shift(bufs, offset)
+	defer unshift(shifted)
+	return ifce.ReadVector(*shifted, sizes)
+}
+
+// WriteOffset writes one or more packets from bufs, starting at offset in
+// each buffer. It returns the number of packets written. This matches the
+// Write method of wireguard-go's tun.Device.
+func (ifce *Interface) WriteOffset(bufs [][]byte, offset int) (int, error) {
+	if offset == 0 {
+		return ifce.WriteVector(bufs)
+	}
+	shifted := shift(bufs, offset)
+	defer unshift(shifted)
+	return ifce.WriteVector(*shifted)
+}
+
+// ReadBatch resets the buffers of b and reads one or more packets into them,
+// behind their headroom. It returns the number of packets read. If the
+// interface is not vector native, only the first buffer is used, as every
+// further buffer would take another blocking read.
+func (ifce *Interface) ReadBatch(b *Batch) (int, error) {
+	b.bufs = b.bufs[:0]
+	for _, buf := range b.Buffers {
+		buf.Reset()
+		b.bufs = append(b.bufs, buf.readSpace())
+	}
+	if !ifce.IsVectorNative() && len(b.bufs) > 1 {
+		b.bufs = b.bufs[:1]
+	}
+	if cap(b.sizes) < len(b.bufs) {
+		b.sizes = make([]int, len(b.bufs))
+	}
+	b.sizes = b.sizes[:len(b.bufs)]
+
+	n, err := ifce.ReadVector(b.bufs, b.sizes)
+	for i := range n {
+		b.Buffers[i].Put(b.sizes[i])
+	}
+	return n, err
+}
+
+// WriteBatch writes the packets of all buffers of b. It returns the number of
+// packets written. Empty buffers are skipped and not counted, as a zero-length
+// write is not a packet and some devices reject it.
+func (ifce *Interface) WriteBatch(b *Batch) (int, error) {
+	b.bufs = b.bufs[:0]
+	for _, buf := range b.Buffers {
+		if buf.Len() > 0 {
+			b.bufs = append(b.bufs, buf.Bytes())
+		}
+	}
+	return ifce.WriteVector(b.bufs)
+}
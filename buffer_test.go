@@ -0,0 +1,134 @@
+package water
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// queueDevice returns queued packets from Read and records writes.
+type queueDevice struct {
+	in  [][]byte
+	out [][]byte
+}
+
+func (q *queueDevice) Read(b []byte) (int, error) {
+	if len(q.in) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, q.in[0])
+	q.in = q.in[1:]
+	return n, nil
+}
+
+func (q *queueDevice) Write(b []byte) (int, error) {
+	q.out = append(q.out, bytes.Clone(b))
+	return len(b), nil
+}
+
+func (q *queueDevice) Close() error {
+	return nil
+}
+
+func TestPacketBuffer(t *testing.T) {
+	pool := NewBufferPool(BufferConfig{Headroom: 16, Size: 100, Tailroom: 4})
+	b := pool.Get()
+	if b.Len() != 0 || b.Headroom() != 16 || b.Tailroom() != 104 {
+		t.Fatalf("new buffer: len %d, headroom %d, tailroom %d", b.Len(), b.Headroom(), b.Tailroom())
+	}
+
+	copy(b.Put(5), "hello")
+	copy(b.Push(3), "hdr")
+	copy(b.Put(2), "!!")
+	if got := string(b.Bytes()); got != "hdrhello!!" {
+		t.Errorf("packet = %q", got)
+	}
+	if got := string(b.Pull(3)); got != "hdr" {
+		t.Errorf("pulled %q", got)
+	}
+	b.Truncate(5)
+	if got := string(b.Bytes()); got != "hello" {
+		t.Errorf("truncated packet = %q", got)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("Push beyond headroom did not panic")
+			}
+		}()
+		b.Push(b.Headroom() + 1)
+	}()
+
+	b.Release()
+	if b := pool.Get(); b.Len() != 0 || b.Headroom() != 16 {
+		t.Errorf("reused buffer not reset: len %d, headroom %d", b.Len(), b.Headroom())
+	}
+}
+
+func TestBatch(t *testing.T) {
+	q := &queueDevice{in: [][]byte{[]byte("one"), []byte("two")}}
+	ifce, err := NewFromReadWriteCloser(q, TUN, "fake0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := NewBufferPool(BufferConfig{Headroom: 4, Size: 10})
+	batch := pool.GetBatch(2)
+	defer batch.Release()
+	// The device is not vector native, so only one packet is read.
+	n, err := ifce.ReadBatch(batch)
+	if err != nil || n != 1 {
+		t.Fatalf("ReadBatch = %d, %v", n, err)
+	}
+	if batch.Buffers[1].Len() != 0 {
+		t.Fatalf("second buffer holds %q", batch.Buffers[1].Bytes())
+	}
+	copy(batch.Buffers[1].Put(3), "two")
+	for i, want := range []string{"one", "two"} {
+		if got := string(batch.Buffers[i].Bytes()); got != want {
+			t.Errorf("packet %d = %q, want %q", i, got, want)
+		}
+		copy(batch.Buffers[i].Push(4), "hdr:")
+	}
+
+	if n, err := ifce.WriteBatch(batch); err != nil || n != 2 {
+		t.Fatalf("WriteBatch = %d, %v", n, err)
+	}
+	if string(q.out[0]) != "hdr:one" || string(q.out[1]) != "hdr:two" {
+		t.Errorf("written %q", q.out)
+	}
+
+	// Empty buffers are skipped.
+	batch.Buffers[0].Reset()
+	if n, err := ifce.WriteBatch(batch); err != nil || n != 1 {
+		t.Fatalf("WriteBatch with an empty buffer = %d, %v", n, err)
+	}
+	if len(q.out) != 3 || string(q.out[2]) != "hdr:two" {
+		t.Errorf("written %q", q.out)
+	}
+}
+
+func TestOffset(t *testing.T) {
+	q := &queueDevice{in: [][]byte{[]byte("packet")}}
+	ifce, err := NewFromReadWriteCloser(q, TUN, "fake0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bufs := [][]byte{make([]byte, 32)}
+	sizes := make([]int, 1)
+	if n, err := ifce.ReadOffset(bufs, sizes, 16); err != nil || n != 1 || sizes[0] != 6 {
+		t.Fatalf("ReadOffset = %d, %v, size %d", n, err, sizes[0])
+	}
+	if got := string(bufs[0][16:22]); got != "packet" {
+		t.Errorf("read %q at offset", got)
+	}
+
+	if n, err := ifce.WriteOffset([][]byte{[]byte("....data")}, 4); err != nil || n != 1 {
+		t.Fatalf("WriteOffset = %d, %v", n, err)
+	}
+	if string(q.out[0]) != "data" {
+		t.Errorf("written %q", q.out[0])
+	}
+}
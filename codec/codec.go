@@ -0,0 +1,248 @@
+// Package codec carries packets over stream transports such as TCP, TLS or
+// unix stream sockets by prefixing each packet with its length.
+package codec
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// PrefixSize is the size in bytes of the big-endian length prefix in front of
+// every packet.
+type PrefixSize int
+
+// Supported prefix sizes.
+const (
+	Prefix16 PrefixSize = 2
+	Prefix32 PrefixSize = 4
+)
+
+// MaxPacketSize is the largest packet accepted with Prefix32. With Prefix16
+// the limit is 65535 bytes.
+const MaxPacketSize = 1 << 24
+
+var (
+	ErrInvalidPrefixSize = errors.New("invalid prefix size")
+	ErrPacketTooLarge    = errors.New("packet too large")
+)
+
+// Codec reads and writes length-prefixed packets on a stream. Reads and writes
+// are buffered; written packets are only sent once Flush is called, which
+// allows batching several packets into a single write on the stream.
+//
+// Read and Write preserve packet boundaries, so a Codec can be used in place
+// of a TUN/TAP device. A Codec also implements water.VectorReadWrite.
+type Codec struct {
+	rw     io.ReadWriter
+	prefix PrefixSize
+	max    int
+
+	rmu     sync.Mutex
+	r       *bufio.Reader
+	rLenBuf [4]byte
+	rErr    error
+	dropped atomic.Uint64
+
+	wmu     sync.Mutex
+	w       *bufio.Writer
+	wLenBuf [4]byte
+}
+
+// New creates a Codec on rw using the given prefix size.
+func New(rw io.ReadWriter, prefix PrefixSize) (*Codec, error) {
+	c := &Codec{
+		rw:     rw,
+		prefix: prefix,
+		r:      bufio.NewReaderSize(rw, 64*1024),
+		w:      bufio.NewWriterSize(rw, 64*1024),
+	}
+	switch prefix {
+	case Prefix16:
+		c.max = 0xFFFF
+	case Prefix32:
+		c.max = MaxPacketSize
+	default:
+		return nil, ErrInvalidPrefixSize
+	}
+	return c, nil
+}
+
+// ReadPacket reads a single packet into b and returns its size. If the packet
+// does not fit in b, it is discarded, counted in Dropped and io.ErrShortBuffer
+// is returned.
+//
+// A length prefix above the limit of the prefix size returns
+// ErrPacketTooLarge. The packet is not discarded, as the prefix most likely
+// means that the stream is corrupt, and the stream is unusable afterwards:
+// every later read returns the same error.
+func (c *Codec) ReadPacket(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	return c.readPacket(b)
+}
+
+func (c *Codec) readPacket(b []byte) (int, error) {
+	if c.rErr != nil {
+		return 0, c.rErr
+	}
+	lenBuf := c.rLenBuf[:c.prefix]
+	if _, err := io.ReadFull(c.r, lenBuf); err != nil {
+		return 0, err
+	}
+	size := c.decodeLength(lenBuf)
+	if size > c.max {
+		c.rErr = fmt.Errorf("%w: %d bytes", ErrPacketTooLarge, size)
+		return 0, c.rErr
+	}
+	if size > len(b) {
+		if _, err := c.r.Discard(size); err != nil {
+			return 0, noEOF(err)
+		}
+		c.dropped.Add(1)
+		return 0, io.ErrShortBuffer
+	}
+	if _, err := io.ReadFull(c.r, b[:size]); err != nil {
+		return 0, noEOF(err)
+	}
+	return size, nil
+}
+
+// Dropped returns the number of packets discarded because they did not fit in
+// the buffer passed to ReadPacket.
+func (c *Codec) Dropped() uint64 {
+	return c.dropped.Load()
+}
+
+// bufferedPacket reports whether a complete packet is already buffered, so
+// that it can be read without blocking.
+func (c *Codec) bufferedPacket() bool {
+	if c.r.Buffered() < int(c.prefix) {
+		return false
+	}
+	lenBuf, err := c.r.Peek(int(c.prefix))
+	if err != nil {
+		return false
+	}
+	return c.r.Buffered() >= int(c.prefix)+c.decodeLength(lenBuf)
+}
+
+func (c *Codec) decodeLength(lenBuf []byte) int {
+	if c.prefix == Prefix16 {
+		return int(binary.BigEndian.Uint16(lenBuf))
+	}
+	return int(binary.BigEndian.Uint32(lenBuf))
+}
+
+// WritePacket queues a single packet. It is sent once Flush is called or the
+// write buffer fills up.
+func (c *Codec) WritePacket(p []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	return c.writePacket(p)
+}
+
+func (c *Codec) writePacket(p []byte) error {
+	if len(p) > c.max {
+		return fmt.Errorf("%w: %d bytes", ErrPacketTooLarge, len(p))
+	}
+	lenBuf := c.wLenBuf[:c.prefix]
+	if c.prefix == Prefix16 {
+		binary.BigEndian.PutUint16(lenBuf, uint16(len(p))) // #nosec G115 -- checked against c.max above
+	} else {
+		binary.BigEndian.PutUint32(lenBuf, uint32(len(p))) // #nosec G115 -- checked against c.max above
+	}
+	if _, err := c.w.Write(lenBuf); err != nil {
+		return err
+	}
+	_, err := c.w.Write(p)
+	return err
+}
+
+// Flush sends all queued packets.
+func (c *Codec) Flush() error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	return c.w.Flush()
+}
+
+// Read reads a single packet into b. See ReadPacket.
+func (c *Codec) Read(b []byte) (int, error) {
+	return c.ReadPacket(b)
+}
+
+// Write sends p as a single packet and flushes the write buffer.
+func (c *Codec) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if err := c.writePacket(p); err != nil {
+		return 0, err
+	}
+	if err := c.w.Flush(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// ReadVector blocks until at least one packet is available and then reads as
+// many packets as are already buffered, up to len(bufs).
+func (c *Codec) ReadVector(bufs [][]byte, sizes []int) (n int, err error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	for i, buf := range bufs {
+		if i > 0 && !c.bufferedPacket() {
+			return i, nil
+		}
+		sizes[i], err = c.readPacket(buf)
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(bufs), nil
+}
+
+// WriteVector sends all packets in bufs with a single flush.
+func (c *Codec) WriteVector(bufs [][]byte) (n int, err error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	for i, buf := range bufs {
+		if err = c.writePacket(buf); err != nil {
+			return i, err
+		}
+	}
+	if err = c.w.Flush(); err != nil {
+		return 0, err
+	}
+	return len(bufs), nil
+}
+
+// IsVectorNative returns true, as vector writes are batched into a single
+// write on the stream.
+func (c *Codec) IsVectorNative() bool {
+	return true
+}
+
+// Close closes the underlying stream if it implements io.Closer.
+func (c *Codec) Close() error {
+	if closer, ok := c.rw.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,157 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Doridian/water/internal/fakedev"
+)
+
+func TestRoundTrip(t *testing.T) {
+	for _, prefix := range []PrefixSize{Prefix16, Prefix32} {
+		var stream bytes.Buffer
+		c, err := New(&stream, prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		packets := [][]byte{{0x45, 0x00}, {}, bytes.Repeat([]byte{0xaa}, 1500)}
+		if n, err := c.WriteVector(packets); err != nil || n != len(packets) {
+			t.Fatalf("WriteVector: %d, %v", n, err)
+		}
+		if want := 3*int(prefix) + 2 + 1500; stream.Len() != want {
+			t.Fatalf("expected %d bytes on stream, got %d", want, stream.Len())
+		}
+
+		bufs := [][]byte{make([]byte, 2000), make([]byte, 2000), make([]byte, 2000), make([]byte, 2000)}
+		sizes := make([]int, len(bufs))
+		n, err := c.ReadVector(bufs, sizes)
+		if err != nil || n != len(packets) {
+			t.Fatalf("ReadVector: %d, %v", n, err)
+		}
+		for i, p := range packets {
+			if !bytes.Equal(bufs[i][:sizes[i]], p) {
+				t.Fatalf("packet %d mismatch", i)
+			}
+		}
+
+		if _, err := c.Read(bufs[0]); err != io.EOF {
+			t.Fatalf("expected io.EOF, got %v", err)
+		}
+	}
+}
+
+func TestShortBuffer(t *testing.T) {
+	var stream bytes.Buffer
+	c, _ := New(&stream, Prefix16)
+	_, _ = c.Write([]byte{1, 2, 3, 4})
+	_, _ = c.Write([]byte{5})
+
+	buf := make([]byte, 2)
+	if _, err := c.Read(buf); err != io.ErrShortBuffer {
+		t.Fatalf("expected io.ErrShortBuffer, got %v", err)
+	}
+	if n, err := c.Read(buf); err != nil || n != 1 || buf[0] != 5 {
+		t.Fatalf("stream out of sync after short read: %d, %v", n, err)
+	}
+}
+
+func TestTooLarge(t *testing.T) {
+	var stream bytes.Buffer
+	c, _ := New(&stream, Prefix16)
+	if _, err := c.Write(make([]byte, 70000)); !errors.Is(err, ErrPacketTooLarge) {
+		t.Fatalf("expected ErrPacketTooLarge, got %v", err)
+	}
+	if _, err := New(&stream, 3); err != ErrInvalidPrefixSize {
+		t.Fatalf("expected ErrInvalidPrefixSize, got %v", err)
+	}
+
+	// An oversized prefix leaves the stream unusable.
+	stream.Reset()
+	c, _ = New(&stream, Prefix32)
+	_, _ = stream.Write([]byte{0x10, 0, 0, 0, 1, 2, 3})
+	_ = c.WritePacket([]byte{4})
+	_ = c.Flush()
+	buf := make([]byte, 100)
+	for range 2 {
+		if _, err := c.Read(buf); !errors.Is(err, ErrPacketTooLarge) {
+			t.Fatalf("expected ErrPacketTooLarge, got %v", err)
+		}
+	}
+}
+
+func TestForward(t *testing.T) {
+	dev := fakedev.NewVector()
+	local, remote := net.Pipe()
+	conn, _ := New(local, Prefix32)
+	peer, _ := New(remote, Prefix32)
+
+	done := make(chan error, 1)
+	go func() { done <- Forward(dev, conn) }()
+
+	dev.In <- []byte{0x45, 1, 2, 3}
+	buf := make([]byte, 100)
+	n, err := peer.Read(buf)
+	if err != nil || !bytes.Equal(buf[:n], []byte{0x45, 1, 2, 3}) {
+		t.Fatalf("unexpected packet from device: % x, %v", buf[:n], err)
+	}
+
+	if _, err := peer.Write([]byte{0x60, 4, 5}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case p := <-dev.Out:
+		if !bytes.Equal(p, []byte{0x60, 4, 5}) {
+			t.Fatalf("unexpected packet to device: % x", p)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for packet to device")
+	}
+
+	_ = peer.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("expected clean shutdown, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Forward did not return after the connection closed")
+	}
+	select {
+	case <-dev.Closed():
+	default:
+		t.Fatal("device was not closed")
+	}
+}
+
+func TestForwardOversized(t *testing.T) {
+	dev := fakedev.NewVector()
+	local, remote := net.Pipe()
+	conn, _ := New(local, Prefix32)
+	peer, _ := New(remote, Prefix32)
+
+	done := make(chan error, 1)
+	go func() { done <- Forward(dev, conn) }()
+
+	if _, err := peer.Write(make([]byte, 70000)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := peer.Write([]byte{0x60, 4, 5}); err != nil {
+		t.Fatal(err)
+	}
+	if p := dev.Expect(t); !bytes.Equal(p, []byte{0x60, 4, 5}) {
+		t.Fatalf("unexpected packet to device: % x", p)
+	}
+	if conn.Dropped() != 1 {
+		t.Fatalf("expected 1 dropped packet, got %d", conn.Dropped())
+	}
+
+	_ = peer.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("expected clean shutdown, got %v", err)
+	}
+}
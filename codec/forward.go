@@ -0,0 +1,97 @@
+package codec
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/Doridian/water"
+)
+
+const (
+	forwardBatchSize  = 16
+	forwardBufferSize = 65535
+)
+
+// Device is the part of *water.Interface used by Forward.
+type Device interface {
+	io.ReadWriteCloser
+	water.VectorReadWrite
+}
+
+// Forward pumps packets from ifce to conn and from conn to ifce until either
+// direction fails. It then closes both ifce and conn, waits for the other
+// direction to stop and returns the first error. A clean shutdown, i.e. conn
+// reaching EOF or either side being closed, returns nil.
+//
+// Packets from conn that are larger than 65535 bytes do not fit in a TUN/TAP
+// device; they are dropped, counted in conn.Dropped, and forwarding goes on.
+func Forward(ifce Device, conn *Codec) error {
+	var (
+		once     sync.Once
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	stop := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			_ = ifce.Close()
+			_ = conn.Close()
+		})
+	}
+
+	batch := 1
+	if ifce.IsVectorNative() {
+		batch = forwardBatchSize
+	}
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		stop(pump(ifce, conn, batch))
+	}()
+	go func() {
+		defer wg.Done()
+		stop(pump(conn, ifce, forwardBatchSize))
+	}()
+	wg.Wait()
+
+	if isClosed(firstErr) {
+		return nil
+	}
+	return firstErr
+}
+
+func pump(from water.VectorReadWrite, to water.VectorReadWrite, batch int) error {
+	bufs := make([][]byte, batch)
+	for i := range bufs {
+		bufs[i] = make([]byte, forwardBufferSize)
+	}
+	sizes := make([]int, batch)
+	out := make([][]byte, batch)
+
+	for {
+		n, err := from.ReadVector(bufs, sizes)
+		for i := 0; i < n; i++ {
+			out[i] = bufs[i][:sizes[i]]
+		}
+		if n > 0 {
+			if _, werr := to.WriteVector(out[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err != nil && !errors.Is(err, io.ErrShortBuffer) {
+			return err
+		}
+	}
+}
+
+func isClosed(err error) bool {
+	return err == nil ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, os.ErrClosed) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, io.ErrClosedPipe)
+}
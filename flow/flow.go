@@ -0,0 +1,233 @@
+// Package flow extracts a key identifying the flow a packet belongs to, so
+// that packets can be spread across workers or queues while every flow stays
+// in order.
+package flow
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"github.com/Doridian/water/waterutil"
+)
+
+// ErrNotIP is returned by FromFrame for frames that carry neither IPv4 nor
+// IPv6.
+var ErrNotIP = errors.New("frame does not carry an IP packet")
+
+// FlowKey identifies a flow by its 5-tuple and VLAN IDs. It is comparable and
+// can be used as a map key.
+//
+// Ports are only set for TCP, UDP, DCCP and SCTP. For ICMP echo requests and
+// replies, both ports hold the echo identifier. Fragments, including the first
+// one, carry no ports, so that all fragments of a datagram map to the same
+// key. ICMP errors map to the flow of the packet they quote, in the direction
+// of the error, so that they reach the same worker as the flow's packets.
+type FlowKey struct {
+	// VLAN and InnerVLAN are the VLAN IDs of the outer and inner tag of a
+	// TAP frame, or zero if absent.
+	VLAN, InnerVLAN uint16
+
+	Protocol         waterutil.IPProtocol
+	Src, Dst         netip.Addr
+	SrcPort, DstPort uint16
+}
+
+// FromPacket returns the key of an IPv4 or IPv6 packet, as read from a TUN
+// interface.
+func FromPacket(packet []byte) (FlowKey, error) {
+	var k FlowKey
+	if err := k.parse(packet); err != nil {
+		return FlowKey{}, err
+	}
+	return k, nil
+}
+
+// FromFrame returns the key of an Ethernet frame carrying an IPv4 or IPv6
+// packet, as read from a TAP interface. Up to two VLAN tags are recorded.
+func FromFrame(frame []byte) (FlowKey, error) {
+	if err := waterutil.ValidateMACFrame(frame); err != nil {
+		return FlowKey{}, err
+	}
+	var k FlowKey
+	n := 0
+	for tag := range waterutil.MACVLANTags(frame) {
+		switch n {
+		case 0:
+			k.VLAN = tag.VID()
+		case 1:
+			k.InnerVLAN = tag.VID()
+		}
+		n++
+	}
+	switch waterutil.MACEthertype(frame) {
+	case waterutil.IPv4, waterutil.IPv6:
+	default:
+		return FlowKey{}, ErrNotIP
+	}
+	if err := k.parse(waterutil.MACPayload(frame)); err != nil {
+		return FlowKey{}, err
+	}
+	return k, nil
+}
+
+// parse fills k from a complete IP packet, resolving ICMP errors to the flow
+// they refer to.
+func (k *FlowKey) parse(packet []byte) error {
+	if err := waterutil.ValidateIP(packet); err != nil {
+		return err
+	}
+	if waterutil.IPVersion(packet) == 4 {
+		packet = packet[:waterutil.IPv4TotalLength(packet)]
+	} else {
+		packet = packet[:40+int(waterutil.IPv6PayloadLength(packet))]
+	}
+
+	hdr := k.parseIP(packet)
+	if len(hdr) < 8 || !isICMPError(k.Protocol, hdr[0]) {
+		return nil
+	}
+	inner := FlowKey{VLAN: k.VLAN, InnerVLAN: k.InnerVLAN}
+	if inner.parseIP(hdr[8:]); !inner.Src.IsValid() {
+		// The quote is too short to tell the flow.
+		return nil
+	}
+	*k = inner.Reverse()
+	return nil
+}
+
+// parseIP fills the addresses, protocol and ports of k from the IP header at
+// the start of b. b may end anywhere after the IP header, as in the quote of
+// an ICMP error. It returns the upper-layer header, or nil if it is absent or
+// b is a fragment.
+func (k *FlowKey) parseIP(b []byte) []byte {
+	var (
+		hdr      []byte
+		fragment bool
+	)
+	switch {
+	case len(b) >= 20 && waterutil.IPVersion(b) == 4:
+		ihl := int(b[0]&0x0F) * 4
+		if ihl < 20 || len(b) < ihl {
+			return nil
+		}
+		k.Src = netip.AddrFrom4([4]byte(b[12:16]))
+		k.Dst = netip.AddrFrom4([4]byte(b[16:20]))
+		k.Protocol = waterutil.IPv4Protocol(b)
+		fragment = waterutil.IPv4IsFragment(b)
+		hdr = b[ihl:]
+	case len(b) >= 40 && waterutil.IPVersion(b) == 6:
+		k.Src = netip.AddrFrom16([16]byte(b[8:24]))
+		k.Dst = netip.AddrFrom16([16]byte(b[24:40]))
+		k.Protocol = waterutil.IPv6NextHeader(b)
+		offset := 40
+		for hdrType, ext := range waterutil.IPv6ExtensionHeaders(b) {
+			fragment = fragment || hdrType == waterutil.IPv6_Frag
+			k.Protocol = waterutil.IPProtocol(ext[0])
+			offset += len(ext)
+		}
+		if waterutil.IsIPv6ExtensionHeader(k.Protocol) {
+			// Truncated chain, the upper-layer protocol is unknown.
+			return nil
+		}
+		hdr = b[offset:]
+	default:
+		return nil
+	}
+	if fragment {
+		return nil
+	}
+
+	switch k.Protocol {
+	case waterutil.TCP, waterutil.UDP, waterutil.DCCP, waterutil.SCTP:
+		if len(hdr) >= 4 {
+			k.SrcPort = binary.BigEndian.Uint16(hdr[0:2])
+			k.DstPort = binary.BigEndian.Uint16(hdr[2:4])
+		}
+	case waterutil.ICMP, waterutil.IPv6_ICMP:
+		if len(hdr) >= 8 && isICMPEcho(k.Protocol, hdr[0]) {
+			k.SrcPort = binary.BigEndian.Uint16(hdr[4:6])
+			k.DstPort = k.SrcPort
+		}
+	}
+	return hdr
+}
+
+func isICMPEcho(protocol waterutil.IPProtocol, icmpType byte) bool {
+	if protocol == waterutil.ICMP {
+		return icmpType == waterutil.ICMPv4EchoRequest || icmpType == waterutil.ICMPv4EchoReply
+	}
+	return icmpType == waterutil.ICMPv6EchoRequest || icmpType == waterutil.ICMPv6EchoReply
+}
+
+func isICMPError(protocol waterutil.IPProtocol, icmpType byte) bool {
+	switch protocol {
+	case waterutil.ICMP:
+		switch icmpType {
+		case waterutil.ICMPv4DestinationUnreachable, waterutil.ICMPv4SourceQuench, waterutil.ICMPv4Redirect,
+			waterutil.ICMPv4TimeExceeded, waterutil.ICMPv4ParameterProblem:
+			return true
+		}
+	case waterutil.IPv6_ICMP:
+		// ICMPv6 error messages have types below 128.
+		return icmpType < 128
+	}
+	return false
+}
+
+// Reverse returns the key of the opposite direction.
+func (k FlowKey) Reverse() FlowKey {
+	k.Src, k.Dst = k.Dst, k.Src
+	k.SrcPort, k.DstPort = k.DstPort, k.SrcPort
+	return k
+}
+
+// Canonical returns the direction-normalized key, which is the same for both
+// directions of a flow. Its source is the lower of the two endpoints.
+func (k FlowKey) Canonical() FlowKey {
+	if c := k.Src.Compare(k.Dst); c > 0 || (c == 0 && k.SrcPort > k.DstPort) {
+		return k.Reverse()
+	}
+	return k
+}
+
+// Hash returns a hash of the key that is the same for both directions of a
+// flow. It is stable across processes, so it can also select hardware or
+// multiqueue queues.
+func (k FlowKey) Hash() uint64 {
+	k = k.Canonical()
+	var b [41]byte
+	binary.BigEndian.PutUint16(b[0:2], k.VLAN)
+	binary.BigEndian.PutUint16(b[2:4], k.InnerVLAN)
+	b[4] = byte(k.Protocol)
+	src, dst := k.Src.As16(), k.Dst.As16()
+	copy(b[5:21], src[:])
+	copy(b[21:37], dst[:])
+	binary.BigEndian.PutUint16(b[37:39], k.SrcPort)
+	binary.BigEndian.PutUint16(b[39:41], k.DstPort)
+
+	// FNV-1a followed by a finalizer to spread the low bits, which callers
+	// typically use as a queue index.
+	h := uint64(14695981039346656037)
+	for _, c := range b {
+		h ^= uint64(c)
+		h *= 1099511628211
+	}
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	return h
+}
+
+func (k FlowKey) String() string {
+	s := fmt.Sprintf("%d %s -> %s",
+		k.Protocol, netip.AddrPortFrom(k.Src, k.SrcPort), netip.AddrPortFrom(k.Dst, k.DstPort))
+	if k.VLAN != 0 {
+		s += fmt.Sprintf(" vlan %d", k.VLAN)
+		if k.InnerVLAN != 0 {
+			s += fmt.Sprintf(".%d", k.InnerVLAN)
+		}
+	}
+	return s
+}
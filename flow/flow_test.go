@@ -0,0 +1,186 @@
+package flow
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/Doridian/water/ipfrag"
+	"github.com/Doridian/water/waterutil"
+)
+
+var (
+	client4 = netip.MustParseAddr("10.0.0.1")
+	server4 = netip.MustParseAddr("10.0.0.2")
+	router4 = netip.MustParseAddr("10.0.0.254")
+	client6 = netip.MustParseAddr("fd00::1")
+	server6 = netip.MustParseAddr("fd00::2")
+	router6 = netip.MustParseAddr("fd00::fe")
+)
+
+// buildUDP returns a UDP packet with the given payload size.
+func buildUDP(src, dst netip.Addr, srcPort, dstPort uint16, size int) []byte {
+	udp := make([]byte, 8+size)
+	binary.BigEndian.PutUint16(udp[0:2], srcPort)
+	binary.BigEndian.PutUint16(udp[2:4], dstPort)
+	binary.BigEndian.PutUint16(udp[4:6], uint16(len(udp)))
+	var packet []byte
+	if src.Is4() {
+		packet = waterutil.AppendIPv4Header(nil, waterutil.UDP, waterutil.DefaultTTL, src, dst, len(udp))
+	} else {
+		packet = waterutil.AppendIPv6Header(nil, waterutil.UDP, waterutil.DefaultTTL, src, dst, len(udp))
+	}
+	packet = append(packet, udp...)
+	_ = waterutil.FixTransportChecksum(packet)
+	return packet
+}
+
+func mustKey(t *testing.T, packet []byte) FlowKey {
+	t.Helper()
+	k, err := FromPacket(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestFromPacket(t *testing.T) {
+	for _, tt := range []struct{ client, server netip.Addr }{{client4, server4}, {client6, server6}} {
+		k := mustKey(t, buildUDP(tt.client, tt.server, 1234, 53, 10))
+		want := FlowKey{Protocol: waterutil.UDP, Src: tt.client, Dst: tt.server, SrcPort: 1234, DstPort: 53}
+		if k != want {
+			t.Errorf("key = %v, want %v", k, want)
+		}
+
+		reply := mustKey(t, buildUDP(tt.server, tt.client, 53, 1234, 10))
+		if reply != k.Reverse() {
+			t.Errorf("reply key = %v, want %v", reply, k.Reverse())
+		}
+		if reply.Hash() != k.Hash() {
+			t.Error("hash is not symmetric")
+		}
+		if reply.Canonical() != k.Canonical() {
+			t.Error("canonical form differs between directions")
+		}
+		if other := mustKey(t, buildUDP(tt.client, tt.server, 1235, 53, 10)); other.Hash() == k.Hash() {
+			t.Error("different flows have the same hash")
+		}
+	}
+}
+
+func TestCanonical(t *testing.T) {
+	k := FlowKey{Protocol: waterutil.TCP, Src: server4, Dst: client4, SrcPort: 80, DstPort: 1234}
+	if c := k.Canonical(); c.Src != client4 || c.SrcPort != 1234 {
+		t.Errorf("canonical = %v", c)
+	}
+	// Same address, ordered by port.
+	k = FlowKey{Protocol: waterutil.UDP, Src: client4, Dst: client4, SrcPort: 2000, DstPort: 1000}
+	if c := k.Canonical(); c.SrcPort != 1000 {
+		t.Errorf("canonical = %v", c)
+	}
+}
+
+func TestFromFrame(t *testing.T) {
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	frame := waterutil.AppendEthernetHeader(nil, mac, mac, waterutil.IPv6)
+	frame = append(frame, buildUDP(client6, server6, 1234, 53, 10)...)
+	frame, err := waterutil.PushVLANTag(frame, waterutil.IEEE802_1Q, waterutil.VLANTCI(0, false, 20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame, err = waterutil.PushVLANTag(frame, waterutil.IEEE802_1ad, waterutil.VLANTCI(0, false, 10)); err != nil {
+		t.Fatal(err)
+	}
+	frame = append(frame, 0, 0, 0, 0) // padding
+
+	k, err := FromFrame(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := FlowKey{VLAN: 10, InnerVLAN: 20, Protocol: waterutil.UDP, Src: client6, Dst: server6, SrcPort: 1234, DstPort: 53}
+	if k != want {
+		t.Errorf("key = %v, want %v", k, want)
+	}
+	if k.String() != "17 [fd00::1]:1234 -> [fd00::2]:53 vlan 10.20" {
+		t.Errorf("String = %q", k.String())
+	}
+
+	untagged := mustKey(t, buildUDP(client6, server6, 1234, 53, 10))
+	if untagged.Hash() == k.Hash() {
+		t.Error("VLAN is not part of the hash")
+	}
+
+	arp := waterutil.BuildARPRequest(mac, client4, server4)
+	if _, err := FromFrame(arp); err != ErrNotIP {
+		t.Errorf("ARP: %v", err)
+	}
+}
+
+func TestFragments(t *testing.T) {
+	for _, tt := range []struct{ client, server netip.Addr }{{client4, server4}, {client6, server6}} {
+		frags, err := ipfrag.Fragment(buildUDP(tt.client, tt.server, 1234, 53, 3000), 1280)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := FlowKey{Protocol: waterutil.UDP, Src: tt.client, Dst: tt.server}
+		for i, frag := range frags {
+			if k := mustKey(t, frag); k != want {
+				t.Errorf("fragment %d: key = %v, want %v", i, k, want)
+			}
+		}
+	}
+}
+
+func TestICMP(t *testing.T) {
+	for _, tt := range []struct{ client, server, router netip.Addr }{
+		{client4, server4, router4},
+		{client6, server6, router6},
+	} {
+		request := mustKey(t, waterutil.BuildEchoRequest(tt.client, tt.server, 42, 1, nil))
+		if request.SrcPort != 42 || request.DstPort != 42 {
+			t.Errorf("echo key = %v", request)
+		}
+		reply, err := waterutil.BuildEchoReply(waterutil.BuildEchoRequest(tt.client, tt.server, 42, 1, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if k := mustKey(t, reply); k != request.Reverse() {
+			t.Errorf("echo reply key = %v, want %v", k, request.Reverse())
+		}
+
+		// An error from a router on the path maps to the flow it refers to.
+		packet := buildUDP(tt.client, tt.server, 1234, 53, 10)
+		flow := mustKey(t, packet)
+		icmpErr, err := waterutil.BuildPortUnreachable(packet, tt.router)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if k := mustKey(t, icmpErr); k != flow.Reverse() {
+			t.Errorf("ICMP error key = %v, want %v", k, flow.Reverse())
+		}
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	packet := buildUDP(client4, server4, 1234, 53, 10)
+	for i := range packet[:20] {
+		if _, err := FromPacket(packet[:i]); err == nil {
+			t.Errorf("truncated to %d bytes: no error", i)
+		}
+	}
+	if _, err := FromFrame(make([]byte, 10)); err == nil {
+		t.Error("short frame: no error")
+	}
+}
+
+func TestAllocs(t *testing.T) {
+	packet := buildUDP(client6, server6, 1234, 53, 100)
+	allocs := testing.AllocsPerRun(100, func() {
+		k, _ := FromPacket(packet)
+		_ = k.Hash()
+	})
+	if allocs != 0 {
+		t.Errorf("%v allocations per packet", allocs)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 )
 
 type VectorReadWrite interface {
@@ -80,6 +81,28 @@ func New(config Config) (ifce *Interface, err error) {
 	}
 }
 
+// NewFromReadWriteCloser creates an Interface on top of an existing userspace
+// transport. Every Read on rwc must return exactly one IP packet (TUN) or
+// Ethernet frame (TAP), and every Write must send exactly one. If rwc also
+// implements VectorReadWrite, it is used for vector reads and writes.
+func NewFromReadWriteCloser(rwc io.ReadWriteCloser, deviceType DeviceType, name string) (*Interface, error) {
+	switch deviceType {
+	case TUN, TAP:
+	default:
+		return nil, errors.New("unknown device type")
+	}
+	vrw, ok := rwc.(VectorReadWrite)
+	if !ok {
+		vrw = &ReadWriteVectorProxy{ReadWriteCloser: rwc}
+	}
+	return &Interface{
+		isTAP:           deviceType == TAP,
+		VectorReadWrite: vrw,
+		ReadWriteCloser: rwc,
+		name:            name,
+	}, nil
+}
+
 // IsTUN returns true if ifce is a TUN interface.
 func (ifce *Interface) IsTUN() bool {
 	return !ifce.isTAP
@@ -95,6 +118,21 @@ func (ifce *Interface) Name() string {
 	return ifce.name
 }
 
+// MTU returns the MTU of ifce. If the underlying transport provides an
+// MTU() (int, error) method, such as a wireguard-go tun.Device, its result is
+// returned. Otherwise the MTU of the OS network interface named ifce.Name() is
+// returned.
+func (ifce *Interface) MTU() (int, error) {
+	if m, ok := ifce.ReadWriteCloser.(interface{ MTU() (int, error) }); ok {
+		return m.MTU()
+	}
+	iface, err := net.InterfaceByName(ifce.name)
+	if err != nil {
+		return 0, err
+	}
+	return iface.MTU, nil
+}
+
 type ReadWriteVectorProxy struct {
 	io.ReadWriteCloser
 }
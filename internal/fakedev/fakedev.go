@@ -0,0 +1,140 @@
+// Package fakedev provides in-memory devices for the tests of the packages
+// built on Interface. Wrap them with water.NewFromReadWriteCloser.
+package fakedev
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// QueueSize is the number of packets the channels of a Device buffer.
+const QueueSize = 16
+
+// Device is an in-memory TUN or TAP device. Read returns the packets sent to
+// In, blocking until one is queued, and Write sends a copy of every packet to
+// Out. Read returns io.EOF once the device or In is closed.
+type Device struct {
+	In  chan []byte
+	Out chan []byte
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// New returns a Device with channels buffering QueueSize packets.
+func New() *Device {
+	return &Device{
+		In:     make(chan []byte, QueueSize),
+		Out:    make(chan []byte, QueueSize),
+		closed: make(chan struct{}),
+	}
+}
+
+func (d *Device) Read(b []byte) (int, error) {
+	select {
+	case p, ok := <-d.In:
+		if !ok {
+			return 0, io.EOF
+		}
+		return copy(b, p), nil
+	case <-d.closed:
+		return 0, io.EOF
+	}
+}
+
+func (d *Device) Write(b []byte) (int, error) {
+	d.Out <- bytes.Clone(b)
+	return len(b), nil
+}
+
+func (d *Device) Close() error {
+	d.closeOnce.Do(func() { close(d.closed) })
+	return nil
+}
+
+// Closed returns a channel that is closed when the device is closed.
+func (d *Device) Closed() <-chan struct{} {
+	return d.closed
+}
+
+// Expect returns the next written packet. It fails t if none is written
+// within a second.
+func (d *Device) Expect(t testing.TB) []byte {
+	t.Helper()
+	select {
+	case p := <-d.Out:
+		return p
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for packet")
+		return nil
+	}
+}
+
+// ExpectNothing fails t if a packet is written within 50 milliseconds.
+func (d *Device) ExpectNothing(t testing.TB) {
+	t.Helper()
+	select {
+	case p := <-d.Out:
+		t.Fatalf("unexpected packet % x", p)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// Vector is a Device with native vector reads and writes. ReadVector blocks
+// until a packet is queued and then returns all queued packets that fit.
+type Vector struct {
+	*Device
+
+	mu      sync.Mutex
+	batches []int
+}
+
+// NewVector returns a Vector with channels buffering QueueSize packets.
+func NewVector() *Vector {
+	return &Vector{Device: New()}
+}
+
+func (v *Vector) ReadVector(bufs [][]byte, sizes []int) (int, error) {
+	n, err := v.Read(bufs[0])
+	if err != nil {
+		return 0, err
+	}
+	sizes[0] = n
+	count := 1
+	for ; count < len(bufs); count++ {
+		select {
+		case p, ok := <-v.In:
+			if ok {
+				sizes[count] = copy(bufs[count], p)
+				continue
+			}
+		default:
+		}
+		break
+	}
+	v.mu.Lock()
+	v.batches = append(v.batches, count)
+	v.mu.Unlock()
+	return count, nil
+}
+
+func (v *Vector) WriteVector(bufs [][]byte) (int, error) {
+	for _, b := range bufs {
+		_, _ = v.Write(b)
+	}
+	return len(bufs), nil
+}
+
+func (v *Vector) IsVectorNative() bool {
+	return true
+}
+
+// Batches returns the number of packets returned by each ReadVector call.
+func (v *Vector) Batches() []int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return append([]int(nil), v.batches...)
+}
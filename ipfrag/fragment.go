@@ -0,0 +1,185 @@
+// Package ipfrag fragments IPv4 and IPv6 packets to fit an MTU and reassembles
+// fragmented datagrams, so that code inspecting or rewriting packets always
+// sees whole datagrams.
+package ipfrag
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sync/atomic"
+
+	"github.com/Doridian/water/waterutil"
+)
+
+var (
+	// ErrDontFragment is returned when an IPv4 packet with the Don't Fragment
+	// flag exceeds the MTU. The sender should be notified with an ICMP
+	// Fragmentation Needed message, see waterutil.BuildFragmentationNeeded.
+	ErrDontFragment = errors.New("packet exceeds MTU and must not be fragmented")
+	// ErrMTUTooSmall is returned when the MTU does not leave room for at
+	// least 8 bytes of payload per fragment.
+	ErrMTUTooSmall = errors.New("MTU too small to fragment packet")
+)
+
+// ipv6ID is the identification of the next IPv6 fragmented packet. It starts
+// at a random value, as recommended by RFC 7739.
+var ipv6ID atomic.Uint32
+
+func init() {
+	var b [4]byte
+	_, _ = rand.Read(b[:])
+	ipv6ID.Store(binary.BigEndian.Uint32(b[:]))
+}
+
+// Fragment splits an IPv4 or IPv6 packet into fragments of at most mtu bytes.
+// If the packet fits, it is returned as the only element without being
+// copied. Otherwise every fragment is a newly allocated packet.
+//
+// IPv4 packets that are themselves fragments are split further. IPv6 packets
+// that already carry a Fragment header are rejected with
+// waterutil.ErrFragmented, as only the source may fragment IPv6 packets.
+func Fragment(packet []byte, mtu int) ([][]byte, error) {
+	version, err := waterutil.ParseIPVersion(packet)
+	if err != nil {
+		return nil, err
+	}
+	if version == 4 {
+		return fragmentIPv4(packet, mtu)
+	}
+	return fragmentIPv6(packet, mtu)
+}
+
+func fragmentIPv4(packet []byte, mtu int) ([][]byte, error) {
+	p, err := waterutil.NewIPv4Packet(packet)
+	if err != nil {
+		return nil, err
+	}
+	if len(p) <= mtu {
+		return [][]byte{packet}, nil
+	}
+	if p.DontFragment() {
+		return nil, ErrDontFragment
+	}
+
+	first := p[:p.HeaderLength()]
+	rest := append(append([]byte(nil), p[:20]...), copiedOptions(p.Options())...)
+	rest[0] = 0x40 | byte(len(rest)/4) // #nosec G115 -- at most 60 bytes
+	baseOffset := int(p.FragmentOffset()) * 8
+	more := p.MoreFragments()
+	payload := p.Payload()
+
+	var frags [][]byte
+	for off := 0; off < len(payload); {
+		header := rest
+		if off == 0 {
+			header = first
+		}
+		n := (mtu - len(header)) &^ 7
+		if n <= 0 {
+			return nil, ErrMTUTooSmall
+		}
+		n = min(n, len(payload)-off)
+
+		frag := waterutil.IPv4Packet(make([]byte, len(header)+n))
+		copy(frag, header)
+		copy(frag[len(header):], payload[off:off+n])
+		frag.SetTotalLength(uint16(len(frag)))                 // #nosec G115 -- at most the original length
+		frag.SetFragmentOffset(uint16((baseOffset + off) / 8)) // #nosec G115 -- at most the original offset
+		flags := frag.Flags() &^ 0x01
+		if more || off+n < len(payload) {
+			flags |= 0x01
+		}
+		frag.SetFlags(flags)
+		frag.FixChecksum()
+		frags = append(frags, frag)
+		off += n
+	}
+	return frags, nil
+}
+
+// copiedOptions returns the IPv4 options with the copied flag, which must be
+// repeated in every fragment, padded to a multiple of 4 bytes.
+func copiedOptions(options []byte) []byte {
+	var copied []byte
+	for i := 0; i < len(options); {
+		switch options[i] {
+		case 0: // End of Option List
+			i = len(options)
+			continue
+		case 1: // No Operation
+			i++
+			continue
+		}
+		if i+1 >= len(options) || options[i+1] < 2 || i+int(options[i+1]) > len(options) {
+			break
+		}
+		length := int(options[i+1])
+		if options[i]&0x80 != 0 {
+			copied = append(copied, options[i:i+length]...)
+		}
+		i += length
+	}
+	for len(copied)%4 != 0 {
+		copied = append(copied, 0)
+	}
+	return copied
+}
+
+func fragmentIPv6(packet []byte, mtu int) ([][]byte, error) {
+	p, err := waterutil.NewIPv6Packet(packet)
+	if err != nil {
+		return nil, err
+	}
+	if waterutil.IPv6FragmentHeader(p) != nil {
+		return nil, waterutil.ErrFragmented
+	}
+	if len(p) <= mtu {
+		return [][]byte{packet}, nil
+	}
+
+	// The unfragmentable part is the fixed header followed by Hop-by-Hop
+	// Options, Routing and Destination Options headers up to the last
+	// Routing header. nextField is the Next Header field pointing to the
+	// first fragmentable header.
+	unfragmentable, nextField := 40, 6
+	off, field := 40, 6
+	for hdrType, hdr := range p.ExtensionHeaders() {
+		if hdrType != waterutil.HOPOPT && hdrType != waterutil.IPv6_Route && hdrType != waterutil.IPv6_Opts {
+			break
+		}
+		field = off
+		off += len(hdr)
+		if hdrType != waterutil.IPv6_Opts {
+			unfragmentable, nextField = off, field
+		}
+	}
+
+	header := p[:unfragmentable]
+	next := p[nextField]
+	payload := p[unfragmentable:]
+	id := ipv6ID.Add(1)
+
+	n := (mtu - len(header) - 8) &^ 7
+	if n <= 0 {
+		return nil, ErrMTUTooSmall
+	}
+	var frags [][]byte
+	for off := 0; off < len(payload); off += n {
+		size := min(n, len(payload)-off)
+		frag := make([]byte, 0, len(header)+8+size)
+		frag = append(frag, header...)
+		frag[nextField] = byte(waterutil.IPv6_Frag)
+		offsetFlags := uint16(off) // #nosec G115 -- payload is at most 65535 bytes
+		if off+size < len(payload) {
+			offsetFlags |= 0x01
+		}
+		frag = append(frag, next, 0)
+		frag = binary.BigEndian.AppendUint16(frag, offsetFlags)
+		frag = binary.BigEndian.AppendUint32(frag, id)
+		frag = append(frag, payload[off:off+size]...)
+		waterutil.SetIPv6PayloadLength(frag, uint16(len(frag)-40)) // #nosec G115 -- at most the original length
+		frags = append(frags, frag)
+	}
+	return frags, nil
+}
@@ -0,0 +1,265 @@
+package ipfrag
+
+import (
+	"bytes"
+	"math/rand/v2"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/Doridian/water/waterutil"
+)
+
+var (
+	src4 = netip.MustParseAddr("10.0.0.1")
+	dst4 = netip.MustParseAddr("10.0.0.2")
+	src6 = netip.MustParseAddr("fd00::1")
+	dst6 = netip.MustParseAddr("fd00::2")
+)
+
+func udpPacket(src, dst netip.Addr, size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	udp := append([]byte{0x04, 0xd2, 0x00, 0x35, byte((8 + size) >> 8), byte(8 + size), 0, 0}, data...)
+	var packet []byte
+	if src.Is4() {
+		packet = waterutil.AppendIPv4Header(nil, waterutil.UDP, 64, src, dst, len(udp))
+		packet[4], packet[5] = 0xbe, 0xef
+		waterutil.FixIPv4Checksum(packet)
+	} else {
+		packet = waterutil.AppendIPv6Header(nil, waterutil.UDP, 64, src, dst, len(udp))
+	}
+	packet = append(packet, udp...)
+	if err := waterutil.FixTransportChecksum(packet); err != nil {
+		panic(err)
+	}
+	return packet
+}
+
+func TestFragmentAndReassemble(t *testing.T) {
+	for _, packet := range [][]byte{udpPacket(src4, dst4, 3000), udpPacket(src6, dst6, 3000)} {
+		frags, err := Fragment(packet, 1280)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(frags) != 3 {
+			t.Fatalf("expected 3 fragments, got %d", len(frags))
+		}
+		for _, frag := range frags {
+			if len(frag) > 1280 {
+				t.Fatalf("fragment of %d bytes exceeds the MTU", len(frag))
+			}
+			if waterutil.IPVersion(frag) == 4 && waterutil.ComputeIPv4Checksum(frag) != waterutil.IPv4Checksum(frag) {
+				t.Fatal("fragment has an invalid header checksum")
+			}
+		}
+
+		r := NewReassembler(Config{})
+		rand.Shuffle(len(frags), func(i, j int) { frags[i], frags[j] = frags[j], frags[i] })
+		var whole []byte
+		for i, frag := range frags {
+			whole, err = r.Process(frag)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (whole != nil) != (i == len(frags)-1) {
+				t.Fatalf("datagram completed after %d of %d fragments", i+1, len(frags))
+			}
+		}
+		if !bytes.Equal(whole, packet) {
+			t.Fatal("reassembled datagram differs from the original")
+		}
+		if r.Pending() != 0 || r.Stats().Reassembled != 1 {
+			t.Fatalf("unexpected state: %d pending, %+v", r.Pending(), r.Stats())
+		}
+	}
+}
+
+func TestFragmentFits(t *testing.T) {
+	packet := udpPacket(src4, dst4, 100)
+	frags, err := Fragment(packet, 1500)
+	if err != nil || len(frags) != 1 || &frags[0][0] != &packet[0] {
+		t.Fatal("a packet that fits must be returned unchanged")
+	}
+	if got, err := NewReassembler(Config{}).Process(packet); err != nil || &got[0] != &packet[0] {
+		t.Fatal("a packet that is not a fragment must be returned unchanged")
+	}
+
+	packet = udpPacket(src4, dst4, 2000)
+	packet[6] |= 0x40
+	if _, err := Fragment(packet, 1500); err != ErrDontFragment {
+		t.Fatalf("expected ErrDontFragment, got %v", err)
+	}
+	if _, err := Fragment(udpPacket(src6, dst6, 2000), 48); err != ErrMTUTooSmall {
+		t.Fatalf("expected ErrMTUTooSmall, got %v", err)
+	}
+}
+
+func TestRefragmentIPv4(t *testing.T) {
+	packet := udpPacket(src4, dst4, 3000)
+	frags, err := Fragment(packet, 1500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var small [][]byte
+	for _, frag := range frags {
+		more, err := Fragment(frag, 576)
+		if err != nil {
+			t.Fatal(err)
+		}
+		small = append(small, more...)
+	}
+
+	r := NewReassembler(Config{})
+	var whole []byte
+	for _, frag := range small {
+		if whole, err = r.Process(frag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(whole, packet) {
+		t.Fatal("reassembled datagram differs from the original")
+	}
+}
+
+func TestReassemblerOverlap(t *testing.T) {
+	frags, err := Fragment(udpPacket(src6, dst6, 3000), 1280)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReassembler(Config{})
+	if _, err := r.Process(frags[0]); err != nil {
+		t.Fatal(err)
+	}
+	// An exact duplicate is ignored.
+	if _, err := r.Process(frags[0]); err != nil {
+		t.Fatalf("expected a duplicate to be ignored, got %v", err)
+	}
+
+	// Move the second fragment back by 8 bytes, overlapping the first.
+	overlapping := bytes.Clone(frags[1])
+	offset, _, _, _ := waterutil.IPv6FragmentInfo(overlapping)
+	overlapping[40+2] = byte((offset - 1) >> 5)
+	overlapping[40+3] = byte((offset-1)<<3) | 0x01
+	if _, err := r.Process(overlapping); err != ErrOverlap {
+		t.Fatalf("expected ErrOverlap, got %v", err)
+	}
+	if r.Pending() != 0 || r.Stats().Dropped != 1 {
+		t.Fatal("the datagram must be dropped on overlap")
+	}
+}
+
+func TestReassemblerLimits(t *testing.T) {
+	r := NewReassembler(Config{Timeout: time.Second, MaxBytes: 2000})
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	a, _ := Fragment(udpPacket(src4, dst4, 3000), 1500)
+	b := udpPacket(src4, dst4, 3000)
+	b[5]++ // different identification
+	waterutil.FixIPv4Checksum(b)
+	bFrags, _ := Fragment(b, 1500)
+
+	if _, err := r.Process(a[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Process(bFrags[0]); err != nil {
+		t.Fatal(err)
+	}
+	if r.Pending() != 1 || r.Stats().Evicted != 1 {
+		t.Fatalf("expected the oldest datagram to be evicted, got %d pending, %+v", r.Pending(), r.Stats())
+	}
+
+	now = now.Add(2 * time.Second)
+	if _, err := r.Process(a[1]); err != nil {
+		t.Fatal(err)
+	}
+	if r.Stats().TimedOut != 1 {
+		t.Fatalf("expected a timeout, got %+v", r.Stats())
+	}
+
+	r = NewReassembler(Config{MaxFragments: 2})
+	frags, _ := Fragment(udpPacket(src4, dst4, 3000), 576)
+	for _, frag := range frags[:2] {
+		if _, err := r.Process(frag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := r.Process(frags[2]); err != ErrTooManyFragments {
+		t.Fatalf("expected ErrTooManyFragments, got %v", err)
+	}
+}
+
+// ipv4Fragment returns an IPv4 fragment at offset bytes carrying data.
+func ipv4Fragment(offset int, more bool, data []byte) []byte {
+	frag := waterutil.IPv4Packet(waterutil.AppendIPv4Header(nil, waterutil.UDP, 64, src4, dst4, len(data)))
+	frag.SetFragmentOffset(uint16(offset / 8))
+	if more {
+		frag.SetFlags(0x01)
+	}
+	frag.FixChecksum()
+	return append(frag, data...)
+}
+
+func TestReassemblerMaxSize(t *testing.T) {
+	// The largest datagram reassembles with a valid total length.
+	frags, err := Fragment(udpPacket(src4, dst4, 65535-20-8), 1500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReassembler(Config{MaxFragments: len(frags)})
+	var packet []byte
+	for _, frag := range frags {
+		if packet, err = r.Process(frag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(packet) != 65535 || waterutil.ValidateIP(packet) != nil {
+		t.Fatalf("reassembled %d bytes", len(packet))
+	}
+
+	// A payload ending at 65535 does not leave room for the header.
+	r = NewReassembler(Config{})
+	if _, err := r.Process(ipv4Fragment(0, true, make([]byte, 8))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Process(ipv4Fragment(65528, false, make([]byte, 7))); err != ErrTooLarge {
+		t.Fatalf("expected ErrTooLarge, got %v", err)
+	}
+
+	// Options in a first fragment arriving last shrink the room as well.
+	r = NewReassembler(Config{})
+	if _, err := r.Process(ipv4Fragment(65512, false, make([]byte, 3))); err != nil {
+		t.Fatal(err)
+	}
+	first := ipv4Fragment(0, true, make([]byte, 8))
+	first = append(first[:20:20], append([]byte{1, 1, 1, 1}, first[20:]...)...)
+	first[0]++
+	waterutil.IPv4Packet(first).SetTotalLength(uint16(len(first)))
+	waterutil.IPv4Packet(first).FixChecksum()
+	if _, err := r.Process(first); err != ErrTooLarge {
+		t.Fatalf("expected ErrTooLarge, got %v", err)
+	}
+
+	// IPv6 extension headers before the Fragment header count as well.
+	hopByHop := []byte{byte(waterutil.IPv6_Frag), 0, 1, 4, 0, 0, 0, 0}
+	ipv6Fragment := func(offset int, more bool, data []byte) []byte {
+		frag := waterutil.AppendIPv6Header(nil, waterutil.HOPOPT, 64, src6, dst6, 16+len(data))
+		frag = append(frag, hopByHop...)
+		offsetFlags := uint16(offset)
+		if more {
+			offsetFlags |= 0x01
+		}
+		frag = append(frag, byte(waterutil.UDP), 0, byte(offsetFlags>>8), byte(offsetFlags), 0, 0, 0, 1)
+		return append(frag, data...)
+	}
+	r = NewReassembler(Config{})
+	if _, err := r.Process(ipv6Fragment(0, true, make([]byte, 8))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Process(ipv6Fragment(65528, false, make([]byte, 7))); err != ErrTooLarge {
+		t.Fatalf("expected ErrTooLarge, got %v", err)
+	}
+}
@@ -0,0 +1,370 @@
+package ipfrag
+
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/Doridian/water/waterutil"
+)
+
+// Defaults used by Config.
+const (
+	DefaultTimeout      = 30 * time.Second
+	DefaultMaxBytes     = 4 << 20
+	DefaultMaxFragments = 64
+)
+
+const maxDatagramSize = 65535
+
+var (
+	// ErrOverlap is returned when a fragment overlaps a previously received
+	// one. Following RFC 5722, the whole datagram is dropped.
+	ErrOverlap = errors.New("overlapping fragment")
+	// ErrTooManyFragments is returned when a datagram consists of more than
+	// Config.MaxFragments fragments. The datagram is dropped.
+	ErrTooManyFragments = errors.New("too many fragments")
+	// ErrTooLarge is returned when a fragment extends beyond the maximum
+	// datagram size. The datagram is dropped.
+	ErrTooLarge = errors.New("reassembled datagram too large")
+	// ErrInvalidFragment is returned for a fragment that is not the last one
+	// but whose length is not a multiple of 8, or that contradicts the
+	// length determined by the last fragment. The datagram is dropped.
+	ErrInvalidFragment = errors.New("invalid fragment")
+)
+
+// Config defines the limits of a Reassembler. A zero-value Config is valid.
+type Config struct {
+	// Timeout is the time after the first fragment was received after which
+	// an incomplete datagram is dropped. It defaults to DefaultTimeout.
+	Timeout time.Duration
+
+	// MaxBytes limits the fragment data held for all incomplete datagrams.
+	// When exceeded, the oldest datagrams are dropped. It defaults to
+	// DefaultMaxBytes.
+	MaxBytes int
+
+	// MaxFragments limits the number of fragments of a single datagram. It
+	// defaults to DefaultMaxFragments.
+	MaxFragments int
+}
+
+// Stats holds the counters of a Reassembler.
+type Stats struct {
+	// Reassembled counts completed datagrams.
+	Reassembled uint64
+	// TimedOut counts incomplete datagrams dropped after Config.Timeout.
+	TimedOut uint64
+	// Evicted counts incomplete datagrams dropped to stay below
+	// Config.MaxBytes.
+	Evicted uint64
+	// Dropped counts datagrams dropped because of an invalid, overlapping or
+	// excess fragment.
+	Dropped uint64
+}
+
+// key identifies a datagram: IPv4 datagrams by source, destination,
+// identification and protocol, IPv6 datagrams by source, destination and
+// identification.
+type key struct {
+	src, dst netip.Addr
+	id       uint32
+	protocol waterutil.IPProtocol
+}
+
+type fragment struct {
+	offset int
+	data   []byte
+}
+
+type datagram struct {
+	key      key
+	elem     *list.Element
+	deadline time.Time
+	// header is the IP header of the first fragment, for IPv6 up to but
+	// excluding the Fragment header.
+	header []byte
+	// nextField is the offset of the Next Header field pointing to the
+	// Fragment header in an IPv6 header, and next its value after
+	// reassembly.
+	nextField int
+	next      byte
+	frags     []fragment
+	// length is the total length of the payload, or -1 until the last
+	// fragment was received.
+	length   int
+	received int
+	bytes    int
+}
+
+// Reassembler reassembles fragmented IPv4 and IPv6 datagrams. It is safe for
+// concurrent use.
+type Reassembler struct {
+	timeout      time.Duration
+	maxBytes     int
+	maxFragments int
+	now          func() time.Time
+
+	mu        sync.Mutex
+	datagrams map[key]*datagram
+	// order holds the datagrams from oldest to newest.
+	order *list.List
+	bytes int
+	stats Stats
+}
+
+// NewReassembler returns a Reassembler with the given limits.
+func NewReassembler(config Config) *Reassembler {
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultTimeout
+	}
+	if config.MaxBytes <= 0 {
+		config.MaxBytes = DefaultMaxBytes
+	}
+	if config.MaxFragments <= 0 {
+		config.MaxFragments = DefaultMaxFragments
+	}
+	return &Reassembler{
+		timeout:      config.Timeout,
+		maxBytes:     config.MaxBytes,
+		maxFragments: config.MaxFragments,
+		now:          time.Now,
+		datagrams:    make(map[key]*datagram),
+		order:        list.New(),
+	}
+}
+
+// Stats returns a snapshot of the reassembler's counters.
+func (r *Reassembler) Stats() Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stats
+}
+
+// Pending returns the number of incomplete datagrams.
+func (r *Reassembler) Pending() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.datagrams)
+}
+
+// Process handles an IPv4 or IPv6 packet. A packet that is not a fragment is
+// returned unchanged. A fragment is stored and nil is returned, until the
+// fragment completing its datagram is processed, which returns the
+// reassembled datagram in a newly allocated buffer. Fragment data is copied,
+// so packet may be reused after Process returns.
+func (r *Reassembler) Process(packet []byte) ([]byte, error) {
+	version, err := waterutil.ParseIPVersion(packet)
+	if err != nil {
+		return nil, err
+	}
+	if version == 4 {
+		return r.processIPv4(packet)
+	}
+	return r.processIPv6(packet)
+}
+
+func (r *Reassembler) processIPv4(packet []byte) ([]byte, error) {
+	p, err := waterutil.NewIPv4Packet(packet)
+	if err != nil {
+		return nil, err
+	}
+	if !p.MoreFragments() && p.FragmentOffset() == 0 {
+		return packet, nil
+	}
+	k := key{
+		src:      p.Source(),
+		dst:      p.Destination(),
+		id:       uint32(p.Identification()),
+		protocol: p.Protocol(),
+	}
+	return r.add(k, p[:p.HeaderLength()], 0, 0, int(p.FragmentOffset())*8, p.MoreFragments(), p.Payload())
+}
+
+func (r *Reassembler) processIPv6(packet []byte) ([]byte, error) {
+	p, err := waterutil.NewIPv6Packet(packet)
+	if err != nil {
+		return nil, err
+	}
+	off, field := 40, 6
+	for hdrType, hdr := range p.ExtensionHeaders() {
+		if hdrType != waterutil.IPv6_Frag {
+			field = off
+			off += len(hdr)
+			continue
+		}
+		offset := int(binary.BigEndian.Uint16(hdr[2:4]) &^ 0x07)
+		more := hdr[3]&0x01 != 0
+		k := key{
+			src: p.Source(),
+			dst: p.Destination(),
+			id:  binary.BigEndian.Uint32(hdr[4:8]),
+		}
+		return r.add(k, p[:off], field, hdr[0], offset, more, p[off+8:])
+	}
+	return packet, nil
+}
+
+// add stores a fragment of the datagram identified by k. header, nextField
+// and next are only used for the first fragment.
+func (r *Reassembler) add(k key, header []byte, nextField int, next byte, offset int, more bool, data []byte) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	r.expire(now)
+
+	d := r.datagrams[k]
+	if d == nil {
+		if !more && offset == 0 {
+			// An atomic fragment, which does not need to be stored.
+			d = &datagram{key: k, length: len(data)}
+			d.frags = []fragment{{data: data}}
+			d.received = len(data)
+			d.header, d.nextField, d.next = header, nextField, next
+			r.stats.Reassembled++
+			return d.assemble(), nil
+		}
+		d = &datagram{key: k, deadline: now.Add(r.timeout), length: -1}
+		d.elem = r.order.PushBack(d)
+		r.datagrams[k] = d
+	}
+
+	// The reassembled datagram uses the header of the first fragment, which
+	// may be longer than the header of other IPv4 fragments.
+	headerLen := len(header)
+	if d.header != nil {
+		headerLen = len(d.header)
+	}
+	if waterutil.IPVersion(header) == 6 {
+		headerLen -= 40
+	}
+	if err := d.check(offset, more, data, maxDatagramSize-headerLen, r.maxFragments); err != nil {
+		if err == errDuplicate {
+			return nil, nil
+		}
+		r.drop(d)
+		r.stats.Dropped++
+		return nil, err
+	}
+
+	frag := fragment{offset: offset, data: append([]byte(nil), data...)}
+	i := 0
+	for i < len(d.frags) && d.frags[i].offset < offset {
+		i++
+	}
+	d.frags = append(d.frags, fragment{})
+	copy(d.frags[i+1:], d.frags[i:])
+	d.frags[i] = frag
+	d.received += len(data)
+	d.bytes += len(data)
+	r.bytes += len(data)
+	if offset == 0 {
+		d.header = append([]byte(nil), header...)
+		d.nextField, d.next = nextField, next
+		d.bytes += len(header)
+		r.bytes += len(header)
+	}
+	if !more {
+		d.length = offset + len(data)
+	}
+
+	if d.length >= 0 && d.received == d.length && d.header != nil {
+		r.drop(d)
+		r.stats.Reassembled++
+		return d.assemble(), nil
+	}
+
+	for r.bytes > r.maxBytes && r.order.Len() > 0 {
+		oldest := r.order.Front().Value.(*datagram)
+		r.drop(oldest)
+		r.stats.Evicted++
+	}
+	return nil, nil
+}
+
+var errDuplicate = errors.New("duplicate fragment")
+
+// check validates a new fragment against the fragments received so far.
+// maxLength is the largest payload that fits the length field of the
+// reassembled datagram. An exact duplicate of a received fragment returns
+// errDuplicate.
+func (d *datagram) check(offset int, more bool, data []byte, maxLength, maxFragments int) error {
+	end := offset + len(data)
+	if end > maxLength || (offset == 0 && max(d.length, d.lastEnd()) > maxLength) {
+		return ErrTooLarge
+	}
+	if more && (len(data) == 0 || len(data)%8 != 0) {
+		return ErrInvalidFragment
+	}
+	if d.length >= 0 && (end > d.length || (!more && end != d.length)) {
+		return ErrInvalidFragment
+	}
+	for _, f := range d.frags {
+		if offset < f.offset+len(f.data) && f.offset < end {
+			if f.offset == offset && len(f.data) == len(data) {
+				return errDuplicate
+			}
+			return ErrOverlap
+		}
+	}
+	if !more && end < d.lastEnd() {
+		return ErrInvalidFragment
+	}
+	if len(d.frags) >= maxFragments {
+		return ErrTooManyFragments
+	}
+	return nil
+}
+
+func (d *datagram) lastEnd() int {
+	if len(d.frags) == 0 {
+		return 0
+	}
+	last := d.frags[len(d.frags)-1]
+	return last.offset + len(last.data)
+}
+
+// assemble returns the reassembled datagram. All fragments must be present.
+func (d *datagram) assemble() []byte {
+	packet := make([]byte, 0, len(d.header)+d.length)
+	packet = append(packet, d.header...)
+	for _, f := range d.frags {
+		packet = append(packet, f.data...)
+	}
+	if waterutil.IPVersion(packet) == 4 {
+		p := waterutil.IPv4Packet(packet)
+		p.SetTotalLength(uint16(len(packet))) // #nosec G115 -- check limits the datagram to 65535 bytes
+		p.SetFlags(p.Flags() &^ 0x01)
+		p.SetFragmentOffset(0)
+		p.FixChecksum()
+	} else {
+		packet[d.nextField] = d.next
+		waterutil.SetIPv6PayloadLength(packet, uint16(len(packet)-40)) // #nosec G115 -- check limits the payload to 65535 bytes
+	}
+	return packet
+}
+
+func (r *Reassembler) expire(now time.Time) {
+	for r.order.Len() > 0 {
+		oldest := r.order.Front().Value.(*datagram)
+		if now.Before(oldest.deadline) {
+			return
+		}
+		r.drop(oldest)
+		r.stats.TimedOut++
+	}
+}
+
+func (r *Reassembler) drop(d *datagram) {
+	if d.elem == nil {
+		return
+	}
+	r.order.Remove(d.elem)
+	d.elem = nil
+	delete(r.datagrams, d.key)
+	r.bytes -= d.bytes
+}
@@ -0,0 +1,504 @@
+// Package l2switch implements a userspace learning Ethernet switch. It joins
+// any number of TAP interfaces, or other ports that exchange whole Ethernet
+// frames, into a single L2 segment.
+package l2switch
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Doridian/water"
+	"github.com/Doridian/water/waterutil"
+)
+
+// DefaultAgingTime is the aging time used when Config.AgingTime is zero. It
+// matches the IEEE 802.1D recommended default.
+const DefaultAgingTime = 300 * time.Second
+
+// DefaultFrameSize is the read buffer size used when Config.FrameSize is zero.
+// It fits a 1500 byte MTU frame with a single VLAN tag.
+const DefaultFrameSize = 1522
+
+var (
+	ErrUnknownPort = errors.New("unknown port")
+	ErrClosed      = errors.New("switch is closed")
+	ErrNotTAP      = errors.New("interface is not a TAP interface")
+	ErrInvalidMAC  = errors.New("invalid MAC address")
+)
+
+// Port is anything that can exchange Ethernet frames with the switch. Every
+// Read must return exactly one frame and every Write must send exactly one
+// frame. A TAP *water.Interface satisfies Port.
+type Port interface {
+	io.ReadWriter
+}
+
+// PortID identifies a port attached to a Switch.
+type PortID int
+
+// PortStats holds the counters of a single port.
+type PortStats struct {
+	// RxFrames and RxBytes count frames received from the port.
+	RxFrames uint64
+	RxBytes  uint64
+	// TxFrames and TxBytes count frames sent out of the port.
+	TxFrames uint64
+	TxBytes  uint64
+	// RxDropped counts received frames that were not forwarded, either because
+	// they were malformed or because their destination is on the same port.
+	RxDropped uint64
+	// Flooded counts received frames that were flooded to all other ports.
+	Flooded uint64
+	// TxErrors counts failed writes to the port.
+	TxErrors uint64
+}
+
+// MACEntry is a single entry of the MAC address table.
+type MACEntry struct {
+	MAC    net.HardwareAddr
+	Port   PortID
+	Static bool
+	// Age is the time since a frame from MAC was last seen. It is always zero
+	// for static entries.
+	Age time.Duration
+}
+
+// Config defines parameters of a Switch. A zero-value Config is valid.
+type Config struct {
+	// AgingTime is the time after which learned MAC addresses are forgotten
+	// if no frame has been received from them. Defaults to DefaultAgingTime.
+	AgingTime time.Duration
+
+	// FrameSize is the size of the buffer used to read from each port.
+	// Longer frames are truncated by the port. Defaults to DefaultFrameSize.
+	FrameSize int
+
+	// PortErrorHandler, if non-nil, is called when reading from a port fails.
+	// The port has already been removed from the switch when it is called.
+	// It runs on the port's read loop and must not call Switch.Close, which
+	// waits for that loop to return.
+	PortErrorHandler func(id PortID, err error)
+}
+
+type portStats struct {
+	rxFrames  atomic.Uint64
+	rxBytes   atomic.Uint64
+	txFrames  atomic.Uint64
+	txBytes   atomic.Uint64
+	rxDropped atomic.Uint64
+	flooded   atomic.Uint64
+	txErrors  atomic.Uint64
+}
+
+type port struct {
+	id      PortID
+	rw      Port
+	wmu     sync.Mutex
+	removed atomic.Bool
+	stats   portStats
+
+	// outs is scratch space for the destinations of a frame, used only by
+	// the port's read loop.
+	outs []*port
+}
+
+type macKey [6]byte
+
+type macEntry struct {
+	port     PortID
+	static   bool
+	lastSeen time.Time
+}
+
+// Switch is a learning Ethernet switch. Frames received on one port are
+// forwarded to the port their destination MAC address was learned on, or
+// flooded to all other ports if the destination is unknown, broadcast or
+// multicast.
+type Switch struct {
+	agingTime  time.Duration
+	frameSize  int
+	errHandler func(id PortID, err error)
+
+	mu     sync.RWMutex
+	ports  map[PortID]*port
+	nextID PortID
+	closed bool
+
+	tmu   sync.Mutex
+	table map[macKey]*macEntry
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// New creates a Switch with no ports.
+func New(config Config) *Switch {
+	if config.AgingTime <= 0 {
+		config.AgingTime = DefaultAgingTime
+	}
+	if config.FrameSize <= 0 {
+		config.FrameSize = DefaultFrameSize
+	}
+	s := &Switch{
+		agingTime:  config.AgingTime,
+		frameSize:  config.FrameSize,
+		errHandler: config.PortErrorHandler,
+		ports:      make(map[PortID]*port),
+		table:      make(map[macKey]*macEntry),
+		done:       make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go s.ager()
+	return s
+}
+
+// AddPort attaches p to the switch and starts forwarding frames read from it.
+func (s *Switch) AddPort(p Port) (PortID, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return 0, ErrClosed
+	}
+	s.nextID++
+	pt := &port{id: s.nextID, rw: p}
+	s.ports[pt.id] = pt
+
+	s.wg.Add(1)
+	go s.run(pt)
+	return pt.id, nil
+}
+
+// AddInterface attaches a TAP interface to the switch.
+func (s *Switch) AddInterface(ifce *water.Interface) (PortID, error) {
+	if !ifce.IsTAP() {
+		return 0, ErrNotTAP
+	}
+	return s.AddPort(ifce)
+}
+
+// RemovePort detaches a port from the switch and forgets all MAC addresses,
+// including static ones, that were associated with it. If the port implements
+// io.Closer it is closed, which stops its read loop.
+func (s *Switch) RemovePort(id PortID) error {
+	s.mu.Lock()
+	pt, ok := s.ports[id]
+	if ok {
+		delete(s.ports, id)
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		return ErrUnknownPort
+	}
+	return s.detach(pt)
+}
+
+func (s *Switch) detach(pt *port) error {
+	pt.removed.Store(true)
+	s.flushPort(pt.id)
+	if c, ok := pt.rw.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Ports returns the IDs of all attached ports in ascending order.
+func (s *Switch) Ports() []PortID {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ids := make([]PortID, 0, len(s.ports))
+	for id := range s.ports {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// PortStats returns a snapshot of the counters of a port.
+func (s *Switch) PortStats(id PortID) (PortStats, error) {
+	s.mu.RLock()
+	pt, ok := s.ports[id]
+	s.mu.RUnlock()
+
+	if !ok {
+		return PortStats{}, ErrUnknownPort
+	}
+	return PortStats{
+		RxFrames:  pt.stats.rxFrames.Load(),
+		RxBytes:   pt.stats.rxBytes.Load(),
+		TxFrames:  pt.stats.txFrames.Load(),
+		TxBytes:   pt.stats.txBytes.Load(),
+		RxDropped: pt.stats.rxDropped.Load(),
+		Flooded:   pt.stats.flooded.Load(),
+		TxErrors:  pt.stats.txErrors.Load(),
+	}, nil
+}
+
+// AddStaticEntry binds mac to a port. Static entries never age out and are
+// not overridden by learning.
+func (s *Switch) AddStaticEntry(mac net.HardwareAddr, id PortID) error {
+	if len(mac) != 6 {
+		return ErrInvalidMAC
+	}
+	s.mu.RLock()
+	_, ok := s.ports[id]
+	s.mu.RUnlock()
+	if !ok {
+		return ErrUnknownPort
+	}
+
+	s.tmu.Lock()
+	defer s.tmu.Unlock()
+	s.table[macKey(mac)] = &macEntry{port: id, static: true}
+	return nil
+}
+
+// RemoveStaticEntry removes a static entry for mac. Learned entries are left
+// untouched.
+func (s *Switch) RemoveStaticEntry(mac net.HardwareAddr) {
+	if len(mac) != 6 {
+		return
+	}
+	s.tmu.Lock()
+	defer s.tmu.Unlock()
+	if e, ok := s.table[macKey(mac)]; ok && e.static {
+		delete(s.table, macKey(mac))
+	}
+}
+
+// Flush forgets all learned MAC addresses. Static entries are kept.
+func (s *Switch) Flush() {
+	s.tmu.Lock()
+	defer s.tmu.Unlock()
+	for k, e := range s.table {
+		if !e.static {
+			delete(s.table, k)
+		}
+	}
+}
+
+func (s *Switch) flushPort(id PortID) {
+	s.tmu.Lock()
+	defer s.tmu.Unlock()
+	for k, e := range s.table {
+		if e.port == id {
+			delete(s.table, k)
+		}
+	}
+}
+
+// MACTable returns a snapshot of the MAC address table, ordered by port and
+// then by MAC address. Expired entries are omitted.
+func (s *Switch) MACTable() []MACEntry {
+	now := time.Now()
+
+	s.tmu.Lock()
+	entries := make([]MACEntry, 0, len(s.table))
+	for k, e := range s.table {
+		entry := MACEntry{
+			MAC:    net.HardwareAddr(bytes.Clone(k[:])),
+			Port:   e.port,
+			Static: e.static,
+		}
+		if !e.static {
+			entry.Age = now.Sub(e.lastSeen)
+			if entry.Age > s.agingTime {
+				continue
+			}
+		}
+		entries = append(entries, entry)
+	}
+	s.tmu.Unlock()
+
+	slices.SortFunc(entries, func(a, b MACEntry) int {
+		if a.Port != b.Port {
+			return int(a.Port - b.Port)
+		}
+		return bytes.Compare(a.MAC, b.MAC)
+	})
+	return entries
+}
+
+// Close detaches all ports and stops the switch. Ports implementing io.Closer
+// are closed. Close waits for the read loops of all ports to return, so a
+// port that does not implement io.Closer must return from a pending Read by
+// other means; the frame it returns is discarded.
+func (s *Switch) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrClosed
+	}
+	s.closed = true
+	ports := s.ports
+	s.ports = make(map[PortID]*port)
+	s.mu.Unlock()
+
+	close(s.done)
+
+	var err error
+	for _, pt := range ports {
+		if newErr := s.detach(pt); err == nil {
+			err = newErr
+		}
+	}
+	s.wg.Wait()
+	return err
+}
+
+func (s *Switch) run(pt *port) {
+	defer s.wg.Done()
+
+	buf := make([]byte, s.frameSize)
+	for {
+		n, err := pt.rw.Read(buf)
+		if pt.removed.Load() {
+			return
+		}
+		if err != nil {
+			s.mu.Lock()
+			_, ok := s.ports[pt.id]
+			delete(s.ports, pt.id)
+			s.mu.Unlock()
+			if ok {
+				pt.removed.Store(true)
+				s.flushPort(pt.id)
+				if s.errHandler != nil {
+					s.errHandler(pt.id, err)
+				}
+			}
+			return
+		}
+		s.forward(pt, buf[:n])
+	}
+}
+
+func (s *Switch) forward(in *port, frame []byte) {
+	in.stats.rxFrames.Add(1)
+	in.stats.rxBytes.Add(uint64(len(frame)))
+
+	if len(frame) < 14 {
+		in.stats.rxDropped.Add(1)
+		return
+	}
+
+	dst := waterutil.MACDestination(frame)
+	src := waterutil.MACSource(frame)
+	if waterutil.IsMACUnicast(src) {
+		s.learn(src, in.id)
+	}
+
+	var outID PortID
+	if !waterutil.IsMACBroadcast(dst) && waterutil.IsMACUnicast(dst) {
+		outID = s.lookup(dst)
+	}
+
+	if outID == in.id {
+		in.stats.rxDropped.Add(1)
+		return
+	}
+
+	// Writes may block, so they happen after the ports lock is released.
+	outs := in.outs[:0]
+	s.mu.RLock()
+	if out, ok := s.ports[outID]; ok {
+		outs = append(outs, out)
+	} else {
+		in.stats.flooded.Add(1)
+		for _, out := range s.ports {
+			if out != in {
+				outs = append(outs, out)
+			}
+		}
+	}
+	s.mu.RUnlock()
+
+	for _, out := range outs {
+		s.send(out, frame)
+	}
+	clear(outs)
+	in.outs = outs
+}
+
+func (s *Switch) send(out *port, frame []byte) {
+	out.wmu.Lock()
+	_, err := out.rw.Write(frame)
+	out.wmu.Unlock()
+
+	if err != nil {
+		out.stats.txErrors.Add(1)
+		return
+	}
+	out.stats.txFrames.Add(1)
+	out.stats.txBytes.Add(uint64(len(frame)))
+}
+
+func (s *Switch) learn(mac net.HardwareAddr, id PortID) {
+	key := macKey(mac)
+	now := time.Now()
+
+	s.tmu.Lock()
+	defer s.tmu.Unlock()
+
+	e, ok := s.table[key]
+	if !ok {
+		s.table[key] = &macEntry{port: id, lastSeen: now}
+		return
+	}
+	if e.static {
+		return
+	}
+	e.port = id
+	e.lastSeen = now
+}
+
+func (s *Switch) lookup(mac net.HardwareAddr) PortID {
+	key := macKey(mac)
+
+	s.tmu.Lock()
+	defer s.tmu.Unlock()
+
+	e, ok := s.table[key]
+	if !ok {
+		return 0
+	}
+	if !e.static && time.Since(e.lastSeen) > s.agingTime {
+		delete(s.table, key)
+		return 0
+	}
+	return e.port
+}
+
+func (s *Switch) ager() {
+	defer s.wg.Done()
+
+	interval := s.agingTime / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			s.tmu.Lock()
+			for k, e := range s.table {
+				if !e.static && now.Sub(e.lastSeen) > s.agingTime {
+					delete(s.table, k)
+				}
+			}
+			s.tmu.Unlock()
+		}
+	}
+}
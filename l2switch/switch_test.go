@@ -0,0 +1,161 @@
+package l2switch
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Doridian/water/internal/fakedev"
+)
+
+// expectFrame fails t unless p writes want next.
+func expectFrame(t *testing.T, p *fakedev.Device, want []byte) {
+	t.Helper()
+	if got := p.Expect(t); !bytes.Equal(got, want) {
+		t.Fatalf("unexpected frame % x, want % x", got, want)
+	}
+}
+
+var (
+	macA  = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x0a}
+	macB  = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x0b}
+	macC  = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x0c}
+	bcast = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+)
+
+func frame(dst, src net.HardwareAddr) []byte {
+	f := make([]byte, 0, 60)
+	f = append(f, dst...)
+	f = append(f, src...)
+	f = append(f, 0x08, 0x00)
+	return append(f, make([]byte, 60-len(f))...)
+}
+
+func setup(t *testing.T, config Config) (*Switch, []*fakedev.Device, []PortID) {
+	s := New(config)
+	t.Cleanup(func() { _ = s.Close() })
+
+	ports := []*fakedev.Device{fakedev.New(), fakedev.New(), fakedev.New()}
+	ids := make([]PortID, len(ports))
+	for i, p := range ports {
+		id, err := s.AddPort(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = id
+	}
+	return s, ports, ids
+}
+
+func TestLearningAndFlooding(t *testing.T) {
+	s, ports, ids := setup(t, Config{})
+
+	// Unknown destination: flooded to every other port.
+	f1 := frame(macB, macA)
+	ports[0].In <- f1
+	expectFrame(t, ports[1], f1)
+	expectFrame(t, ports[2], f1)
+	ports[0].ExpectNothing(t)
+
+	// macA is now known: the reply only goes to port 0.
+	f2 := frame(macA, macB)
+	ports[1].In <- f2
+	expectFrame(t, ports[0], f2)
+	ports[2].ExpectNothing(t)
+
+	// Broadcast is always flooded.
+	f3 := frame(bcast, macC)
+	ports[2].In <- f3
+	expectFrame(t, ports[0], f3)
+	expectFrame(t, ports[1], f3)
+
+	table := s.MACTable()
+	if len(table) != 3 {
+		t.Fatalf("expected 3 MAC entries, got %d", len(table))
+	}
+	for i, mac := range []net.HardwareAddr{macA, macB, macC} {
+		if !bytes.Equal(table[i].MAC, mac) || table[i].Port != ids[i] || table[i].Static {
+			t.Fatalf("unexpected MAC entry %d: %+v", i, table[i])
+		}
+	}
+
+	stats, err := s.PortStats(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.RxFrames != 1 || stats.TxFrames != 2 || stats.Flooded != 1 {
+		t.Fatalf("unexpected stats for port 0: %+v", stats)
+	}
+}
+
+func TestAging(t *testing.T) {
+	s, ports, _ := setup(t, Config{AgingTime: 100 * time.Millisecond})
+
+	f1 := frame(macB, macA)
+	ports[0].In <- f1
+	expectFrame(t, ports[1], f1)
+	expectFrame(t, ports[2], f1)
+
+	time.Sleep(200 * time.Millisecond)
+	if len(s.MACTable()) != 0 {
+		t.Fatal("expected learned entry to age out")
+	}
+
+	f2 := frame(macA, macB)
+	ports[1].In <- f2
+	expectFrame(t, ports[0], f2)
+	expectFrame(t, ports[2], f2)
+}
+
+func TestStaticEntry(t *testing.T) {
+	s, ports, ids := setup(t, Config{})
+
+	if err := s.AddStaticEntry(macA, ids[2]); err != nil {
+		t.Fatal(err)
+	}
+
+	// A frame from macA on another port must not move the static entry.
+	f1 := frame(bcast, macA)
+	ports[0].In <- f1
+	expectFrame(t, ports[1], f1)
+	expectFrame(t, ports[2], f1)
+
+	f2 := frame(macA, macB)
+	ports[1].In <- f2
+	expectFrame(t, ports[2], f2)
+	ports[0].ExpectNothing(t)
+
+	if err := s.AddStaticEntry(macA, 42); !errors.Is(err, ErrUnknownPort) {
+		t.Fatalf("expected ErrUnknownPort, got %v", err)
+	}
+}
+
+func TestPortError(t *testing.T) {
+	removed := make(chan PortID, 1)
+	s, ports, ids := setup(t, Config{
+		PortErrorHandler: func(id PortID, err error) {
+			removed <- id
+		},
+	})
+
+	_ = ports[1].Close()
+	select {
+	case id := <-removed:
+		if id != ids[1] {
+			t.Fatalf("unexpected port %d removed", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for port removal")
+	}
+
+	if _, err := s.PortStats(ids[1]); !errors.Is(err, ErrUnknownPort) {
+		t.Fatalf("expected ErrUnknownPort, got %v", err)
+	}
+
+	f1 := frame(bcast, macA)
+	ports[0].In <- f1
+	expectFrame(t, ports[2], f1)
+	ports[1].ExpectNothing(t)
+}
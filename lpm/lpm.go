@@ -0,0 +1,368 @@
+// Package lpm implements a longest-prefix-match table for IPv4 and IPv6
+// prefixes, e.g. to route packets from a single TUN interface to peers the
+// way WireGuard's AllowedIPs does.
+package lpm
+
+import (
+	"errors"
+	"iter"
+	"math/bits"
+	"net/netip"
+	"sync"
+
+	"github.com/Doridian/water/waterutil"
+)
+
+var ErrInvalidPrefix = errors.New("invalid prefix")
+
+// key holds the bits of an address, most significant first. IPv4 addresses
+// use the first 32 bits of hi.
+type key struct {
+	hi, lo uint64
+}
+
+func keyFromAddr(addr netip.Addr) (key, int) {
+	if addr.Is4() {
+		a := addr.As4()
+		return key{hi: uint64(a[0])<<56 | uint64(a[1])<<48 | uint64(a[2])<<40 | uint64(a[3])<<32}, 32
+	}
+	a := addr.As16()
+	var k key
+	for i := range 8 {
+		k.hi = k.hi<<8 | uint64(a[i])
+		k.lo = k.lo<<8 | uint64(a[i+8])
+	}
+	return k, 128
+}
+
+func (k key) addr(is4 bool) netip.Addr {
+	if is4 {
+		return netip.AddrFrom4([4]byte{byte(k.hi >> 56), byte(k.hi >> 48), byte(k.hi >> 40), byte(k.hi >> 32)})
+	}
+	var a [16]byte
+	for i := range 8 {
+		a[i] = byte(k.hi >> (56 - 8*i))
+		a[i+8] = byte(k.lo >> (56 - 8*i))
+	}
+	return netip.AddrFrom16(a)
+}
+
+// bit returns bit i of k, counting from the most significant bit.
+func (k key) bit(i int) int {
+	if i < 64 {
+		return int(k.hi>>(63-i)) & 1
+	}
+	return int(k.lo>>(127-i)) & 1
+}
+
+// commonBits returns the length of the common prefix of a and b, at most
+// limit.
+func commonBits(a, b key, limit int) int {
+	n := bits.LeadingZeros64(a.hi ^ b.hi)
+	if n == 64 {
+		n += bits.LeadingZeros64(a.lo ^ b.lo)
+	}
+	return min(n, limit)
+}
+
+// mask clears all but the first n bits of k.
+func (k key) mask(n int) key {
+	switch {
+	case n == 0:
+		return key{}
+	case n < 64:
+		return key{hi: k.hi &^ (^uint64(0) >> n)}
+	case n == 64:
+		return key{hi: k.hi}
+	case n < 128:
+		return key{hi: k.hi, lo: k.lo &^ (^uint64(0) >> (n - 64))}
+	default:
+		return k
+	}
+}
+
+// node is a node of a path-compressed binary trie. Nodes without a value
+// only exist to branch and always have two children.
+type node[V comparable] struct {
+	key      key
+	bits     int
+	children [2]*node[V]
+	value    V
+	hasValue bool
+}
+
+// Table maps IPv4 and IPv6 prefixes to values and finds the longest prefix
+// containing an address. It is safe for concurrent use; lookups run in
+// parallel and only wait for updates in progress. The zero value is an empty
+// table.
+type Table[V comparable] struct {
+	mu     sync.RWMutex
+	v4, v6 *node[V]
+	len    int
+}
+
+func (t *Table[V]) root(is4 bool) **node[V] {
+	if is4 {
+		return &t.v4
+	}
+	return &t.v6
+}
+
+// Insert maps prefix to value, replacing any previous value for the same
+// prefix. Host bits of prefix are ignored.
+func (t *Table[V]) Insert(prefix netip.Prefix, value V) error {
+	if !prefix.IsValid() {
+		return ErrInvalidPrefix
+	}
+	k, _ := keyFromAddr(prefix.Addr())
+	n := prefix.Bits()
+	k = k.mask(n)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p := t.root(prefix.Addr().Is4())
+	for {
+		cur := *p
+		if cur == nil {
+			*p = &node[V]{key: k, bits: n, value: value, hasValue: true}
+			t.len++
+			return nil
+		}
+		common := commonBits(cur.key, k, min(cur.bits, n))
+		switch {
+		case common == cur.bits && common == n:
+			if !cur.hasValue {
+				t.len++
+			}
+			cur.value, cur.hasValue = value, true
+			return nil
+		case common == cur.bits:
+			p = &cur.children[k.bit(cur.bits)]
+			continue
+		case common == n:
+			leaf := &node[V]{key: k, bits: n, value: value, hasValue: true}
+			leaf.children[cur.key.bit(n)] = cur
+			*p = leaf
+		default:
+			branch := &node[V]{key: k.mask(common), bits: common}
+			branch.children[cur.key.bit(common)] = cur
+			branch.children[k.bit(common)] = &node[V]{key: k, bits: n, value: value, hasValue: true}
+			*p = branch
+		}
+		t.len++
+		return nil
+	}
+}
+
+// Delete removes prefix and reports whether it was present.
+func (t *Table[V]) Delete(prefix netip.Prefix) bool {
+	if !prefix.IsValid() {
+		return false
+	}
+	k, _ := keyFromAddr(prefix.Addr())
+	n := prefix.Bits()
+	k = k.mask(n)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.delete(prefix.Addr().Is4(), k, n)
+}
+
+func (t *Table[V]) delete(is4 bool, k key, n int) bool {
+	var parent **node[V]
+	p := t.root(is4)
+	for *p != nil && (*p).bits < n && commonBits((*p).key, k, (*p).bits) == (*p).bits {
+		parent = p
+		p = &(*p).children[k.bit((*p).bits)]
+	}
+	cur := *p
+	if cur == nil || cur.bits != n || cur.key != k || !cur.hasValue {
+		return false
+	}
+	t.len--
+
+	var zero V
+	cur.value, cur.hasValue = zero, false
+	switch {
+	case cur.children[0] != nil && cur.children[1] != nil:
+		// Keep as a branch node.
+	case cur.children[0] != nil:
+		*p = cur.children[0]
+	case cur.children[1] != nil:
+		*p = cur.children[1]
+	default:
+		*p = nil
+		// The parent may now be a branch node with a single child.
+		if parent != nil && !(*parent).hasValue {
+			pn := *parent
+			if pn.children[0] != nil {
+				*parent = pn.children[0]
+			} else {
+				*parent = pn.children[1]
+			}
+		}
+	}
+	return true
+}
+
+// Get returns the value stored for exactly prefix.
+func (t *Table[V]) Get(prefix netip.Prefix) (V, bool) {
+	var zero V
+	if !prefix.IsValid() {
+		return zero, false
+	}
+	k, _ := keyFromAddr(prefix.Addr())
+	n := prefix.Bits()
+	k = k.mask(n)
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	cur := *t.root(prefix.Addr().Is4())
+	for cur != nil && cur.bits < n && commonBits(cur.key, k, cur.bits) == cur.bits {
+		cur = cur.children[k.bit(cur.bits)]
+	}
+	if cur == nil || cur.bits != n || cur.key != k || !cur.hasValue {
+		return zero, false
+	}
+	return cur.value, true
+}
+
+// LookupPrefix returns the longest prefix containing addr and its value.
+func (t *Table[V]) LookupPrefix(addr netip.Addr) (netip.Prefix, V, bool) {
+	var zero V
+	if !addr.IsValid() {
+		return netip.Prefix{}, zero, false
+	}
+	k, maxBits := keyFromAddr(addr)
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var best *node[V]
+	for cur := *t.root(addr.Is4()); cur != nil; {
+		if commonBits(cur.key, k, cur.bits) < cur.bits {
+			break
+		}
+		if cur.hasValue {
+			best = cur
+		}
+		if cur.bits == maxBits {
+			break
+		}
+		cur = cur.children[k.bit(cur.bits)]
+	}
+	if best == nil {
+		return netip.Prefix{}, zero, false
+	}
+	return netip.PrefixFrom(best.key.addr(addr.Is4()), best.bits), best.value, true
+}
+
+// Lookup returns the value of the longest prefix containing addr.
+func (t *Table[V]) Lookup(addr netip.Addr) (V, bool) {
+	_, value, ok := t.LookupPrefix(addr)
+	return value, ok
+}
+
+// LookupPacket returns the value of the longest prefix containing the
+// destination of an IPv4 or IPv6 packet.
+func (t *Table[V]) LookupPacket(packet []byte) (V, bool) {
+	dst, err := waterutil.ParseIPDestination(packet)
+	if err != nil {
+		var zero V
+		return zero, false
+	}
+	addr, _ := netip.AddrFromSlice(dst)
+	return t.Lookup(addr)
+}
+
+// ValidSource performs a reverse-path check: it reports whether the source
+// address of an IPv4 or IPv6 packet received from the peer identified by from
+// routes back to from. Packets failing the check have a spoofed source.
+func (t *Table[V]) ValidSource(packet []byte, from V) bool {
+	src, err := waterutil.ParseIPSource(packet)
+	if err != nil {
+		return false
+	}
+	addr, _ := netip.AddrFromSlice(src)
+	value, ok := t.Lookup(addr)
+	return ok && value == from
+}
+
+// Len returns the number of prefixes in the table.
+func (t *Table[V]) Len() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.len
+}
+
+// All walks the table in prefix order, IPv4 before IPv6, yielding every
+// prefix and its value. It iterates over a snapshot, so the table may be
+// modified during iteration.
+func (t *Table[V]) All() iter.Seq2[netip.Prefix, V] {
+	type entry struct {
+		prefix netip.Prefix
+		value  V
+	}
+	return func(yield func(netip.Prefix, V) bool) {
+		t.mu.RLock()
+		entries := make([]entry, 0, t.len)
+		var walk func(n *node[V], is4 bool)
+		walk = func(n *node[V], is4 bool) {
+			if n == nil {
+				return
+			}
+			if n.hasValue {
+				entries = append(entries, entry{netip.PrefixFrom(n.key.addr(is4), n.bits), n.value})
+			}
+			walk(n.children[0], is4)
+			walk(n.children[1], is4)
+		}
+		walk(t.v4, true)
+		walk(t.v6, false)
+		t.mu.RUnlock()
+
+		for _, e := range entries {
+			if !yield(e.prefix, e.value) {
+				return
+			}
+		}
+	}
+}
+
+// DeleteValue removes all prefixes mapped to value, e.g. when a peer goes
+// away, and returns how many were removed.
+func (t *Table[V]) DeleteValue(value V) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	type match struct {
+		key  key
+		bits int
+	}
+	var matches []match
+	var walk func(n *node[V])
+	walk = func(n *node[V]) {
+		if n == nil {
+			return
+		}
+		if n.hasValue && n.value == value {
+			matches = append(matches, match{n.key, n.bits})
+		}
+		walk(n.children[0])
+		walk(n.children[1])
+	}
+
+	removed := 0
+	for _, is4 := range []bool{true, false} {
+		matches = matches[:0]
+		walk(*t.root(is4))
+		for _, m := range matches {
+			if t.delete(is4, m.key, m.bits) {
+				removed++
+			}
+		}
+	}
+	return removed
+}
@@ -0,0 +1,219 @@
+package lpm
+
+import (
+	"math/rand/v2"
+	"net/netip"
+	"sync"
+	"testing"
+
+	"github.com/Doridian/water/waterutil"
+)
+
+func mustInsert[V comparable](t *testing.T, table *Table[V], prefix string, value V) {
+	t.Helper()
+	if err := table.Insert(netip.MustParsePrefix(prefix), value); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	var table Table[string]
+	mustInsert(t, &table, "0.0.0.0/0", "default")
+	mustInsert(t, &table, "10.0.0.0/8", "a")
+	mustInsert(t, &table, "10.1.0.0/16", "b")
+	mustInsert(t, &table, "10.1.2.3/32", "c")
+	mustInsert(t, &table, "10.128.0.0/9", "d")
+	mustInsert(t, &table, "fd00::/8", "v6")
+	mustInsert(t, &table, "fd00:1::/32", "v6-1")
+
+	tests := []struct {
+		addr   string
+		want   string
+		prefix string
+	}{
+		{"10.1.2.3", "c", "10.1.2.3/32"},
+		{"10.1.2.4", "b", "10.1.0.0/16"},
+		{"10.2.0.1", "a", "10.0.0.0/8"},
+		{"10.200.0.1", "d", "10.128.0.0/9"},
+		{"192.168.0.1", "default", "0.0.0.0/0"},
+		{"fd00:1::1", "v6-1", "fd00:1::/32"},
+		{"fd00:2::1", "v6", "fd00::/8"},
+		{"2001:db8::1", "", ""},
+	}
+	for _, tt := range tests {
+		prefix, got, ok := table.LookupPrefix(netip.MustParseAddr(tt.addr))
+		if tt.want == "" {
+			if ok {
+				t.Errorf("%s: found %s", tt.addr, got)
+			}
+			continue
+		}
+		if !ok || got != tt.want || prefix.String() != tt.prefix {
+			t.Errorf("%s: got %s via %v, want %s via %s", tt.addr, got, prefix, tt.want, tt.prefix)
+		}
+	}
+	if table.Len() != 7 {
+		t.Errorf("Len = %d", table.Len())
+	}
+
+	// Replacing a value keeps the length.
+	mustInsert(t, &table, "10.0.0.0/8", "a2")
+	if v, _ := table.Get(netip.MustParsePrefix("10.0.0.0/8")); v != "a2" || table.Len() != 7 {
+		t.Errorf("after replace: %s, len %d", v, table.Len())
+	}
+	if _, ok := table.Get(netip.MustParsePrefix("10.0.0.0/9")); ok {
+		t.Error("Get matched a different prefix length")
+	}
+	if err := table.Insert(netip.Prefix{}, "x"); err != ErrInvalidPrefix {
+		t.Errorf("invalid prefix: %v", err)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	var table Table[int]
+	mustInsert(t, &table, "10.0.0.0/8", 1)
+	mustInsert(t, &table, "10.1.0.0/16", 2)
+	mustInsert(t, &table, "10.2.0.0/16", 3)
+
+	if table.Delete(netip.MustParsePrefix("10.3.0.0/16")) {
+		t.Error("deleted a missing prefix")
+	}
+	if !table.Delete(netip.MustParsePrefix("10.0.0.0/8")) {
+		t.Fatal("prefix not deleted")
+	}
+	if v, ok := table.Lookup(netip.MustParseAddr("10.1.0.1")); !ok || v != 2 {
+		t.Errorf("after delete: %d, %v", v, ok)
+	}
+	if _, ok := table.Lookup(netip.MustParseAddr("10.3.0.1")); ok {
+		t.Error("deleted prefix still matches")
+	}
+	if !table.Delete(netip.MustParsePrefix("10.1.0.0/16")) || !table.Delete(netip.MustParsePrefix("10.2.0.0/16")) {
+		t.Fatal("prefixes not deleted")
+	}
+	if table.Len() != 0 || table.v4 != nil {
+		t.Errorf("table not empty: len %d", table.Len())
+	}
+}
+
+func TestAllAndDeleteValue(t *testing.T) {
+	var table Table[int]
+	for i, prefix := range []string{"fd00::/8", "10.1.0.0/16", "10.0.0.0/8", "192.168.0.0/24"} {
+		mustInsert(t, &table, prefix, i%2)
+	}
+	var got []string
+	for prefix := range table.All() {
+		got = append(got, prefix.String())
+	}
+	want := []string{"10.0.0.0/8", "10.1.0.0/16", "192.168.0.0/24", "fd00::/8"}
+	if len(got) != len(want) {
+		t.Fatalf("All = %v", got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("All = %v, want %v", got, want)
+		}
+	}
+
+	if n := table.DeleteValue(0); n != 2 {
+		t.Errorf("DeleteValue removed %d", n)
+	}
+	for _, v := range table.All() {
+		if v == 0 {
+			t.Error("value not removed")
+		}
+	}
+}
+
+func TestPacket(t *testing.T) {
+	var table Table[string]
+	mustInsert(t, &table, "10.0.1.0/24", "peer1")
+	mustInsert(t, &table, "10.0.2.0/24", "peer2")
+
+	packet := waterutil.BuildEchoRequest(netip.MustParseAddr("10.0.1.5"), netip.MustParseAddr("10.0.2.7"), 1, 1, nil)
+	if v, ok := table.LookupPacket(packet); !ok || v != "peer2" {
+		t.Errorf("LookupPacket = %s, %v", v, ok)
+	}
+	if !table.ValidSource(packet, "peer1") {
+		t.Error("valid source rejected")
+	}
+	if table.ValidSource(packet, "peer2") {
+		t.Error("spoofed source accepted")
+	}
+	if _, ok := table.LookupPacket(packet[:10]); ok {
+		t.Error("truncated packet matched")
+	}
+}
+
+// TestRandom compares the table with a linear search over random prefixes.
+func TestRandom(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	randomAddr := func(is4 bool) netip.Addr {
+		var a [16]byte
+		for i := range a {
+			a[i] = byte(rng.IntN(4)) // few distinct values to share prefixes
+		}
+		if is4 {
+			return netip.AddrFrom4([4]byte(a[:4]))
+		}
+		return netip.AddrFrom16(a)
+	}
+
+	var table Table[int]
+	ref := map[netip.Prefix]int{}
+	for i := range 2000 {
+		is4 := rng.IntN(2) == 0
+		maxBits := 128
+		if is4 {
+			maxBits = 32
+		}
+		prefix := netip.PrefixFrom(randomAddr(is4), rng.IntN(maxBits+1)).Masked()
+		if rng.IntN(3) == 0 {
+			_, want := ref[prefix]
+			if got := table.Delete(prefix); got != want {
+				t.Fatalf("Delete(%v) = %v, want %v", prefix, got, want)
+			}
+			delete(ref, prefix)
+		} else {
+			ref[prefix] = i
+			if err := table.Insert(prefix, i); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		addr := randomAddr(rng.IntN(2) == 0)
+		wantBits, want := -1, 0
+		for p, v := range ref {
+			if p.Contains(addr) && p.Bits() > wantBits {
+				wantBits, want = p.Bits(), v
+			}
+		}
+		prefix, got, ok := table.LookupPrefix(addr)
+		if ok != (wantBits >= 0) || (ok && (got != want || prefix.Bits() != wantBits)) {
+			t.Fatalf("Lookup(%v) = %v %d %v, want /%d %d", addr, prefix, got, ok, wantBits, want)
+		}
+		if table.Len() != len(ref) {
+			t.Fatalf("Len = %d, want %d", table.Len(), len(ref))
+		}
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	var table Table[int]
+	var wg sync.WaitGroup
+	for i := range 4 {
+		wg.Go(func() {
+			for j := range 500 {
+				prefix := netip.PrefixFrom(netip.AddrFrom4([4]byte{10, byte(i), byte(j >> 8), byte(j)}), 32)
+				_ = table.Insert(prefix, j)
+				table.Lookup(prefix.Addr())
+				if j%2 == 0 {
+					table.Delete(prefix)
+				}
+			}
+		})
+	}
+	wg.Wait()
+	if table.Len() != 4*250 {
+		t.Errorf("Len = %d", table.Len())
+	}
+}
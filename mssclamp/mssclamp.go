@@ -0,0 +1,127 @@
+// Package mssclamp lowers the maximum segment size (MSS) advertised in TCP SYN
+// and SYN-ACK packets, so that TCP connections through a tunnel with reduced
+// MTU work even if ICMP Fragmentation Needed or Packet Too Big messages are
+// blocked on the path.
+package mssclamp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	"github.com/Doridian/water"
+	"github.com/Doridian/water/waterutil"
+)
+
+// Size of the IP and TCP headers without options.
+const (
+	ipv4Overhead = 20 + 20
+	ipv6Overhead = 40 + 20
+)
+
+// MSSFromMTU returns the largest MSS for which segments fit in mtu, for IP
+// version 4 or 6.
+func MSSFromMTU(mtu int, version byte) uint16 {
+	overhead := ipv4Overhead
+	if version == 6 {
+		overhead = ipv6Overhead
+	}
+	return uint16(min(max(mtu-overhead, 0), 0xffff)) // #nosec G115 -- clamped above
+}
+
+// needsClamp reports whether packet is a TCP SYN or SYN-ACK with an MSS
+// option larger than mss.
+func needsClamp(packet []byte, mss uint16) bool {
+	if waterutil.ValidateTCP(packet) != nil || waterutil.TCPFlags(packet)&waterutil.TCPFlagSYN == 0 {
+		return false
+	}
+	current, ok := waterutil.TCPMSS(packet)
+	return ok && current > mss
+}
+
+// Clamp lowers the MSS option of a TCP SYN or SYN-ACK carried by an IPv4 or
+// IPv6 packet to mss, updating the TCP checksum incrementally. It reports
+// whether packet was modified. Other packets and SYNs without an MSS option
+// are left unchanged.
+func Clamp(packet []byte, mss uint16) bool {
+	return needsClamp(packet, mss) && waterutil.SetTCPMSSWithChecksum(packet, mss)
+}
+
+// Config defines the MSS an Interface is clamped to.
+type Config struct {
+	// MSS is the largest MSS allowed for both IPv4 and IPv6. If zero, it is
+	// derived from MTU.
+	MSS uint16
+
+	// MTU is the MTU of the path the clamped connections take.
+	MTU int
+}
+
+type clamper struct {
+	ifce       *water.Interface
+	mss4, mss6 uint16
+}
+
+var _ io.ReadWriteCloser = (*clamper)(nil)
+
+// New wraps a TUN or TAP interface, clamping the MSS of TCP SYN and SYN-ACK
+// packets in both directions. Closing the returned interface closes ifce.
+func New(ifce *water.Interface, config Config) (*water.Interface, error) {
+	c := &clamper{ifce: ifce, mss4: config.MSS, mss6: config.MSS}
+	if config.MSS == 0 {
+		if config.MTU <= ipv6Overhead {
+			return nil, errors.New("either MSS or an MTU larger than 60 is required")
+		}
+		c.mss4 = MSSFromMTU(config.MTU, 4)
+		c.mss6 = MSSFromMTU(config.MTU, 6)
+	}
+	var deviceType water.DeviceType = water.TUN
+	if ifce.IsTAP() {
+		deviceType = water.TAP
+	}
+	return water.NewFromReadWriteCloser(c, deviceType, ifce.Name())
+}
+
+// packet returns the IP packet in b and the MSS it is clamped to.
+func (c *clamper) packet(b []byte) ([]byte, uint16) {
+	if c.ifce.IsTAP() {
+		if waterutil.ValidateMACFrame(b) != nil {
+			return nil, 0
+		}
+		switch waterutil.MACEthertype(b) {
+		case waterutil.IPv4, waterutil.IPv6:
+		default:
+			return nil, 0
+		}
+		b = waterutil.MACPayload(b)
+	}
+	if len(b) > 0 && waterutil.IPVersion(b) == 6 {
+		return b, c.mss6
+	}
+	return b, c.mss4
+}
+
+func (c *clamper) Read(to []byte) (int, error) {
+	n, err := c.ifce.Read(to)
+	if n > 0 {
+		packet, mss := c.packet(to[:n])
+		Clamp(packet, mss)
+	}
+	return n, err
+}
+
+// Write clamps a copy of from if needed, leaving the caller's buffer
+// unchanged.
+func (c *clamper) Write(from []byte) (int, error) {
+	if packet, mss := c.packet(from); needsClamp(packet, mss) {
+		clamped := bytes.Clone(from)
+		packet, _ = c.packet(clamped)
+		Clamp(packet, mss)
+		from = clamped
+	}
+	return c.ifce.Write(from)
+}
+
+func (c *clamper) Close() error {
+	return c.ifce.Close()
+}
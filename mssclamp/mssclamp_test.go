@@ -0,0 +1,218 @@
+package mssclamp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/Doridian/water"
+	"github.com/Doridian/water/internal/fakedev"
+	"github.com/Doridian/water/waterutil"
+)
+
+var (
+	src4 = netip.MustParseAddr("10.0.0.1")
+	dst4 = netip.MustParseAddr("10.0.0.2")
+	src6 = netip.MustParseAddr("fd00::1")
+	dst6 = netip.MustParseAddr("fd00::2")
+)
+
+// buildTCP builds a TCP packet from src to dst with the given flags and
+// options, padded to a multiple of 4 bytes, and a valid checksum.
+func buildTCP(src, dst netip.Addr, flags byte, options []byte) []byte {
+	for len(options)%4 != 0 {
+		options = append(options, 0)
+	}
+	tcp := make([]byte, 20, 20+len(options))
+	binary.BigEndian.PutUint16(tcp[0:2], 12345)
+	binary.BigEndian.PutUint16(tcp[2:4], 80)
+	tcp[12] = byte((20+len(options))/4) << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:16], 65535)
+	tcp = append(tcp, options...)
+	waterutil.TCPSegment(tcp).FixChecksum(src, dst)
+
+	var packet []byte
+	if src.Is4() {
+		packet = waterutil.AppendIPv4Header(nil, waterutil.TCP, waterutil.DefaultTTL, src, dst, len(tcp))
+	} else {
+		packet = waterutil.AppendIPv6Header(nil, waterutil.TCP, waterutil.DefaultTTL, src, dst, len(tcp))
+	}
+	return append(packet, tcp...)
+}
+
+func mssOf(t *testing.T, packet []byte) uint16 {
+	t.Helper()
+	mss, ok := waterutil.TCPMSS(packet)
+	if !ok {
+		t.Fatal("no MSS option")
+	}
+	return mss
+}
+
+func checkChecksum(t *testing.T, packet []byte, src, dst netip.Addr) {
+	t.Helper()
+	seg := waterutil.TCPSegment(waterutil.IPPayload(packet))
+	if got, want := seg.Checksum(), seg.ComputeChecksum(src, dst); got != want {
+		t.Errorf("checksum = %#04x, want %#04x", got, want)
+	}
+}
+
+func TestClamp(t *testing.T) {
+	const syn, ack = 0x02, 0x10
+	mss := []byte{2, 4, 0x05, 0xb4} // 1460
+	tests := []struct {
+		name     string
+		src, dst netip.Addr
+		flags    byte
+		options  []byte
+		clamped  bool
+	}{
+		{"IPv4 SYN", src4, dst4, syn, mss, true},
+		{"IPv4 SYN-ACK", dst4, src4, syn | ack, mss, true},
+		{"IPv4 unaligned", src4, dst4, syn, append([]byte{1}, mss...), true},
+		{"IPv6 SYN", src6, dst6, syn, mss, true},
+		{"IPv6 unaligned", src6, dst6, syn, append([]byte{1, 1, 1}, mss...), true},
+		{"after other options", src4, dst4, syn, append([]byte{4, 2, 3, 3, 7}, mss...), true},
+		{"ACK", src4, dst4, ack, mss, false},
+		{"no MSS", src4, dst4, syn, []byte{3, 3, 7}, false},
+		{"after end of options", src4, dst4, syn, append([]byte{0}, mss...), false},
+		{"below limit", src4, dst4, syn, []byte{2, 4, 0x04, 0x00}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packet := buildTCP(tt.src, tt.dst, tt.flags, tt.options)
+			orig := bytes.Clone(packet)
+			if got := Clamp(packet, 1200); got != tt.clamped {
+				t.Fatalf("Clamp = %v, want %v", got, tt.clamped)
+			}
+			if !tt.clamped {
+				if !bytes.Equal(packet, orig) {
+					t.Error("packet modified")
+				}
+				return
+			}
+			if got := mssOf(t, packet); got != 1200 {
+				t.Errorf("MSS = %d, want 1200", got)
+			}
+			checkChecksum(t, packet, tt.src, tt.dst)
+		})
+	}
+}
+
+func TestClampMalformed(t *testing.T) {
+	packet := buildTCP(src4, dst4, 0x02, []byte{2, 4, 0x05, 0xb4})
+	for i := range packet {
+		if Clamp(bytes.Clone(packet[:i]), 1200) {
+			t.Errorf("truncated to %d bytes: clamped", i)
+		}
+	}
+	// An option length running past the header.
+	packet = buildTCP(src4, dst4, 0x02, []byte{3, 9, 0, 2, 4, 0x05, 0xb4})
+	if Clamp(packet, 1200) {
+		t.Error("invalid option length: clamped")
+	}
+}
+
+func TestMSSFromMTU(t *testing.T) {
+	if got := MSSFromMTU(1420, 4); got != 1380 {
+		t.Errorf("IPv4 = %d, want 1380", got)
+	}
+	if got := MSSFromMTU(1420, 6); got != 1360 {
+		t.Errorf("IPv6 = %d, want 1360", got)
+	}
+	if got := MSSFromMTU(10, 4); got != 0 {
+		t.Errorf("tiny MTU = %d, want 0", got)
+	}
+}
+
+func TestNewTUN(t *testing.T) {
+	f := fakedev.New()
+	f.In <- buildTCP(src6, dst6, 0x02, []byte{2, 4, 0x05, 0xb4})
+	var deviceType water.DeviceType = water.TUN
+	tun, err := water.NewFromReadWriteCloser(f, deviceType, "fake0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ifce, err := New(tun, Config{MTU: 1280})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1500)
+	n, err := ifce.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := mssOf(t, buf[:n]); got != 1220 {
+		t.Errorf("read MSS = %d, want 1220", got)
+	}
+	checkChecksum(t, buf[:n], src6, dst6)
+
+	syn := buildTCP(src4, dst4, 0x02, []byte{2, 4, 0x05, 0xb4})
+	orig := bytes.Clone(syn)
+	if _, err := ifce.Write(syn); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(syn, orig) {
+		t.Error("Write modified the caller's buffer")
+	}
+	written := f.Expect(t)
+	if got := mssOf(t, written); got != 1240 {
+		t.Errorf("written MSS = %d, want 1240", got)
+	}
+	checkChecksum(t, written, src4, dst4)
+}
+
+func TestNewTAP(t *testing.T) {
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	frame := waterutil.AppendEthernetHeader(nil, mac, mac, waterutil.IPv4)
+	frame = append(frame, buildTCP(src4, dst4, 0x12, []byte{2, 4, 0x05, 0xb4})...)
+	f := fakedev.New()
+	f.In <- frame
+	var deviceType water.DeviceType = water.TAP
+	tap, err := water.NewFromReadWriteCloser(f, deviceType, "fake0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ifce, err := New(tap, Config{MSS: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ifce.IsTAP() {
+		t.Error("wrapped interface is not a TAP interface")
+	}
+
+	buf := make([]byte, 1500)
+	n, err := ifce.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := waterutil.MACPayload(buf[:n])
+	if got := mssOf(t, packet); got != 1000 {
+		t.Errorf("MSS = %d, want 1000", got)
+	}
+	checkChecksum(t, packet, src4, dst4)
+
+	// Frames that do not carry IP are passed through unchanged.
+	frame = waterutil.AppendEthernetHeader(nil, mac, mac, waterutil.ARP)
+	frame = append(frame, buildTCP(src4, dst4, 0x12, []byte{2, 4, 0x05, 0xb4})...)
+	orig := bytes.Clone(frame)
+	f.In <- frame
+	if n, err = ifce.Read(buf); err != nil || !bytes.Equal(buf[:n], orig) {
+		t.Errorf("non-IP frame modified: % x, %v", buf[:n], err)
+	}
+}
+
+func TestNewInvalidConfig(t *testing.T) {
+	var deviceType water.DeviceType = water.TUN
+	tun, err := water.NewFromReadWriteCloser(fakedev.New(), deviceType, "fake0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(tun, Config{}); err == nil {
+		t.Error("expected error for empty config")
+	}
+}
@@ -0,0 +1,321 @@
+// Package mux owns the read loop of an Interface and dispatches every packet
+// to a handler registered for its ethertype, IP version, protocol,
+// destination port or destination prefix.
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/netip"
+	"slices"
+	"sync"
+
+	"github.com/Doridian/water"
+	"github.com/Doridian/water/waterutil"
+)
+
+// DefaultBatchSize is the number of packets read at once when
+// Config.BatchSize is zero and the interface supports vector reads.
+const DefaultBatchSize = 32
+
+// DefaultPacketSize is the read buffer size per packet used when
+// Config.PacketSize is zero. It fits any IP packet and its Ethernet header.
+const DefaultPacketSize = 65535 + 22
+
+var (
+	ErrClosed  = errors.New("mux is closed")
+	ErrServing = errors.New("mux is already serving")
+)
+
+// Handler handles a packet read from the interface. On a TUN interface packet
+// is an IP packet, on a TAP interface an Ethernet frame. packet is only valid
+// until ServePacket returns. Replies written to w are sent out of the
+// interface.
+type Handler interface {
+	ServePacket(w io.Writer, packet []byte)
+}
+
+// HandlerFunc adapts a function to a Handler.
+type HandlerFunc func(w io.Writer, packet []byte)
+
+func (f HandlerFunc) ServePacket(w io.Writer, packet []byte) {
+	f(w, packet)
+}
+
+// Config defines parameters of a Mux. A zero-value Config is valid.
+type Config struct {
+	// BatchSize is the number of packets read at once with ReadVector.
+	// Defaults to DefaultBatchSize. Interfaces without native vector support
+	// always read a single packet at a time, as their ReadVector waits until
+	// the whole batch is filled.
+	BatchSize int
+
+	// PacketSize is the read buffer size per packet. Longer packets are
+	// truncated by the interface. Defaults to DefaultPacketSize.
+	PacketSize int
+
+	// PanicHandler, if non-nil, is called with the recovered value when a
+	// handler panics. The packet is dropped and the mux keeps running.
+	PanicHandler func(v any, packet []byte)
+}
+
+type portKey struct {
+	protocol waterutil.IPProtocol
+	port     uint16
+}
+
+type prefixRoute struct {
+	prefix  netip.Prefix
+	handler Handler
+}
+
+// Mux reads packets from an Interface and dispatches them to handlers. A
+// packet goes to the first handler that matches, in this order: destination
+// port, longest destination prefix, IP protocol, IP version, ethertype, and
+// finally the default handler. Packets no handler matches are dropped.
+// Handlers can be registered at any time and are called from the read loop,
+// one packet after another. Registering a nil handler removes the existing
+// registration.
+type Mux struct {
+	ifce       *water.Interface
+	batchSize  int
+	packetSize int
+	onPanic    func(v any, packet []byte)
+	w          replyWriter
+
+	mu         sync.RWMutex
+	ethertypes map[waterutil.Ethertype]Handler
+	versions   map[byte]Handler
+	protocols  map[waterutil.IPProtocol]Handler
+	ports      map[portKey]Handler
+	prefixes   []prefixRoute
+	fallback   Handler
+
+	runMu   sync.Mutex
+	closed  bool
+	serving bool
+	done    chan struct{}
+}
+
+// New creates a Mux for ifce. Call Serve to start dispatching.
+func New(ifce *water.Interface, config Config) *Mux {
+	if config.BatchSize <= 0 {
+		config.BatchSize = DefaultBatchSize
+	}
+	if !ifce.IsVectorNative() {
+		config.BatchSize = 1
+	}
+	if config.PacketSize <= 0 {
+		config.PacketSize = DefaultPacketSize
+	}
+	return &Mux{
+		ifce:       ifce,
+		batchSize:  config.BatchSize,
+		packetSize: config.PacketSize,
+		onPanic:    config.PanicHandler,
+		w:          replyWriter{ifce: ifce},
+		ethertypes: make(map[waterutil.Ethertype]Handler),
+		versions:   make(map[byte]Handler),
+		protocols:  make(map[waterutil.IPProtocol]Handler),
+		ports:      make(map[portKey]Handler),
+		done:       make(chan struct{}),
+	}
+}
+
+// HandleEthertype registers h for Ethernet frames of the given ethertype. It
+// only applies to TAP interfaces.
+func (m *Mux) HandleEthertype(ethertype waterutil.Ethertype, h Handler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ethertypes[ethertype] = h
+}
+
+// HandleIPVersion registers h for IP packets of version 4 or 6.
+func (m *Mux) HandleIPVersion(version byte, h Handler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.versions[version] = h
+}
+
+// HandleProtocol registers h for IP packets carrying protocol. IPv6 extension
+// headers are skipped.
+func (m *Mux) HandleProtocol(protocol waterutil.IPProtocol, h Handler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.protocols[protocol] = h
+}
+
+// HandlePort registers h for TCP, UDP, DCCP or SCTP packets to the given
+// destination port. Non-first fragments carry no port and do not match.
+func (m *Mux) HandlePort(protocol waterutil.IPProtocol, port uint16, h Handler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ports[portKey{protocol, port}] = h
+}
+
+// HandlePrefix registers h for IP packets whose destination is in prefix. If
+// several prefixes match, the longest one wins.
+func (m *Mux) HandlePrefix(prefix netip.Prefix, h Handler) {
+	prefix = prefix.Masked()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.prefixes = slices.DeleteFunc(m.prefixes, func(r prefixRoute) bool {
+		return r.prefix == prefix
+	})
+	i, _ := slices.BinarySearchFunc(m.prefixes, prefix, func(r prefixRoute, p netip.Prefix) int {
+		return p.Bits() - r.prefix.Bits()
+	})
+	if h != nil {
+		m.prefixes = slices.Insert(m.prefixes, i, prefixRoute{prefix, h})
+	}
+}
+
+// HandleDefault registers h for packets that match no other handler.
+func (m *Mux) HandleDefault(h Handler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.fallback = h
+}
+
+// Serve reads packets and dispatches them until Close is called, in which
+// case it returns nil, or reading fails.
+func (m *Mux) Serve() error {
+	m.runMu.Lock()
+	if m.closed {
+		m.runMu.Unlock()
+		return ErrClosed
+	}
+	if m.serving {
+		m.runMu.Unlock()
+		return ErrServing
+	}
+	m.serving = true
+	m.runMu.Unlock()
+	defer close(m.done)
+
+	bufs := make([][]byte, m.batchSize)
+	for i := range bufs {
+		bufs[i] = make([]byte, m.packetSize)
+	}
+	sizes := make([]int, m.batchSize)
+	for {
+		n, err := m.ifce.ReadVector(bufs, sizes)
+		for i := range n {
+			m.dispatch(bufs[i][:sizes[i]])
+		}
+		if err != nil {
+			m.runMu.Lock()
+			closed := m.closed
+			m.runMu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// Close closes the interface, which stops Serve, and waits for the packet
+// being handled to finish. Handlers must therefore not call Close, which
+// would wait for the handler itself; a handler can stop the Mux with
+// go m.Close() instead.
+func (m *Mux) Close() error {
+	m.runMu.Lock()
+	if m.closed {
+		m.runMu.Unlock()
+		return ErrClosed
+	}
+	m.closed = true
+	serving := m.serving
+	m.runMu.Unlock()
+
+	err := m.ifce.Close()
+	if serving {
+		<-m.done
+	}
+	return err
+}
+
+// Handler returns the handler packet would be dispatched to, or nil.
+func (m *Mux) Handler(packet []byte) Handler {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	ip := packet
+	if m.ifce.IsTAP() {
+		if waterutil.ValidateMACFrame(packet) != nil {
+			return m.fallback
+		}
+		ethertype := waterutil.MACEthertype(packet)
+		if ethertype != waterutil.IPv4 && ethertype != waterutil.IPv6 {
+			return m.or(m.ethertypes[ethertype])
+		}
+		ip = waterutil.MACPayload(packet)
+	}
+
+	protocol, hdr, err := waterutil.Transport(ip)
+	if err != nil && err != waterutil.ErrFragmented {
+		if m.ifce.IsTAP() {
+			return m.or(m.ethertypes[waterutil.MACEthertype(packet)])
+		}
+		return m.fallback
+	}
+
+	if len(hdr) >= 4 && len(m.ports) > 0 {
+		switch protocol {
+		case waterutil.TCP, waterutil.UDP, waterutil.DCCP, waterutil.SCTP:
+			if h := m.ports[portKey{protocol, binary.BigEndian.Uint16(hdr[2:4])}]; h != nil {
+				return h
+			}
+		}
+	}
+	if len(m.prefixes) > 0 {
+		dst, _ := netip.AddrFromSlice(waterutil.IPDestination(ip))
+		for _, r := range m.prefixes {
+			if r.prefix.Contains(dst) {
+				return r.handler
+			}
+		}
+	}
+	if h := m.protocols[protocol]; h != nil {
+		return h
+	}
+	if h := m.versions[waterutil.IPVersion(ip)]; h != nil {
+		return h
+	}
+	if m.ifce.IsTAP() {
+		return m.or(m.ethertypes[waterutil.MACEthertype(packet)])
+	}
+	return m.fallback
+}
+
+func (m *Mux) or(h Handler) Handler {
+	if h != nil {
+		return h
+	}
+	return m.fallback
+}
+
+func (m *Mux) dispatch(packet []byte) {
+	h := m.Handler(packet)
+	if h == nil {
+		return
+	}
+	defer func() {
+		if v := recover(); v != nil && m.onPanic != nil {
+			m.onPanic(v, packet)
+		}
+	}()
+	h.ServePacket(m.w, packet)
+}
+
+// replyWriter sends replies out of the interface. It hides the Interface from
+// handlers, so that they cannot read from or close it.
+type replyWriter struct {
+	ifce *water.Interface
+}
+
+func (w replyWriter) Write(packet []byte) (int, error) {
+	return w.ifce.Write(packet)
+}
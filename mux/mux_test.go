@@ -0,0 +1,191 @@
+package mux
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Doridian/water"
+	"github.com/Doridian/water/internal/fakedev"
+	"github.com/Doridian/water/waterutil"
+)
+
+var (
+	src4 = netip.MustParseAddr("10.0.0.1")
+	dst4 = netip.MustParseAddr("10.0.0.2")
+	dst6 = netip.MustParseAddr("fd00::2")
+)
+
+func buildUDP(src, dst netip.Addr, dstPort uint16) []byte {
+	udp := make([]byte, 8)
+	binary.BigEndian.PutUint16(udp[0:2], 1234)
+	binary.BigEndian.PutUint16(udp[2:4], dstPort)
+	binary.BigEndian.PutUint16(udp[4:6], 8)
+	var packet []byte
+	if dst.Is4() {
+		packet = waterutil.AppendIPv4Header(nil, waterutil.UDP, waterutil.DefaultTTL, src, dst, len(udp))
+	} else {
+		packet = waterutil.AppendIPv6Header(nil, waterutil.UDP, waterutil.DefaultTTL, src, dst, len(udp))
+	}
+	return append(packet, udp...)
+}
+
+// recorder is a handler that records the name it was registered under.
+type recorder struct {
+	mu  sync.Mutex
+	got []string
+}
+
+func (r *recorder) handler(name string) Handler {
+	return HandlerFunc(func(w io.Writer, packet []byte) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.got = append(r.got, name)
+	})
+}
+
+func newMux(t *testing.T, deviceType water.DeviceType, rwc io.ReadWriteCloser, config Config) *Mux {
+	t.Helper()
+	ifce, err := water.NewFromReadWriteCloser(rwc, deviceType, "fake0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(ifce, config)
+}
+
+func TestRouting(t *testing.T) {
+	var deviceType water.DeviceType = water.TUN
+	m := newMux(t, deviceType, fakedev.New(), Config{})
+	r := &recorder{}
+	m.HandlePort(waterutil.UDP, 53, r.handler("dns"))
+	m.HandlePrefix(netip.MustParsePrefix("10.0.0.0/8"), r.handler("10/8"))
+	m.HandlePrefix(netip.MustParsePrefix("10.0.0.0/24"), r.handler("10.0.0/24"))
+	m.HandleProtocol(waterutil.UDP, r.handler("udp"))
+	m.HandleIPVersion(6, r.handler("v6"))
+	m.HandleDefault(r.handler("default"))
+
+	tests := []struct {
+		name   string
+		packet []byte
+		want   string
+	}{
+		{"port", buildUDP(src4, dst4, 53), "dns"},
+		{"longest prefix", buildUDP(src4, dst4, 80), "10.0.0/24"},
+		{"shorter prefix", buildUDP(src4, netip.MustParseAddr("10.1.0.1"), 80), "10/8"},
+		{"protocol", buildUDP(src4, netip.MustParseAddr("192.168.0.1"), 80), "udp"},
+		{"default", []byte{0x45, 0}, "default"},
+	}
+	for _, tt := range tests {
+		r.got = nil
+		m.dispatch(tt.packet)
+		if len(r.got) != 1 || r.got[0] != tt.want {
+			t.Errorf("%s: dispatched to %v, want %s", tt.name, r.got, tt.want)
+		}
+	}
+
+	m.HandleProtocol(waterutil.UDP, nil)
+	if h := m.Handler(buildUDP(netip.MustParseAddr("fd00::1"), dst6, 80)); h == nil {
+		t.Error("IPv6 packet not dispatched")
+	}
+	m.HandlePrefix(netip.MustParsePrefix("10.0.0.0/24"), nil)
+	r.got = nil
+	m.dispatch(buildUDP(src4, dst4, 80))
+	if len(r.got) != 1 || r.got[0] != "10/8" {
+		t.Errorf("after removing prefix: dispatched to %v", r.got)
+	}
+}
+
+func TestTAP(t *testing.T) {
+	var deviceType water.DeviceType = water.TAP
+	m := newMux(t, deviceType, fakedev.New(), Config{})
+	r := &recorder{}
+	m.HandleEthertype(waterutil.ARP, r.handler("arp"))
+	m.HandlePort(waterutil.UDP, 53, r.handler("dns"))
+
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	m.dispatch(waterutil.BuildARPRequest(mac, src4, dst4))
+	frame := waterutil.AppendEthernetHeader(nil, mac, mac, waterutil.IPv4)
+	frame = append(frame, buildUDP(src4, dst4, 53)...)
+	frame, err := waterutil.PushVLANTag(frame, waterutil.IEEE802_1Q, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.dispatch(frame)
+	m.dispatch(waterutil.AppendEthernetHeader(nil, mac, mac, waterutil.RARP))
+
+	if len(r.got) != 2 || r.got[0] != "arp" || r.got[1] != "dns" {
+		t.Errorf("dispatched to %v", r.got)
+	}
+}
+
+func TestServe(t *testing.T) {
+	v := fakedev.NewVector()
+	var deviceType water.DeviceType = water.TUN
+	var panics int
+	m := newMux(t, deviceType, v, Config{BatchSize: 4, PanicHandler: func(any, []byte) { panics++ }})
+
+	handled := make(chan struct{}, 16)
+	m.HandlePort(waterutil.UDP, 7, HandlerFunc(func(w io.Writer, packet []byte) {
+		defer func() { handled <- struct{}{} }()
+		if waterutil.DestinationPort(packet) == 7 && packet[len(packet)-1] == 0xff {
+			panic("boom")
+		}
+		_, _ = w.Write(packet)
+	}))
+
+	for i := range 3 {
+		packet := buildUDP(src4, dst4, 7)
+		if i == 1 {
+			packet = append(packet, 0xff)
+		}
+		v.In <- packet
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- m.Serve() }()
+	for range 3 {
+		select {
+		case <-handled:
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for packets")
+		}
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Errorf("Serve returned %v", err)
+	}
+	if panics != 1 {
+		t.Errorf("%d panics recovered, want 1", panics)
+	}
+	if len(v.Out) != 2 {
+		t.Errorf("%d replies, want 2", len(v.Out))
+	}
+	if batches := v.Batches(); len(batches) == 0 || batches[0] != 3 {
+		t.Errorf("batches = %v, want the first batch to hold 3 packets", batches)
+	}
+	if err := m.Serve(); err != ErrClosed {
+		t.Errorf("Serve after Close: %v", err)
+	}
+	if err := m.Close(); err != ErrClosed {
+		t.Errorf("second Close: %v", err)
+	}
+}
+
+func TestServeReadError(t *testing.T) {
+	f := fakedev.New()
+	var deviceType water.DeviceType = water.TUN
+	m := newMux(t, deviceType, f, Config{})
+	if m.batchSize != 1 {
+		t.Errorf("batch size %d for a non-vector device", m.batchSize)
+	}
+	_ = f.Close()
+	if err := m.Serve(); err != io.EOF {
+		t.Errorf("Serve returned %v, want EOF", err)
+	}
+}
@@ -0,0 +1,223 @@
+package nat
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"time"
+
+	"github.com/Doridian/water/waterutil"
+)
+
+// sweepInterval is the minimum time between two scans of the connection
+// table for expired connections.
+const sweepInterval = time.Second
+
+// tcpClosedTimeout is the idle timeout of TCP connections that were reset,
+// unless the transitory timeout is shorter. It keeps the mapping for
+// retransmitted RSTs without holding its port for long.
+const tcpClosedTimeout = 10 * time.Second
+
+// tuple identifies the packets of one direction of a connection. ICMP echo
+// requests carry their identifier as source port and echo replies as
+// destination port, so that the tuple of a reply is the reverse of the tuple
+// of its request.
+type tuple struct {
+	protocol waterutil.IPProtocol
+	src, dst netip.AddrPort
+}
+
+func (t tuple) reverse() tuple {
+	return tuple{protocol: t.protocol, src: t.dst, dst: t.src}
+}
+
+// isEchoRequest reports whether hdr is an ICMPv4 or ICMPv6 echo request.
+func isEchoRequest(protocol waterutil.IPProtocol, hdr []byte) bool {
+	return protocol == waterutil.ICMP && hdr[0] == waterutil.ICMPv4EchoRequest ||
+		protocol == waterutil.IPv6_ICMP && hdr[0] == waterutil.ICMPv6EchoRequest
+}
+
+// tupleOf returns the tuple of a TCP, UDP or ICMP echo packet from src to dst
+// with the upper-layer header hdr. ok is false for other packets.
+func tupleOf(protocol waterutil.IPProtocol, src, dst netip.Addr, hdr []byte) (t tuple, ok bool) {
+	t.protocol = protocol
+	switch protocol {
+	case waterutil.TCP, waterutil.UDP:
+		if len(hdr) < 4 {
+			return t, false
+		}
+		t.src = netip.AddrPortFrom(src, binary.BigEndian.Uint16(hdr[0:2]))
+		t.dst = netip.AddrPortFrom(dst, binary.BigEndian.Uint16(hdr[2:4]))
+	case waterutil.ICMP, waterutil.IPv6_ICMP:
+		if len(hdr) < 8 {
+			return t, false
+		}
+		id := binary.BigEndian.Uint16(hdr[4:6])
+		switch hdr[0] {
+		case waterutil.ICMPv4EchoRequest, waterutil.ICMPv6EchoRequest:
+			t.src, t.dst = netip.AddrPortFrom(src, id), netip.AddrPortFrom(dst, 0)
+		case waterutil.ICMPv4EchoReply, waterutil.ICMPv6EchoReply:
+			t.src, t.dst = netip.AddrPortFrom(src, 0), netip.AddrPortFrom(dst, id)
+		default:
+			return t, false
+		}
+	default:
+		return t, false
+	}
+	return t, true
+}
+
+// startsConnection reports whether a packet with the upper-layer header hdr
+// may create a connection: a TCP SYN, any UDP packet or an ICMP echo request.
+func startsConnection(protocol waterutil.IPProtocol, hdr []byte) bool {
+	switch protocol {
+	case waterutil.TCP:
+		return len(hdr) >= 14 && hdr[13]&(waterutil.TCPFlagSYN|waterutil.TCPFlagACK|waterutil.TCPFlagRST) == waterutil.TCPFlagSYN
+	case waterutil.UDP:
+		return true
+	default:
+		return isEchoRequest(protocol, hdr)
+	}
+}
+
+type tcpState uint8
+
+const (
+	tcpSynSent tcpState = iota
+	tcpSynReceived
+	tcpEstablished
+	tcpFinWait
+	tcpClosing
+	tcpClosed
+)
+
+// conn is a tracked connection. orig is the tuple of the packet that created
+// it, reply the tuple expected for answers after translation. A connection is
+// stored under both tuples.
+type conn struct {
+	orig, reply tuple
+	origDir     Direction
+	hairpin     bool
+
+	state             tcpState
+	finOrig, finReply bool
+	expires           time.Time
+}
+
+// direction returns the direction packets matching the original or the reply
+// tuple arrive from.
+func (c *conn) direction(reply bool) Direction {
+	if !reply {
+		return c.origDir
+	}
+	if c.hairpin || c.origDir == Inbound {
+		return Outbound
+	}
+	return Inbound
+}
+
+// target returns the tuple a packet matching the original or the reply tuple
+// is translated to.
+func (c *conn) target(reply bool) tuple {
+	if reply {
+		return c.orig.reverse()
+	}
+	return c.reply.reverse()
+}
+
+// update advances the TCP state with the upper-layer header hdr of a packet
+// matching the original or the reply tuple and extends the connection's
+// lifetime.
+func (c *conn) update(reply bool, hdr []byte, now time.Time, n *NAT) {
+	var timeout time.Duration
+	switch c.orig.protocol {
+	case waterutil.TCP:
+		if len(hdr) >= 14 {
+			c.updateTCP(reply, hdr[13])
+		}
+		switch c.state {
+		case tcpEstablished:
+			timeout = n.tcpEstablishedTimeout
+		case tcpClosed:
+			timeout = min(n.tcpTransitoryTimeout, tcpClosedTimeout)
+		default:
+			timeout = n.tcpTransitoryTimeout
+		}
+	case waterutil.UDP:
+		timeout = n.udpTimeout
+	default:
+		timeout = n.icmpTimeout
+	}
+	c.expires = now.Add(timeout)
+}
+
+func (c *conn) updateTCP(reply bool, flags byte) {
+	switch {
+	case !reply && c.state >= tcpFinWait &&
+		flags&(waterutil.TCPFlagSYN|waterutil.TCPFlagACK|waterutil.TCPFlagRST|waterutil.TCPFlagFIN) == waterutil.TCPFlagSYN:
+		// The client reuses the tuple for a new connection.
+		c.state = tcpSynSent
+		c.finOrig, c.finReply = false, false
+	case flags&waterutil.TCPFlagRST != 0:
+		c.state = tcpClosed
+	case flags&waterutil.TCPFlagFIN != 0:
+		if reply {
+			c.finReply = true
+		} else {
+			c.finOrig = true
+		}
+		c.state = tcpFinWait
+		if c.finOrig && c.finReply {
+			c.state = tcpClosing
+		}
+	case c.state == tcpSynSent && reply &&
+		flags&(waterutil.TCPFlagSYN|waterutil.TCPFlagACK) == waterutil.TCPFlagSYN|waterutil.TCPFlagACK:
+		c.state = tcpSynReceived
+	case c.state == tcpSynReceived && !reply && flags&waterutil.TCPFlagACK != 0:
+		c.state = tcpEstablished
+	}
+}
+
+// lookup returns the live connection t belongs to and whether t is its reply
+// tuple. Expired connections are removed. n.mu must be held.
+func (n *NAT) lookup(t tuple, now time.Time) (c *conn, reply bool, ok bool) {
+	c, ok = n.conns[t]
+	if !ok {
+		return nil, false, false
+	}
+	if now.After(c.expires) {
+		n.remove(c)
+		n.stats.Expired++
+		return nil, false, false
+	}
+	return c, t == c.reply, true
+}
+
+// insert adds c to the table. n.mu must be held.
+func (n *NAT) insert(c *conn) {
+	n.conns[c.orig] = c
+	n.conns[c.reply] = c
+	n.len++
+	n.stats.Created++
+}
+
+// remove deletes c from the table. n.mu must be held.
+func (n *NAT) remove(c *conn) {
+	delete(n.conns, c.orig)
+	delete(n.conns, c.reply)
+	n.len--
+}
+
+// sweep removes expired connections, at most once per sweepInterval. n.mu must
+// be held.
+func (n *NAT) sweep(now time.Time) {
+	if now.Sub(n.lastSweep) < sweepInterval {
+		return
+	}
+	n.lastSweep = now
+	for t, c := range n.conns {
+		if t == c.orig && now.After(c.expires) {
+			n.remove(c)
+			n.stats.Expired++
+		}
+	}
+}
@@ -0,0 +1,578 @@
+// Package nat implements userspace network address translation for IPv4 and
+// IPv6 (NAT66) packets: source NAT to an address pool or masquerading,
+// destination NAT to forward ports to inside hosts, and hairpinning between
+// the two, backed by a connection tracking table.
+package nat
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/Doridian/water/waterutil"
+)
+
+// Defaults used by Config and SNATRule. The timeouts follow RFC 5382 for TCP,
+// RFC 4787 for UDP and RFC 5508 for ICMP.
+const (
+	DefaultTCPEstablishedTimeout = 2*time.Hour + 4*time.Minute
+	DefaultTCPTransitoryTimeout  = 4 * time.Minute
+	DefaultUDPTimeout            = 5 * time.Minute
+	DefaultICMPTimeout           = 60 * time.Second
+	DefaultMaxConns              = 65536
+	DefaultPortMin               = 1024
+	DefaultPortMax               = 65535
+)
+
+var (
+	// ErrNoMapping is returned for inbound packets that belong to no tracked
+	// connection and match no DNAT rule, for packets that cannot start a
+	// connection, such as a TCP segment without SYN, and for packets arriving
+	// from the wrong side of their connection. Inbound packets may be meant
+	// for the NAT itself; otherwise they should be dropped.
+	ErrNoMapping = errors.New("no NAT mapping for packet")
+	// ErrPortsExhausted is returned when the port range of the matching SNAT
+	// rule has no free port left for a new connection.
+	ErrPortsExhausted = errors.New("no free port in SNAT range")
+	// ErrTableFull is returned when a new connection would exceed
+	// Config.MaxConns.
+	ErrTableFull = errors.New("connection table full")
+	// ErrInvalidRule is returned by New for a malformed SNAT or DNAT rule.
+	ErrInvalidRule = errors.New("invalid NAT rule")
+)
+
+// Direction is the direction of a packet relative to the NAT.
+type Direction int
+
+const (
+	// Outbound packets travel from the inside network to the outside.
+	Outbound Direction = iota
+	// Inbound packets travel from the outside network to the inside.
+	Inbound
+)
+
+// SNATRule translates the source of outbound packets. Masquerading is an
+// SNATRule with the outside address of the NAT as the only pool address.
+type SNATRule struct {
+	// Source selects the inside addresses the rule applies to.
+	Source netip.Prefix
+
+	// Addrs is the pool of outside addresses, of the same family as Source.
+	// An inside address is always mapped to the same pool address.
+	Addrs []netip.Addr
+
+	// PortMin and PortMax delimit the outside ports and ICMP identifiers.
+	// The original port is kept if it is in range and free. They default to
+	// DefaultPortMin and DefaultPortMax if both are zero.
+	PortMin, PortMax uint16
+}
+
+// DNATRule forwards inbound TCP or UDP packets for an outside address and
+// port to an inside host. Outbound packets from the inside to the outside
+// address and port are hairpinned: they are translated like inbound ones and
+// sent back inside. For the replies to return through the NAT, the inside
+// sources must also be covered by an SNATRule.
+type DNATRule struct {
+	// Protocol is waterutil.TCP or waterutil.UDP.
+	Protocol waterutil.IPProtocol
+	Addr     netip.Addr
+	Port     uint16
+
+	// To is the inside destination, of the same family as Addr. If its port
+	// is zero, Port is kept.
+	To netip.AddrPort
+}
+
+// Config defines the rules and limits of a NAT. A zero-value Config is valid
+// but does not translate anything.
+type Config struct {
+	// SNAT and DNAT are the translation rules. The first matching rule of
+	// each kind applies.
+	SNAT []SNATRule
+	DNAT []DNATRule
+
+	// TCPEstablishedTimeout is the idle timeout of established TCP
+	// connections. It defaults to DefaultTCPEstablishedTimeout.
+	TCPEstablishedTimeout time.Duration
+
+	// TCPTransitoryTimeout is the idle timeout of TCP connections that are
+	// being opened or closed. It defaults to DefaultTCPTransitoryTimeout.
+	// Connections closed by a RST expire after at most 10 seconds.
+	TCPTransitoryTimeout time.Duration
+
+	// UDPTimeout is the idle timeout of UDP flows. It defaults to
+	// DefaultUDPTimeout.
+	UDPTimeout time.Duration
+
+	// ICMPTimeout is the idle timeout of ICMP echo flows. It defaults to
+	// DefaultICMPTimeout.
+	ICMPTimeout time.Duration
+
+	// MaxConns limits the number of tracked connections. It defaults to
+	// DefaultMaxConns.
+	MaxConns int
+}
+
+// Stats holds the counters of a NAT.
+type Stats struct {
+	// Created counts tracked connections.
+	Created uint64
+	// Expired counts connections removed after their idle timeout.
+	Expired uint64
+	// Translated counts rewritten packets.
+	Translated uint64
+	// Rejected counts packets for which Translate returned an error.
+	Rejected uint64
+}
+
+// NAT translates packets between an inside and an outside network. It is
+// safe for concurrent use.
+type NAT struct {
+	snat []SNATRule
+	dnat []DNATRule
+
+	tcpEstablishedTimeout time.Duration
+	tcpTransitoryTimeout  time.Duration
+	udpTimeout            time.Duration
+	icmpTimeout           time.Duration
+	maxConns              int
+	now                   func() time.Time
+
+	mu        sync.Mutex
+	conns     map[tuple]*conn
+	len       int
+	lastSweep time.Time
+	stats     Stats
+}
+
+// New returns a NAT with the given rules and limits.
+func New(config Config) (*NAT, error) {
+	if config.TCPEstablishedTimeout <= 0 {
+		config.TCPEstablishedTimeout = DefaultTCPEstablishedTimeout
+	}
+	if config.TCPTransitoryTimeout <= 0 {
+		config.TCPTransitoryTimeout = DefaultTCPTransitoryTimeout
+	}
+	if config.UDPTimeout <= 0 {
+		config.UDPTimeout = DefaultUDPTimeout
+	}
+	if config.ICMPTimeout <= 0 {
+		config.ICMPTimeout = DefaultICMPTimeout
+	}
+	if config.MaxConns <= 0 {
+		config.MaxConns = DefaultMaxConns
+	}
+
+	n := &NAT{
+		tcpEstablishedTimeout: config.TCPEstablishedTimeout,
+		tcpTransitoryTimeout:  config.TCPTransitoryTimeout,
+		udpTimeout:            config.UDPTimeout,
+		icmpTimeout:           config.ICMPTimeout,
+		maxConns:              config.MaxConns,
+		now:                   time.Now,
+		conns:                 make(map[tuple]*conn),
+	}
+	for _, rule := range config.SNAT {
+		if !rule.Source.IsValid() || len(rule.Addrs) == 0 {
+			return nil, ErrInvalidRule
+		}
+		rule.Source = rule.Source.Masked()
+		addrs := make([]netip.Addr, len(rule.Addrs))
+		for i, addr := range rule.Addrs {
+			addrs[i] = addr.Unmap()
+			if !addrs[i].IsValid() || addrs[i].Is4() != rule.Source.Addr().Is4() {
+				return nil, ErrInvalidRule
+			}
+		}
+		rule.Addrs = addrs
+		if rule.PortMin == 0 && rule.PortMax == 0 {
+			rule.PortMin, rule.PortMax = DefaultPortMin, DefaultPortMax
+		}
+		if rule.PortMin == 0 || rule.PortMin > rule.PortMax {
+			return nil, ErrInvalidRule
+		}
+		n.snat = append(n.snat, rule)
+	}
+	for _, rule := range config.DNAT {
+		rule.Addr = rule.Addr.Unmap()
+		rule.To = netip.AddrPortFrom(rule.To.Addr().Unmap(), rule.To.Port())
+		if rule.Protocol != waterutil.TCP && rule.Protocol != waterutil.UDP || !rule.Addr.IsValid() ||
+			rule.Port == 0 || !rule.To.Addr().IsValid() || rule.Addr.Is4() != rule.To.Addr().Is4() {
+			return nil, ErrInvalidRule
+		}
+		if rule.To.Port() == 0 {
+			rule.To = netip.AddrPortFrom(rule.To.Addr(), rule.Port)
+		}
+		n.dnat = append(n.dnat, rule)
+	}
+	return n, nil
+}
+
+// Len returns the number of tracked connections, including expired ones that
+// have not been removed yet.
+func (n *NAT) Len() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.len
+}
+
+// Stats returns a snapshot of the NAT's counters.
+func (n *NAT) Stats() Stats {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.stats
+}
+
+// Translate rewrites the addresses, ports and ICMP echo identifiers of an
+// IPv4 or IPv6 packet in place, according to the connection it belongs to,
+// and returns the direction in which it must be sent on. This is dir, except
+// for hairpinned packets, which are sent back inside as Inbound.
+//
+// A connection is created for the first outbound packet matching an SNAT or
+// DNAT rule and for the first inbound packet matching a DNAT rule. Outbound
+// packets to which no rule applies are left untouched. Only TCP, UDP and ICMP
+// echo can be translated, as well as ICMP errors quoting them; fragments must
+// be reassembled first, e.g. with ipfrag.
+func (n *NAT) Translate(packet []byte, dir Direction) (Direction, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	out, translated, err := n.translate(packet, dir)
+	if err != nil {
+		n.stats.Rejected++
+	} else if translated {
+		n.stats.Translated++
+	}
+	return out, err
+}
+
+// translate implements Translate and reports whether packet was rewritten.
+// n.mu must be held.
+func (n *NAT) translate(packet []byte, dir Direction) (Direction, bool, error) {
+	protocol, hdr, err := waterutil.Transport(packet)
+	if err == nil && isFragment(packet) {
+		err = waterutil.ErrFragmented
+	}
+	if err != nil && err != waterutil.ErrFragmented {
+		return dir, false, err
+	}
+	src, _ := netip.AddrFromSlice(waterutil.IPSource(packet))
+	dst, _ := netip.AddrFromSlice(waterutil.IPDestination(packet))
+	src, dst = src.Unmap(), dst.Unmap()
+	if err != nil {
+		return dir, false, n.untranslatable(src, dir, err)
+	}
+
+	now := n.now()
+	n.sweep(now)
+
+	if isICMPError(protocol, hdr) {
+		return n.translateICMPError(packet, protocol, hdr, src, dir, now)
+	}
+	t, ok := tupleOf(protocol, src, dst, hdr)
+	if !ok {
+		return dir, false, n.untranslatable(src, dir, waterutil.ErrUnsupportedProtocol)
+	}
+
+	c, reply, ok := n.lookup(t, now)
+	if ok && c.direction(reply) != dir {
+		return dir, false, ErrNoMapping
+	}
+	if !ok {
+		if c, err = n.create(t, dir, hdr, now); c == nil {
+			return dir, false, err
+		}
+	}
+	rewrite(packet, hdr, t, c.target(reply))
+	c.update(reply, hdr, now, n)
+	if c.hairpin {
+		return Inbound, true, nil
+	}
+	return dir, true, nil
+}
+
+// untranslatable returns the error for a packet from src that cannot be
+// translated because of err. Outbound packets to which no SNAT rule applies
+// are passed on untouched, inbound packets have no mapping.
+func (n *NAT) untranslatable(src netip.Addr, dir Direction, err error) error {
+	if dir == Inbound {
+		if err == waterutil.ErrFragmented {
+			return err
+		}
+		return ErrNoMapping
+	}
+	if n.matchSNAT(src) == nil {
+		return nil
+	}
+	return err
+}
+
+func isFragment(packet []byte) bool {
+	if waterutil.IPVersion(packet) == 4 {
+		return waterutil.IPv4IsFragment(packet)
+	}
+	return waterutil.IPv6FragmentHeader(packet) != nil
+}
+
+func (n *NAT) matchSNAT(src netip.Addr) *SNATRule {
+	for i := range n.snat {
+		if n.snat[i].Source.Contains(src) {
+			return &n.snat[i]
+		}
+	}
+	return nil
+}
+
+func (n *NAT) matchDNAT(t tuple) *DNATRule {
+	for i := range n.dnat {
+		rule := &n.dnat[i]
+		if rule.Protocol == t.protocol && rule.Addr == t.dst.Addr() && rule.Port == t.dst.Port() {
+			return rule
+		}
+	}
+	return nil
+}
+
+// create tracks a new connection for a packet with tuple t and upper-layer
+// header hdr. It returns nil and no error if no rule applies to an outbound
+// packet. n.mu must be held.
+func (n *NAT) create(t tuple, dir Direction, hdr []byte, now time.Time) (*conn, error) {
+	dst := t.dst
+	rule := n.matchDNAT(t)
+	if rule != nil {
+		dst = rule.To
+	}
+	var snat *SNATRule
+	if dir == Outbound {
+		snat = n.matchSNAT(t.src.Addr())
+	}
+	if rule == nil && snat == nil {
+		if dir == Inbound {
+			return nil, ErrNoMapping
+		}
+		return nil, nil
+	}
+	if !startsConnection(t.protocol, hdr) {
+		return nil, ErrNoMapping
+	}
+	if n.len >= n.maxConns {
+		return nil, ErrTableFull
+	}
+
+	src := t.src
+	if snat != nil {
+		var err error
+		if src, err = n.allocate(snat, t, dst); err != nil {
+			return nil, err
+		}
+	}
+	c := &conn{
+		orig:    t,
+		reply:   tuple{protocol: t.protocol, src: dst, dst: src},
+		origDir: dir,
+		hairpin: rule != nil && dir == Outbound,
+	}
+	if _, ok := n.conns[c.reply]; ok {
+		return nil, ErrNoMapping
+	}
+	n.insert(c)
+	return c, nil
+}
+
+// allocate picks the outside address and port for a connection with tuple t
+// to dst, such that the reply tuple is not in use. n.mu must be held.
+func (n *NAT) allocate(rule *SNATRule, t tuple, dst netip.AddrPort) (netip.AddrPort, error) {
+	h := fnv.New32a()
+	_, _ = h.Write(t.src.Addr().AsSlice())
+	addr := rule.Addrs[h.Sum32()%uint32(len(rule.Addrs))] // #nosec G115 -- the pool is small
+
+	lo, size := int(rule.PortMin), int(rule.PortMax)-int(rule.PortMin)+1
+	start := int(t.src.Port()) - lo
+	if start < 0 || start >= size {
+		start = rand.IntN(size) // #nosec G404 -- port randomization needs no cryptographic strength
+	}
+	for i := range size {
+		port := uint16(lo + (start+i)%size) // #nosec G115 -- within [PortMin, PortMax]
+		candidate := netip.AddrPortFrom(addr, port)
+		if _, ok := n.conns[tuple{protocol: t.protocol, src: dst, dst: candidate}]; !ok {
+			return candidate, nil
+		}
+	}
+	return netip.AddrPort{}, ErrPortsExhausted
+}
+
+// rewrite translates a packet with tuple from and upper-layer header hdr to
+// tuple to, updating all checksums.
+func rewrite(packet, hdr []byte, from, to tuple) {
+	if to.src.Addr() != from.src.Addr() {
+		waterutil.SetIPSourceWithChecksum(packet, net.IP(to.src.Addr().AsSlice()))
+	}
+	if to.dst.Addr() != from.dst.Addr() {
+		waterutil.SetIPDestinationWithChecksum(packet, net.IP(to.dst.Addr().AsSlice()))
+	}
+	switch from.protocol {
+	case waterutil.TCP, waterutil.UDP:
+		if to.src.Port() != from.src.Port() {
+			waterutil.SetSourcePortWithChecksum(packet, to.src.Port())
+		}
+		if to.dst.Port() != from.dst.Port() {
+			waterutil.SetDestinationPortWithChecksum(packet, to.dst.Port())
+		}
+	default:
+		id := to.dst.Port()
+		if isEchoRequest(from.protocol, hdr) {
+			id = to.src.Port()
+		}
+		if id != binary.BigEndian.Uint16(hdr[4:6]) {
+			waterutil.SetICMPIdentifierWithChecksum(packet, id)
+		}
+	}
+}
+
+// isICMPError reports whether hdr is an ICMPv4 or ICMPv6 error message that
+// quotes an offending packet.
+func isICMPError(protocol waterutil.IPProtocol, hdr []byte) bool {
+	if len(hdr) < 8 {
+		return false
+	}
+	switch protocol {
+	case waterutil.ICMP:
+		switch hdr[0] {
+		case waterutil.ICMPv4DestinationUnreachable, waterutil.ICMPv4SourceQuench, waterutil.ICMPv4Redirect,
+			waterutil.ICMPv4TimeExceeded, waterutil.ICMPv4ParameterProblem:
+			return true
+		}
+	case waterutil.IPv6_ICMP:
+		switch hdr[0] {
+		case waterutil.ICMPv6DestinationUnreachable, waterutil.ICMPv6PacketTooBig,
+			waterutil.ICMPv6TimeExceeded, waterutil.ICMPv6ParameterProblem:
+			return true
+		}
+	}
+	return false
+}
+
+// translateICMPError translates an ICMP error from src with the ICMP header
+// hdr. The quoted packet travelled opposite to the error, so the error belongs
+// to the connection of the reverse of its tuple. Both the outer header and the
+// quoted packet are rewritten; the source is only rewritten if the error was
+// sent by the connection's endpoint rather than by a router on the path.
+// n.mu must be held.
+func (n *NAT) translateICMPError(packet []byte, protocol waterutil.IPProtocol, hdr []byte, src netip.Addr, dir Direction, now time.Time) (Direction, bool, error) {
+	quoted := hdr[8:]
+	hl, quotedProtocol, ok := parseQuoted(quoted, waterutil.IPVersion(packet))
+	if !ok {
+		return dir, false, n.untranslatable(src, dir, ErrNoMapping)
+	}
+	quotedSrc, _ := netip.AddrFromSlice(waterutil.IPSource(quoted))
+	quotedDst, _ := netip.AddrFromSlice(waterutil.IPDestination(quoted))
+	q, ok := tupleOf(quotedProtocol, quotedSrc, quotedDst, quoted[hl:])
+	if !ok {
+		return dir, false, n.untranslatable(src, dir, ErrNoMapping)
+	}
+	t := q.reverse()
+	c, reply, ok := n.lookup(t, now)
+	if !ok || c.direction(reply) != dir {
+		return dir, false, n.untranslatable(src, dir, ErrNoMapping)
+	}
+
+	target := c.target(reply)
+	rewriteQuoted(quoted, hl, q, target.reverse())
+	if src == t.src.Addr() && target.src.Addr() != src {
+		waterutil.SetIPSourceWithChecksum(packet, net.IP(target.src.Addr().AsSlice()))
+	}
+	if target.dst.Addr() != t.dst.Addr() {
+		waterutil.SetIPDestinationWithChecksum(packet, net.IP(target.dst.Addr().AsSlice()))
+	}
+	// The quoted packet is covered by the ICMP checksum.
+	_ = waterutil.FixTransportChecksum(packet)
+	if c.hairpin {
+		return Inbound, true, nil
+	}
+	return dir, true, nil
+}
+
+// parseQuoted returns the header length and upper-layer protocol of the
+// packet quoted by an ICMP error, which is usually truncated. Quoted IPv6
+// packets with extension headers are not supported.
+func parseQuoted(quoted []byte, version byte) (int, waterutil.IPProtocol, bool) {
+	if len(quoted) < 1 || waterutil.IPVersion(quoted) != version {
+		return 0, 0, false
+	}
+	if version == 4 {
+		if len(quoted) < 20 {
+			return 0, 0, false
+		}
+		hl := int(quoted[0]&0x0F) * 4
+		if hl < 20 || len(quoted) < hl || waterutil.IPv4FragmentOffset(quoted) != 0 {
+			return 0, 0, false
+		}
+		return hl, waterutil.IPv4Protocol(quoted), true
+	}
+	if len(quoted) < 40 {
+		return 0, 0, false
+	}
+	return 40, waterutil.IPv6NextHeader(quoted), true
+}
+
+// rewriteQuoted translates the packet quoted by an ICMP error with header
+// length hl from tuple from to tuple to. Its IPv4 header checksum is
+// recomputed and its transport checksum updated if it was quoted.
+func rewriteQuoted(quoted []byte, hl int, from, to tuple) {
+	hdr := quoted[hl:]
+	is4 := waterutil.IPVersion(quoted) == 4
+	addrs := quoted[12:20]
+	if !is4 {
+		addrs = quoted[8:40]
+	}
+	oldAddrs := append([]byte(nil), addrs...)
+	copy(addrs, to.src.Addr().AsSlice())
+	copy(addrs[len(addrs)/2:], to.dst.Addr().AsSlice())
+	if is4 {
+		waterutil.FixIPv4Checksum(quoted)
+	}
+
+	var field []byte
+	var checksumOffset int
+	switch from.protocol {
+	case waterutil.TCP, waterutil.UDP:
+		field = hdr[0:4]
+		checksumOffset = 16
+		if from.protocol == waterutil.UDP {
+			checksumOffset = 6
+		}
+	default:
+		field = hdr[4:6]
+		checksumOffset = 2
+	}
+	oldField := append([]byte(nil), field...)
+	if len(field) == 4 {
+		binary.BigEndian.PutUint16(field[0:], to.src.Port())
+		binary.BigEndian.PutUint16(field[2:], to.dst.Port())
+	} else if isEchoRequest(from.protocol, hdr) {
+		binary.BigEndian.PutUint16(field, to.src.Port())
+	} else {
+		binary.BigEndian.PutUint16(field, to.dst.Port())
+	}
+
+	if len(hdr) < checksumOffset+2 {
+		return
+	}
+	checksum := binary.BigEndian.Uint16(hdr[checksumOffset:])
+	if from.protocol == waterutil.UDP && checksum == 0 {
+		return
+	}
+	if from.protocol != waterutil.ICMP {
+		checksum = waterutil.ChecksumUpdate(checksum, oldAddrs, addrs)
+	}
+	checksum = waterutil.ChecksumUpdate(checksum, oldField, field)
+	if from.protocol == waterutil.UDP && checksum == 0 {
+		checksum = 0xFFFF
+	}
+	binary.BigEndian.PutUint16(hdr[checksumOffset:], checksum)
+}
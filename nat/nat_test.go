@@ -0,0 +1,434 @@
+package nat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/Doridian/water/waterutil"
+)
+
+var (
+	inside4  = netip.MustParsePrefix("192.168.1.0/24")
+	outside4 = netip.MustParseAddr("203.0.113.1")
+	inside6  = netip.MustParsePrefix("fd00::/64")
+	outside6 = netip.MustParseAddr("2001:db8::1")
+	server4  = netip.MustParseAddrPort("198.51.100.7:53")
+	server6  = netip.MustParseAddrPort("[2001:db8:1::7]:53")
+)
+
+func newNAT(t *testing.T, config Config) *NAT {
+	t.Helper()
+	if config.SNAT == nil {
+		config.SNAT = []SNATRule{
+			{Source: inside4, Addrs: []netip.Addr{outside4}},
+			{Source: inside6, Addrs: []netip.Addr{outside6}},
+		}
+	}
+	n, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// build returns a TCP or UDP packet from src to dst with valid checksums.
+// flags are the TCP flags.
+func build(protocol waterutil.IPProtocol, src, dst netip.AddrPort, flags byte) []byte {
+	var l4 []byte
+	if protocol == waterutil.TCP {
+		l4 = make([]byte, 20)
+		l4[12] = 5 << 4
+		l4[13] = flags
+	} else {
+		l4 = make([]byte, 8, 12)
+		l4 = append(l4, "data"...)
+		binary.BigEndian.PutUint16(l4[4:6], uint16(len(l4)))
+	}
+	binary.BigEndian.PutUint16(l4[0:2], src.Port())
+	binary.BigEndian.PutUint16(l4[2:4], dst.Port())
+
+	var packet []byte
+	if src.Addr().Is4() {
+		packet = waterutil.AppendIPv4Header(nil, protocol, waterutil.DefaultTTL, src.Addr(), dst.Addr(), len(l4))
+	} else {
+		packet = waterutil.AppendIPv6Header(nil, protocol, waterutil.DefaultTTL, src.Addr(), dst.Addr(), len(l4))
+	}
+	packet = append(packet, l4...)
+	if err := waterutil.FixTransportChecksum(packet); err != nil {
+		panic(err)
+	}
+	return packet
+}
+
+func endpoints(packet []byte) (netip.AddrPort, netip.AddrPort) {
+	src, _ := netip.AddrFromSlice(waterutil.IPSource(packet))
+	dst, _ := netip.AddrFromSlice(waterutil.IPDestination(packet))
+	return netip.AddrPortFrom(src.Unmap(), waterutil.SourcePort(packet)),
+		netip.AddrPortFrom(dst.Unmap(), waterutil.DestinationPort(packet))
+}
+
+func checkChecksums(t *testing.T, packet []byte) {
+	t.Helper()
+	if waterutil.IPVersion(packet) == 4 && waterutil.ComputeIPv4Checksum(packet) != waterutil.IPv4Checksum(packet) {
+		t.Fatal("IPv4 header checksum is stale")
+	}
+	want, err := waterutil.ComputeTransportChecksum(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clone := bytes.Clone(packet)
+	if err := waterutil.FixTransportChecksum(clone); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(clone, packet) {
+		t.Fatalf("transport checksum is stale, want %#04x", want)
+	}
+}
+
+func translate(t *testing.T, n *NAT, packet []byte, dir, wantDir Direction) {
+	t.Helper()
+	got, err := n.Translate(packet, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != wantDir {
+		t.Fatalf("direction is %d, want %d", got, wantDir)
+	}
+	checkChecksums(t, packet)
+}
+
+func expectEndpoints(t *testing.T, packet []byte, src, dst netip.AddrPort) {
+	t.Helper()
+	if gotSrc, gotDst := endpoints(packet); gotSrc != src || gotDst != dst {
+		t.Fatalf("packet is %v -> %v, want %v -> %v", gotSrc, gotDst, src, dst)
+	}
+}
+
+func TestSNAT(t *testing.T) {
+	for _, tt := range []struct {
+		client, server netip.AddrPort
+		outside        netip.Addr
+	}{
+		{netip.MustParseAddrPort("192.168.1.10:5000"), server4, outside4},
+		{netip.MustParseAddrPort("[fd00::10]:5000"), server6, outside6},
+	} {
+		n := newNAT(t, Config{})
+		for _, protocol := range []waterutil.IPProtocol{waterutil.UDP, waterutil.TCP} {
+			packet := build(protocol, tt.client, tt.server, waterutil.TCPFlagSYN)
+			translate(t, n, packet, Outbound, Outbound)
+			mapped := netip.AddrPortFrom(tt.outside, tt.client.Port())
+			expectEndpoints(t, packet, mapped, tt.server)
+
+			reply := build(protocol, tt.server, mapped, waterutil.TCPFlagSYN|waterutil.TCPFlagACK)
+			translate(t, n, reply, Inbound, Inbound)
+			expectEndpoints(t, reply, tt.server, tt.client)
+
+			// A second client using the same port gets another one.
+			other := netip.AddrPortFrom(tt.client.Addr().Next(), tt.client.Port())
+			packet = build(protocol, other, tt.server, waterutil.TCPFlagSYN)
+			translate(t, n, packet, Outbound, Outbound)
+			if src, _ := endpoints(packet); src.Addr() != tt.outside || src.Port() == tt.client.Port() {
+				t.Errorf("second client mapped to %v", src)
+			}
+		}
+		if n.Len() != 4 {
+			t.Errorf("Len = %d", n.Len())
+		}
+		if stats := n.Stats(); stats.Created != 4 || stats.Translated != 6 {
+			t.Errorf("stats = %+v", stats)
+		}
+	}
+}
+
+func TestNoMapping(t *testing.T) {
+	n := newNAT(t, Config{})
+	client := netip.MustParseAddrPort("192.168.1.10:5000")
+
+	// Inbound packets without a connection are rejected.
+	if _, err := n.Translate(build(waterutil.UDP, server4, netip.AddrPortFrom(outside4, 5000), 0), Inbound); err != ErrNoMapping {
+		t.Errorf("inbound: %v", err)
+	}
+	// TCP connections must start with a SYN.
+	if _, err := n.Translate(build(waterutil.TCP, client, server4, waterutil.TCPFlagACK), Outbound); err != ErrNoMapping {
+		t.Errorf("TCP without SYN: %v", err)
+	}
+	// Packets not matching any SNAT rule pass untouched.
+	packet := build(waterutil.UDP, netip.MustParseAddrPort("10.0.0.1:5000"), server4, 0)
+	want := bytes.Clone(packet)
+	if _, err := n.Translate(packet, Outbound); err != nil || !bytes.Equal(packet, want) {
+		t.Errorf("passthrough: %v", err)
+	}
+	// Packets from the wrong side of a connection are rejected.
+	packet = build(waterutil.UDP, client, server4, 0)
+	if _, err := n.Translate(bytes.Clone(packet), Outbound); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.Translate(packet, Inbound); err != ErrNoMapping {
+		t.Errorf("wrong direction: %v", err)
+	}
+	// Fragments cannot be translated.
+	packet = build(waterutil.UDP, client, server4, 0)
+	packet[6] |= 0x20
+	waterutil.FixIPv4Checksum(packet)
+	if _, err := n.Translate(packet, Outbound); err != waterutil.ErrFragmented {
+		t.Errorf("fragment: %v", err)
+	}
+	if _, err := n.Translate(packet[:10], Outbound); err == nil {
+		t.Error("truncated packet accepted")
+	}
+}
+
+func TestICMPEcho(t *testing.T) {
+	n := newNAT(t, Config{SNAT: []SNATRule{
+		{Source: inside4, Addrs: []netip.Addr{outside4}, PortMin: 2000, PortMax: 2000},
+		{Source: inside6, Addrs: []netip.Addr{outside6}, PortMin: 2000, PortMax: 2000},
+	}})
+	for _, tt := range []struct {
+		client, server, outside netip.Addr
+	}{
+		{netip.MustParseAddr("192.168.1.10"), server4.Addr(), outside4},
+		{netip.MustParseAddr("fd00::10"), server6.Addr(), outside6},
+	} {
+		request := waterutil.BuildEchoRequest(tt.client, tt.server, 1, 7, []byte("ping"))
+		translate(t, n, request, Outbound, Outbound)
+		if src, _ := endpoints(request); src.Addr() != tt.outside || waterutil.ICMPIdentifier(request) != 2000 {
+			t.Fatalf("request from %v with id %d", src, waterutil.ICMPIdentifier(request))
+		}
+
+		reply, err := waterutil.BuildEchoReply(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		translate(t, n, reply, Inbound, Inbound)
+		if _, dst := endpoints(reply); dst.Addr() != tt.client || waterutil.ICMPIdentifier(reply) != 1 {
+			t.Fatalf("reply to %v with id %d", dst, waterutil.ICMPIdentifier(reply))
+		}
+
+		// The only identifier is taken.
+		request = waterutil.BuildEchoRequest(tt.client.Next(), tt.server, 1, 7, nil)
+		if _, err := n.Translate(request, Outbound); err != ErrPortsExhausted {
+			t.Errorf("exhausted range: %v", err)
+		}
+	}
+}
+
+func TestTCPState(t *testing.T) {
+	n := newNAT(t, Config{TCPTransitoryTimeout: time.Minute, TCPEstablishedTimeout: time.Hour})
+	now := time.Now()
+	n.now = func() time.Time { return now }
+
+	client := netip.MustParseAddrPort("192.168.1.10:40000")
+	mapped := netip.AddrPortFrom(outside4, client.Port())
+	send := func(flags byte, reply bool) error {
+		if reply {
+			_, err := n.Translate(build(waterutil.TCP, server4, mapped, flags), Inbound)
+			return err
+		}
+		_, err := n.Translate(build(waterutil.TCP, client, server4, flags), Outbound)
+		return err
+	}
+
+	if err := send(waterutil.TCPFlagSYN, false); err != nil {
+		t.Fatal(err)
+	}
+	c := n.conns[tuple{protocol: waterutil.TCP, src: client, dst: server4}]
+	if err := send(waterutil.TCPFlagSYN|waterutil.TCPFlagACK, true); err != nil || c.state != tcpSynReceived {
+		t.Fatalf("SYN-ACK: %v, state %d", err, c.state)
+	}
+	if err := send(waterutil.TCPFlagACK, false); err != nil || c.state != tcpEstablished {
+		t.Fatalf("ACK: %v, state %d", err, c.state)
+	}
+
+	// Established connections use the long timeout.
+	now = now.Add(30 * time.Minute)
+	if err := send(waterutil.TCPFlagACK, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := send(waterutil.TCPFlagFIN|waterutil.TCPFlagACK, false); err != nil || c.state != tcpFinWait {
+		t.Fatalf("FIN: %v, state %d", err, c.state)
+	}
+	if err := send(waterutil.TCPFlagFIN|waterutil.TCPFlagACK, true); err != nil || c.state != tcpClosing {
+		t.Fatalf("FIN: %v, state %d", err, c.state)
+	}
+
+	// Closing connections use the transitory timeout.
+	now = now.Add(2 * time.Minute)
+	if err := send(waterutil.TCPFlagACK, true); err != ErrNoMapping {
+		t.Errorf("after timeout: %v", err)
+	}
+	if n.Len() != 0 || n.Stats().Expired != 1 {
+		t.Errorf("Len = %d, stats = %+v", n.Len(), n.Stats())
+	}
+}
+
+func TestTCPReuse(t *testing.T) {
+	n := newNAT(t, Config{TCPTransitoryTimeout: time.Minute})
+	now := time.Now()
+	n.now = func() time.Time { return now }
+
+	client := netip.MustParseAddrPort("192.168.1.10:40000")
+	mapped := netip.AddrPortFrom(outside4, client.Port())
+	send := func(flags byte, reply bool) error {
+		if reply {
+			_, err := n.Translate(build(waterutil.TCP, server4, mapped, flags), Inbound)
+			return err
+		}
+		_, err := n.Translate(build(waterutil.TCP, client, server4, flags), Outbound)
+		return err
+	}
+
+	for _, step := range []struct {
+		flags byte
+		reply bool
+	}{
+		{waterutil.TCPFlagSYN, false},
+		{waterutil.TCPFlagSYN | waterutil.TCPFlagACK, true},
+		{waterutil.TCPFlagACK, false},
+		{waterutil.TCPFlagRST, true},
+	} {
+		if err := send(step.flags, step.reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := n.conns[tuple{protocol: waterutil.TCP, src: client, dst: server4}]
+	if c.state != tcpClosed || c.expires != now.Add(tcpClosedTimeout) {
+		t.Fatalf("after RST: state %d, expires in %v", c.state, c.expires.Sub(now))
+	}
+
+	// A new SYN on the same tuple opens the connection again.
+	now = now.Add(time.Second)
+	if err := send(waterutil.TCPFlagSYN, false); err != nil || c.state != tcpSynSent || c.finOrig || c.finReply {
+		t.Fatalf("SYN: %v, state %d", err, c.state)
+	}
+	if err := send(waterutil.TCPFlagSYN|waterutil.TCPFlagACK, true); err != nil || c.state != tcpSynReceived {
+		t.Fatalf("SYN-ACK: %v, state %d", err, c.state)
+	}
+	if err := send(waterutil.TCPFlagACK, false); err != nil || c.state != tcpEstablished {
+		t.Fatalf("ACK: %v, state %d", err, c.state)
+	}
+	if n.Len() != 1 || n.Stats().Created != 1 {
+		t.Errorf("Len = %d, stats = %+v", n.Len(), n.Stats())
+	}
+}
+
+func TestExpire(t *testing.T) {
+	n := newNAT(t, Config{UDPTimeout: time.Minute})
+	now := time.Now()
+	n.now = func() time.Time { return now }
+
+	for i := range 3 {
+		client := netip.AddrPortFrom(netip.MustParseAddr("192.168.1.10"), uint16(5000+i))
+		if _, err := n.Translate(build(waterutil.UDP, client, server4, 0), Outbound); err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(30 * time.Second)
+	}
+	// The sweep removes the first two flows.
+	now = now.Add(time.Second)
+	if _, err := n.Translate(build(waterutil.UDP, netip.MustParseAddrPort("10.0.0.1:1"), server4, 0), Outbound); err != nil {
+		t.Fatal(err)
+	}
+	if n.Len() != 1 || n.Stats().Expired != 2 {
+		t.Errorf("Len = %d, stats = %+v", n.Len(), n.Stats())
+	}
+}
+
+func TestDNAT(t *testing.T) {
+	web := netip.MustParseAddrPort("192.168.1.20:80")
+	public := netip.AddrPortFrom(outside4, 8080)
+	n := newNAT(t, Config{DNAT: []DNATRule{{Protocol: waterutil.TCP, Addr: outside4, Port: 8080, To: web}}})
+
+	// Port forwarding from the outside.
+	remote := netip.MustParseAddrPort("198.51.100.9:50000")
+	packet := build(waterutil.TCP, remote, public, waterutil.TCPFlagSYN)
+	translate(t, n, packet, Inbound, Inbound)
+	expectEndpoints(t, packet, remote, web)
+	packet = build(waterutil.TCP, web, remote, waterutil.TCPFlagSYN|waterutil.TCPFlagACK)
+	translate(t, n, packet, Outbound, Outbound)
+	expectEndpoints(t, packet, public, remote)
+
+	// Other ports are not forwarded.
+	if _, err := n.Translate(build(waterutil.TCP, remote, netip.AddrPortFrom(outside4, 22), waterutil.TCPFlagSYN), Inbound); err != ErrNoMapping {
+		t.Errorf("unforwarded port: %v", err)
+	}
+
+	// Hairpinning from an inside client.
+	client := netip.MustParseAddrPort("192.168.1.10:40000")
+	packet = build(waterutil.TCP, client, public, waterutil.TCPFlagSYN)
+	translate(t, n, packet, Outbound, Inbound)
+	src, dst := endpoints(packet)
+	if src.Addr() != outside4 || dst != web {
+		t.Fatalf("hairpinned packet is %v -> %v", src, dst)
+	}
+	packet = build(waterutil.TCP, web, src, waterutil.TCPFlagSYN|waterutil.TCPFlagACK)
+	translate(t, n, packet, Outbound, Inbound)
+	expectEndpoints(t, packet, public, client)
+}
+
+func TestICMPError(t *testing.T) {
+	router4 := netip.MustParseAddr("198.51.100.1")
+	for _, tt := range []struct {
+		client, server netip.AddrPort
+		build          func(original []byte) ([]byte, error)
+	}{
+		// An error from a router on the path.
+		{netip.MustParseAddrPort("192.168.1.10:5000"), server4, func(original []byte) ([]byte, error) {
+			return waterutil.BuildTimeExceeded(original, router4)
+		}},
+		// An error from the server itself.
+		{netip.MustParseAddrPort("[fd00::10]:5000"), server6, func(original []byte) ([]byte, error) {
+			return waterutil.BuildPortUnreachable(original, server6.Addr())
+		}},
+	} {
+		n := newNAT(t, Config{})
+		original := build(waterutil.UDP, tt.client, tt.server, 0)
+		packet := bytes.Clone(original)
+		translate(t, n, packet, Outbound, Outbound)
+
+		icmpErr, err := tt.build(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outerSrc, _ := endpoints(icmpErr)
+		translate(t, n, icmpErr, Inbound, Inbound)
+		if src, dst := endpoints(icmpErr); src != outerSrc || dst.Addr() != tt.client.Addr() {
+			t.Errorf("ICMP error is %v -> %v", src, dst)
+		}
+		// The quoted packet is restored exactly, including its checksums.
+		quoted := waterutil.IPPayload(icmpErr)[8:]
+		if !bytes.Equal(quoted, original) {
+			t.Errorf("quoted packet\n% x\nwant\n% x", quoted, original)
+		}
+	}
+}
+
+func TestTableFull(t *testing.T) {
+	n := newNAT(t, Config{MaxConns: 1})
+	if _, err := n.Translate(build(waterutil.UDP, netip.MustParseAddrPort("192.168.1.10:1"), server4, 0), Outbound); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.Translate(build(waterutil.UDP, netip.MustParseAddrPort("192.168.1.10:2"), server4, 0), Outbound); err != ErrTableFull {
+		t.Errorf("full table: %v", err)
+	}
+	if n.Stats().Rejected != 1 {
+		t.Errorf("stats = %+v", n.Stats())
+	}
+}
+
+func TestInvalidRules(t *testing.T) {
+	for _, config := range []Config{
+		{SNAT: []SNATRule{{Source: inside4}}},
+		{SNAT: []SNATRule{{Source: inside4, Addrs: []netip.Addr{outside6}}}},
+		{SNAT: []SNATRule{{Source: inside4, Addrs: []netip.Addr{outside4}, PortMin: 2000, PortMax: 1000}}},
+		{DNAT: []DNATRule{{Protocol: waterutil.ICMP, Addr: outside4, Port: 1, To: server4}}},
+		{DNAT: []DNATRule{{Protocol: waterutil.TCP, Addr: outside4, To: server4}}},
+		{DNAT: []DNATRule{{Protocol: waterutil.TCP, Addr: outside4, Port: 1, To: server6}}},
+	} {
+		if _, err := New(config); err != ErrInvalidRule {
+			t.Errorf("%+v: %v", config, err)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+// Package qemu exposes QEMU network backend connections as TAP interfaces.
+//
+// QEMU's `-netdev stream` backend and the legacy `-netdev socket` backend with
+// `connect=` or `listen=` exchange Ethernet frames over a stream socket, each
+// frame prefixed with its length as a 4-byte big-endian integer. The
+// `-netdev dgram` backend and the legacy `-netdev socket` backend with `udp=`
+// send every frame as a single datagram without any prefix.
+//
+// For example, a VM started with
+//
+//	qemu-system-x86_64 -netdev stream,id=n0,server=off,addr.type=unix,addr.path=/tmp/vm.sock -device virtio-net,netdev=n0
+//
+// can be attached with
+//
+//	l, err := qemu.Listen("unix", "/tmp/vm.sock")
+//	ifce, err := l.Accept()
+//
+// No kernel TAP device and no root privileges are required.
+package qemu
+
+import (
+	"errors"
+	"net"
+
+	"github.com/Doridian/water"
+	"github.com/Doridian/water/codec"
+)
+
+// NewStream creates a TAP interface on top of an established stream
+// connection speaking QEMU's stream protocol.
+func NewStream(conn net.Conn) (*water.Interface, error) {
+	c, err := codec.New(conn, codec.Prefix32)
+	if err != nil {
+		return nil, err
+	}
+	return water.NewFromReadWriteCloser(c, water.TAP, name(conn))
+}
+
+// NewDgram creates a TAP interface on top of a connected datagram socket
+// speaking QEMU's dgram protocol.
+func NewDgram(conn net.Conn) (*water.Interface, error) {
+	return water.NewFromReadWriteCloser(conn, water.TAP, name(conn))
+}
+
+// Dial connects to a QEMU stream backend listening on address, i.e. one
+// configured with `-netdev stream,server=on` or `-netdev socket,listen=`.
+// Network is any stream network accepted by net.Dial, e.g. "tcp" or "unix".
+func Dial(network, address string) (*water.Interface, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	ifce, err := NewStream(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return ifce, nil
+}
+
+// DialDgram creates a datagram socket bound to laddr that exchanges frames
+// with a QEMU dgram backend at raddr. This matches a VM configured with
+// `-netdev dgram` or `-netdev socket,udp=` whose local and remote addresses
+// are raddr and laddr respectively. Network is "udp", "udp4", "udp6" or
+// "unixgram".
+func DialDgram(network, laddr, raddr string) (*water.Interface, error) {
+	var (
+		conn net.Conn
+		err  error
+	)
+	switch network {
+	case "udp", "udp4", "udp6":
+		var la, ra *net.UDPAddr
+		if la, err = net.ResolveUDPAddr(network, laddr); err != nil {
+			return nil, err
+		}
+		if ra, err = net.ResolveUDPAddr(network, raddr); err != nil {
+			return nil, err
+		}
+		conn, err = net.DialUDP(network, la, ra)
+	case "unixgram":
+		var la, ra *net.UnixAddr
+		if la, err = net.ResolveUnixAddr(network, laddr); err != nil {
+			return nil, err
+		}
+		if ra, err = net.ResolveUnixAddr(network, raddr); err != nil {
+			return nil, err
+		}
+		conn, err = net.DialUnix(network, la, ra)
+	default:
+		return nil, errors.New("unsupported datagram network " + network)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewDgram(conn)
+}
+
+// Listener accepts connections from QEMU stream backends configured with
+// `-netdev stream,server=off` or `-netdev socket,connect=`.
+type Listener struct {
+	net.Listener
+}
+
+// Listen listens for QEMU stream backends on address. Network is any stream
+// network accepted by net.Listen, e.g. "tcp" or "unix".
+func Listen(network, address string) (*Listener, error) {
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{Listener: l}, nil
+}
+
+// Accept waits for the next VM to connect and returns it as a TAP interface.
+func (l *Listener) Accept() (*water.Interface, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	ifce, err := NewStream(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return ifce, nil
+}
+
+func name(conn net.Conn) string {
+	if addr := conn.RemoteAddr(); addr != nil && addr.String() != "" {
+		return "qemu:" + addr.String()
+	}
+	if addr := conn.LocalAddr(); addr != nil {
+		return "qemu:" + addr.String()
+	}
+	return "qemu"
+}
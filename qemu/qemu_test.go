@@ -0,0 +1,121 @@
+package qemu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+var testFrame = []byte{
+	0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+	0x52, 0x54, 0x00, 0x12, 0x34, 0x56,
+	0x08, 0x06, 0x00, 0x01,
+}
+
+func TestStreamProtocol(t *testing.T) {
+	local, vm := net.Pipe()
+	ifce, err := NewStream(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ifce.Close() }()
+	if !ifce.IsTAP() {
+		t.Fatal("expected a TAP interface")
+	}
+
+	go func() {
+		msg := binary.BigEndian.AppendUint32(nil, uint32(len(testFrame)))
+		_, _ = vm.Write(append(msg, testFrame...))
+	}()
+	buf := make([]byte, 1500)
+	n, err := ifce.Read(buf)
+	if err != nil || !bytes.Equal(buf[:n], testFrame) {
+		t.Fatalf("unexpected frame % x, %v", buf[:n], err)
+	}
+
+	go func() { _, _ = ifce.Write(testFrame) }()
+	raw := make([]byte, 4+len(testFrame))
+	if _, err := vm.Read(raw); err != nil {
+		t.Fatal(err)
+	}
+	if binary.BigEndian.Uint32(raw) != uint32(len(testFrame)) || !bytes.Equal(raw[4:], testFrame) {
+		t.Fatalf("unexpected data on stream % x", raw)
+	}
+}
+
+func TestListenDial(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "vm.sock")
+	l, err := Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+
+	accepted := make(chan error, 1)
+	go func() {
+		ifce, err := l.Accept()
+		if err != nil {
+			accepted <- err
+			return
+		}
+		defer func() { _ = ifce.Close() }()
+		buf := make([]byte, 1500)
+		n, err := ifce.Read(buf)
+		if err == nil {
+			_, err = ifce.Write(buf[:n])
+		}
+		accepted <- err
+	}()
+
+	ifce, err := Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ifce.Close() }()
+	if _, err := ifce.Write(testFrame); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	n, err := ifce.Read(buf)
+	if err != nil || !bytes.Equal(buf[:n], testFrame) {
+		t.Fatalf("unexpected echo % x, %v", buf[:n], err)
+	}
+	if err := <-accepted; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDgram(t *testing.T) {
+	vm, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = vm.Close() }()
+
+	ifce, err := DialDgram("udp", "127.0.0.1:0", vm.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ifce.Close() }()
+	if !ifce.IsTAP() {
+		t.Fatal("expected a TAP interface")
+	}
+
+	if _, err := ifce.Write(testFrame); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	n, from, err := vm.ReadFromUDP(buf)
+	if err != nil || !bytes.Equal(buf[:n], testFrame) {
+		t.Fatalf("unexpected datagram % x, %v", buf[:n], err)
+	}
+	if _, err := vm.WriteToUDP(testFrame[:14], from); err != nil {
+		t.Fatal(err)
+	}
+	n, err = ifce.Read(buf)
+	if err != nil || !bytes.Equal(buf[:n], testFrame[:14]) {
+		t.Fatalf("unexpected frame % x, %v", buf[:n], err)
+	}
+}
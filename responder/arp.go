@@ -0,0 +1,163 @@
+package responder
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+
+	"github.com/Doridian/water"
+	"github.com/Doridian/water/waterutil"
+)
+
+// ARPConfig defines parameters of an ARP responder.
+type ARPConfig struct {
+	// MAC is the MAC address of the userspace host. It is required.
+	MAC net.HardwareAddr
+
+	// Addresses are the IPv4 addresses ARP requests are answered for.
+	Addresses []netip.Addr
+
+	// DisableGratuitous disables the gratuitous ARP announcements sent for
+	// every address when the responder is created and when an address is
+	// added.
+	DisableGratuitous bool
+}
+
+// ARPResponder answers ARP requests for a set of IPv4 addresses on a TAP
+// interface.
+type ARPResponder struct {
+	tap        *water.Interface
+	ifce       *water.Interface
+	mac        net.HardwareAddr
+	addrs      *addressSet
+	gratuitous bool
+}
+
+var _ io.ReadWriteCloser = (*ARPResponder)(nil)
+
+// NewARP wraps a TAP interface with an ARP responder. Closing the returned
+// interface closes tap.
+func NewARP(tap *water.Interface, config ARPConfig) (*water.Interface, error) {
+	r, err := NewARPResponder(tap, config)
+	if err != nil {
+		return nil, err
+	}
+	return r.Interface(), nil
+}
+
+// NewARPResponder is like NewARP, but returns the ARPResponder, which allows
+// changing the set of addresses.
+func NewARPResponder(tap *water.Interface, config ARPConfig) (*ARPResponder, error) {
+	if !tap.IsTAP() {
+		return nil, ErrNotTAP
+	}
+	if len(config.MAC) != 6 {
+		return nil, errors.New("MAC must be 6 bytes long")
+	}
+	for _, addr := range config.Addresses {
+		if !addr.Is4() {
+			return nil, errors.New("addresses must be IPv4 addresses")
+		}
+	}
+
+	r := &ARPResponder{
+		tap:        tap,
+		mac:        config.MAC,
+		addrs:      newAddressSet(config.Addresses),
+		gratuitous: !config.DisableGratuitous,
+	}
+	ifce, err := water.NewFromReadWriteCloser(r, water.TAP, tap.Name())
+	if err != nil {
+		return nil, err
+	}
+	r.ifce = ifce
+
+	if r.gratuitous {
+		if err := r.Announce(); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Interface returns the TAP interface wrapped by the responder.
+func (r *ARPResponder) Interface() *water.Interface {
+	return r.ifce
+}
+
+// AddAddress starts answering ARP requests for addr and announces it with a
+// gratuitous ARP unless disabled.
+func (r *ARPResponder) AddAddress(addr netip.Addr) error {
+	if !addr.Is4() {
+		return errors.New("address must be an IPv4 address")
+	}
+	if !r.addrs.add(addr) || !r.gratuitous {
+		return nil
+	}
+	_, err := r.tap.Write(waterutil.BuildGratuitousARP(r.mac, addr))
+	return err
+}
+
+// RemoveAddress stops answering ARP requests for addr.
+func (r *ARPResponder) RemoveAddress(addr netip.Addr) {
+	r.addrs.remove(addr)
+}
+
+// Addresses returns the addresses ARP requests are answered for, in sorted
+// order.
+func (r *ARPResponder) Addresses() []netip.Addr {
+	return r.addrs.list()
+}
+
+// Announce sends a gratuitous ARP for every address, e.g. after the MAC
+// address of the host moved.
+func (r *ARPResponder) Announce() error {
+	for _, addr := range r.addrs.list() {
+		if _, err := r.tap.Write(waterutil.BuildGratuitousARP(r.mac, addr)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Read returns the next frame from the TAP interface. ARP requests for one
+// of the addresses are answered and not returned.
+func (r *ARPResponder) Read(to []byte) (int, error) {
+	for {
+		n, err := r.tap.Read(to)
+		if err != nil || !r.handle(to[:n]) {
+			return n, err
+		}
+	}
+}
+
+// handle answers frame if it is an ARP request for one of the addresses. It
+// reports whether frame was consumed.
+func (r *ARPResponder) handle(frame []byte) bool {
+	if waterutil.ValidateMACFrame(frame) != nil ||
+		waterutil.MACTagging(frame) != waterutil.NotTagged ||
+		waterutil.MACEthertype(frame) != waterutil.ARP {
+		return false
+	}
+	if dst := waterutil.MACDestination(frame); !waterutil.IsMACBroadcast(dst) && !macEqual(dst, r.mac) {
+		return false
+	}
+	arp, err := waterutil.NewARPPacket(waterutil.MACPayload(frame))
+	if err != nil || arp.Operation() != waterutil.ARPRequest || arp.IsGratuitous() ||
+		!r.addrs.contains(arp.TargetIP()) {
+		return false
+	}
+	_, _ = r.tap.Write(waterutil.BuildARPReply(arp, r.mac))
+	return true
+}
+
+// Write sends a frame to the TAP interface unchanged.
+func (r *ARPResponder) Write(from []byte) (int, error) {
+	return r.tap.Write(from)
+}
+
+// Close closes the TAP interface.
+func (r *ARPResponder) Close() error {
+	return r.tap.Close()
+}
@@ -0,0 +1,154 @@
+package responder
+
+import (
+	"io"
+	"net/netip"
+
+	"github.com/Doridian/water"
+	"github.com/Doridian/water/waterutil"
+)
+
+// EchoConfig defines parameters of an echo responder.
+type EchoConfig struct {
+	// Addresses are the IPv4 and IPv6 addresses echo requests are answered
+	// for.
+	Addresses []netip.Addr
+
+	// AllAddresses answers requests to every unicast address, regardless of
+	// Addresses.
+	AllAddresses bool
+}
+
+// EchoResponder answers ICMPv4 and ICMPv6 echo requests on a TUN or TAP
+// interface. On a TAP interface, requests in untagged frames are answered by
+// swapping the MAC addresses.
+type EchoResponder struct {
+	wrapped *water.Interface
+	ifce    *water.Interface
+	addrs   *addressSet
+	all     bool
+}
+
+var _ io.ReadWriteCloser = (*EchoResponder)(nil)
+
+// NewEcho wraps a TUN or TAP interface with an echo responder. Closing the
+// returned interface closes ifce.
+func NewEcho(ifce *water.Interface, config EchoConfig) (*water.Interface, error) {
+	r, err := NewEchoResponder(ifce, config)
+	if err != nil {
+		return nil, err
+	}
+	return r.Interface(), nil
+}
+
+// NewEchoResponder is like NewEcho, but returns the EchoResponder, which
+// allows changing the set of addresses.
+func NewEchoResponder(ifce *water.Interface, config EchoConfig) (*EchoResponder, error) {
+	r := &EchoResponder{
+		wrapped: ifce,
+		addrs:   newAddressSet(nil),
+		all:     config.AllAddresses,
+	}
+	for _, addr := range config.Addresses {
+		r.addrs.add(addr.Unmap())
+	}
+	var deviceType water.DeviceType = water.TUN
+	if ifce.IsTAP() {
+		deviceType = water.TAP
+	}
+	wrapper, err := water.NewFromReadWriteCloser(r, deviceType, ifce.Name())
+	if err != nil {
+		return nil, err
+	}
+	r.ifce = wrapper
+	return r, nil
+}
+
+// Interface returns the interface wrapped by the responder.
+func (r *EchoResponder) Interface() *water.Interface {
+	return r.ifce
+}
+
+// AddAddress starts answering echo requests for addr.
+func (r *EchoResponder) AddAddress(addr netip.Addr) {
+	r.addrs.add(addr.Unmap())
+}
+
+// RemoveAddress stops answering echo requests for addr, unless the responder
+// answers for all addresses.
+func (r *EchoResponder) RemoveAddress(addr netip.Addr) {
+	r.addrs.remove(addr.Unmap())
+}
+
+// Addresses returns the addresses echo requests are answered for, in sorted
+// order.
+func (r *EchoResponder) Addresses() []netip.Addr {
+	return r.addrs.list()
+}
+
+// Read returns the next packet or frame from the wrapped interface. Echo
+// requests for one of the addresses are answered and not returned.
+func (r *EchoResponder) Read(to []byte) (int, error) {
+	for {
+		n, err := r.wrapped.Read(to)
+		if err != nil || !r.handle(to[:n]) {
+			return n, err
+		}
+	}
+}
+
+// handle answers b if it is an echo request for one of the addresses. It
+// reports whether b was consumed.
+func (r *EchoResponder) handle(b []byte) bool {
+	packet := b
+	if r.wrapped.IsTAP() {
+		if waterutil.ValidateMACFrame(b) != nil ||
+			waterutil.MACTagging(b) != waterutil.NotTagged ||
+			!waterutil.IsMACUnicast(waterutil.MACDestination(b)) {
+			return false
+		}
+		switch waterutil.MACEthertype(b) {
+		case waterutil.IPv4, waterutil.IPv6:
+		default:
+			return false
+		}
+		packet = waterutil.MACPayload(b)
+	}
+	if waterutil.ValidateIP(packet) != nil || !r.answersFor(packet) {
+		return false
+	}
+	reply, err := waterutil.BuildEchoReply(packet)
+	if err != nil {
+		return false
+	}
+
+	if r.wrapped.IsTAP() {
+		frame := make([]byte, 0, 14+len(reply))
+		frame = waterutil.AppendEthernetHeader(frame, waterutil.MACSource(b), waterutil.MACDestination(b), waterutil.MACEthertype(b))
+		reply = append(frame, reply...)
+	}
+	_, _ = r.wrapped.Write(reply)
+	return true
+}
+
+func (r *EchoResponder) answersFor(packet []byte) bool {
+	dst, ok := netip.AddrFromSlice(waterutil.IPDestination(packet))
+	if !ok {
+		return false
+	}
+	dst = dst.Unmap()
+	if !r.all {
+		return r.addrs.contains(dst)
+	}
+	return !dst.IsMulticast() && !dst.IsUnspecified() && dst != netip.AddrFrom4([4]byte{255, 255, 255, 255})
+}
+
+// Write sends a packet or frame to the wrapped interface unchanged.
+func (r *EchoResponder) Write(from []byte) (int, error) {
+	return r.wrapped.Write(from)
+}
+
+// Close closes the wrapped interface.
+func (r *EchoResponder) Close() error {
+	return r.wrapped.Close()
+}
@@ -0,0 +1,284 @@
+package responder
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/Doridian/water"
+	"github.com/Doridian/water/waterutil"
+)
+
+// Defaults used by RAConfig.
+const (
+	DefaultRAInterval        = 200 * time.Second
+	DefaultValidLifetime     = 24 * time.Hour
+	DefaultPreferredLifetime = 4 * time.Hour
+)
+
+var allNodes = netip.MustParseAddr("ff02::1")
+
+// RAConfig enables Router Advertisements, so that the kernel side of the TAP
+// interface autoconfigures addresses via SLAAC.
+type RAConfig struct {
+	// Prefixes are advertised as on-link and for autonomous address
+	// configuration. SLAAC requires /64 prefixes.
+	Prefixes []netip.Prefix
+
+	// MTU is advertised if non-zero.
+	MTU uint32
+
+	// RouterLifetime is the time the host is used as default router. If
+	// zero, it is not used as default router, but prefixes are still
+	// advertised. It is clamped to between 0 and 9000 seconds.
+	RouterLifetime time.Duration
+
+	// Interval is the time between unsolicited advertisements. It defaults
+	// to DefaultRAInterval. Router Solicitations are always answered.
+	Interval time.Duration
+}
+
+// NDPConfig defines parameters of a Neighbor Discovery responder.
+type NDPConfig struct {
+	// MAC is the MAC address of the userspace host. It is required.
+	MAC net.HardwareAddr
+
+	// Addresses are the IPv6 addresses Neighbor Solicitations are answered
+	// for. Unless it contains a link-local address, the link-local address
+	// derived from MAC is added.
+	Addresses []netip.Addr
+
+	// RA enables Router Advertisements if non-nil.
+	RA *RAConfig
+}
+
+// NDPResponder answers IPv6 Neighbor Solicitations for a set of addresses on
+// a TAP interface and optionally acts as a router sending Router
+// Advertisements.
+type NDPResponder struct {
+	tap       *water.Interface
+	ifce      *water.Interface
+	mac       net.HardwareAddr
+	linkLocal netip.Addr
+	addrs     *addressSet
+	ra        *RAConfig
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+var _ io.ReadWriteCloser = (*NDPResponder)(nil)
+
+// NewNDP wraps a TAP interface with a Neighbor Discovery responder. Closing
+// the returned interface closes tap.
+func NewNDP(tap *water.Interface, config NDPConfig) (*water.Interface, error) {
+	r, err := NewNDPResponder(tap, config)
+	if err != nil {
+		return nil, err
+	}
+	return r.Interface(), nil
+}
+
+// NewNDPResponder is like NewNDP, but returns the NDPResponder, which allows
+// changing the set of addresses.
+func NewNDPResponder(tap *water.Interface, config NDPConfig) (*NDPResponder, error) {
+	if !tap.IsTAP() {
+		return nil, ErrNotTAP
+	}
+	if len(config.MAC) != 6 {
+		return nil, errors.New("MAC must be 6 bytes long")
+	}
+	var linkLocal netip.Addr
+	for _, addr := range config.Addresses {
+		if !addr.Is6() || addr.Is4In6() {
+			return nil, errors.New("addresses must be IPv6 addresses")
+		}
+		if addr.IsLinkLocalUnicast() && !linkLocal.IsValid() {
+			linkLocal = addr
+		}
+	}
+	addrs := newAddressSet(config.Addresses)
+	if !linkLocal.IsValid() {
+		linkLocal = waterutil.IPv6LinkLocalFromMAC(config.MAC)
+		addrs.add(linkLocal)
+	}
+
+	r := &NDPResponder{
+		tap:       tap,
+		mac:       config.MAC,
+		linkLocal: linkLocal,
+		addrs:     addrs,
+		done:      make(chan struct{}),
+	}
+	if config.RA != nil {
+		ra := *config.RA
+		for _, prefix := range ra.Prefixes {
+			if !prefix.Addr().Is6() {
+				return nil, errors.New("RA prefixes must be IPv6 prefixes")
+			}
+		}
+		if ra.Interval <= 0 {
+			ra.Interval = DefaultRAInterval
+		}
+		r.ra = &ra
+	}
+
+	ifce, err := water.NewFromReadWriteCloser(r, water.TAP, tap.Name())
+	if err != nil {
+		return nil, err
+	}
+	r.ifce = ifce
+
+	if r.ra != nil {
+		if err := r.sendRA(); err != nil {
+			return nil, err
+		}
+		go r.advertise()
+	}
+	return r, nil
+}
+
+// Interface returns the TAP interface wrapped by the responder.
+func (r *NDPResponder) Interface() *water.Interface {
+	return r.ifce
+}
+
+// AddAddress starts answering Neighbor Solicitations for addr.
+func (r *NDPResponder) AddAddress(addr netip.Addr) error {
+	if !addr.Is6() || addr.Is4In6() {
+		return errors.New("address must be an IPv6 address")
+	}
+	r.addrs.add(addr)
+	return nil
+}
+
+// RemoveAddress stops answering Neighbor Solicitations for addr.
+func (r *NDPResponder) RemoveAddress(addr netip.Addr) {
+	r.addrs.remove(addr)
+}
+
+// Addresses returns the addresses Neighbor Solicitations are answered for,
+// in sorted order.
+func (r *NDPResponder) Addresses() []netip.Addr {
+	return r.addrs.list()
+}
+
+// LinkLocal returns the link-local address Router Advertisements are sent
+// from.
+func (r *NDPResponder) LinkLocal() netip.Addr {
+	return r.linkLocal
+}
+
+func (r *NDPResponder) advertise() {
+	ticker := time.NewTicker(r.ra.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			_ = r.sendRA()
+		case <-r.done:
+			return
+		}
+	}
+}
+
+func (r *NDPResponder) sendRA() error {
+	lifetime := min(max(r.ra.RouterLifetime/time.Second, 0), 9000)
+	msg := waterutil.AppendRouterAdvertisement(nil, waterutil.RouterAdvertisement{
+		RouterLifetime: uint16(lifetime), // #nosec G115 -- clamped to [0, 9000] above
+	})
+	msg = waterutil.AppendNDPLinkLayerAddressOption(msg, waterutil.NDPOptionSourceLinkLayerAddress, r.mac)
+	if r.ra.MTU != 0 {
+		msg = waterutil.AppendNDPMTUOption(msg, r.ra.MTU)
+	}
+	for _, prefix := range r.ra.Prefixes {
+		msg = waterutil.AppendNDPPrefixInformationOption(msg, waterutil.NDPPrefixInformation{
+			Prefix:            prefix,
+			OnLink:            true,
+			Autonomous:        true,
+			ValidLifetime:     uint32(DefaultValidLifetime / time.Second),
+			PreferredLifetime: uint32(DefaultPreferredLifetime / time.Second),
+		})
+	}
+	return r.send(waterutil.IPv6MulticastMAC(allNodes), waterutil.BuildNDPPacket(r.linkLocal, allNodes, msg))
+}
+
+func (r *NDPResponder) send(dst net.HardwareAddr, packet []byte) error {
+	frame := make([]byte, 0, 14+len(packet))
+	frame = waterutil.AppendEthernetHeader(frame, dst, r.mac, waterutil.IPv6)
+	_, err := r.tap.Write(append(frame, packet...))
+	return err
+}
+
+// Read returns the next frame from the TAP interface. Neighbor Solicitations
+// for one of the addresses and, if Router Advertisements are enabled, Router
+// Solicitations are answered and not returned.
+func (r *NDPResponder) Read(to []byte) (int, error) {
+	for {
+		n, err := r.tap.Read(to)
+		if err != nil || !r.handle(to[:n]) {
+			return n, err
+		}
+	}
+}
+
+// handle answers frame if it is a Neighbor Solicitation for one of the
+// addresses or a Router Solicitation. It reports whether frame was consumed.
+func (r *NDPResponder) handle(frame []byte) bool {
+	if waterutil.ValidateMACFrame(frame) != nil ||
+		waterutil.MACTagging(frame) != waterutil.NotTagged ||
+		waterutil.MACEthertype(frame) != waterutil.IPv6 {
+		return false
+	}
+	if dst := waterutil.MACDestination(frame); waterutil.IsMACUnicast(dst) && !macEqual(dst, r.mac) {
+		return false
+	}
+	packet := waterutil.MACPayload(frame)
+	msg, err := waterutil.ParseNDP(packet)
+	if err != nil {
+		return false
+	}
+
+	switch msg.Type() {
+	case waterutil.NDPNeighborSolicitation:
+		target := msg.TargetAddress()
+		if !r.addrs.contains(target) {
+			return false
+		}
+		src := netip.AddrFrom16([16]byte(waterutil.IPv6Source(packet)))
+		r.answerNS(waterutil.MACSource(frame), src, msg)
+		return true
+	case waterutil.NDPRouterSolicitation:
+		if r.ra == nil {
+			return false
+		}
+		_ = r.sendRA()
+		return true
+	default:
+		return false
+	}
+}
+
+func (r *NDPResponder) answerNS(ethSrc net.HardwareAddr, src netip.Addr, ns waterutil.NDPMessage) {
+	var flags byte
+	if r.ra != nil {
+		flags = waterutil.NDPFlagRouter
+	}
+	_, _ = r.tap.Write(waterutil.BuildNeighborAdvertisementFrame(ethSrc, src, ns, r.mac, flags))
+}
+
+// Write sends a frame to the TAP interface unchanged.
+func (r *NDPResponder) Write(from []byte) (int, error) {
+	return r.tap.Write(from)
+}
+
+// Close stops sending Router Advertisements and closes the TAP interface.
+func (r *NDPResponder) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.done)
+	})
+	return r.tap.Close()
+}
@@ -0,0 +1,73 @@
+// Package responder answers control traffic such as ARP, Neighbor Discovery
+// and ping on behalf of a userspace host attached to a TUN or TAP interface,
+// so that the host's own stack only needs to deal with its actual traffic.
+//
+// Every responder wraps an Interface and returns a new Interface. Requests it
+// answers are consumed, everything else is passed through unchanged.
+// Responders can be stacked by wrapping the result of one with another.
+package responder
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+)
+
+// ErrNotTAP is returned when a responder requiring a TAP interface is given a
+// TUN interface.
+var ErrNotTAP = errors.New("interface is not a TAP interface")
+
+// addressSet is a set of addresses that can be changed while a responder is
+// running.
+type addressSet struct {
+	mu    sync.RWMutex
+	addrs map[netip.Addr]struct{}
+}
+
+func newAddressSet(addrs []netip.Addr) *addressSet {
+	s := &addressSet{addrs: make(map[netip.Addr]struct{}, len(addrs))}
+	for _, addr := range addrs {
+		s.addrs[addr] = struct{}{}
+	}
+	return s
+}
+
+func (s *addressSet) add(addr netip.Addr) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.addrs[addr]; ok {
+		return false
+	}
+	s.addrs[addr] = struct{}{}
+	return true
+}
+
+func (s *addressSet) remove(addr netip.Addr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.addrs, addr)
+}
+
+func (s *addressSet) contains(addr netip.Addr) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.addrs[addr]
+	return ok
+}
+
+func (s *addressSet) list() []netip.Addr {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	addrs := make([]netip.Addr, 0, len(s.addrs))
+	for addr := range s.addrs {
+		addrs = append(addrs, addr)
+	}
+	slices.SortFunc(addrs, netip.Addr.Compare)
+	return addrs
+}
+
+func macEqual(a, b net.HardwareAddr) bool {
+	return len(a) == len(b) && string(a) == string(b)
+}
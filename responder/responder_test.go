@@ -0,0 +1,288 @@
+package responder
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/Doridian/water"
+	"github.com/Doridian/water/internal/fakedev"
+	"github.com/Doridian/water/waterutil"
+)
+
+func newFake(t *testing.T, deviceType water.DeviceType) (*water.Interface, *fakedev.Device) {
+	f := fakedev.New()
+	ifce, err := water.NewFromReadWriteCloser(f, deviceType, "fake0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ifce, f
+}
+
+var (
+	kernelMAC = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}
+	hostMAC   = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02}
+	kernelIP4 = netip.MustParseAddr("10.0.0.1")
+	hostIP4   = netip.MustParseAddr("10.0.0.2")
+)
+
+func TestARPResponder(t *testing.T) {
+	tap, f := newFake(t, water.TAP)
+	r, err := NewARPResponder(tap, ARPConfig{MAC: hostMAC, Addresses: []netip.Addr{hostIP4}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	announcement, err := waterutil.NewARPPacket(waterutil.MACPayload(f.Expect(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !announcement.IsGratuitous() || announcement.SenderIP() != hostIP4 || !bytes.Equal(announcement.SenderMAC(), hostMAC) {
+		t.Fatal("expected a gratuitous ARP for the host address")
+	}
+
+	other := netip.MustParseAddr("10.0.0.3")
+	f.In <- waterutil.BuildARPRequest(kernelMAC, kernelIP4, other)
+	f.In <- waterutil.BuildARPRequest(kernelMAC, kernelIP4, hostIP4)
+	f.In <- []byte("end")
+
+	buf := make([]byte, 1500)
+	n, err := r.Interface().Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if arp, err := waterutil.NewARPPacket(waterutil.MACPayload(buf[:n])); err != nil || arp.TargetIP() != other {
+		t.Fatal("requests for other addresses must be passed through")
+	}
+	if n, err = r.Interface().Read(buf); err != nil || string(buf[:n]) != "end" {
+		t.Fatal("answered requests must be consumed")
+	}
+
+	reply := f.Expect(t)
+	if !bytes.Equal(waterutil.MACDestination(reply), kernelMAC) {
+		t.Fatal("reply must be sent to the requester")
+	}
+	arp, err := waterutil.NewARPPacket(waterutil.MACPayload(reply))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if arp.Operation() != waterutil.ARPReply || arp.SenderIP() != hostIP4 || !bytes.Equal(arp.SenderMAC(), hostMAC) ||
+		arp.TargetIP() != kernelIP4 || !bytes.Equal(arp.TargetMAC(), kernelMAC) {
+		t.Fatalf("unexpected reply % x", []byte(arp))
+	}
+
+	r.RemoveAddress(hostIP4)
+	if err := r.AddAddress(other); err != nil {
+		t.Fatal(err)
+	}
+	f.Expect(t)
+	if addrs := r.Addresses(); len(addrs) != 1 || addrs[0] != other {
+		t.Fatalf("unexpected addresses %v", addrs)
+	}
+	f.ExpectNothing(t)
+}
+
+func TestARPResponderRequiresTAP(t *testing.T) {
+	tun, _ := newFake(t, water.TUN)
+	if _, err := NewARP(tun, ARPConfig{MAC: hostMAC}); err != ErrNotTAP {
+		t.Fatalf("expected ErrNotTAP, got %v", err)
+	}
+}
+
+func nsFrame(src, target netip.Addr) []byte {
+	msg := waterutil.AppendNeighborSolicitation(nil, target)
+	if !src.IsUnspecified() {
+		msg = waterutil.AppendNDPLinkLayerAddressOption(msg, waterutil.NDPOptionSourceLinkLayerAddress, kernelMAC)
+	}
+	dst := waterutil.SolicitedNodeMulticast(target)
+	frame := waterutil.AppendEthernetHeader(nil, waterutil.IPv6MulticastMAC(dst), kernelMAC, waterutil.IPv6)
+	return append(frame, waterutil.BuildNDPPacket(src, dst, msg)...)
+}
+
+func expectNDP(t *testing.T, f *fakedev.Device, msgType byte) (net.HardwareAddr, []byte, waterutil.NDPMessage) {
+	t.Helper()
+	frame := f.Expect(t)
+	packet := waterutil.MACPayload(frame)
+	msg, err := waterutil.ParseNDP(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type() != msgType {
+		t.Fatalf("expected NDP message type %d, got %d", msgType, msg.Type())
+	}
+	return waterutil.MACDestination(frame), packet, msg
+}
+
+func TestNDPResponder(t *testing.T) {
+	tap, f := newFake(t, water.TAP)
+	hostIP6 := netip.MustParseAddr("fd00::2")
+	kernelIP6 := netip.MustParseAddr("fe80::1")
+	r, err := NewNDPResponder(tap, NDPConfig{MAC: hostMAC, Addresses: []netip.Addr{hostIP6}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if r.LinkLocal() != waterutil.IPv6LinkLocalFromMAC(hostMAC) || len(r.Addresses()) != 2 {
+		t.Fatalf("expected the derived link-local address to be added, got %v", r.Addresses())
+	}
+	f.ExpectNothing(t)
+
+	other := netip.MustParseAddr("fd00::3")
+	f.In <- nsFrame(kernelIP6, other)
+	f.In <- nsFrame(kernelIP6, hostIP6)
+	f.In <- nsFrame(netip.IPv6Unspecified(), hostIP6)
+	f.In <- []byte("end")
+
+	buf := make([]byte, 1500)
+	n, err := r.Interface().Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := waterutil.ParseNDP(waterutil.MACPayload(buf[:n])); err != nil || msg.TargetAddress() != other {
+		t.Fatal("solicitations for other addresses must be passed through")
+	}
+	if n, err = r.Interface().Read(buf); err != nil || string(buf[:n]) != "end" {
+		t.Fatal("answered solicitations must be consumed")
+	}
+
+	dstMAC, packet, na := expectNDP(t, f, waterutil.NDPNeighborAdvertisement)
+	if !bytes.Equal(dstMAC, kernelMAC) || waterutil.IPv6Destination(packet).String() != kernelIP6.String() {
+		t.Fatal("advertisement must be sent to the soliciting node")
+	}
+	if na.TargetAddress() != hostIP6 || na.NeighborFlags() != waterutil.NDPFlagSolicited|waterutil.NDPFlagOverride ||
+		!bytes.Equal(na.TargetLinkLayerAddress(), hostMAC) {
+		t.Fatal("unexpected Neighbor Advertisement")
+	}
+
+	_, packet, na = expectNDP(t, f, waterutil.NDPNeighborAdvertisement)
+	if waterutil.IPv6Destination(packet).String() != "ff02::1" || na.NeighborFlags()&waterutil.NDPFlagSolicited != 0 {
+		t.Fatal("duplicate address detection must be answered to all nodes without the solicited flag")
+	}
+}
+
+func TestNDPRouterAdvertisement(t *testing.T) {
+	tap, f := newFake(t, water.TAP)
+	prefix := netip.MustParsePrefix("fd00:1::/64")
+	r, err := NewNDPResponder(tap, NDPConfig{
+		MAC: hostMAC,
+		RA:  &RAConfig{Prefixes: []netip.Prefix{prefix}, MTU: 1400, RouterLifetime: time.Hour},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	dstMAC, packet, ra := expectNDP(t, f, waterutil.NDPRouterAdvertisement)
+	if dstMAC.String() != "33:33:00:00:00:01" || waterutil.IPv6Source(packet).String() != r.LinkLocal().String() {
+		t.Fatal("advertisements must be sent from the link-local address to all nodes")
+	}
+	if ra.RouterLifetime() != 3600 || !bytes.Equal(ra.SourceLinkLayerAddress(), hostMAC) {
+		t.Fatal("unexpected Router Advertisement")
+	}
+	if mtu, _ := ra.MTU(); mtu != 1400 {
+		t.Fatalf("unexpected MTU %d", mtu)
+	}
+	for info := range ra.PrefixInformation() {
+		if info.Prefix != prefix || !info.Autonomous || !info.OnLink {
+			t.Fatalf("unexpected prefix information %+v", info)
+		}
+	}
+
+	rs := waterutil.AppendEthernetHeader(nil, net.HardwareAddr{0x33, 0x33, 0, 0, 0, 2}, kernelMAC, waterutil.IPv6)
+	rs = append(rs, waterutil.BuildNDPPacket(netip.MustParseAddr("fe80::1"), netip.MustParseAddr("ff02::2"),
+		waterutil.AppendRouterSolicitation(nil))...)
+	f.In <- rs
+	f.In <- []byte("end")
+	buf := make([]byte, 1500)
+	if n, err := r.Interface().Read(buf); err != nil || string(buf[:n]) != "end" {
+		t.Fatal("Router Solicitations must be consumed")
+	}
+	expectNDP(t, f, waterutil.NDPRouterAdvertisement)
+}
+
+func TestNDPRouterLifetimeClamp(t *testing.T) {
+	for lifetime, want := range map[time.Duration]uint16{-time.Hour: 0, 10 * time.Hour: 9000} {
+		tap, f := newFake(t, water.TAP)
+		r, err := NewNDPResponder(tap, NDPConfig{MAC: hostMAC, RA: &RAConfig{RouterLifetime: lifetime}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, ra := expectNDP(t, f, waterutil.NDPRouterAdvertisement); ra.RouterLifetime() != want {
+			t.Fatalf("router lifetime %v advertised as %d, expected %d", lifetime, ra.RouterLifetime(), want)
+		}
+		_ = r.Close()
+	}
+}
+
+func TestEchoResponderTUN(t *testing.T) {
+	tun, f := newFake(t, water.TUN)
+	r, err := NewEchoResponder(tun, EchoConfig{Addresses: []netip.Addr{hostIP4}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Interface().IsTUN() {
+		t.Fatal("expected a TUN interface")
+	}
+
+	f.In <- waterutil.BuildEchoRequest(kernelIP4, netip.MustParseAddr("10.0.0.3"), 1, 1, nil)
+	f.In <- waterutil.BuildEchoRequest(kernelIP4, hostIP4, 1, 2, []byte("ping"))
+	f.In <- []byte("end")
+	buf := make([]byte, 1500)
+	n, err := r.Interface().Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if waterutil.IPv4Destination(buf[:n]).String() != "10.0.0.3" {
+		t.Fatal("requests for other addresses must be passed through")
+	}
+	if n, err = r.Interface().Read(buf); err != nil || string(buf[:n]) != "end" {
+		t.Fatal("answered requests must be consumed")
+	}
+
+	reply := f.Expect(t)
+	icmp, err := waterutil.NewICMPMessage(waterutil.IPPayload(reply))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if waterutil.IPv4Source(reply).String() != hostIP4.String() || icmp.Type() != waterutil.ICMPv4EchoReply ||
+		icmp.Sequence() != 2 || string(icmp.Body()) != "ping" {
+		t.Fatal("unexpected echo reply")
+	}
+
+	// Without addresses, nothing is answered.
+	r.RemoveAddress(hostIP4)
+	request := waterutil.BuildEchoRequest(kernelIP4, hostIP4, 1, 3, nil)
+	f.In <- request
+	if n, err = r.Interface().Read(buf); err != nil || !bytes.Equal(buf[:n], request) {
+		t.Fatal("requests must be passed through once all addresses are removed")
+	}
+}
+
+func TestEchoResponderTAP(t *testing.T) {
+	tap, f := newFake(t, water.TAP)
+	ifce, err := NewEcho(tap, EchoConfig{AllAddresses: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kernelIP6 := netip.MustParseAddr("fd00::1")
+	hostIP6 := netip.MustParseAddr("fd00::2")
+	frame := waterutil.AppendEthernetHeader(nil, hostMAC, kernelMAC, waterutil.IPv6)
+	f.In <- append(frame, waterutil.BuildEchoRequest(kernelIP6, hostIP6, 1, 1, nil)...)
+	f.In <- []byte("end")
+	buf := make([]byte, 1500)
+	if n, err := ifce.Read(buf); err != nil || string(buf[:n]) != "end" {
+		t.Fatal("answered requests must be consumed")
+	}
+
+	reply := f.Expect(t)
+	if !bytes.Equal(waterutil.MACDestination(reply), kernelMAC) || !bytes.Equal(waterutil.MACSource(reply), hostMAC) {
+		t.Fatal("reply must swap the MAC addresses")
+	}
+	packet := waterutil.MACPayload(reply)
+	if waterutil.IPv6Source(packet).String() != hostIP6.String() || waterutil.IPPayload(packet)[0] != waterutil.ICMPv6EchoReply {
+		t.Fatal("unexpected echo reply")
+	}
+}
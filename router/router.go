@@ -0,0 +1,488 @@
+// Package router implements a userspace IPv4 and IPv6 router forwarding
+// packets between TUN interfaces according to a routing table.
+package router
+
+import (
+	"errors"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Doridian/water"
+	"github.com/Doridian/water/ipfrag"
+	"github.com/Doridian/water/lpm"
+	"github.com/Doridian/water/waterutil"
+)
+
+// DefaultMTU is the MTU of an interface whose InterfaceConfig.MTU is zero and
+// whose MTU cannot be queried.
+const DefaultMTU = 1500
+
+// DefaultPacketSize is the read buffer size used when Config.PacketSize is
+// zero. It fits the largest IP packet.
+const DefaultPacketSize = 65535
+
+var (
+	ErrUnknownInterface = errors.New("unknown interface")
+	ErrUnknownRoute     = errors.New("unknown route")
+	ErrClosed           = errors.New("router is closed")
+	ErrNotTUN           = errors.New("interface is not a TUN interface")
+)
+
+// InterfaceID identifies an interface attached to a Router.
+type InterfaceID int
+
+// InterfaceConfig defines parameters of an interface attached to a Router. A
+// zero-value InterfaceConfig is valid.
+type InterfaceConfig struct {
+	// Addrs are the addresses of the router on this interface. Echo requests
+	// to them are answered, and ICMP errors for packets received on the
+	// interface are sent from the first address of the matching family. If
+	// there is none, no ICMP errors are sent.
+	Addrs []netip.Addr
+
+	// MTU is the largest packet sent out of the interface. Defaults to the MTU
+	// of the interface, or DefaultMTU if it cannot be queried.
+	MTU int
+}
+
+// Config defines parameters of a Router. A zero-value Config is valid.
+type Config struct {
+	// PacketSize is the size of the buffer used to read from each interface.
+	// Defaults to DefaultPacketSize.
+	PacketSize int
+
+	// InterfaceErrorHandler, if non-nil, is called when reading from an
+	// interface fails. The interface and its routes have already been removed
+	// from the router when it is called.
+	InterfaceErrorHandler func(id InterfaceID, err error)
+}
+
+// Route is an entry of the routing table.
+type Route struct {
+	Prefix    netip.Prefix
+	Interface InterfaceID
+	Stats     RouteStats
+}
+
+// RouteStats holds the counters of a single route.
+type RouteStats struct {
+	// Packets and Bytes count packets forwarded along the route. A packet
+	// that was fragmented is counted once, with its original size.
+	Packets uint64
+	Bytes   uint64
+	// Fragmented counts forwarded IPv4 packets that were fragmented to fit
+	// the MTU of the interface.
+	Fragmented uint64
+	// TTLExceeded counts packets dropped because their TTL or hop limit
+	// expired.
+	TTLExceeded uint64
+	// TooBig counts packets dropped because they exceeded the MTU of the
+	// interface and could not be fragmented.
+	TooBig uint64
+	// TxErrors counts failed writes to the interface.
+	TxErrors uint64
+}
+
+// Stats holds the counters of packets that were not forwarded along a route.
+type Stats struct {
+	// Received counts all packets read from the interfaces.
+	Received uint64
+	// Local counts packets addressed to the router itself.
+	Local uint64
+	// NoRoute counts packets for which there was no route.
+	NoRoute uint64
+	// Dropped counts malformed packets, packets to multicast, link-local or
+	// loopback destinations and packets from link-local sources, which are
+	// never forwarded.
+	Dropped uint64
+}
+
+type routeStats struct {
+	packets     atomic.Uint64
+	bytes       atomic.Uint64
+	fragmented  atomic.Uint64
+	ttlExceeded atomic.Uint64
+	tooBig      atomic.Uint64
+	txErrors    atomic.Uint64
+}
+
+type route struct {
+	prefix netip.Prefix
+	out    *iface
+	stats  routeStats
+}
+
+type iface struct {
+	id      InterfaceID
+	ifce    *water.Interface
+	addrs   []netip.Addr
+	mtu     int
+	wmu     sync.Mutex
+	removed atomic.Bool
+}
+
+// Router forwards packets between TUN interfaces. Packets are routed to the
+// interface of the longest matching route, with their TTL or hop limit
+// decremented. ICMP errors are sent back through the interface a packet was
+// received on.
+type Router struct {
+	packetSize int
+	errHandler func(id InterfaceID, err error)
+
+	mu     sync.RWMutex
+	ifaces map[InterfaceID]*iface
+	local  map[netip.Addr]struct{}
+	nextID InterfaceID
+	closed bool
+
+	routes lpm.Table[*route]
+
+	received atomic.Uint64
+	localPkt atomic.Uint64
+	noRoute  atomic.Uint64
+	dropped  atomic.Uint64
+
+	wg sync.WaitGroup
+}
+
+// New creates a Router with no interfaces and an empty routing table.
+func New(config Config) *Router {
+	if config.PacketSize <= 0 {
+		config.PacketSize = DefaultPacketSize
+	}
+	return &Router{
+		packetSize: config.PacketSize,
+		errHandler: config.InterfaceErrorHandler,
+		ifaces:     make(map[InterfaceID]*iface),
+		local:      make(map[netip.Addr]struct{}),
+	}
+}
+
+// AddInterface attaches a TUN interface to the router and starts forwarding
+// packets read from it.
+func (r *Router) AddInterface(ifce *water.Interface, config InterfaceConfig) (InterfaceID, error) {
+	if !ifce.IsTUN() {
+		return 0, ErrNotTUN
+	}
+	if config.MTU <= 0 {
+		mtu, err := ifce.MTU()
+		if err != nil || mtu <= 0 {
+			mtu = DefaultMTU
+		}
+		config.MTU = mtu
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return 0, ErrClosed
+	}
+	r.nextID++
+	in := &iface{
+		id:    r.nextID,
+		ifce:  ifce,
+		addrs: slices.Clone(config.Addrs),
+		mtu:   config.MTU,
+	}
+	r.ifaces[in.id] = in
+	r.updateLocal()
+
+	r.wg.Add(1)
+	go r.run(in)
+	return in.id, nil
+}
+
+// RemoveInterface detaches an interface from the router, removes all routes
+// through it and closes it.
+func (r *Router) RemoveInterface(id InterfaceID) error {
+	r.mu.Lock()
+	in, ok := r.ifaces[id]
+	if ok {
+		r.detach(in)
+	}
+	r.mu.Unlock()
+
+	if !ok {
+		return ErrUnknownInterface
+	}
+	return in.ifce.Close()
+}
+
+// detach removes in and its routes. r.mu must be held.
+func (r *Router) detach(in *iface) {
+	in.removed.Store(true)
+	delete(r.ifaces, in.id)
+	r.updateLocal()
+	for prefix, rt := range r.routes.All() {
+		if rt.out == in {
+			r.routes.Delete(prefix)
+		}
+	}
+}
+
+// updateLocal rebuilds the set of local addresses. r.mu must be held.
+func (r *Router) updateLocal() {
+	clear(r.local)
+	for _, in := range r.ifaces {
+		for _, addr := range in.addrs {
+			r.local[addr.Unmap()] = struct{}{}
+		}
+	}
+}
+
+// Interfaces returns the IDs of all attached interfaces in ascending order.
+func (r *Router) Interfaces() []InterfaceID {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ids := make([]InterfaceID, 0, len(r.ifaces))
+	for id := range r.ifaces {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// AddRoute routes packets to prefix through an interface. An existing route
+// for prefix is replaced and its counters are reset.
+func (r *Router) AddRoute(prefix netip.Prefix, id InterfaceID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	out, ok := r.ifaces[id]
+	if !ok {
+		return ErrUnknownInterface
+	}
+	prefix = prefix.Masked()
+	return r.routes.Insert(prefix, &route{prefix: prefix, out: out})
+}
+
+// RemoveRoute removes the route for prefix.
+func (r *Router) RemoveRoute(prefix netip.Prefix) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.routes.Delete(prefix.Masked()) {
+		return ErrUnknownRoute
+	}
+	return nil
+}
+
+// Routes returns a snapshot of the routing table and its counters, ordered by
+// prefix with IPv4 routes first.
+func (r *Router) Routes() []Route {
+	var routes []Route
+	for _, rt := range r.routes.All() {
+		routes = append(routes, rt.snapshot())
+	}
+	return routes
+}
+
+// RouteStats returns a snapshot of the counters of the route for prefix.
+func (r *Router) RouteStats(prefix netip.Prefix) (RouteStats, error) {
+	rt, ok := r.routes.Get(prefix.Masked())
+	if !ok {
+		return RouteStats{}, ErrUnknownRoute
+	}
+	return rt.snapshot().Stats, nil
+}
+
+func (rt *route) snapshot() Route {
+	return Route{
+		Prefix:    rt.prefix,
+		Interface: rt.out.id,
+		Stats: RouteStats{
+			Packets:     rt.stats.packets.Load(),
+			Bytes:       rt.stats.bytes.Load(),
+			Fragmented:  rt.stats.fragmented.Load(),
+			TTLExceeded: rt.stats.ttlExceeded.Load(),
+			TooBig:      rt.stats.tooBig.Load(),
+			TxErrors:    rt.stats.txErrors.Load(),
+		},
+	}
+}
+
+// Stats returns a snapshot of the counters of the router.
+func (r *Router) Stats() Stats {
+	return Stats{
+		Received: r.received.Load(),
+		Local:    r.localPkt.Load(),
+		NoRoute:  r.noRoute.Load(),
+		Dropped:  r.dropped.Load(),
+	}
+}
+
+// Close detaches and closes all interfaces and waits for their read loops to
+// stop.
+func (r *Router) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return ErrClosed
+	}
+	r.closed = true
+	ifaces := make([]*iface, 0, len(r.ifaces))
+	for _, in := range r.ifaces {
+		ifaces = append(ifaces, in)
+		r.detach(in)
+	}
+	r.mu.Unlock()
+
+	var err error
+	for _, in := range ifaces {
+		if newErr := in.ifce.Close(); err == nil {
+			err = newErr
+		}
+	}
+	r.wg.Wait()
+	return err
+}
+
+func (r *Router) run(in *iface) {
+	defer r.wg.Done()
+
+	buf := make([]byte, r.packetSize)
+	for {
+		n, err := in.ifce.Read(buf)
+		if in.removed.Load() {
+			return
+		}
+		if err != nil {
+			r.mu.Lock()
+			_, ok := r.ifaces[in.id]
+			if ok {
+				r.detach(in)
+			}
+			r.mu.Unlock()
+			if ok && r.errHandler != nil {
+				r.errHandler(in.id, err)
+			}
+			return
+		}
+		r.forward(in, buf[:n])
+	}
+}
+
+func (r *Router) forward(in *iface, packet []byte) {
+	r.received.Add(1)
+
+	if waterutil.ValidateIP(packet) != nil {
+		r.dropped.Add(1)
+		return
+	}
+	is4 := waterutil.IPVersion(packet) == 4
+	if is4 {
+		packet = packet[:waterutil.IPv4TotalLength(packet)]
+	} else {
+		packet = packet[:40+int(waterutil.IPv6PayloadLength(packet))]
+	}
+	dst, _ := netip.AddrFromSlice(waterutil.IPDestination(packet))
+	dst = dst.Unmap()
+
+	r.mu.RLock()
+	_, local := r.local[dst]
+	r.mu.RUnlock()
+	if local {
+		r.localPkt.Add(1)
+		if reply, err := waterutil.BuildEchoReply(packet); err == nil {
+			in.write(reply)
+		}
+		return
+	}
+	src, _ := netip.AddrFromSlice(waterutil.IPSource(packet))
+	if dst.IsMulticast() || dst.IsLinkLocalUnicast() || dst.IsLoopback() || dst.IsUnspecified() ||
+		dst == netip.AddrFrom4([4]byte{255, 255, 255, 255}) || src.Unmap().IsLinkLocalUnicast() {
+		r.dropped.Add(1)
+		return
+	}
+
+	rt, ok := r.routes.Lookup(dst)
+	if !ok || rt.out.removed.Load() {
+		r.noRoute.Add(1)
+		r.sendError(in, packet, func(src netip.Addr) ([]byte, error) {
+			if is4 {
+				return waterutil.BuildICMPv4Error(packet, waterutil.ICMPv4DestinationUnreachable,
+					waterutil.ICMPv4NetUnreachable, 0, src)
+			}
+			return waterutil.BuildICMPv6Error(packet, waterutil.ICMPv6DestinationUnreachable,
+				waterutil.ICMPv6NoRoute, 0, src)
+		})
+		return
+	}
+
+	var ttl byte
+	if is4 {
+		ttl = waterutil.IPv4TTL(packet)
+	} else {
+		ttl = waterutil.IPv6HopLimit(packet)
+	}
+	if ttl <= 1 {
+		rt.stats.ttlExceeded.Add(1)
+		r.sendError(in, packet, func(src netip.Addr) ([]byte, error) {
+			return waterutil.BuildTimeExceeded(packet, src)
+		})
+		return
+	}
+
+	out := rt.out
+	if len(packet) > out.mtu && (!is4 || waterutil.IPv4DontFragment(packet)) {
+		rt.stats.tooBig.Add(1)
+		r.sendError(in, packet, func(src netip.Addr) ([]byte, error) {
+			if is4 {
+				return waterutil.BuildFragmentationNeeded(packet, uint16(min(out.mtu, 65535)), src) // #nosec G115 -- clamped to 65535
+			}
+			return waterutil.BuildPacketTooBig(packet, uint32(out.mtu), src) // #nosec G115 -- MTU is positive
+		})
+		return
+	}
+
+	if is4 {
+		waterutil.SetIPv4TTLWithChecksum(packet, ttl-1)
+	} else {
+		waterutil.SetIPv6HopLimit(packet, ttl-1)
+	}
+
+	frags := [][]byte{packet}
+	if len(packet) > out.mtu {
+		var err error
+		if frags, err = ipfrag.Fragment(packet, out.mtu); err != nil {
+			rt.stats.tooBig.Add(1)
+			return
+		}
+		rt.stats.fragmented.Add(1)
+	}
+	for _, frag := range frags {
+		if !out.write(frag) {
+			rt.stats.txErrors.Add(1)
+			return
+		}
+	}
+	rt.stats.packets.Add(1)
+	rt.stats.bytes.Add(uint64(len(packet)))
+}
+
+// sendError sends the ICMP error returned by build back through in, using
+// the first address of in matching the family of packet as the source.
+func (r *Router) sendError(in *iface, packet []byte, build func(src netip.Addr) ([]byte, error)) {
+	is4 := waterutil.IPVersion(packet) == 4
+	for _, addr := range in.addrs {
+		addr = addr.Unmap()
+		if addr.Is4() != is4 {
+			continue
+		}
+		if reply, err := build(addr); err == nil {
+			in.write(reply)
+		}
+		return
+	}
+}
+
+func (in *iface) write(packet []byte) bool {
+	in.wmu.Lock()
+	defer in.wmu.Unlock()
+	_, err := in.ifce.Write(packet)
+	return err == nil
+}
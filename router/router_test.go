@@ -0,0 +1,327 @@
+package router
+
+import (
+	"io"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/Doridian/water"
+	"github.com/Doridian/water/internal/fakedev"
+	"github.com/Doridian/water/waterutil"
+)
+
+// mtuDevice is a fake device reporting an MTU.
+type mtuDevice struct {
+	*fakedev.Device
+	mtu int
+}
+
+func (d mtuDevice) MTU() (int, error) {
+	return d.mtu, nil
+}
+
+func newDevice(t *testing.T, mtu int) (*fakedev.Device, *water.Interface) {
+	t.Helper()
+	d := fakedev.New()
+	var rwc io.ReadWriteCloser = d
+	if mtu != 0 {
+		rwc = mtuDevice{Device: d, mtu: mtu}
+	}
+	ifce, err := water.NewFromReadWriteCloser(rwc, water.TUN, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d, ifce
+}
+
+var (
+	addrA4  = netip.MustParseAddr("10.0.1.1")
+	addrA6  = netip.MustParseAddr("fd01::1")
+	hostA4  = netip.MustParseAddr("10.0.1.2")
+	hostA6  = netip.MustParseAddr("fd01::2")
+	hostB4  = netip.MustParseAddr("10.0.2.2")
+	hostB6  = netip.MustParseAddr("fd02::2")
+	prefixA = netip.MustParsePrefix("10.0.1.0/24")
+	prefixB = netip.MustParsePrefix("10.0.2.0/24")
+)
+
+// setup returns a router joining interface A, with addresses, and interface
+// B with an MTU of 1280, each with a route for its IPv4 and IPv6 prefix.
+func setup(t *testing.T) (*Router, *fakedev.Device, *fakedev.Device) {
+	t.Helper()
+	r := New(Config{})
+	t.Cleanup(func() { _ = r.Close() })
+
+	devA, ifceA := newDevice(t, 0)
+	devB, ifceB := newDevice(t, 1280)
+	a, err := r.AddInterface(ifceA, InterfaceConfig{Addrs: []netip.Addr{addrA4, addrA6}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := r.AddInterface(ifceB, InterfaceConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, route := range []struct {
+		prefix string
+		id     InterfaceID
+	}{{"10.0.1.0/24", a}, {"fd01::/64", a}, {"10.0.2.0/24", b}, {"fd02::/64", b}} {
+		if err := r.AddRoute(netip.MustParsePrefix(route.prefix), route.id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return r, devA, devB
+}
+
+func udp(src, dst netip.Addr, ttl byte, size int) []byte {
+	var packet []byte
+	if src.Is4() {
+		packet = waterutil.AppendIPv4Header(nil, waterutil.UDP, ttl, src, dst, 8+size)
+	} else {
+		packet = waterutil.AppendIPv6Header(nil, waterutil.UDP, ttl, src, dst, 8+size)
+	}
+	packet = append(packet, 0x30, 0x39, 0, 53, byte((8+size)>>8), byte(8+size), 0, 0)
+	packet = append(packet, make([]byte, size)...)
+	if err := waterutil.FixTransportChecksum(packet); err != nil {
+		panic(err)
+	}
+	return packet
+}
+
+func checkValid(t *testing.T, packet []byte) {
+	t.Helper()
+	if err := waterutil.ValidateIP(packet); err != nil {
+		t.Fatal(err)
+	}
+	if waterutil.IPVersion(packet) == 4 && waterutil.ComputeIPv4Checksum(packet) != waterutil.IPv4Checksum(packet) {
+		t.Fatal("IPv4 header checksum is stale")
+	}
+}
+
+// expectICMP checks that packet is an ICMP message of the given type and code
+// from src, and returns its second header word.
+func expectICMP(t *testing.T, packet []byte, src netip.Addr, icmpType, code byte) uint32 {
+	t.Helper()
+	checkValid(t, packet)
+	if got, _ := netip.AddrFromSlice(waterutil.IPSource(packet)); got.Unmap() != src {
+		t.Fatalf("ICMP source is %v, want %v", got, src)
+	}
+	if got := waterutil.ICMPType(packet); got != icmpType {
+		t.Fatalf("ICMP type is %d, want %d", got, icmpType)
+	}
+	if got := waterutil.ICMPCode(packet); got != code {
+		t.Fatalf("ICMP code is %d, want %d", got, code)
+	}
+	icmp := waterutil.IPPayload(packet)
+	return uint32(icmp[4])<<24 | uint32(icmp[5])<<16 | uint32(icmp[6])<<8 | uint32(icmp[7])
+}
+
+func TestForward(t *testing.T) {
+	r, devA, devB := setup(t)
+
+	for _, addrs := range [][2]netip.Addr{{hostA4, hostB4}, {hostA6, hostB6}} {
+		packet := udp(addrs[0], addrs[1], 64, 100)
+		devA.In <- packet
+		got := devB.Expect(t)
+		checkValid(t, got)
+		var hops byte
+		if addrs[0].Is4() {
+			hops = waterutil.IPv4TTL(got)
+		} else {
+			hops = waterutil.IPv6HopLimit(got)
+		}
+		if hops != 63 {
+			t.Errorf("TTL is %d, want 63", hops)
+		}
+		if want, _ := waterutil.ComputeTransportChecksum(got); waterutil.UDPChecksum(got) != want {
+			t.Error("UDP checksum is stale")
+		}
+	}
+
+	stats, err := r.RouteStats(netip.MustParsePrefix("10.0.2.0/24"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Packets != 1 || stats.Bytes != 128 {
+		t.Errorf("route stats = %+v", stats)
+	}
+	if r.Stats().Received != 2 {
+		t.Errorf("stats = %+v", r.Stats())
+	}
+}
+
+func TestTTLExceeded(t *testing.T) {
+	r, devA, devB := setup(t)
+
+	devA.In <- udp(hostA4, hostB4, 1, 10)
+	expectICMP(t, devA.Expect(t), addrA4, waterutil.ICMPv4TimeExceeded, 0)
+	devA.In <- udp(hostA6, hostB6, 1, 10)
+	expectICMP(t, devA.Expect(t), addrA6, waterutil.ICMPv6TimeExceeded, 0)
+	devB.ExpectNothing(t)
+
+	// Without an address on the ingress interface no error is sent.
+	devB.In <- udp(hostB4, hostA4, 1, 10)
+	devB.ExpectNothing(t)
+
+	if stats, _ := r.RouteStats(prefixB); stats.TTLExceeded != 1 || stats.Packets != 0 {
+		t.Errorf("route stats = %+v", stats)
+	}
+	if stats, _ := r.RouteStats(prefixA); stats.TTLExceeded != 1 {
+		t.Errorf("route stats = %+v", stats)
+	}
+}
+
+func TestNoRoute(t *testing.T) {
+	r, devA, devB := setup(t)
+
+	devA.In <- udp(hostA4, netip.MustParseAddr("192.0.2.1"), 64, 10)
+	expectICMP(t, devA.Expect(t), addrA4, waterutil.ICMPv4DestinationUnreachable, waterutil.ICMPv4NetUnreachable)
+	devA.In <- udp(hostA6, netip.MustParseAddr("2001:db8::1"), 64, 10)
+	expectICMP(t, devA.Expect(t), addrA6, waterutil.ICMPv6DestinationUnreachable, waterutil.ICMPv6NoRoute)
+
+	// Multicast, link-local and loopback destinations and link-local sources
+	// are dropped silently.
+	devA.In <- udp(hostA4, netip.MustParseAddr("224.0.0.1"), 64, 10)
+	devA.In <- udp(hostA6, netip.MustParseAddr("fe80::1"), 64, 10)
+	devA.In <- udp(hostA4, netip.MustParseAddr("127.0.0.1"), 64, 10)
+	devA.In <- udp(hostA6, netip.IPv6Loopback(), 64, 10)
+	devA.In <- udp(netip.MustParseAddr("169.254.1.1"), hostB4, 64, 10)
+	devA.In <- udp(netip.MustParseAddr("fe80::2"), hostB6, 64, 10)
+	devA.In <- []byte{0x45, 0}
+	devA.ExpectNothing(t)
+	devB.ExpectNothing(t)
+
+	if stats := r.Stats(); stats.NoRoute != 2 || stats.Dropped != 7 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestMTU(t *testing.T) {
+	r, devA, devB := setup(t)
+
+	// IPv4 with Don't Fragment.
+	packet := udp(hostA4, hostB4, 64, 1400)
+	packet[6] |= 0x40
+	waterutil.FixIPv4Checksum(packet)
+	devA.In <- packet
+	if mtu := expectICMP(t, devA.Expect(t), addrA4, waterutil.ICMPv4DestinationUnreachable,
+		waterutil.ICMPv4FragmentationNeeded); mtu != 1280 {
+		t.Errorf("advertised MTU is %d", mtu)
+	}
+
+	// IPv6.
+	devA.In <- udp(hostA6, hostB6, 64, 1400)
+	if mtu := expectICMP(t, devA.Expect(t), addrA6, waterutil.ICMPv6PacketTooBig, 0); mtu != 1280 {
+		t.Errorf("advertised MTU is %d", mtu)
+	}
+	devB.ExpectNothing(t)
+
+	// IPv4 without Don't Fragment is fragmented.
+	packet = udp(hostA4, hostB4, 64, 1400)
+	devA.In <- packet
+	for _, more := range []bool{true, false} {
+		frag := devB.Expect(t)
+		checkValid(t, frag)
+		if len(frag) > 1280 || waterutil.IPv4MoreFragments(frag) != more || waterutil.IPv4TTL(frag) != 63 {
+			t.Fatalf("unexpected fragment % x", frag[:20])
+		}
+	}
+
+	stats, _ := r.RouteStats(prefixB)
+	if stats.TooBig != 1 || stats.Fragmented != 1 || stats.Packets != 1 || stats.Bytes != uint64(len(packet)) {
+		t.Errorf("route stats = %+v", stats)
+	}
+}
+
+func TestLocal(t *testing.T) {
+	r, devA, devB := setup(t)
+
+	devB.In <- waterutil.BuildEchoRequest(hostB4, addrA4, 1, 2, []byte("ping"))
+	reply := devB.Expect(t)
+	if waterutil.ICMPType(reply) != waterutil.ICMPv4EchoReply || waterutil.ICMPIdentifier(reply) != 1 {
+		t.Fatalf("unexpected reply % x", reply)
+	}
+	devB.In <- udp(hostB6, addrA6, 64, 10)
+	devA.ExpectNothing(t)
+	devB.ExpectNothing(t)
+
+	if r.Stats().Local != 2 {
+		t.Errorf("stats = %+v", r.Stats())
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	r, devA, devB := setup(t)
+	ids := r.Interfaces()
+	if len(ids) != 2 {
+		t.Fatalf("interfaces = %v", ids)
+	}
+
+	// A more specific route wins.
+	host := netip.PrefixFrom(hostB4, 32)
+	if err := r.AddRoute(host, ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	devA.In <- udp(hostA4, hostB4, 64, 10)
+	devA.Expect(t)
+	if err := r.RemoveRoute(host); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.RemoveRoute(host); err != ErrUnknownRoute {
+		t.Errorf("RemoveRoute = %v", err)
+	}
+	devA.In <- udp(hostA4, hostB4, 64, 10)
+	devB.Expect(t)
+
+	if err := r.AddRoute(host, 42); err != ErrUnknownInterface {
+		t.Errorf("AddRoute = %v", err)
+	}
+
+	// Removing an interface removes its routes.
+	if err := r.RemoveInterface(ids[1]); err != nil {
+		t.Fatal(err)
+	}
+	routes := r.Routes()
+	if len(routes) != 2 || routes[0].Prefix != prefixA || routes[0].Interface != ids[0] {
+		t.Fatalf("routes = %+v", routes)
+	}
+	devA.In <- udp(hostA4, hostB4, 64, 10)
+	expectICMP(t, devA.Expect(t), addrA4, waterutil.ICMPv4DestinationUnreachable, waterutil.ICMPv4NetUnreachable)
+}
+
+func TestInterfaceError(t *testing.T) {
+	failed := make(chan InterfaceID, 1)
+	r := New(Config{InterfaceErrorHandler: func(id InterfaceID, err error) { failed <- id }})
+	defer r.Close()
+
+	dev, ifce := newDevice(t, 0)
+	id, err := r.AddInterface(ifce, InterfaceConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = dev.Close()
+	select {
+	case got := <-failed:
+		if got != id {
+			t.Errorf("failed interface %d, want %d", got, id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("error handler not called")
+	}
+	if len(r.Interfaces()) != 0 {
+		t.Error("interface not removed")
+	}
+
+	_, tap := newDevice(t, 0)
+	tap, _ = water.NewFromReadWriteCloser(tap.ReadWriteCloser, water.TAP, "tap")
+	if _, err := r.AddInterface(tap, InterfaceConfig{}); err != ErrNotTUN {
+		t.Errorf("AddInterface = %v", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.AddInterface(ifce, InterfaceConfig{}); err != ErrClosed {
+		t.Errorf("AddInterface after Close = %v", err)
+	}
+}
@@ -288,59 +288,6 @@ func openTap(config Config) (ifce *Interface, err error) {
 	return nil, errIfceNameNotFound
 }
 
-type wintunRWC struct {
-	ad  wintun.Device
-	rmu sync.Mutex
-	wmu sync.Mutex
-}
-
-func (w *wintunRWC) Close() error {
-	return w.ad.Close()
-}
-
-func (w *wintunRWC) ReadVector(bufs [][]byte, sizes []int) (int, error) {
-	w.rmu.Lock()
-	defer w.rmu.Unlock()
-
-	return w.ad.Read(bufs, sizes, 0)
-}
-
-func (w *wintunRWC) WriteVector(bufs [][]byte) (int, error) {
-	w.wmu.Lock()
-	defer w.wmu.Unlock()
-
-	return w.ad.Write(bufs, 0)
-}
-
-func (w *wintunRWC) Read(b []byte) (int, error) {
-	lens := []int{0}
-	res, err := w.ad.Read([][]byte{b}, lens, 0)
-	if err != nil {
-		return 0, err
-	}
-
-	if res <= 0 {
-		return res, nil
-	}
-	return lens[0], nil
-}
-
-func (w *wintunRWC) Write(b []byte) (int, error) {
-	res, err := w.WriteVector([][]byte{b})
-	if err != nil {
-		return 0, err
-	}
-
-	if res <= 0 {
-		return res, nil
-	}
-	return len(b), nil
-}
-
-func (w *wintunRWC) IsVectorNative() bool {
-	return true
-}
-
 // openDev find and open an interface.
 func openDev(config Config) (ifce *Interface, err error) {
 	// TAP
@@ -367,8 +314,8 @@ func openDev(config Config) (ifce *Interface, err error) {
 		return
 	}
 
-	wt := &wintunRWC{ad: ad}
-	return &Interface{VectorReadWrite: wt, ReadWriteCloser: wt, name: name}, nil
+	// wintun copies packets into its ring and needs no headroom.
+	return NewFromReadWriteCloser(newTUNDeviceRWC(ad, true), TUN, name)
 }
 
 func (ifce *Interface) SetMTU(mtu int) error {
@@ -377,12 +324,12 @@ func (ifce *Interface) SetMTU(mtu int) error {
 		return err
 	}
 
-	wtun, ok := ifce.ReadWriteCloser.(*wintunRWC)
+	wtun, ok := ifce.ReadWriteCloser.(*tunDeviceRWC)
 	if !ok {
 		return nil // TAP interface
 	}
 
-	ad, ok := wtun.ad.(*wintun.NativeTun)
+	ad, ok := wtun.dev.(*wintun.NativeTun)
 	if !ok {
 		return errors.New("cannot cast ad to NativeTun")
 	}
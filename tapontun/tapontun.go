@@ -0,0 +1,431 @@
+// Package tapontun emulates a TAP interface on top of a TUN interface.
+//
+// This is useful for L2 code on hosts that only provide TUN devices, such as
+// utun on macOS or wintun on Windows. The kernel behind the TUN interface is
+// presented as a single Ethernet host with a synthetic MAC address that
+// answers every ARP request and Neighbor Solicitation, i.e. it acts as a proxy
+// for all addresses reachable through the TUN interface. Frames that do not
+// carry IP are dropped and counted.
+//
+// The package does not depend on any platform-specific code.
+package tapontun
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Doridian/water"
+	"github.com/Doridian/water/waterutil"
+)
+
+const (
+	ethHeaderLen = 14
+	// localQueueLen is the number of locally generated frames, such as ARP
+	// replies, that may wait for Read.
+	localQueueLen = 16
+	// DefaultMTU is the MTU used when Config.MTU is zero.
+	DefaultMTU = 1500
+)
+
+// Config defines parameters of the emulated TAP interface. A zero-value Config
+// is valid.
+type Config struct {
+	// HostMAC is the MAC address of the host emulated behind the TUN
+	// interface. It defaults to a random locally administered unicast address.
+	HostMAC net.HardwareAddr
+
+	// PeerMAC is the MAC address frames from the TUN interface are sent to.
+	// If nil, it is learned from frames written to the TAP interface. Until it
+	// is known, unicast packets are sent to the broadcast address.
+	PeerMAC net.HardwareAddr
+
+	// MTU is the largest packet read from the TUN interface. It defaults to
+	// DefaultMTU.
+	MTU int
+}
+
+// Stats holds the counters of an Adapter.
+type Stats struct {
+	// ARPReplies and NDPReplies count locally answered ARP requests and
+	// Neighbor Solicitations.
+	ARPReplies uint64
+	NDPReplies uint64
+	// DroppedNonIP counts frames dropped because they carry neither IPv4,
+	// IPv6 nor ARP.
+	DroppedNonIP uint64
+	// DroppedNotForHost counts unicast frames not addressed to HostMAC.
+	DroppedNotForHost uint64
+	// DroppedMalformed counts frames too short or otherwise malformed.
+	DroppedMalformed uint64
+	// DroppedLocal counts ARP and NDP messages that were consumed without a
+	// reply, and replies dropped because Read was not called fast enough.
+	DroppedLocal uint64
+}
+
+// Adapter is a TAP interface backed by a TUN interface.
+type Adapter struct {
+	tun    *water.Interface
+	ifce   *water.Interface
+	mac    net.HardwareAddr
+	mtu    int
+	static bool
+
+	peerMu  sync.RWMutex
+	peerMAC net.HardwareAddr
+
+	frames chan *[]byte
+	local  chan []byte
+	pool   sync.Pool
+	err    error
+
+	closeOnce sync.Once
+	done      chan struct{}
+
+	wMu sync.Mutex
+
+	arpReplies        atomic.Uint64
+	ndpReplies        atomic.Uint64
+	droppedNonIP      atomic.Uint64
+	droppedNotForHost atomic.Uint64
+	droppedMalformed  atomic.Uint64
+	droppedLocal      atomic.Uint64
+}
+
+var _ io.ReadWriteCloser = (*Adapter)(nil)
+
+// New wraps a TUN interface and returns a TAP interface. Closing the returned
+// interface closes tun.
+func New(tun *water.Interface, config Config) (*water.Interface, error) {
+	a, err := NewAdapter(tun, config)
+	if err != nil {
+		return nil, err
+	}
+	return a.Interface(), nil
+}
+
+// NewAdapter is like New, but returns the Adapter, which gives access to its
+// counters.
+func NewAdapter(tun *water.Interface, config Config) (*Adapter, error) {
+	if !tun.IsTUN() {
+		return nil, errors.New("interface is not a TUN interface")
+	}
+
+	mac := config.HostMAC
+	if mac == nil {
+		mac = make(net.HardwareAddr, 6)
+		if _, err := rand.Read(mac); err != nil {
+			return nil, err
+		}
+		mac[0] = (mac[0] &^ 0x01) | 0x02
+	} else if len(mac) != 6 {
+		return nil, errors.New("HostMAC must be 6 bytes long")
+	}
+	if config.MTU <= 0 {
+		config.MTU = DefaultMTU
+	}
+
+	a := &Adapter{
+		tun:    tun,
+		mac:    mac,
+		mtu:    config.MTU,
+		frames: make(chan *[]byte),
+		local:  make(chan []byte, localQueueLen),
+		done:   make(chan struct{}),
+	}
+	a.pool.New = func() any {
+		buf := make([]byte, ethHeaderLen+a.mtu)
+		return &buf
+	}
+	if config.PeerMAC != nil {
+		if len(config.PeerMAC) != 6 {
+			return nil, errors.New("PeerMAC must be 6 bytes long")
+		}
+		a.peerMAC = config.PeerMAC
+		a.static = true
+	}
+
+	ifce, err := water.NewFromReadWriteCloser(a, water.TAP, tun.Name())
+	if err != nil {
+		return nil, err
+	}
+	a.ifce = ifce
+
+	go a.readTUN()
+	return a, nil
+}
+
+// Interface returns the TAP interface backed by the adapter.
+func (a *Adapter) Interface() *water.Interface {
+	return a.ifce
+}
+
+// Stats returns a snapshot of the adapter's counters.
+func (a *Adapter) Stats() Stats {
+	return Stats{
+		ARPReplies:        a.arpReplies.Load(),
+		NDPReplies:        a.ndpReplies.Load(),
+		DroppedNonIP:      a.droppedNonIP.Load(),
+		DroppedNotForHost: a.droppedNotForHost.Load(),
+		DroppedMalformed:  a.droppedMalformed.Load(),
+		DroppedLocal:      a.droppedLocal.Load(),
+	}
+}
+
+func (a *Adapter) readTUN() {
+	defer close(a.frames)
+	for {
+		bufp := a.pool.Get().(*[]byte)
+		buf := *bufp
+		n, err := a.tun.Read(buf[ethHeaderLen:])
+		if err != nil {
+			a.err = err
+			a.pool.Put(bufp)
+			return
+		}
+		if n == 0 {
+			a.pool.Put(bufp)
+			continue
+		}
+		frame := buf[:ethHeaderLen+n]
+		packet := frame[ethHeaderLen:]
+
+		var ethertype waterutil.Ethertype
+		switch waterutil.IPVersion(packet) {
+		case 4:
+			ethertype = waterutil.IPv4
+		case 6:
+			ethertype = waterutil.IPv6
+		default:
+			a.pool.Put(bufp)
+			continue
+		}
+		copy(frame[0:6], a.destinationFor(packet))
+		copy(frame[6:12], a.mac)
+		copy(frame[12:14], ethertype[:])
+
+		// The frame is passed in the pooled slice, which Read restores to the
+		// full buffer before returning it to the pool.
+		*bufp = frame
+		select {
+		case a.frames <- bufp:
+		case <-a.done:
+			return
+		}
+	}
+}
+
+// destinationFor maps the destination of an IP packet to a MAC address.
+func (a *Adapter) destinationFor(packet []byte) net.HardwareAddr {
+	switch waterutil.IPVersion(packet) {
+	case 4:
+		if len(packet) < 20 {
+			break
+		}
+		dst := waterutil.IPv4Destination(packet)
+		if dst[0]&0xf0 == 0xe0 {
+			return net.HardwareAddr{0x01, 0x00, 0x5e, dst[1] & 0x7f, dst[2], dst[3]}
+		}
+		if dst.Equal(net.IPv4bcast) {
+			return waterutil.BroadcastMAC
+		}
+	case 6:
+		if len(packet) < 40 {
+			break
+		}
+		dst := waterutil.IPv6Destination(packet)
+		if dst[0] == 0xff {
+			return net.HardwareAddr{0x33, 0x33, dst[12], dst[13], dst[14], dst[15]}
+		}
+	}
+	if peer := a.peer(); peer != nil {
+		return peer
+	}
+	return waterutil.BroadcastMAC
+}
+
+// Read returns the next frame, either a packet from the TUN interface with a
+// synthesized Ethernet header or a locally generated ARP or NDP reply.
+func (a *Adapter) Read(to []byte) (int, error) {
+	select {
+	case frame := <-a.local:
+		return copy(to, frame), nil
+	default:
+	}
+
+	select {
+	case frame := <-a.local:
+		return copy(to, frame), nil
+	case framep, ok := <-a.frames:
+		if !ok {
+			if a.err != nil {
+				return 0, a.err
+			}
+			return 0, io.EOF
+		}
+		n := copy(to, *framep)
+		*framep = (*framep)[:cap(*framep)]
+		a.pool.Put(framep)
+		return n, nil
+	}
+}
+
+// Write consumes a single Ethernet frame. IP packets addressed to HostMAC, or
+// to a broadcast or multicast address, are written to the TUN interface.
+// Write reports the whole frame as written even if it was dropped or answered
+// locally, as a network card would.
+func (a *Adapter) Write(frame []byte) (int, error) {
+	if waterutil.ValidateMACFrame(frame) != nil {
+		a.droppedMalformed.Add(1)
+		return len(frame), nil
+	}
+
+	dst := waterutil.MACDestination(frame)
+	src := waterutil.MACSource(frame)
+	if waterutil.IsMACUnicast(dst) && !macEqual(dst, a.mac) {
+		a.droppedNotForHost.Add(1)
+		return len(frame), nil
+	}
+	if waterutil.IsMACUnicast(src) {
+		a.learn(src)
+	}
+
+	payload := waterutil.MACPayload(frame)
+	switch waterutil.MACEthertype(frame) {
+	case waterutil.ARP:
+		a.handleARP(payload)
+		return len(frame), nil
+	case waterutil.IPv4:
+		if waterutil.ValidateIPv4(payload) != nil {
+			a.droppedMalformed.Add(1)
+			return len(frame), nil
+		}
+		// Drop Ethernet padding.
+		payload = payload[:waterutil.IPv4TotalLength(payload)]
+	case waterutil.IPv6:
+		if waterutil.ValidateIPv6(payload) != nil {
+			a.droppedMalformed.Add(1)
+			return len(frame), nil
+		}
+		// Drop Ethernet padding.
+		payload = payload[:40+int(waterutil.IPv6PayloadLength(payload))]
+		if a.handleNDP(src, payload) {
+			return len(frame), nil
+		}
+	default:
+		a.droppedNonIP.Add(1)
+		return len(frame), nil
+	}
+
+	a.wMu.Lock()
+	defer a.wMu.Unlock()
+	if _, err := a.tun.Write(payload); err != nil {
+		return 0, err
+	}
+	return len(frame), nil
+}
+
+// Close closes the TUN interface.
+func (a *Adapter) Close() error {
+	a.closeOnce.Do(func() {
+		close(a.done)
+	})
+	return a.tun.Close()
+}
+
+func (a *Adapter) learn(mac net.HardwareAddr) {
+	if a.static {
+		return
+	}
+	a.peerMu.RLock()
+	known := macEqual(a.peerMAC, mac)
+	a.peerMu.RUnlock()
+	if known {
+		return
+	}
+
+	a.peerMu.Lock()
+	a.peerMAC = append(a.peerMAC[:0], mac...)
+	a.peerMu.Unlock()
+}
+
+func (a *Adapter) peer() net.HardwareAddr {
+	a.peerMu.RLock()
+	defer a.peerMu.RUnlock()
+	if a.peerMAC == nil {
+		return nil
+	}
+	return append(net.HardwareAddr(nil), a.peerMAC...)
+}
+
+func (a *Adapter) queueLocal(frame []byte) bool {
+	select {
+	case a.local <- frame:
+		return true
+	default:
+		a.droppedLocal.Add(1)
+		return false
+	}
+}
+
+// handleARP answers every ARP request except gratuitous ones and duplicate
+// address detection probes.
+func (a *Adapter) handleARP(payload []byte) {
+	arp, err := waterutil.NewARPPacket(payload)
+	if err != nil {
+		a.droppedMalformed.Add(1)
+		return
+	}
+	if arp.Operation() != waterutil.ARPRequest || !answersFor(arp.SenderIP(), arp.TargetIP()) {
+		a.droppedLocal.Add(1)
+		return
+	}
+	if a.queueLocal(waterutil.BuildARPReply(arp, a.mac)) {
+		a.arpReplies.Add(1)
+	}
+}
+
+// handleNDP answers Neighbor Solicitations and consumes all other Neighbor
+// Discovery messages, which only make sense on the local link. It reports
+// whether the packet was consumed.
+func (a *Adapter) handleNDP(src net.HardwareAddr, packet []byte) bool {
+	if waterutil.IPv6Protocol(packet) != waterutil.IPv6_ICMP {
+		return false
+	}
+	icmp := waterutil.IPv6Payload(packet)
+	if len(icmp) < 1 || icmp[0] < waterutil.NDPRouterSolicitation || icmp[0] > waterutil.NDPRedirect {
+		return false
+	}
+	ns, err := waterutil.ParseNDP(packet)
+	if err != nil || ns.Type() != waterutil.NDPNeighborSolicitation {
+		a.droppedLocal.Add(1)
+		return true
+	}
+
+	senderIP := netip.AddrFrom16([16]byte(waterutil.IPv6Source(packet)))
+	targetIP := ns.TargetAddress()
+	if !answersFor(senderIP, targetIP) {
+		a.droppedLocal.Add(1)
+		return true
+	}
+
+	reply := waterutil.BuildNeighborAdvertisementFrame(src, senderIP, ns, a.mac, waterutil.NDPFlagRouter)
+	if a.queueLocal(reply) {
+		a.ndpReplies.Add(1)
+	}
+	return true
+}
+
+// answersFor never answers duplicate address detection or gratuitous
+// requests, as the requester would consider its own address to be in use.
+func answersFor(sender, target netip.Addr) bool {
+	return !sender.IsUnspecified() && sender != target
+}
+
+func macEqual(a, b net.HardwareAddr) bool {
+	return len(a) == len(b) && string(a) == string(b)
+}
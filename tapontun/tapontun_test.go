@@ -0,0 +1,149 @@
+package tapontun
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/Doridian/water"
+	"github.com/Doridian/water/internal/fakedev"
+	"github.com/Doridian/water/waterutil"
+)
+
+var (
+	hostMAC = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}
+	appMAC  = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02}
+)
+
+func setup(t *testing.T) (*Adapter, *fakedev.Device) {
+	f := fakedev.New()
+	tun, err := water.NewFromReadWriteCloser(f, water.TUN, "tun0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewAdapter(tun, Config{HostMAC: hostMAC})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.Interface().IsTAP() {
+		t.Fatal("expected a TAP interface")
+	}
+	return a, f
+}
+
+func readFrame(t *testing.T, ifce *water.Interface) []byte {
+	t.Helper()
+	ch := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, 1600)
+		n, _ := ifce.Read(buf)
+		ch <- buf[:n]
+	}()
+	select {
+	case frame := <-ch:
+		return frame
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for frame")
+		return nil
+	}
+}
+
+var ipv4Packet = []byte{0x45, 0, 0, 20, 0, 0, 0, 0, 64, 1, 0, 0, 10, 0, 0, 2, 10, 0, 0, 1}
+
+func TestARP(t *testing.T) {
+	a, _ := setup(t)
+	ifce := a.Interface()
+
+	req := waterutil.AppendEthernetHeader(nil, waterutil.BroadcastMAC, appMAC, waterutil.ARP)
+	req = append(req, 0, 1, 0x08, 0x00, 6, 4, 0, 1)
+	req = append(req, appMAC...)
+	req = append(req, 10, 0, 0, 2)
+	req = append(req, 0, 0, 0, 0, 0, 0)
+	req = append(req, 10, 0, 0, 1)
+	if _, err := ifce.Write(req); err != nil {
+		t.Fatal(err)
+	}
+
+	reply := readFrame(t, ifce)
+	arp := waterutil.MACPayload(reply)
+	if !bytes.Equal(waterutil.MACDestination(reply), appMAC) ||
+		binary.BigEndian.Uint16(arp[6:8]) != 2 || !bytes.Equal(arp[8:14], hostMAC) {
+		t.Fatalf("unexpected ARP reply % x", reply)
+	}
+	if a.Stats().ARPReplies != 1 {
+		t.Fatalf("unexpected stats %+v", a.Stats())
+	}
+}
+
+func TestNDP(t *testing.T) {
+	a, _ := setup(t)
+	ifce := a.Interface()
+
+	// The advertisement goes to the link-layer address the solicitation
+	// names, not to the frame's source.
+	sllaMAC := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x03}
+	src := netip.MustParseAddr("fd00::2")
+	target := netip.MustParseAddr("fd00::1")
+	dst := waterutil.SolicitedNodeMulticast(target)
+	msg := waterutil.AppendNeighborSolicitation(nil, target)
+	msg = waterutil.AppendNDPLinkLayerAddressOption(msg, waterutil.NDPOptionSourceLinkLayerAddress, sllaMAC)
+	ns := waterutil.AppendEthernetHeader(nil, waterutil.IPv6MulticastMAC(dst), appMAC, waterutil.IPv6)
+	ns = append(ns, waterutil.BuildNDPPacket(src, dst, msg)...)
+	if _, err := ifce.Write(ns); err != nil {
+		t.Fatal(err)
+	}
+
+	reply := readFrame(t, ifce)
+	packet := waterutil.MACPayload(reply)
+	na, err := waterutil.ParseNDP(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(waterutil.MACDestination(reply), sllaMAC) || !bytes.Equal(waterutil.MACSource(reply), hostMAC) ||
+		waterutil.IPv6Destination(packet).String() != src.String() || na.TargetAddress() != target ||
+		na.NeighborFlags() != waterutil.NDPFlagRouter|waterutil.NDPFlagSolicited|waterutil.NDPFlagOverride ||
+		!bytes.Equal(na.TargetLinkLayerAddress(), hostMAC) {
+		t.Fatalf("unexpected Neighbor Advertisement % x", reply)
+	}
+	if a.Stats().NDPReplies != 1 {
+		t.Fatalf("unexpected stats %+v", a.Stats())
+	}
+}
+
+func TestPackets(t *testing.T) {
+	a, f := setup(t)
+	ifce := a.Interface()
+
+	frame := append(waterutil.AppendEthernetHeader(nil, hostMAC, appMAC, waterutil.IPv4), ipv4Packet...)
+	if _, err := ifce.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+	if p := f.Expect(t); !bytes.Equal(p, ipv4Packet) {
+		t.Fatalf("unexpected packet % x", p)
+	}
+
+	f.In <- ipv4Packet
+	got := readFrame(t, ifce)
+	if !bytes.Equal(waterutil.MACDestination(got), appMAC) ||
+		!bytes.Equal(waterutil.MACSource(got), hostMAC) ||
+		!bytes.Equal(waterutil.MACPayload(got), ipv4Packet) {
+		t.Fatalf("unexpected frame % x", got)
+	}
+}
+
+func TestDrops(t *testing.T) {
+	a, _ := setup(t)
+	ifce := a.Interface()
+
+	_, _ = ifce.Write(waterutil.AppendEthernetHeader(nil, hostMAC, appMAC, waterutil.LLDP))
+	_, _ = ifce.Write(append(waterutil.AppendEthernetHeader(nil, appMAC, appMAC, waterutil.IPv4), ipv4Packet...))
+	_, _ = ifce.Write([]byte{1, 2, 3})
+
+	stats := a.Stats()
+	if stats.DroppedNonIP != 1 || stats.DroppedNotForHost != 1 || stats.DroppedMalformed != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
@@ -0,0 +1,278 @@
+// Package tunontap emulates a TUN interface on top of a TAP interface.
+//
+// This is useful on platforms and drivers that only provide L2 frames, such as
+// tap-windows or feth on macOS, for applications working with L3 packets. The
+// adapter strips and adds Ethernet headers, answers the kernel's ARP requests
+// and IPv6 Neighbor Solicitations for a configured gateway and learns the MAC
+// address of the kernel side of the TAP interface.
+package tunontap
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/Doridian/water"
+	"github.com/Doridian/water/waterutil"
+)
+
+const (
+	ethHeaderLen = 14
+	// maxFrameOverhead is the Ethernet header plus up to two VLAN tags.
+	maxFrameOverhead = ethHeaderLen + 8
+)
+
+// allNodesMAC is the Ethernet multicast address of ff02::1.
+var allNodesMAC = net.HardwareAddr{0x33, 0x33, 0x00, 0x00, 0x00, 0x01}
+
+// Config defines parameters of the emulated TUN interface. A zero-value Config
+// is valid, but without a gateway or ProxyAll no ARP or NDP requests are
+// answered.
+type Config struct {
+	// MAC is the MAC address of the emulated side. It defaults to a random
+	// locally administered unicast address.
+	MAC net.HardwareAddr
+
+	// GatewayIPv4 and GatewayIPv6 are the addresses for which ARP requests
+	// and Neighbor Solicitations are answered with MAC. Typically this is the
+	// next hop the kernel routes the TUN traffic to.
+	GatewayIPv4 netip.Addr
+	GatewayIPv6 netip.Addr
+
+	// ProxyAll answers ARP requests and Neighbor Solicitations for every
+	// address except the kernel's own ones. This allows the kernel to treat
+	// the whole subnet as on-link.
+	ProxyAll bool
+
+	// PeerMAC is the MAC address of the kernel side of the TAP interface. If
+	// nil, it is learned from received frames. Until it is known, packets are
+	// sent to the broadcast (IPv4) or all-nodes (IPv6) address.
+	PeerMAC net.HardwareAddr
+}
+
+type tunOnTAP struct {
+	tap    *water.Interface
+	mac    net.HardwareAddr
+	gw4    netip.Addr
+	gw6    netip.Addr
+	proxy  bool
+	static bool
+
+	peerMu  sync.RWMutex
+	peerMAC net.HardwareAddr
+
+	rMu  sync.Mutex
+	rBuf []byte
+
+	wMu  sync.Mutex
+	wBuf []byte
+}
+
+var _ io.ReadWriteCloser = (*tunOnTAP)(nil)
+
+// New wraps a TAP interface and returns a TUN interface. Closing the returned
+// interface closes tap.
+func New(tap *water.Interface, config Config) (*water.Interface, error) {
+	if !tap.IsTAP() {
+		return nil, errors.New("interface is not a TAP interface")
+	}
+	if config.GatewayIPv4.IsValid() && !config.GatewayIPv4.Is4() {
+		return nil, errors.New("GatewayIPv4 must be an IPv4 address")
+	}
+	if config.GatewayIPv6.IsValid() && !config.GatewayIPv6.Is6() {
+		return nil, errors.New("GatewayIPv6 must be an IPv6 address")
+	}
+
+	mac := config.MAC
+	if mac == nil {
+		mac = make(net.HardwareAddr, 6)
+		if _, err := rand.Read(mac); err != nil {
+			return nil, err
+		}
+		mac[0] = (mac[0] &^ 0x01) | 0x02
+	} else if len(mac) != 6 {
+		return nil, errors.New("MAC must be 6 bytes long")
+	}
+
+	t := &tunOnTAP{
+		tap:   tap,
+		mac:   mac,
+		gw4:   config.GatewayIPv4,
+		gw6:   config.GatewayIPv6,
+		proxy: config.ProxyAll,
+	}
+	if config.PeerMAC != nil {
+		if len(config.PeerMAC) != 6 {
+			return nil, errors.New("PeerMAC must be 6 bytes long")
+		}
+		t.peerMAC = config.PeerMAC
+		t.static = true
+	}
+	return water.NewFromReadWriteCloser(t, water.TUN, tap.Name())
+}
+
+// Read returns the next IP packet sent by the kernel. ARP requests and
+// Neighbor Solicitations are answered internally and are not returned.
+func (t *tunOnTAP) Read(to []byte) (int, error) {
+	t.rMu.Lock()
+	defer t.rMu.Unlock()
+
+	if cap(t.rBuf) < len(to)+maxFrameOverhead {
+		t.rBuf = make([]byte, len(to)+maxFrameOverhead)
+	}
+	t.rBuf = t.rBuf[:len(to)+maxFrameOverhead]
+
+	for {
+		n, err := t.tap.Read(t.rBuf)
+		if err != nil {
+			return 0, err
+		}
+		frame := t.rBuf[:n]
+		if waterutil.ValidateMACFrame(frame) != nil {
+			continue
+		}
+
+		dst := waterutil.MACDestination(frame)
+		if waterutil.IsMACUnicast(dst) && !macEqual(dst, t.mac) {
+			continue
+		}
+		src := waterutil.MACSource(frame)
+		if waterutil.IsMACUnicast(src) {
+			t.learn(src)
+		}
+
+		payload := waterutil.MACPayload(frame)
+		switch waterutil.MACEthertype(frame) {
+		case waterutil.ARP:
+			t.handleARP(payload)
+		case waterutil.IPv4:
+			if waterutil.ValidateIPv4(payload) == nil {
+				// Drop Ethernet padding.
+				return copy(to, payload[:waterutil.IPv4TotalLength(payload)]), nil
+			}
+		case waterutil.IPv6:
+			if waterutil.ValidateIPv6(payload) == nil {
+				// Drop Ethernet padding.
+				payload = payload[:40+int(waterutil.IPv6PayloadLength(payload))]
+				if t.handleNS(src, payload) {
+					continue
+				}
+				return copy(to, payload), nil
+			}
+		}
+	}
+}
+
+// Write sends an IP packet to the kernel, adding an Ethernet header.
+func (t *tunOnTAP) Write(from []byte) (int, error) {
+	if len(from) == 0 {
+		return 0, errors.New("unable to determine IP version from packet")
+	}
+
+	var (
+		ethertype waterutil.Ethertype
+		dst       net.HardwareAddr
+	)
+	switch waterutil.IPVersion(from) {
+	case 4:
+		ethertype = waterutil.IPv4
+		dst = waterutil.BroadcastMAC
+	case 6:
+		ethertype = waterutil.IPv6
+		dst = allNodesMAC
+	default:
+		return 0, errors.New("unable to determine IP version from packet")
+	}
+	if peer := t.peer(); peer != nil {
+		dst = peer
+	}
+
+	t.wMu.Lock()
+	defer t.wMu.Unlock()
+
+	t.wBuf = waterutil.AppendEthernetHeader(t.wBuf[:0], dst, t.mac, ethertype)
+	t.wBuf = append(t.wBuf, from...)
+	n, err := t.tap.Write(t.wBuf)
+	n -= ethHeaderLen
+	if n < 0 {
+		n = 0
+	}
+	return n, err
+}
+
+func (t *tunOnTAP) Close() error {
+	return t.tap.Close()
+}
+
+func (t *tunOnTAP) learn(mac net.HardwareAddr) {
+	if t.static {
+		return
+	}
+	t.peerMu.RLock()
+	known := macEqual(t.peerMAC, mac)
+	t.peerMu.RUnlock()
+	if known {
+		return
+	}
+
+	t.peerMu.Lock()
+	t.peerMAC = append(t.peerMAC[:0], mac...)
+	t.peerMu.Unlock()
+}
+
+func (t *tunOnTAP) peer() net.HardwareAddr {
+	t.peerMu.RLock()
+	defer t.peerMu.RUnlock()
+	if t.peerMAC == nil {
+		return nil
+	}
+	return append(net.HardwareAddr(nil), t.peerMAC...)
+}
+
+// handleARP answers an ARP request for the gateway, or for any address with
+// ProxyAll.
+func (t *tunOnTAP) handleARP(payload []byte) {
+	arp, err := waterutil.NewARPPacket(payload)
+	if err != nil || arp.Operation() != waterutil.ARPRequest {
+		return
+	}
+	if !t.answersFor(arp.SenderIP(), arp.TargetIP(), t.gw4) {
+		return
+	}
+	_, _ = t.tap.Write(waterutil.BuildARPReply(arp, t.mac))
+}
+
+// handleNS answers a Neighbor Solicitation for the gateway, or for any address
+// with ProxyAll. It reports whether the packet was a Neighbor Solicitation
+// that was consumed.
+func (t *tunOnTAP) handleNS(src net.HardwareAddr, packet []byte) bool {
+	ns, err := waterutil.ParseNDP(packet)
+	if err != nil || ns.Type() != waterutil.NDPNeighborSolicitation {
+		return false
+	}
+	senderIP := netip.AddrFrom16([16]byte(waterutil.IPv6Source(packet)))
+	targetIP := ns.TargetAddress()
+
+	if !t.answersFor(senderIP, targetIP, t.gw6) {
+		return true
+	}
+
+	_, _ = t.tap.Write(waterutil.BuildNeighborAdvertisementFrame(src, senderIP, ns, t.mac, 0))
+	return true
+}
+
+func (t *tunOnTAP) answersFor(sender, target, gateway netip.Addr) bool {
+	if gateway.IsValid() && target == gateway {
+		return true
+	}
+	// Never answer duplicate address detection or gratuitous requests, the
+	// kernel would consider its own address to be in use.
+	return t.proxy && !sender.IsUnspecified() && sender != target
+}
+
+func macEqual(a, b net.HardwareAddr) bool {
+	return len(a) == len(b) && string(a) == string(b)
+}
@@ -0,0 +1,137 @@
+package tunontap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/Doridian/water"
+	"github.com/Doridian/water/internal/fakedev"
+	"github.com/Doridian/water/waterutil"
+)
+
+var (
+	kernelMAC = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}
+	shimMAC   = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02}
+)
+
+func setup(t *testing.T) (*water.Interface, *fakedev.Device) {
+	f := fakedev.New()
+	tap, err := water.NewFromReadWriteCloser(f, water.TAP, "tap0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tun, err := New(tap, Config{
+		MAC:         shimMAC,
+		GatewayIPv4: netip.MustParseAddr("10.0.0.1"),
+		GatewayIPv6: netip.MustParseAddr("fd00::1"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tun.IsTUN() {
+		t.Fatal("expected a TUN interface")
+	}
+	return tun, f
+}
+
+func TestARP(t *testing.T) {
+	tun, f := setup(t)
+	go func() { _, _ = tun.Read(make([]byte, 1500)) }()
+
+	req := waterutil.AppendEthernetHeader(nil, waterutil.BroadcastMAC, kernelMAC, waterutil.ARP)
+	req = append(req, 0, 1, 0x08, 0x00, 6, 4, 0, 1)
+	req = append(req, kernelMAC...)
+	req = append(req, 10, 0, 0, 2)
+	req = append(req, 0, 0, 0, 0, 0, 0)
+	req = append(req, 10, 0, 0, 1)
+	f.In <- req
+
+	reply := f.Expect(t)
+	if !bytes.Equal(waterutil.MACDestination(reply), kernelMAC) || waterutil.MACEthertype(reply) != waterutil.ARP {
+		t.Fatalf("unexpected reply frame % x", reply)
+	}
+	arp := waterutil.MACPayload(reply)
+	if binary.BigEndian.Uint16(arp[6:8]) != 2 || !bytes.Equal(arp[8:14], shimMAC) ||
+		!bytes.Equal(arp[14:18], []byte{10, 0, 0, 1}) || !bytes.Equal(arp[24:28], []byte{10, 0, 0, 2}) {
+		t.Fatalf("unexpected ARP reply % x", arp)
+	}
+}
+
+func TestNeighborSolicitation(t *testing.T) {
+	tun, f := setup(t)
+	go func() { _, _ = tun.Read(make([]byte, 1500)) }()
+
+	src := netip.MustParseAddr("fd00::2")
+	target := netip.MustParseAddr("fd00::1")
+	ns := waterutil.AppendEthernetHeader(nil, net.HardwareAddr{0x33, 0x33, 0xff, 0, 0, 1}, kernelMAC, waterutil.IPv6)
+	ns = append(ns, 0x60, 0, 0, 0, 0, 24, waterutil.IPv6_ICMP, 255)
+	ns = append(ns, src.AsSlice()...)
+	ns = append(ns, netip.MustParseAddr("ff02::1:ff00:1").AsSlice()...)
+	ns = append(ns, 135, 0, 0, 0, 0, 0, 0, 0)
+	ns = append(ns, target.AsSlice()...)
+	f.In <- ns
+
+	reply := f.Expect(t)
+	packet := waterutil.MACPayload(reply)
+	if !bytes.Equal(waterutil.MACDestination(reply), kernelMAC) || len(packet) != 72 {
+		t.Fatalf("unexpected reply frame % x", reply)
+	}
+	icmp := packet[40:]
+	if icmp[0] != 136 || !bytes.Equal(icmp[8:24], target.AsSlice()) || !bytes.Equal(icmp[26:32], shimMAC) {
+		t.Fatalf("unexpected Neighbor Advertisement % x", icmp)
+	}
+	if sum, err := waterutil.ComputeTransportChecksum(packet); err != nil || binary.BigEndian.Uint16(icmp[2:4]) != sum {
+		t.Fatal("invalid ICMPv6 checksum")
+	}
+}
+
+func TestDAD(t *testing.T) {
+	tun, f := setup(t)
+	go func() { _, _ = tun.Read(make([]byte, 1500)) }()
+
+	// A duplicate address detection probe for the gateway is defended towards
+	// all nodes.
+	gateway := netip.MustParseAddr("fd00::1")
+	dst := waterutil.SolicitedNodeMulticast(gateway)
+	ns := waterutil.AppendEthernetHeader(nil, waterutil.IPv6MulticastMAC(dst), kernelMAC, waterutil.IPv6)
+	ns = append(ns, waterutil.BuildNDPPacket(netip.IPv6Unspecified(), dst, waterutil.AppendNeighborSolicitation(nil, gateway))...)
+	f.In <- ns
+
+	reply := f.Expect(t)
+	packet := waterutil.MACPayload(reply)
+	na, err := waterutil.ParseNDP(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(waterutil.MACDestination(reply), waterutil.IPv6MulticastMAC(netip.MustParseAddr("ff02::1"))) ||
+		waterutil.IPv6Destination(packet).String() != "ff02::1" ||
+		na.NeighborFlags() != waterutil.NDPFlagOverride || na.TargetAddress() != gateway {
+		t.Fatalf("unexpected reply frame % x", reply)
+	}
+}
+
+func TestPackets(t *testing.T) {
+	tun, f := setup(t)
+
+	packet := []byte{0x45, 0, 0, 20, 0, 0, 0, 0, 64, 1, 0, 0, 10, 0, 0, 2, 10, 0, 0, 1}
+	f.In <- append(waterutil.AppendEthernetHeader(nil, shimMAC, kernelMAC, waterutil.IPv4), packet...)
+
+	buf := make([]byte, 1500)
+	n, err := tun.Read(buf)
+	if err != nil || !bytes.Equal(buf[:n], packet) {
+		t.Fatalf("unexpected packet % x, %v", buf[:n], err)
+	}
+
+	if _, err := tun.Write(packet); err != nil {
+		t.Fatal(err)
+	}
+	frame := f.Expect(t)
+	if !bytes.Equal(waterutil.MACDestination(frame), kernelMAC) ||
+		!bytes.Equal(waterutil.MACSource(frame), shimMAC) ||
+		!bytes.Equal(waterutil.MACPayload(frame), packet) {
+		t.Fatalf("unexpected frame % x", frame)
+	}
+}
@@ -0,0 +1,128 @@
+package waterutil
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+)
+
+// ARP operations.
+const (
+	ARPRequest uint16 = 1
+	ARPReply   uint16 = 2
+)
+
+// ARPPacketLen is the length of an ARP packet for IPv4 over Ethernet.
+const ARPPacketLen = 28
+
+// BroadcastMAC is the Ethernet broadcast address.
+var BroadcastMAC = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+// ARPPacket is a zero-copy view of an ARP packet for IPv4 over Ethernet, i.e.
+// the payload of a MAC frame with the ARP ethertype. Create it with
+// NewARPPacket.
+type ARPPacket []byte
+
+// NewARPPacket validates b and returns a view of it, trimmed to ARPPacketLen.
+// Trailing bytes, e.g. Ethernet padding, are allowed.
+func NewARPPacket(b []byte) (ARPPacket, error) {
+	if len(b) < ARPPacketLen {
+		return nil, ErrTruncated
+	}
+	if binary.BigEndian.Uint16(b[0:2]) != 1 || // Ethernet
+		Ethertype(b[2:4]) != IPv4 ||
+		b[4] != 6 || b[5] != 4 {
+		return nil, ErrUnsupportedARP
+	}
+	return ARPPacket(b[:ARPPacketLen]), nil
+}
+
+func (p ARPPacket) Operation() uint16 {
+	return binary.BigEndian.Uint16(p[6:8])
+}
+
+func (p ARPPacket) SetOperation(op uint16) {
+	binary.BigEndian.PutUint16(p[6:8], op)
+}
+
+func (p ARPPacket) SenderMAC() net.HardwareAddr {
+	return net.HardwareAddr(p[8:14])
+}
+
+func (p ARPPacket) SetSenderMAC(mac net.HardwareAddr) {
+	copy(p[8:14], mac)
+}
+
+func (p ARPPacket) SenderIP() netip.Addr {
+	return netip.AddrFrom4([4]byte(p[14:18]))
+}
+
+func (p ARPPacket) SetSenderIP(addr netip.Addr) {
+	a := addr.As4()
+	copy(p[14:18], a[:])
+}
+
+func (p ARPPacket) TargetMAC() net.HardwareAddr {
+	return net.HardwareAddr(p[18:24])
+}
+
+func (p ARPPacket) SetTargetMAC(mac net.HardwareAddr) {
+	copy(p[18:24], mac)
+}
+
+func (p ARPPacket) TargetIP() netip.Addr {
+	return netip.AddrFrom4([4]byte(p[24:28]))
+}
+
+func (p ARPPacket) SetTargetIP(addr netip.Addr) {
+	a := addr.As4()
+	copy(p[24:28], a[:])
+}
+
+// IsProbe reports whether p is an RFC 5227 address probe, i.e. a request with
+// an unspecified sender address.
+func (p ARPPacket) IsProbe() bool {
+	return p.Operation() == ARPRequest && p.SenderIP().IsUnspecified()
+}
+
+// IsGratuitous reports whether p announces the sender's own address, i.e. the
+// sender and target addresses are equal.
+func (p ARPPacket) IsGratuitous() bool {
+	return p.SenderIP() == p.TargetIP()
+}
+
+// AppendARP appends an ARP packet for IPv4 over Ethernet to b and returns the
+// extended buffer. senderIP and targetIP must be IPv4 addresses.
+func AppendARP(b []byte, op uint16, senderMAC net.HardwareAddr, senderIP netip.Addr, targetMAC net.HardwareAddr, targetIP netip.Addr) []byte {
+	sip, tip := senderIP.As4(), targetIP.As4()
+	b = append(b, 0, 1) // Ethernet
+	b = append(b, IPv4[:]...)
+	b = append(b, 6, 4)
+	b = binary.BigEndian.AppendUint16(b, op)
+	b = append(b, senderMAC[:6]...)
+	b = append(b, sip[:]...)
+	b = append(b, targetMAC[:6]...)
+	return append(b, tip[:]...)
+}
+
+// BuildARPRequest returns a broadcast MAC frame asking for the MAC address of
+// targetIP.
+func BuildARPRequest(senderMAC net.HardwareAddr, senderIP, targetIP netip.Addr) []byte {
+	b := make([]byte, 0, 14+ARPPacketLen)
+	b = AppendEthernetHeader(b, BroadcastMAC, senderMAC, ARP)
+	return AppendARP(b, ARPRequest, senderMAC, senderIP, make(net.HardwareAddr, 6), targetIP)
+}
+
+// BuildARPReply returns a MAC frame answering request with mac, sent back to
+// the requester.
+func BuildARPReply(request ARPPacket, mac net.HardwareAddr) []byte {
+	b := make([]byte, 0, 14+ARPPacketLen)
+	b = AppendEthernetHeader(b, request.SenderMAC(), mac, ARP)
+	return AppendARP(b, ARPReply, mac, request.TargetIP(), request.SenderMAC(), request.SenderIP())
+}
+
+// BuildGratuitousARP returns a broadcast MAC frame announcing that ip is at
+// mac, formatted as an RFC 5227 ARP announcement.
+func BuildGratuitousARP(mac net.HardwareAddr, ip netip.Addr) []byte {
+	return BuildARPRequest(mac, ip, ip)
+}
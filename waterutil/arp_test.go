@@ -0,0 +1,59 @@
+package waterutil
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestARP(t *testing.T) {
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	peer := net.HardwareAddr{0x02, 0, 0, 0, 0, 2}
+	ip := netip.MustParseAddr("192.0.2.1")
+	peerIP := netip.MustParseAddr("192.0.2.2")
+
+	frame := BuildARPRequest(mac, ip, peerIP)
+	if !IsMACBroadcast(MACDestination(frame)) || MACEthertype(frame) != ARP {
+		t.Fatal("a request must be a broadcast ARP frame")
+	}
+	// Ethernet padding is allowed.
+	request, err := NewARPPacket(append(MACPayload(frame), 0, 0, 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(request) != ARPPacketLen || request.Operation() != ARPRequest || request.IsProbe() || request.IsGratuitous() {
+		t.Fatal("unexpected request")
+	}
+
+	reply := BuildARPReply(request, peer)
+	if !bytes.Equal(MACDestination(reply), mac) || !bytes.Equal(MACSource(reply), peer) {
+		t.Fatal("a reply must be sent from the answering host to the requester")
+	}
+	p, err := NewARPPacket(MACPayload(reply))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Operation() != ARPReply || p.SenderIP() != peerIP || !bytes.Equal(p.SenderMAC(), peer) ||
+		p.TargetIP() != ip || !bytes.Equal(p.TargetMAC(), mac) {
+		t.Fatalf("unexpected reply % x", []byte(p))
+	}
+
+	p.SetSenderIP(netip.IPv4Unspecified())
+	p.SetOperation(ARPRequest)
+	if !p.IsProbe() {
+		t.Fatal("a request from 0.0.0.0 is a probe")
+	}
+	if g, _ := NewARPPacket(MACPayload(BuildGratuitousARP(mac, ip))); !g.IsGratuitous() {
+		t.Fatal("expected a gratuitous ARP")
+	}
+
+	if _, err := NewARPPacket(MACPayload(frame)[:27]); err != ErrTruncated {
+		t.Fatalf("expected ErrTruncated, got %v", err)
+	}
+	bad := bytes.Clone(MACPayload(frame))
+	bad[4] = 8
+	if _, err := NewARPPacket(bad); err != ErrUnsupportedARP {
+		t.Fatalf("expected ErrUnsupportedARP, got %v", err)
+	}
+}
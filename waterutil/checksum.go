@@ -0,0 +1,339 @@
+package waterutil
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// ChecksumAdd adds b to a partial Internet checksum (RFC 1071). b is treated
+// as starting at an even offset of the checksummed data; an odd trailing byte
+// is padded with zero.
+func ChecksumAdd(sum uint32, b []byte) uint32 {
+	for len(b) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(b))
+		b = b[2:]
+		if sum > 0xffff0000 {
+			sum = (sum >> 16) + (sum & 0xffff)
+		}
+	}
+	if len(b) > 0 {
+		sum += uint32(b[0]) << 8
+	}
+	return sum
+}
+
+// ChecksumFold folds a partial checksum into 16 bits and complements it.
+func ChecksumFold(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+// Checksum computes the Internet checksum of b.
+func Checksum(b []byte) uint16 {
+	return ChecksumFold(ChecksumAdd(0, b))
+}
+
+// ChecksumUpdate incrementally updates checksum after the 16-bit aligned
+// bytes oldData were replaced with newData, following RFC 1624 equation 3.
+// oldData and newData must have the same length.
+func ChecksumUpdate(checksum uint16, oldData, newData []byte) uint16 {
+	sum := uint32(^checksum)
+	for len(oldData) >= 2 {
+		sum += uint32(^binary.BigEndian.Uint16(oldData))
+		sum += uint32(binary.BigEndian.Uint16(newData))
+		oldData, newData = oldData[2:], newData[2:]
+	}
+	if len(oldData) > 0 {
+		sum += uint32(^(uint16(oldData[0]) << 8))
+		sum += uint32(newData[0]) << 8
+	}
+	return ChecksumFold(sum)
+}
+
+// ChecksumUpdate16 is like ChecksumUpdate for a single 16-bit word.
+func ChecksumUpdate16(checksum uint16, oldValue, newValue uint16) uint16 {
+	sum := uint32(^checksum) + uint32(^oldValue) + uint32(newValue)
+	return ChecksumFold(sum)
+}
+
+// PseudoHeaderChecksum returns the partial checksum of the TCP/UDP/ICMPv6
+// pseudo-header. src and dst are 4 byte IPv4 or 16 byte IPv6 addresses and
+// length is the length of the upper-layer header and payload.
+func PseudoHeaderChecksum(src, dst []byte, protocol IPProtocol, length int) uint32 {
+	sum := ChecksumAdd(0, src)
+	sum = ChecksumAdd(sum, dst)
+	sum += uint32(protocol)
+	sum += uint32(length>>16) + uint32(length&0xffff)
+	return sum
+}
+
+func IPv4Checksum(packet []byte) uint16 {
+	return binary.BigEndian.Uint16(packet[10:12])
+}
+
+func SetIPv4Checksum(packet []byte, checksum uint16) {
+	binary.BigEndian.PutUint16(packet[10:12], checksum)
+}
+
+// ComputeIPv4Checksum computes the header checksum of an IPv4 packet, treating
+// the checksum field as zero.
+func ComputeIPv4Checksum(packet []byte) uint16 {
+	ihl := int(packet[0]&0x0F) * 4
+	sum := ChecksumAdd(0, packet[:10])
+	sum = ChecksumAdd(sum, packet[12:ihl])
+	return ChecksumFold(sum)
+}
+
+// FixIPv4Checksum recomputes and stores the header checksum of an IPv4 packet.
+func FixIPv4Checksum(packet []byte) {
+	SetIPv4Checksum(packet, ComputeIPv4Checksum(packet))
+}
+
+// transportChecksumOffset returns the offset of the checksum field in the
+// header of protocol, or -1 if it is not known.
+func transportChecksumOffset(protocol IPProtocol) int {
+	switch protocol {
+	case TCP:
+		return 16
+	case UDP:
+		return 6
+	case ICMP, IPv6_ICMP:
+		return 2
+	default:
+		return -1
+	}
+}
+
+// transportHeader returns the upper-layer protocol of an IP packet and the
+// upper-layer header with its payload. The header is nil if the packet is a
+// non-first fragment or is too short to contain the header's checksum.
+func transportHeader(packet []byte) (IPProtocol, []byte) {
+	switch IPVersion(packet) {
+	case 4:
+		if len(packet) < 20 {
+			return 0, nil
+		}
+		ihl := int(packet[0]&0x0F) * 4
+		if ihl < 20 || len(packet) < ihl {
+			return 0, nil
+		}
+		protocol := IPv4Protocol(packet)
+		if IPv4FragmentOffset(packet) != 0 {
+			return protocol, nil
+		}
+		end := len(packet)
+		if total := int(IPv4TotalLength(packet)); total >= ihl && total < end {
+			end = total
+		}
+		hdr := packet[ihl:end]
+		if off := transportChecksumOffset(protocol); off < 0 || len(hdr) < off+2 {
+			return protocol, nil
+		}
+		return protocol, hdr
+	case 6:
+		protocol, offset, err := ParseIPv6UpperLayer(packet)
+		if err != nil {
+			return 0, nil
+		}
+		if isNonFirstFragment(packet) {
+			return protocol, nil
+		}
+		hdr := packet[offset : 40+int(IPv6PayloadLength(packet))]
+		if off := transportChecksumOffset(protocol); off < 0 || len(hdr) < off+2 {
+			return protocol, nil
+		}
+		return protocol, hdr
+	default:
+		return 0, nil
+	}
+}
+
+// isNonFirstFragment reports whether packet is an IPv4 or IPv6 fragment that
+// does not carry the upper-layer header.
+func isNonFirstFragment(packet []byte) bool {
+	switch IPVersion(packet) {
+	case 4:
+		return len(packet) >= 20 && IPv4FragmentOffset(packet) != 0
+	case 6:
+		hdr := IPv6FragmentHeader(packet)
+		return hdr != nil && ipv6FragmentOffset(hdr) != 0
+	default:
+		return false
+	}
+}
+
+// ComputeTransportChecksum computes the TCP, UDP, ICMP or ICMPv6 checksum of
+// an IPv4 or IPv6 packet, treating the checksum field as zero. A UDP checksum
+// computing to zero is returned as 0xFFFF.
+func ComputeTransportChecksum(packet []byte) (uint16, error) {
+	if len(packet) == 0 {
+		return 0, ErrTruncated
+	}
+	protocol, hdr := transportHeader(packet)
+	if hdr == nil {
+		if transportChecksumOffset(protocol) < 0 {
+			return 0, ErrUnsupportedProtocol
+		}
+		if isNonFirstFragment(packet) {
+			return 0, ErrFragmented
+		}
+		return 0, ErrTruncated
+	}
+	off := transportChecksumOffset(protocol)
+
+	var sum uint32
+	switch {
+	case protocol == ICMP:
+	case IPVersion(packet) == 4:
+		sum = PseudoHeaderChecksum(packet[12:16], packet[16:20], protocol, len(hdr))
+	default:
+		sum = PseudoHeaderChecksum(packet[8:24], packet[24:40], protocol, len(hdr))
+	}
+	sum = ChecksumAdd(sum, hdr[:off])
+	sum = ChecksumAdd(sum, hdr[off+2:])
+	checksum := ChecksumFold(sum)
+	if protocol == UDP && checksum == 0 {
+		checksum = 0xFFFF
+	}
+	return checksum, nil
+}
+
+// FixTransportChecksum recomputes and stores the TCP, UDP, ICMP or ICMPv6
+// checksum of an IPv4 or IPv6 packet.
+func FixTransportChecksum(packet []byte) error {
+	checksum, err := ComputeTransportChecksum(packet)
+	if err != nil {
+		return err
+	}
+	protocol, hdr := transportHeader(packet)
+	off := transportChecksumOffset(protocol)
+	binary.BigEndian.PutUint16(hdr[off:], checksum)
+	return nil
+}
+
+// FixChecksums recomputes the IPv4 header checksum, if any, and the transport
+// checksum of packet.
+func FixChecksums(packet []byte) error {
+	if len(packet) > 0 && IPVersion(packet) == 4 {
+		if len(packet) < 20 || len(packet) < int(packet[0]&0x0F)*4 {
+			return ErrTruncated
+		}
+		FixIPv4Checksum(packet)
+	}
+	return FixTransportChecksum(packet)
+}
+
+// updateTransportChecksum incrementally updates the transport checksum of
+// packet after oldData was replaced with newData. If pseudo is set, the change
+// is in the pseudo-header, which ICMPv4 does not cover. A disabled (zero) UDP
+// checksum is left untouched.
+func updateTransportChecksum(packet []byte, oldData, newData []byte, pseudo bool) {
+	protocol, hdr := transportHeader(packet)
+	if hdr == nil || (pseudo && protocol == ICMP) {
+		return
+	}
+	off := transportChecksumOffset(protocol)
+	checksum := binary.BigEndian.Uint16(hdr[off:])
+	if protocol == UDP && checksum == 0 {
+		return
+	}
+	checksum = ChecksumUpdate(checksum, oldData, newData)
+	if protocol == UDP && checksum == 0 {
+		checksum = 0xFFFF
+	}
+	binary.BigEndian.PutUint16(hdr[off:], checksum)
+}
+
+func setIPv4AddressWithChecksum(packet []byte, field []byte, addr net.IP) {
+	old := [4]byte(field)
+	copy(field, addr.To4())
+	SetIPv4Checksum(packet, ChecksumUpdate(IPv4Checksum(packet), old[:], field))
+	updateTransportChecksum(packet, old[:], field, true)
+}
+
+// SetIPv4TTLWithChecksum sets the TTL of an IPv4 packet and updates the header
+// checksum. The transport checksum does not cover the TTL.
+func SetIPv4TTLWithChecksum(packet []byte, ttl byte) {
+	old := binary.BigEndian.Uint16(packet[8:10])
+	packet[8] = ttl
+	SetIPv4Checksum(packet, ChecksumUpdate16(IPv4Checksum(packet), old, binary.BigEndian.Uint16(packet[8:10])))
+}
+
+// SetIPv4SourceWithChecksum is like SetIPv4Source, but also updates the IPv4
+// header checksum and the TCP/UDP checksum.
+func SetIPv4SourceWithChecksum(packet []byte, source net.IP) {
+	setIPv4AddressWithChecksum(packet, packet[12:16], source)
+}
+
+// SetIPv4DestinationWithChecksum is like SetIPv4Destination, but also updates
+// the IPv4 header checksum and the TCP/UDP checksum.
+func SetIPv4DestinationWithChecksum(packet []byte, dest net.IP) {
+	setIPv4AddressWithChecksum(packet, packet[16:20], dest)
+}
+
+func setIPv6AddressWithChecksum(packet []byte, field []byte, addr net.IP) {
+	old := [16]byte(field)
+	copy(field, addr.To16())
+	updateTransportChecksum(packet, old[:], field, true)
+}
+
+// SetIPv6SourceWithChecksum is like SetIPv6Source, but also updates the
+// TCP/UDP/ICMPv6 checksum.
+func SetIPv6SourceWithChecksum(packet []byte, source net.IP) {
+	setIPv6AddressWithChecksum(packet, packet[8:24], source)
+}
+
+// SetIPv6DestinationWithChecksum is like SetIPv6Destination, but also updates
+// the TCP/UDP/ICMPv6 checksum.
+func SetIPv6DestinationWithChecksum(packet []byte, dest net.IP) {
+	setIPv6AddressWithChecksum(packet, packet[24:40], dest)
+}
+
+// SetIPSourceWithChecksum sets the source address of an IPv4 or IPv6 packet
+// and updates all affected checksums.
+func SetIPSourceWithChecksum(packet []byte, source net.IP) {
+	switch IPVersion(packet) {
+	case 4:
+		SetIPv4SourceWithChecksum(packet, source)
+	case 6:
+		SetIPv6SourceWithChecksum(packet, source)
+	}
+}
+
+// SetIPDestinationWithChecksum sets the destination address of an IPv4 or IPv6
+// packet and updates all affected checksums.
+func SetIPDestinationWithChecksum(packet []byte, dest net.IP) {
+	switch IPVersion(packet) {
+	case 4:
+		SetIPv4DestinationWithChecksum(packet, dest)
+	case 6:
+		SetIPv6DestinationWithChecksum(packet, dest)
+	}
+}
+
+func setPortWithChecksum(packet []byte, offset int, port uint16) {
+	protocol, hdr := transportHeader(packet)
+	if hdr == nil || (protocol != TCP && protocol != UDP) {
+		return
+	}
+	var old [2]byte
+	copy(old[:], hdr[offset:offset+2])
+	binary.BigEndian.PutUint16(hdr[offset:], port)
+	updateTransportChecksum(packet, old[:], hdr[offset:offset+2], false)
+}
+
+// SetSourcePortWithChecksum sets the TCP/UDP source port of an IPv4 or IPv6
+// packet and updates its checksum. Packets that are neither TCP nor UDP, and
+// non-first fragments, are left untouched.
+func SetSourcePortWithChecksum(packet []byte, port uint16) {
+	setPortWithChecksum(packet, 0, port)
+}
+
+// SetDestinationPortWithChecksum sets the TCP/UDP destination port of an IPv4
+// or IPv6 packet and updates its checksum. Packets that are neither TCP nor
+// UDP, and non-first fragments, are left untouched.
+func SetDestinationPortWithChecksum(packet []byte, port uint16) {
+	setPortWithChecksum(packet, 2, port)
+}
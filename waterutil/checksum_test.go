@@ -0,0 +1,162 @@
+package waterutil
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// ipv4Header is the example header from
+// https://en.wikipedia.org/wiki/Internet_checksum with checksum 0xb861.
+var ipv4Header = []byte{
+	0x45, 0x00, 0x00, 0x73, 0x00, 0x00, 0x40, 0x00, 0x40, 0x11,
+	0xb8, 0x61, 0xc0, 0xa8, 0x00, 0x01, 0xc0, 0xa8, 0x00, 0xc7,
+}
+
+func buildIPv4(protocol IPProtocol, transport []byte) []byte {
+	packet := make([]byte, 20, 20+len(transport))
+	copy(packet, ipv4Header)
+	packet = append(packet, transport...)
+	binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+	packet[9] = byte(protocol)
+	FixIPv4Checksum(packet)
+	_ = FixTransportChecksum(packet)
+	return packet
+}
+
+func buildIPv6(protocol IPProtocol, transport []byte) []byte {
+	packet := make([]byte, 40, 40+len(transport))
+	packet[0] = 0x60
+	binary.BigEndian.PutUint16(packet[4:6], uint16(len(transport)))
+	packet[6] = byte(protocol)
+	packet[7] = 64
+	copy(packet[8:24], net.ParseIP("fd00::1"))
+	copy(packet[24:40], net.ParseIP("fd00::2"))
+	packet = append(packet, transport...)
+	if err := FixTransportChecksum(packet); err != nil {
+		panic(err)
+	}
+	return packet
+}
+
+func tcpHeader() []byte {
+	return []byte{
+		0x04, 0xd2, 0x00, 0x50, 0, 0, 0, 1, 0, 0, 0, 0, 0x50, 0x02, 0xff, 0xff,
+		0, 0, 0, 0, 'h', 'e', 'l', 'l', 'o',
+	}
+}
+
+func udpHeader() []byte {
+	return []byte{0x04, 0xd2, 0x00, 0x35, 0x00, 0x0b, 0, 0, 'a', 'b', 'c'}
+}
+
+func TestIPv4Checksum(t *testing.T) {
+	if got := ComputeIPv4Checksum(ipv4Header); got != 0xb861 {
+		t.Fatalf("expected checksum 0xb861, got %#04x", got)
+	}
+	if Checksum(ipv4Header) != 0 {
+		t.Fatal("checksum over a valid header must be zero")
+	}
+}
+
+func TestChecksumUpdate(t *testing.T) {
+	header := append([]byte(nil), ipv4Header...)
+	old := append([]byte(nil), header[12:16]...)
+	copy(header[12:16], []byte{10, 1, 2, 3})
+	incremental := ChecksumUpdate(IPv4Checksum(header), old, header[12:16])
+	if full := ComputeIPv4Checksum(header); incremental != full {
+		t.Fatalf("incremental checksum %#04x differs from full checksum %#04x", incremental, full)
+	}
+	if got := ChecksumUpdate16(0xb861, 0x4011, 0x3f11); got != ChecksumUpdate(0xb861, []byte{0x40, 0x11}, []byte{0x3f, 0x11}) {
+		t.Fatalf("ChecksumUpdate16 mismatch: %#04x", got)
+	}
+}
+
+func checkValid(t *testing.T, packet []byte) {
+	t.Helper()
+	if IPVersion(packet) == 4 && ComputeIPv4Checksum(packet) != IPv4Checksum(packet) {
+		t.Fatal("IPv4 header checksum is stale")
+	}
+	protocol, hdr := transportHeader(packet)
+	want, err := ComputeTransportChecksum(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	off := transportChecksumOffset(protocol)
+	if got := binary.BigEndian.Uint16(hdr[off:]); got != want {
+		t.Fatalf("transport checksum is %#04x, expected %#04x", got, want)
+	}
+}
+
+func TestSettersWithChecksum(t *testing.T) {
+	for _, protocol := range []IPProtocol{TCP, UDP} {
+		transport := tcpHeader()
+		if protocol == UDP {
+			transport = udpHeader()
+		}
+
+		packet := buildIPv4(protocol, transport)
+		SetIPv4SourceWithChecksum(packet, net.IPv4(10, 0, 0, 1))
+		checkValid(t, packet)
+		SetIPDestinationWithChecksum(packet, net.IPv4(172, 16, 254, 3))
+		checkValid(t, packet)
+		SetSourcePortWithChecksum(packet, 40000)
+		checkValid(t, packet)
+		SetDestinationPortWithChecksum(packet, 8080)
+		checkValid(t, packet)
+		if IPv4SourcePort(packet) != 40000 || IPv4DestinationPort(packet) != 8080 {
+			t.Fatal("ports were not updated")
+		}
+		SetIPv4TTLWithChecksum(packet, IPv4TTL(packet)-1)
+		checkValid(t, packet)
+
+		packet = buildIPv6(protocol, transport)
+		SetIPv6SourceWithChecksum(packet, net.ParseIP("2001:db8::1"))
+		checkValid(t, packet)
+		SetIPDestinationWithChecksum(packet, net.ParseIP("2001:db8:ffff::2"))
+		checkValid(t, packet)
+		SetSourcePortWithChecksum(packet, 1)
+		checkValid(t, packet)
+		SetDestinationPortWithChecksum(packet, 65535)
+		checkValid(t, packet)
+	}
+}
+
+func TestICMPChecksum(t *testing.T) {
+	echo := []byte{8, 0, 0, 0, 0x12, 0x34, 0, 1, 'p', 'i', 'n', 'g'}
+	packet := buildIPv4(ICMP, echo)
+	before := binary.BigEndian.Uint16(packet[22:24])
+	SetIPv4SourceWithChecksum(packet, net.IPv4(10, 9, 8, 7))
+	checkValid(t, packet)
+	if binary.BigEndian.Uint16(packet[22:24]) != before {
+		t.Fatal("ICMPv4 checksum must not depend on addresses")
+	}
+
+	packet = buildIPv6(IPv6_ICMP, []byte{128, 0, 0, 0, 0x12, 0x34, 0, 1})
+	SetIPv6DestinationWithChecksum(packet, net.ParseIP("fe80::1"))
+	checkValid(t, packet)
+}
+
+func TestUDPZeroChecksum(t *testing.T) {
+	packet := buildIPv4(UDP, udpHeader())
+	binary.BigEndian.PutUint16(packet[26:28], 0)
+	SetIPv4SourceWithChecksum(packet, net.IPv4(10, 0, 0, 1))
+	SetSourcePortWithChecksum(packet, 1)
+	if binary.BigEndian.Uint16(packet[26:28]) != 0 {
+		t.Fatal("a disabled UDP checksum must stay disabled")
+	}
+	if ComputeIPv4Checksum(packet) != IPv4Checksum(packet) {
+		t.Fatal("IPv4 header checksum is stale")
+	}
+}
+
+func TestFragmentChecksum(t *testing.T) {
+	packet := buildIPv4(UDP, udpHeader())
+	packet[7] = 0x10
+	if _, err := ComputeTransportChecksum(packet); err != ErrFragmented {
+		t.Fatalf("expected ErrFragmented, got %v", err)
+	}
+	if _, err := ComputeTransportChecksum(buildIPv4(GRE, []byte{0, 0, 0, 0})); err != ErrUnsupportedProtocol {
+		t.Fatalf("expected ErrUnsupportedProtocol, got %v", err)
+	}
+}
@@ -0,0 +1,21 @@
+package waterutil
+
+import "errors"
+
+// Errors returned by the checked parsing functions.
+var (
+	ErrTruncated           = errors.New("packet truncated")
+	ErrInvalidVersion      = errors.New("invalid IP version")
+	ErrInvalidIHL          = errors.New("invalid IPv4 header length")
+	ErrInvalidTotalLength  = errors.New("invalid IPv4 total length")
+	ErrInvalidPayloadLen   = errors.New("invalid IPv6 payload length")
+	ErrUnsupportedProtocol = errors.New("unsupported protocol")
+	ErrFragmented          = errors.New("packet is a non-first fragment")
+	ErrInvalidDataOffset   = errors.New("invalid TCP data offset")
+	ErrInvalidUDPLength    = errors.New("invalid UDP length")
+	ErrNotVLANTagged       = errors.New("frame is not VLAN tagged")
+	ErrUnsupportedARP      = errors.New("unsupported ARP hardware or protocol type")
+	ErrInvalidNDP          = errors.New("invalid NDP message")
+	ErrICMPSuppressed      = errors.New("ICMP error must not be sent in response to this packet")
+	ErrNotEchoRequest      = errors.New("packet is not an ICMP echo request")
+)
@@ -13,6 +13,7 @@ var (
 	RARP                = Ethertype{0x80, 0x35}
 	AppleTalk           = Ethertype{0x80, 0x9B}
 	AARP                = Ethertype{0x80, 0xF3}
+	IEEE802_1Q          = Ethertype{0x81, 0x00}
 	IPX1                = Ethertype{0x81, 0x37}
 	IPX2                = Ethertype{0x81, 0x38}
 	QNXQnet             = Ethertype{0x82, 0x04}
@@ -31,6 +32,7 @@ var (
 	HyperSCSI           = Ethertype{0x88, 0x9A}
 	AoE                 = Ethertype{0x88, 0xA2}
 	EtherCAT            = Ethertype{0x88, 0xA4}
+	IEEE802_1ad         = Ethertype{0x88, 0xA8}
 	EthernetPowerlink   = Ethertype{0x88, 0xAB}
 	LLDP                = Ethertype{0x88, 0xCC}
 	SERCOS3             = Ethertype{0x88, 0xCD}
@@ -43,5 +45,6 @@ var (
 	FCoEInit            = Ethertype{0x89, 0x14}
 	RoCE                = Ethertype{0x89, 0x15}
 	CTP                 = Ethertype{0x90, 0x00}
+	QinQ                = Ethertype{0x91, 0x00}
 	VeritasLLT          = Ethertype{0xCA, 0xFE}
 )
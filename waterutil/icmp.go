@@ -0,0 +1,251 @@
+package waterutil
+
+import (
+	"encoding/binary"
+	"net/netip"
+)
+
+// ICMPv4 message types.
+const (
+	ICMPv4EchoReply              byte = 0
+	ICMPv4DestinationUnreachable byte = 3
+	ICMPv4SourceQuench           byte = 4
+	ICMPv4Redirect               byte = 5
+	ICMPv4EchoRequest            byte = 8
+	ICMPv4TimeExceeded           byte = 11
+	ICMPv4ParameterProblem       byte = 12
+)
+
+// ICMPv4 Destination Unreachable codes.
+const (
+	ICMPv4NetUnreachable          byte = 0
+	ICMPv4HostUnreachable         byte = 1
+	ICMPv4ProtocolUnreachable     byte = 2
+	ICMPv4PortUnreachable         byte = 3
+	ICMPv4FragmentationNeeded     byte = 4
+	ICMPv4AdministrativelyBlocked byte = 13
+)
+
+// ICMPv6 message types. See ndp.go for Neighbor Discovery.
+const (
+	ICMPv6DestinationUnreachable byte = 1
+	ICMPv6PacketTooBig           byte = 2
+	ICMPv6TimeExceeded           byte = 3
+	ICMPv6ParameterProblem       byte = 4
+	ICMPv6EchoRequest            byte = 128
+	ICMPv6EchoReply              byte = 129
+)
+
+// ICMPv6 Destination Unreachable codes.
+const (
+	ICMPv6NoRoute                 byte = 0
+	ICMPv6AdministrativelyBlocked byte = 1
+	ICMPv6AddressUnreachable      byte = 3
+	ICMPv6PortUnreachable         byte = 4
+)
+
+// Maximum sizes of ICMP error packets, including the IP header. ICMPv4 errors
+// must fit the minimum reassembly buffer size (RFC 1812), ICMPv6 errors the
+// minimum IPv6 MTU (RFC 4443). The offending packet is truncated to fit.
+const (
+	ICMPv4ErrorMaxSize = 576
+	ICMPv6ErrorMaxSize = 1280
+)
+
+// isICMPv4Error reports whether packet is an ICMPv4 error message.
+func isICMPv4Error(packet []byte) bool {
+	if IPv4Protocol(packet) != ICMP || IPv4FragmentOffset(packet) != 0 {
+		return false
+	}
+	payload := IPv4Payload(packet)
+	if len(payload) < 1 {
+		return false
+	}
+	switch payload[0] {
+	case ICMPv4DestinationUnreachable, ICMPv4SourceQuench, ICMPv4Redirect, ICMPv4TimeExceeded, ICMPv4ParameterProblem:
+		return true
+	default:
+		return false
+	}
+}
+
+// BuildICMPv4Error returns an ICMPv4 error message of the given type and code
+// from src to the sender of original, quoting as much of original as fits in
+// ICMPv4ErrorMaxSize. rest is the type-specific second word of the header,
+// e.g. the next-hop MTU. Following RFC 1122, it returns ErrICMPSuppressed for
+// ICMP errors, non-first fragments, and packets from or to broadcast or
+// multicast addresses.
+func BuildICMPv4Error(original []byte, icmpType, code byte, rest uint32, src netip.Addr) ([]byte, error) {
+	if err := ValidateIPv4(original); err != nil {
+		return nil, err
+	}
+	original = original[:IPv4TotalLength(original)]
+	origSrc := netip.AddrFrom4([4]byte(original[12:16]))
+	origDst := netip.AddrFrom4([4]byte(original[16:20]))
+	if isICMPv4Error(original) || IPv4FragmentOffset(original) != 0 ||
+		origSrc.IsUnspecified() || origSrc.IsMulticast() || origSrc == ipv4Broadcast ||
+		origDst.IsMulticast() || origDst == ipv4Broadcast {
+		return nil, ErrICMPSuppressed
+	}
+
+	if quote := ICMPv4ErrorMaxSize - 20 - 8; len(original) > quote {
+		original = original[:quote]
+	}
+	packet := make([]byte, 0, 20+8+len(original))
+	packet = AppendIPv4Header(packet, ICMP, DefaultTTL, src, origSrc, 8+len(original))
+	packet = append(packet, icmpType, code, 0, 0)
+	packet = binary.BigEndian.AppendUint32(packet, rest)
+	packet = append(packet, original...)
+	_ = FixTransportChecksum(packet)
+	return packet, nil
+}
+
+var ipv4Broadcast = netip.AddrFrom4([4]byte{255, 255, 255, 255})
+
+// BuildICMPv6Error returns an ICMPv6 error message of the given type and code
+// from src to the sender of original, quoting as much of original as fits in
+// ICMPv6ErrorMaxSize. rest is the type-specific second word of the header,
+// e.g. the MTU of a Packet Too Big message. Following RFC 4443, it returns
+// ErrICMPSuppressed for ICMPv6 errors, packets from unspecified or multicast
+// addresses, and packets to multicast addresses unless the error is a Packet
+// Too Big or a Parameter Problem with code 2.
+func BuildICMPv6Error(original []byte, icmpType, code byte, rest uint32, src netip.Addr) ([]byte, error) {
+	if err := ValidateIPv6(original); err != nil {
+		return nil, err
+	}
+	original = original[:40+int(IPv6PayloadLength(original))]
+	origSrc := netip.AddrFrom16([16]byte(original[8:24]))
+	origDst := netip.AddrFrom16([16]byte(original[24:40]))
+	if origSrc.IsUnspecified() || origSrc.IsMulticast() {
+		return nil, ErrICMPSuppressed
+	}
+	if origDst.IsMulticast() && icmpType != ICMPv6PacketTooBig && (icmpType != ICMPv6ParameterProblem || code != 2) {
+		return nil, ErrICMPSuppressed
+	}
+	if protocol, offset, err := ParseIPv6UpperLayer(original); err == nil && protocol == IPv6_ICMP &&
+		!isNonFirstFragment(original) && offset < len(original) && original[offset] < 128 {
+		return nil, ErrICMPSuppressed
+	}
+
+	if quote := ICMPv6ErrorMaxSize - 40 - 8; len(original) > quote {
+		original = original[:quote]
+	}
+	packet := make([]byte, 0, 40+8+len(original))
+	packet = AppendIPv6Header(packet, IPv6_ICMP, DefaultTTL, src, origSrc, 8+len(original))
+	packet = append(packet, icmpType, code, 0, 0)
+	packet = binary.BigEndian.AppendUint32(packet, rest)
+	packet = append(packet, original...)
+	_ = FixTransportChecksum(packet)
+	return packet, nil
+}
+
+// BuildTimeExceeded returns an ICMPv4 or ICMPv6 Time Exceeded message for an
+// IPv4 or IPv6 packet whose TTL or hop limit expired at src.
+func BuildTimeExceeded(original []byte, src netip.Addr) ([]byte, error) {
+	return buildICMPError(original, ICMPv4TimeExceeded, 0, ICMPv6TimeExceeded, 0, src)
+}
+
+// BuildHostUnreachable returns an ICMPv4 Host Unreachable or ICMPv6 Address
+// Unreachable message for an IPv4 or IPv6 packet.
+func BuildHostUnreachable(original []byte, src netip.Addr) ([]byte, error) {
+	return buildICMPError(original, ICMPv4DestinationUnreachable, ICMPv4HostUnreachable,
+		ICMPv6DestinationUnreachable, ICMPv6AddressUnreachable, src)
+}
+
+// BuildPortUnreachable returns an ICMPv4 or ICMPv6 Port Unreachable message
+// for an IPv4 or IPv6 packet.
+func BuildPortUnreachable(original []byte, src netip.Addr) ([]byte, error) {
+	return buildICMPError(original, ICMPv4DestinationUnreachable, ICMPv4PortUnreachable,
+		ICMPv6DestinationUnreachable, ICMPv6PortUnreachable, src)
+}
+
+// BuildFragmentationNeeded returns an ICMPv4 Fragmentation Needed message
+// advertising mtu for an IPv4 packet with the Don't Fragment flag that does not
+// fit the next hop.
+func BuildFragmentationNeeded(original []byte, mtu uint16, src netip.Addr) ([]byte, error) {
+	return BuildICMPv4Error(original, ICMPv4DestinationUnreachable, ICMPv4FragmentationNeeded, uint32(mtu), src)
+}
+
+// BuildPacketTooBig returns an ICMPv6 Packet Too Big message advertising mtu
+// for an IPv6 packet that does not fit the next hop.
+func BuildPacketTooBig(original []byte, mtu uint32, src netip.Addr) ([]byte, error) {
+	return BuildICMPv6Error(original, ICMPv6PacketTooBig, 0, mtu, src)
+}
+
+func buildICMPError(original []byte, type4, code4, type6, code6 byte, src netip.Addr) ([]byte, error) {
+	version, err := ParseIPVersion(original)
+	if err != nil {
+		return nil, err
+	}
+	if version == 4 {
+		return BuildICMPv4Error(original, type4, code4, 0, src)
+	}
+	return BuildICMPv6Error(original, type6, code6, 0, src)
+}
+
+// BuildEchoRequest returns an ICMPv4 or ICMPv6 echo request from src to dst,
+// depending on the address family of dst.
+func BuildEchoRequest(src, dst netip.Addr, id, seq uint16, data []byte) []byte {
+	var packet []byte
+	if dst.Is4() {
+		packet = make([]byte, 0, 20+8+len(data))
+		packet = AppendIPv4Header(packet, ICMP, DefaultTTL, src, dst, 8+len(data))
+		packet = append(packet, ICMPv4EchoRequest, 0, 0, 0)
+	} else {
+		packet = make([]byte, 0, 40+8+len(data))
+		packet = AppendIPv6Header(packet, IPv6_ICMP, DefaultTTL, src, dst, 8+len(data))
+		packet = append(packet, ICMPv6EchoRequest, 0, 0, 0)
+	}
+	packet = binary.BigEndian.AppendUint16(packet, id)
+	packet = binary.BigEndian.AppendUint16(packet, seq)
+	packet = append(packet, data...)
+	_ = FixTransportChecksum(packet)
+	return packet
+}
+
+// BuildEchoReply returns the reply to an ICMPv4 or ICMPv6 echo request, sent
+// back from its destination with the same identifier, sequence number and
+// data. IPv4 options and IPv6 extension headers are not copied.
+func BuildEchoReply(request []byte) ([]byte, error) {
+	if err := ValidateIP(request); err != nil {
+		return nil, err
+	}
+	var (
+		packet []byte
+		icmp   []byte
+	)
+	if IPVersion(request) == 4 {
+		if IPv4Protocol(request) != ICMP || IPv4FragmentOffset(request) != 0 {
+			return nil, ErrNotEchoRequest
+		}
+		icmp = IPv4Payload(request[:IPv4TotalLength(request)])
+		if len(icmp) < 8 || icmp[0] != ICMPv4EchoRequest {
+			return nil, ErrNotEchoRequest
+		}
+		src := netip.AddrFrom4([4]byte(request[12:16]))
+		dst := netip.AddrFrom4([4]byte(request[16:20]))
+		packet = make([]byte, 0, 20+len(icmp))
+		packet = AppendIPv4Header(packet, ICMP, DefaultTTL, dst, src, len(icmp))
+		packet = append(packet, ICMPv4EchoReply)
+	} else {
+		protocol, offset, err := ParseIPv6UpperLayer(request)
+		if err != nil {
+			return nil, err
+		}
+		if protocol != IPv6_ICMP || isNonFirstFragment(request) {
+			return nil, ErrNotEchoRequest
+		}
+		icmp = request[offset : 40+int(IPv6PayloadLength(request))]
+		if len(icmp) < 8 || icmp[0] != ICMPv6EchoRequest {
+			return nil, ErrNotEchoRequest
+		}
+		src := netip.AddrFrom16([16]byte(request[8:24]))
+		dst := netip.AddrFrom16([16]byte(request[24:40]))
+		packet = make([]byte, 0, 40+len(icmp))
+		packet = AppendIPv6Header(packet, IPv6_ICMP, DefaultTTL, dst, src, len(icmp))
+		packet = append(packet, ICMPv6EchoReply)
+	}
+	packet = append(packet, icmp[1:]...)
+	_ = FixTransportChecksum(packet)
+	return packet, nil
+}
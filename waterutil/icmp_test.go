@@ -0,0 +1,102 @@
+package waterutil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+)
+
+func TestICMPv4Error(t *testing.T) {
+	router := netip.MustParseAddr("10.0.0.254")
+	original := buildIPv4(UDP, append(udpHeader(), make([]byte, 1000)...))
+	packet, err := BuildPortUnreachable(original, router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkValid(t, packet)
+	if len(packet) != ICMPv4ErrorMaxSize {
+		t.Fatalf("expected the error to be truncated to %d bytes, got %d", ICMPv4ErrorMaxSize, len(packet))
+	}
+	if !IPv4Destination(packet).Equal(IPv4Source(original)) || IPv4Source(packet).String() != router.String() {
+		t.Fatal("error must be sent from the router to the original sender")
+	}
+	icmp := IPv4Payload(packet)
+	if icmp[0] != ICMPv4DestinationUnreachable || icmp[1] != ICMPv4PortUnreachable ||
+		!bytes.Equal(icmp[8:], original[:len(icmp)-8]) {
+		t.Fatal("unexpected ICMP header or quote")
+	}
+
+	packet, err = BuildFragmentationNeeded(buildIPv4(TCP, tcpHeader()), 1400, router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binary.BigEndian.Uint16(IPv4Payload(packet)[6:8]) != 1400 {
+		t.Fatal("next-hop MTU must be in the second half of the rest of header")
+	}
+
+	if _, err := BuildTimeExceeded(packet, router); err != ErrICMPSuppressed {
+		t.Fatalf("expected ErrICMPSuppressed for an ICMP error, got %v", err)
+	}
+	multicast := buildIPv4(UDP, udpHeader())
+	SetIPv4Destination(multicast, netip.MustParseAddr("224.0.0.251").AsSlice())
+	if _, err := BuildPortUnreachable(multicast, router); err != ErrICMPSuppressed {
+		t.Fatalf("expected ErrICMPSuppressed for a multicast packet, got %v", err)
+	}
+}
+
+func TestICMPv6Error(t *testing.T) {
+	router := netip.MustParseAddr("fd00::fe")
+	original := buildIPv6(UDP, append(udpHeader(), make([]byte, 1500)...))
+	packet, err := BuildPacketTooBig(original, 1280, router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkValid(t, packet)
+	if len(packet) != ICMPv6ErrorMaxSize {
+		t.Fatalf("expected the error to be truncated to %d bytes, got %d", ICMPv6ErrorMaxSize, len(packet))
+	}
+	if !IPv6Destination(packet).Equal(IPv6Source(original)) {
+		t.Fatal("error must be sent to the original sender")
+	}
+
+	if _, err := BuildHostUnreachable(packet, router); err != ErrICMPSuppressed {
+		t.Fatalf("expected ErrICMPSuppressed for an ICMPv6 error, got %v", err)
+	}
+	SetIPv6Destination(original, netip.MustParseAddr("ff02::1").AsSlice())
+	if _, err := BuildPortUnreachable(original, router); err != ErrICMPSuppressed {
+		t.Fatalf("expected ErrICMPSuppressed for a multicast packet, got %v", err)
+	}
+	if _, err := BuildPacketTooBig(original, 1280, router); err != nil {
+		t.Fatalf("Packet Too Big must be sent for multicast packets, got %v", err)
+	}
+}
+
+func TestEcho(t *testing.T) {
+	for _, addrs := range [][2]netip.Addr{
+		{netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")},
+		{netip.MustParseAddr("fd00::1"), netip.MustParseAddr("fd00::2")},
+	} {
+		request := BuildEchoRequest(addrs[0], addrs[1], 0x1234, 7, []byte("ping"))
+		checkValid(t, request)
+		reply, err := BuildEchoReply(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkValid(t, reply)
+		if IPSource(reply).String() != addrs[1].String() || IPDestination(reply).String() != addrs[0].String() {
+			t.Fatal("reply must swap the addresses")
+		}
+		icmp, err := NewICMPMessage(IPPayload(reply))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if icmp.Type() != ICMPv4EchoReply && icmp.Type() != ICMPv6EchoReply ||
+			icmp.Identifier() != 0x1234 || icmp.Sequence() != 7 || string(icmp.Body()) != "ping" {
+			t.Fatal("unexpected echo reply")
+		}
+		if _, err := BuildEchoReply(reply); err != ErrNotEchoRequest {
+			t.Fatalf("expected ErrNotEchoRequest, got %v", err)
+		}
+	}
+}
@@ -134,6 +134,7 @@ const (
 	PIPE              = 0x83
 	SCTP              = 0x84
 	FC                = 0x85
+	Mobility_Header   = 0x87
 	manet             = 0x8A
 	HIP               = 0x8B
 	Shim6             = 0x8C
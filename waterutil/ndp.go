@@ -0,0 +1,398 @@
+package waterutil
+
+import (
+	"encoding/binary"
+	"iter"
+	"net"
+	"net/netip"
+)
+
+// ICMPv6 Neighbor Discovery message types, see RFC 4861.
+const (
+	NDPRouterSolicitation    byte = 133
+	NDPRouterAdvertisement   byte = 134
+	NDPNeighborSolicitation  byte = 135
+	NDPNeighborAdvertisement byte = 136
+	NDPRedirect              byte = 137
+)
+
+// Neighbor Discovery option types.
+const (
+	NDPOptionSourceLinkLayerAddress byte = 1
+	NDPOptionTargetLinkLayerAddress byte = 2
+	NDPOptionPrefixInformation      byte = 3
+	NDPOptionRedirectedHeader       byte = 4
+	NDPOptionMTU                    byte = 5
+)
+
+// Neighbor Advertisement flags.
+const (
+	NDPFlagRouter    byte = 0x80
+	NDPFlagSolicited byte = 0x40
+	NDPFlagOverride  byte = 0x20
+)
+
+// NDPHopLimit is the hop limit every Neighbor Discovery packet must be sent
+// with. Packets with a different hop limit did not originate on the link.
+const NDPHopLimit = 255
+
+// ndpOptionsOffset returns the offset of the options of an NDP message of the
+// given type, or 0 if it is not an NDP message.
+func ndpOptionsOffset(msgType byte) int {
+	switch msgType {
+	case NDPRouterSolicitation:
+		return 8
+	case NDPRouterAdvertisement:
+		return 16
+	case NDPNeighborSolicitation, NDPNeighborAdvertisement:
+		return 24
+	case NDPRedirect:
+		return 40
+	default:
+		return 0
+	}
+}
+
+// NDPMessage is a zero-copy view of an ICMPv6 Neighbor Discovery message.
+// Create it with NewNDPMessage or ParseNDP. Type-specific accessors must only
+// be called on messages of that type.
+type NDPMessage []byte
+
+// NewNDPMessage validates the ICMPv6 message b, including its options, and
+// returns a view of it.
+func NewNDPMessage(b []byte) (NDPMessage, error) {
+	if len(b) < 4 {
+		return nil, ErrTruncated
+	}
+	off := ndpOptionsOffset(b[0])
+	if off == 0 || b[1] != 0 {
+		return nil, ErrInvalidNDP
+	}
+	if len(b) < off {
+		return nil, ErrTruncated
+	}
+	for len(b) > off {
+		if len(b) < off+2 {
+			return nil, ErrTruncated
+		}
+		length := int(b[off+1]) * 8
+		if length == 0 {
+			return nil, ErrInvalidNDP
+		}
+		if len(b) < off+length {
+			return nil, ErrTruncated
+		}
+		off += length
+	}
+	return NDPMessage(b), nil
+}
+
+// ParseNDP returns a view of the Neighbor Discovery message carried by an IPv6
+// packet. It checks that the packet was sent with NDPHopLimit.
+func ParseNDP(packet []byte) (NDPMessage, error) {
+	protocol, offset, err := ParseIPv6UpperLayer(packet)
+	if err != nil {
+		return nil, err
+	}
+	if protocol != IPv6_ICMP || isNonFirstFragment(packet) {
+		return nil, ErrUnsupportedProtocol
+	}
+	if IPv6HopLimit(packet) != NDPHopLimit {
+		return nil, ErrInvalidNDP
+	}
+	return NewNDPMessage(packet[offset : 40+int(IPv6PayloadLength(packet))])
+}
+
+func (m NDPMessage) Type() byte {
+	return m[0]
+}
+
+// TargetAddress returns the target address of a Neighbor Solicitation,
+// Neighbor Advertisement or Redirect.
+func (m NDPMessage) TargetAddress() netip.Addr {
+	return netip.AddrFrom16([16]byte(m[8:24]))
+}
+
+// NeighborFlags returns the Router, Solicited and Override flags of a Neighbor
+// Advertisement.
+func (m NDPMessage) NeighborFlags() byte {
+	return m[4] & (NDPFlagRouter | NDPFlagSolicited | NDPFlagOverride)
+}
+
+// CurHopLimit returns the hop limit advertised in a Router Advertisement.
+func (m NDPMessage) CurHopLimit() byte {
+	return m[4]
+}
+
+// Managed returns the managed address configuration flag of a Router
+// Advertisement.
+func (m NDPMessage) Managed() bool {
+	return m[5]&0x80 != 0
+}
+
+// OtherConfig returns the other configuration flag of a Router Advertisement.
+func (m NDPMessage) OtherConfig() bool {
+	return m[5]&0x40 != 0
+}
+
+// RouterLifetime returns the router lifetime of a Router Advertisement in
+// seconds.
+func (m NDPMessage) RouterLifetime() uint16 {
+	return binary.BigEndian.Uint16(m[6:8])
+}
+
+// ReachableTime returns the reachable time of a Router Advertisement in
+// milliseconds.
+func (m NDPMessage) ReachableTime() uint32 {
+	return binary.BigEndian.Uint32(m[8:12])
+}
+
+// RetransTimer returns the retransmission timer of a Router Advertisement in
+// milliseconds.
+func (m NDPMessage) RetransTimer() uint32 {
+	return binary.BigEndian.Uint32(m[12:16])
+}
+
+// Options iterates over the options of m.
+func (m NDPMessage) Options() iter.Seq[NDPOption] {
+	return func(yield func(NDPOption) bool) {
+		for off := ndpOptionsOffset(m[0]); len(m) >= off+2 && m[off+1] != 0; {
+			length := int(m[off+1]) * 8
+			if len(m) < off+length || !yield(NDPOption(m[off:off+length])) {
+				return
+			}
+			off += length
+		}
+	}
+}
+
+func (m NDPMessage) option(optType byte) NDPOption {
+	for opt := range m.Options() {
+		if opt.Type() == optType {
+			return opt
+		}
+	}
+	return nil
+}
+
+// SourceLinkLayerAddress returns the source link-layer address option, or nil
+// if there is none.
+func (m NDPMessage) SourceLinkLayerAddress() net.HardwareAddr {
+	return m.option(NDPOptionSourceLinkLayerAddress).linkLayerAddress()
+}
+
+// TargetLinkLayerAddress returns the target link-layer address option, or nil
+// if there is none.
+func (m NDPMessage) TargetLinkLayerAddress() net.HardwareAddr {
+	return m.option(NDPOptionTargetLinkLayerAddress).linkLayerAddress()
+}
+
+// MTU returns the MTU option and whether it is present.
+func (m NDPMessage) MTU() (uint32, bool) {
+	opt := m.option(NDPOptionMTU)
+	if len(opt) < 8 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(opt[4:8]), true
+}
+
+// PrefixInformation iterates over the valid prefix information options.
+func (m NDPMessage) PrefixInformation() iter.Seq[NDPPrefixInformation] {
+	return func(yield func(NDPPrefixInformation) bool) {
+		for opt := range m.Options() {
+			if opt.Type() != NDPOptionPrefixInformation {
+				continue
+			}
+			info, ok := opt.prefixInformation()
+			if ok && !yield(info) {
+				return
+			}
+		}
+	}
+}
+
+// NDPOption is a zero-copy view of a Neighbor Discovery option, including its
+// type and length.
+type NDPOption []byte
+
+func (o NDPOption) Type() byte {
+	return o[0]
+}
+
+// Data returns the option without its type and length.
+func (o NDPOption) Data() []byte {
+	return o[2:]
+}
+
+func (o NDPOption) linkLayerAddress() net.HardwareAddr {
+	if len(o) < 8 {
+		return nil
+	}
+	return net.HardwareAddr(o[2:8])
+}
+
+func (o NDPOption) prefixInformation() (NDPPrefixInformation, bool) {
+	if len(o) < 32 || o[2] > 128 {
+		return NDPPrefixInformation{}, false
+	}
+	return NDPPrefixInformation{
+		Prefix:            netip.PrefixFrom(netip.AddrFrom16([16]byte(o[16:32])), int(o[2])),
+		OnLink:            o[3]&0x80 != 0,
+		Autonomous:        o[3]&0x40 != 0,
+		ValidLifetime:     binary.BigEndian.Uint32(o[4:8]),
+		PreferredLifetime: binary.BigEndian.Uint32(o[8:12]),
+	}, true
+}
+
+// NDPPrefixInformation is the content of a prefix information option.
+// Lifetimes are in seconds, 0xFFFFFFFF means infinity.
+type NDPPrefixInformation struct {
+	Prefix            netip.Prefix
+	OnLink            bool
+	Autonomous        bool
+	ValidLifetime     uint32
+	PreferredLifetime uint32
+}
+
+// RouterAdvertisement holds the header fields of a Router Advertisement. Zero
+// values mean unspecified.
+type RouterAdvertisement struct {
+	CurHopLimit byte
+	Managed     bool
+	OtherConfig bool
+	// RouterLifetime is in seconds. Zero means that the sender is not a
+	// default router.
+	RouterLifetime uint16
+	// ReachableTime and RetransTimer are in milliseconds.
+	ReachableTime uint32
+	RetransTimer  uint32
+}
+
+// AppendRouterSolicitation appends a Router Solicitation without options to b.
+// Options are appended separately; BuildNDPPacket computes the checksum.
+func AppendRouterSolicitation(b []byte) []byte {
+	return append(b, NDPRouterSolicitation, 0, 0, 0, 0, 0, 0, 0)
+}
+
+// AppendRouterAdvertisement appends a Router Advertisement without options to
+// b.
+func AppendRouterAdvertisement(b []byte, ra RouterAdvertisement) []byte {
+	var flags byte
+	if ra.Managed {
+		flags |= 0x80
+	}
+	if ra.OtherConfig {
+		flags |= 0x40
+	}
+	b = append(b, NDPRouterAdvertisement, 0, 0, 0, ra.CurHopLimit, flags)
+	b = binary.BigEndian.AppendUint16(b, ra.RouterLifetime)
+	b = binary.BigEndian.AppendUint32(b, ra.ReachableTime)
+	return binary.BigEndian.AppendUint32(b, ra.RetransTimer)
+}
+
+// AppendNeighborSolicitation appends a Neighbor Solicitation for target
+// without options to b.
+func AppendNeighborSolicitation(b []byte, target netip.Addr) []byte {
+	t := target.As16()
+	b = append(b, NDPNeighborSolicitation, 0, 0, 0, 0, 0, 0, 0)
+	return append(b, t[:]...)
+}
+
+// AppendNeighborAdvertisement appends a Neighbor Advertisement for target with
+// the given NDPFlag values and without options to b.
+func AppendNeighborAdvertisement(b []byte, flags byte, target netip.Addr) []byte {
+	t := target.As16()
+	b = append(b, NDPNeighborAdvertisement, 0, 0, 0, flags, 0, 0, 0)
+	return append(b, t[:]...)
+}
+
+// AppendNDPLinkLayerAddressOption appends a source or target link-layer
+// address option to b.
+func AppendNDPLinkLayerAddressOption(b []byte, optType byte, mac net.HardwareAddr) []byte {
+	b = append(b, optType, 1)
+	return append(b, mac[:6]...)
+}
+
+// AppendNDPMTUOption appends an MTU option to b.
+func AppendNDPMTUOption(b []byte, mtu uint32) []byte {
+	b = append(b, NDPOptionMTU, 1, 0, 0)
+	return binary.BigEndian.AppendUint32(b, mtu)
+}
+
+// AppendNDPPrefixInformationOption appends a prefix information option to b.
+func AppendNDPPrefixInformationOption(b []byte, info NDPPrefixInformation) []byte {
+	var flags byte
+	if info.OnLink {
+		flags |= 0x80
+	}
+	if info.Autonomous {
+		flags |= 0x40
+	}
+	prefix := info.Prefix.Masked().Addr().As16()
+	b = append(b, NDPOptionPrefixInformation, 4, byte(info.Prefix.Bits()), flags)
+	b = binary.BigEndian.AppendUint32(b, info.ValidLifetime)
+	b = binary.BigEndian.AppendUint32(b, info.PreferredLifetime)
+	b = append(b, 0, 0, 0, 0)
+	return append(b, prefix[:]...)
+}
+
+// BuildNDPPacket returns an IPv6 packet from src to dst carrying the Neighbor
+// Discovery message msg, sent with NDPHopLimit and a valid checksum.
+func BuildNDPPacket(src, dst netip.Addr, msg []byte) []byte {
+	packet := make([]byte, 0, 40+len(msg))
+	packet = AppendIPv6Header(packet, IPv6_ICMP, NDPHopLimit, src, dst, len(msg))
+	packet = append(packet, msg...)
+	_ = FixTransportChecksum(packet)
+	return packet
+}
+
+// BuildNeighborAdvertisementFrame returns an Ethernet frame from mac answering
+// the Neighbor Solicitation ns, received in a frame from ethSrc with the IPv6
+// source address src. The advertisement carries mac as target link-layer
+// address and sets NDPFlagOverride in addition to flags. A solicitation for
+// duplicate address detection, sent from the unspecified address, is answered
+// to all nodes without NDPFlagSolicited, as required by RFC 4861.
+func BuildNeighborAdvertisementFrame(ethSrc net.HardwareAddr, src netip.Addr, ns NDPMessage, mac net.HardwareAddr, flags byte) []byte {
+	flags |= NDPFlagOverride
+	dst := src
+	dstMAC := ns.SourceLinkLayerAddress()
+	if dstMAC == nil {
+		dstMAC = ethSrc
+	}
+	if src.IsUnspecified() {
+		dst = netip.AddrFrom16([16]byte{0xff, 0x02, 15: 1})
+		dstMAC = IPv6MulticastMAC(dst)
+	} else {
+		flags |= NDPFlagSolicited
+	}
+
+	target := ns.TargetAddress()
+	msg := AppendNeighborAdvertisement(nil, flags, target)
+	msg = AppendNDPLinkLayerAddressOption(msg, NDPOptionTargetLinkLayerAddress, mac)
+	frame := make([]byte, 0, 14+40+len(msg))
+	frame = AppendEthernetHeader(frame, dstMAC, mac, IPv6)
+	return append(frame, BuildNDPPacket(target, dst, msg)...)
+}
+
+// SolicitedNodeMulticast returns the solicited-node multicast address of an
+// IPv6 address, to which Neighbor Solicitations for it are sent.
+func SolicitedNodeMulticast(addr netip.Addr) netip.Addr {
+	a := addr.As16()
+	return netip.AddrFrom16([16]byte{0xff, 0x02, 10: 0, 11: 1, 12: 0xff, 13: a[13], 14: a[14], 15: a[15]})
+}
+
+// IPv6MulticastMAC returns the Ethernet multicast address an IPv6 multicast
+// address is mapped to.
+func IPv6MulticastMAC(addr netip.Addr) net.HardwareAddr {
+	a := addr.As16()
+	return net.HardwareAddr{0x33, 0x33, a[12], a[13], a[14], a[15]}
+}
+
+// IPv6LinkLocalFromMAC returns the link-local address derived from mac using
+// the modified EUI-64 format.
+func IPv6LinkLocalFromMAC(mac net.HardwareAddr) netip.Addr {
+	return netip.AddrFrom16([16]byte{
+		0xfe, 0x80, 8: mac[0] ^ 0x02, 9: mac[1], 10: mac[2], 11: 0xff,
+		12: 0xfe, 13: mac[3], 14: mac[4], 15: mac[5],
+	})
+}
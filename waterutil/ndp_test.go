@@ -0,0 +1,94 @@
+package waterutil
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestNeighborDiscovery(t *testing.T) {
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	src := netip.MustParseAddr("fe80::1")
+	target := netip.MustParseAddr("2001:db8::1234:5678")
+
+	msg := AppendNeighborSolicitation(nil, target)
+	msg = AppendNDPLinkLayerAddressOption(msg, NDPOptionSourceLinkLayerAddress, mac)
+	packet := BuildNDPPacket(src, SolicitedNodeMulticast(target), msg)
+	checkValid(t, packet)
+	if IPv6Destination(packet).String() != "ff02::1:ff34:5678" {
+		t.Fatalf("unexpected solicited-node address %s", IPv6Destination(packet))
+	}
+
+	ns, err := ParseNDP(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ns.Type() != NDPNeighborSolicitation || ns.TargetAddress() != target ||
+		!bytes.Equal(ns.SourceLinkLayerAddress(), mac) || ns.TargetLinkLayerAddress() != nil {
+		t.Fatal("unexpected Neighbor Solicitation")
+	}
+
+	msg = AppendNeighborAdvertisement(nil, NDPFlagSolicited|NDPFlagOverride, target)
+	msg = AppendNDPLinkLayerAddressOption(msg, NDPOptionTargetLinkLayerAddress, mac)
+	na, err := ParseNDP(BuildNDPPacket(target, src, msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if na.NeighborFlags() != NDPFlagSolicited|NDPFlagOverride || !bytes.Equal(na.TargetLinkLayerAddress(), mac) {
+		t.Fatal("unexpected Neighbor Advertisement")
+	}
+
+	SetIPv6HopLimit(packet, 64)
+	if _, err := ParseNDP(packet); err != ErrInvalidNDP {
+		t.Fatalf("expected ErrInvalidNDP for a routed packet, got %v", err)
+	}
+	if _, err := NewNDPMessage(append(AppendNeighborSolicitation(nil, target), 1, 0)); err != ErrInvalidNDP {
+		t.Fatalf("expected ErrInvalidNDP for a zero length option, got %v", err)
+	}
+	if _, err := NewNDPMessage(append(AppendNeighborSolicitation(nil, target), 1, 1, 0)); err != ErrTruncated {
+		t.Fatalf("expected ErrTruncated for a truncated option, got %v", err)
+	}
+}
+
+func TestRouterAdvertisement(t *testing.T) {
+	mac := net.HardwareAddr{0x02, 0x11, 0x22, 0x33, 0x44, 0x55}
+	src := IPv6LinkLocalFromMAC(mac)
+	if src.String() != "fe80::11:22ff:fe33:4455" {
+		t.Fatalf("unexpected link-local address %s", src)
+	}
+	info := NDPPrefixInformation{
+		Prefix:            netip.MustParsePrefix("2001:db8:1::/64"),
+		OnLink:            true,
+		Autonomous:        true,
+		ValidLifetime:     86400,
+		PreferredLifetime: 14400,
+	}
+
+	msg := AppendRouterAdvertisement(nil, RouterAdvertisement{CurHopLimit: 64, OtherConfig: true, RouterLifetime: 1800})
+	msg = AppendNDPLinkLayerAddressOption(msg, NDPOptionSourceLinkLayerAddress, mac)
+	msg = AppendNDPMTUOption(msg, 1400)
+	msg = AppendNDPPrefixInformationOption(msg, info)
+	ra, err := ParseNDP(BuildNDPPacket(src, netip.MustParseAddr("ff02::1"), msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ra.CurHopLimit() != 64 || ra.Managed() || !ra.OtherConfig() || ra.RouterLifetime() != 1800 {
+		t.Fatal("unexpected Router Advertisement header")
+	}
+	if mtu, ok := ra.MTU(); !ok || mtu != 1400 {
+		t.Fatalf("unexpected MTU %d", mtu)
+	}
+	var prefixes []NDPPrefixInformation
+	for p := range ra.PrefixInformation() {
+		prefixes = append(prefixes, p)
+	}
+	if len(prefixes) != 1 || prefixes[0] != info {
+		t.Fatalf("unexpected prefix information %+v", prefixes)
+	}
+
+	rs, err := ParseNDP(BuildNDPPacket(src, netip.MustParseAddr("ff02::2"), AppendRouterSolicitation(nil)))
+	if err != nil || rs.Type() != NDPRouterSolicitation || rs.SourceLinkLayerAddress() != nil {
+		t.Fatalf("unexpected Router Solicitation (%v)", err)
+	}
+}
@@ -7,6 +7,7 @@ import (
 type Tagging int
 
 // Indicating whether/how a MAC frame is tagged. The value is number of bytes taken by tagging.
+// Frames with more than two VLAN tags have a Tagging of 4 bytes per tag.
 const (
 	NotTagged    Tagging = 0
 	Tagged       Tagging = 4
@@ -21,13 +22,14 @@ func MACSource(macFrame []byte) net.HardwareAddr {
 	return net.HardwareAddr(macFrame[6:12])
 }
 
+// MACTagging returns the number of bytes taken by the VLAN tag stack of
+// macFrame. See IsVLANTPID for the recognized tags.
 func MACTagging(macFrame []byte) Tagging {
-	if macFrame[12] == 0x81 && macFrame[13] == 0x00 {
-		return Tagged
-	} else if macFrame[12] == 0x88 && macFrame[13] == 0xa8 {
-		return DoubleTagged
+	off := 12
+	for len(macFrame) >= off+2 && IsVLANTPID(Ethertype(macFrame[off:off+2])) {
+		off += 4
 	}
-	return NotTagged
+	return Tagging(off - 12)
 }
 
 func MACEthertype(macFrame []byte) Ethertype {
@@ -39,6 +41,14 @@ func MACPayload(macFrame []byte) []byte {
 	return macFrame[12+MACTagging(macFrame)+2:]
 }
 
+// AppendEthernetHeader appends an untagged Ethernet header to b and returns the
+// extended buffer.
+func AppendEthernetHeader(b []byte, dst, src net.HardwareAddr, ethertype Ethertype) []byte {
+	b = append(b, dst[:6]...)
+	b = append(b, src[:6]...)
+	return append(b, ethertype[:]...)
+}
+
 func IsMACBroadcast(addr net.HardwareAddr) bool {
 	return addr[0] == 0xff && addr[1] == 0xff && addr[2] == 0xff && addr[3] == 0xff && addr[4] == 0xff && addr[5] == 0xff
 }
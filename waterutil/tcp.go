@@ -0,0 +1,261 @@
+package waterutil
+
+import (
+	"encoding/binary"
+	"iter"
+)
+
+// TCP header flags, as returned by TCPFlags.
+const (
+	TCPFlagFIN byte = 0x01
+	TCPFlagSYN byte = 0x02
+	TCPFlagRST byte = 0x04
+	TCPFlagPSH byte = 0x08
+	TCPFlagACK byte = 0x10
+	TCPFlagURG byte = 0x20
+	TCPFlagECE byte = 0x40
+	TCPFlagCWR byte = 0x80
+)
+
+// TCP option kinds.
+const (
+	TCPOptionEnd           byte = 0
+	TCPOptionNOP           byte = 1
+	TCPOptionMSS           byte = 2
+	TCPOptionWindowScale   byte = 3
+	TCPOptionSACKPermitted byte = 4
+	TCPOptionSACK          byte = 5
+	TCPOptionTimestamps    byte = 8
+)
+
+// The TCP getters below take a whole IPv4 or IPv6 packet, skipping IPv6
+// extension headers. They do not check the packet; call ValidateTCP first.
+
+// tcpSegment returns the TCP header and payload of packet, trimmed to the IP
+// length.
+func tcpSegment(packet []byte) []byte {
+	_, hdr := transportHeader(packet)
+	return hdr
+}
+
+func TCPSeq(packet []byte) uint32 {
+	return binary.BigEndian.Uint32(tcpSegment(packet)[4:8])
+}
+
+func TCPAck(packet []byte) uint32 {
+	return binary.BigEndian.Uint32(tcpSegment(packet)[8:12])
+}
+
+// TCPDataOffset returns the length of the TCP header, including options, in
+// bytes.
+func TCPDataOffset(packet []byte) int {
+	return int(tcpSegment(packet)[12]>>4) * 4
+}
+
+// TCPFlags returns the 8 flag bits CWR, ECE, URG, ACK, PSH, RST, SYN and FIN,
+// from most to least significant. Test them with the TCPFlag constants.
+func TCPFlags(packet []byte) byte {
+	return tcpSegment(packet)[13]
+}
+
+func TCPWindow(packet []byte) uint16 {
+	return binary.BigEndian.Uint16(tcpSegment(packet)[14:16])
+}
+
+func TCPPayload(packet []byte) []byte {
+	hdr := tcpSegment(packet)
+	return hdr[int(hdr[12]>>4)*4:]
+}
+
+// TCPOptions iterates over the TCP options of packet. See ParseTCPOptions.
+func TCPOptions(packet []byte) iter.Seq[TCPOption] {
+	hdr := tcpSegment(packet)
+	return ParseTCPOptions(hdr[20 : int(hdr[12]>>4)*4])
+}
+
+// ParseTCPOptions iterates over raw TCP options, such as TCPSegment.Options.
+// Padding (End of Option List and No-Operation) is skipped. Iteration stops
+// at the first malformed option.
+func ParseTCPOptions(options []byte) iter.Seq[TCPOption] {
+	return func(yield func(TCPOption) bool) {
+		for _, opt := range tcpOptions(options) {
+			if !yield(opt) {
+				return
+			}
+		}
+	}
+}
+
+// tcpOptions is like ParseTCPOptions, but also yields the offset of each
+// option within options.
+func tcpOptions(options []byte) iter.Seq2[int, TCPOption] {
+	return func(yield func(int, TCPOption) bool) {
+		for off := 0; off < len(options); {
+			switch options[off] {
+			case TCPOptionEnd:
+				return
+			case TCPOptionNOP:
+				off++
+				continue
+			}
+			if off+2 > len(options) {
+				return
+			}
+			length := int(options[off+1])
+			if length < 2 || off+length > len(options) || !yield(off, TCPOption(options[off:off+length])) {
+				return
+			}
+			off += length
+		}
+	}
+}
+
+// TCPOption is a zero-copy view of a TCP option, including its kind and
+// length. The typed decoders report false if the option is of a different
+// kind or has an invalid length.
+type TCPOption []byte
+
+func (o TCPOption) Kind() byte {
+	return o[0]
+}
+
+// Data returns the option without its kind and length.
+func (o TCPOption) Data() []byte {
+	return o[2:]
+}
+
+// MSS returns the maximum segment size of an MSS option.
+func (o TCPOption) MSS() (uint16, bool) {
+	if o[0] != TCPOptionMSS || len(o) != 4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(o[2:4]), true
+}
+
+// WindowScale returns the shift count of a window scale option.
+func (o TCPOption) WindowScale() (byte, bool) {
+	if o[0] != TCPOptionWindowScale || len(o) != 3 {
+		return 0, false
+	}
+	return o[2], true
+}
+
+// SACKPermitted reports whether o is a SACK-permitted option.
+func (o TCPOption) SACKPermitted() bool {
+	return o[0] == TCPOptionSACKPermitted && len(o) == 2
+}
+
+// TCPSACKBlock is a block of data received out of order, from Left up to but
+// not including Right.
+type TCPSACKBlock struct {
+	Left, Right uint32
+}
+
+// SACKBlocks iterates over the blocks of a SACK option. It yields nothing if
+// o is not a valid SACK option.
+func (o TCPOption) SACKBlocks() iter.Seq[TCPSACKBlock] {
+	return func(yield func(TCPSACKBlock) bool) {
+		if o[0] != TCPOptionSACK || (len(o)-2)%8 != 0 {
+			return
+		}
+		for b := o[2:]; len(b) >= 8; b = b[8:] {
+			if !yield(TCPSACKBlock{Left: binary.BigEndian.Uint32(b[0:4]), Right: binary.BigEndian.Uint32(b[4:8])}) {
+				return
+			}
+		}
+	}
+}
+
+// Timestamps returns the timestamp value and echo reply of a timestamps
+// option.
+func (o TCPOption) Timestamps() (value, echo uint32, ok bool) {
+	if o[0] != TCPOptionTimestamps || len(o) != 10 {
+		return 0, 0, false
+	}
+	return binary.BigEndian.Uint32(o[2:6]), binary.BigEndian.Uint32(o[6:10]), true
+}
+
+// TCPMSS returns the value of the MSS option of packet and whether it is
+// present.
+func TCPMSS(packet []byte) (uint16, bool) {
+	for opt := range TCPOptions(packet) {
+		if mss, ok := opt.MSS(); ok {
+			return mss, true
+		}
+	}
+	return 0, false
+}
+
+// checkedTCPSegment is like tcpSegment, but returns nil if packet does not
+// carry a complete TCP header.
+func checkedTCPSegment(packet []byte) []byte {
+	if len(packet) == 0 {
+		return nil
+	}
+	protocol, hdr := transportHeader(packet)
+	if protocol != TCP {
+		return nil
+	}
+	if _, err := NewTCPSegment(hdr); err != nil {
+		return nil
+	}
+	return hdr
+}
+
+// setTCPFieldWithChecksum replaces the bytes at off in the TCP header of
+// packet with data and updates the checksum incrementally. The checksum
+// covers 16-bit words, so the update spans the words containing the field.
+// Packets without a valid TCP header are left untouched.
+func setTCPFieldWithChecksum(packet []byte, off int, data []byte) bool {
+	hdr := checkedTCPSegment(packet)
+	if hdr == nil {
+		return false
+	}
+	start, end := off&^1, (off+len(data)+1)&^1
+	var buf [8]byte
+	old := buf[:end-start]
+	copy(old, hdr[start:end])
+	copy(hdr[off:], data)
+	updateTransportChecksum(packet, old, hdr[start:end], false)
+	return true
+}
+
+// SetTCPSeqWithChecksum sets the sequence number of a TCP packet and updates
+// its checksum. Packets without a valid TCP header are left untouched.
+func SetTCPSeqWithChecksum(packet []byte, seq uint32) {
+	setTCPFieldWithChecksum(packet, 4, binary.BigEndian.AppendUint32(nil, seq))
+}
+
+// SetTCPAckWithChecksum sets the acknowledgment number of a TCP packet and
+// updates its checksum. Packets without a valid TCP header are left untouched.
+func SetTCPAckWithChecksum(packet []byte, ack uint32) {
+	setTCPFieldWithChecksum(packet, 8, binary.BigEndian.AppendUint32(nil, ack))
+}
+
+// SetTCPFlagsWithChecksum sets the flags of a TCP packet and updates its
+// checksum. Packets without a valid TCP header are left untouched.
+func SetTCPFlagsWithChecksum(packet []byte, flags byte) {
+	setTCPFieldWithChecksum(packet, 13, []byte{flags})
+}
+
+// SetTCPWindowWithChecksum sets the window of a TCP packet and updates its
+// checksum. Packets without a valid TCP header are left untouched.
+func SetTCPWindowWithChecksum(packet []byte, window uint16) {
+	setTCPFieldWithChecksum(packet, 14, binary.BigEndian.AppendUint16(nil, window))
+}
+
+// SetTCPMSSWithChecksum sets the value of the MSS option of a TCP packet and
+// updates its checksum. It reports false, leaving packet untouched, if there
+// is no MSS option.
+func SetTCPMSSWithChecksum(packet []byte, mss uint16) bool {
+	hdr := checkedTCPSegment(packet)
+	if hdr == nil {
+		return false
+	}
+	for off, opt := range tcpOptions(hdr[20 : int(hdr[12]>>4)*4]) {
+		if _, ok := opt.MSS(); ok {
+			return setTCPFieldWithChecksum(packet, 20+off+2, binary.BigEndian.AppendUint16(nil, mss))
+		}
+	}
+	return false
+}
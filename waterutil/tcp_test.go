@@ -0,0 +1,162 @@
+package waterutil
+
+import (
+	"slices"
+	"testing"
+)
+
+// tcpWithOptions returns a TCP SYN header with MSS 1460, SACK permitted,
+// timestamps, window scale 7 and a SACK block, in that order.
+func tcpWithOptions() []byte {
+	return []byte{
+		0x04, 0xd2, 0x00, 0x50, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0xd0, 0x12, 0x72, 0x10,
+		0, 0, 0, 0,
+		2, 4, 0x05, 0xb4,
+		4, 2,
+		8, 10, 0, 0, 0, 1, 0, 0, 0, 2,
+		1, 3, 3, 7,
+		5, 10, 0, 0, 0, 10, 0, 0, 0, 20,
+		0, 0,
+		'h', 'i',
+	}
+}
+
+func checkTransportChecksum(t *testing.T, packet []byte) {
+	t.Helper()
+	want, err := ComputeTransportChecksum(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := uint16(tcpSegment(packet)[16])<<8 | uint16(tcpSegment(packet)[17]); got != want {
+		t.Errorf("checksum = %#04x, want %#04x", got, want)
+	}
+}
+
+func TestTCPGetters(t *testing.T) {
+	for _, packet := range [][]byte{
+		buildIPv4(TCP, tcpWithOptions()),
+		withExtensionHeaders(buildIPv6(TCP, tcpWithOptions())),
+	} {
+		if err := ValidateTCP(packet); err != nil {
+			t.Fatal(err)
+		}
+		if got := TCPSeq(packet); got != 0x11223344 {
+			t.Errorf("seq = %#x", got)
+		}
+		if got := TCPAck(packet); got != 0x55667788 {
+			t.Errorf("ack = %#x", got)
+		}
+		if got := TCPDataOffset(packet); got != 52 {
+			t.Errorf("data offset = %d", got)
+		}
+		if got := TCPFlags(packet); got != TCPFlagSYN|TCPFlagACK {
+			t.Errorf("flags = %#02x", got)
+		}
+		if got := TCPWindow(packet); got != 0x7210 {
+			t.Errorf("window = %#x", got)
+		}
+		if got := string(TCPPayload(packet)); got != "hi" {
+			t.Errorf("payload = %q", got)
+		}
+
+		var kinds []byte
+		for opt := range TCPOptions(packet) {
+			kinds = append(kinds, opt.Kind())
+			switch opt.Kind() {
+			case TCPOptionMSS:
+				if mss, ok := opt.MSS(); !ok || mss != 1460 {
+					t.Errorf("MSS = %d, %v", mss, ok)
+				}
+			case TCPOptionSACKPermitted:
+				if !opt.SACKPermitted() {
+					t.Error("SACK permitted not decoded")
+				}
+			case TCPOptionTimestamps:
+				if value, echo, ok := opt.Timestamps(); !ok || value != 1 || echo != 2 {
+					t.Errorf("timestamps = %d, %d, %v", value, echo, ok)
+				}
+			case TCPOptionWindowScale:
+				if shift, ok := opt.WindowScale(); !ok || shift != 7 {
+					t.Errorf("window scale = %d, %v", shift, ok)
+				}
+			case TCPOptionSACK:
+				blocks := slices.Collect(opt.SACKBlocks())
+				if !slices.Equal(blocks, []TCPSACKBlock{{Left: 10, Right: 20}}) {
+					t.Errorf("SACK blocks = %v", blocks)
+				}
+			}
+			if _, ok := opt.MSS(); ok && opt.Kind() != TCPOptionMSS {
+				t.Errorf("option %d decoded as MSS", opt.Kind())
+			}
+		}
+		want := []byte{TCPOptionMSS, TCPOptionSACKPermitted, TCPOptionTimestamps, TCPOptionWindowScale, TCPOptionSACK}
+		if !slices.Equal(kinds, want) {
+			t.Errorf("option kinds = %v, want %v", kinds, want)
+		}
+	}
+}
+
+func TestTCPSetters(t *testing.T) {
+	for _, packet := range [][]byte{
+		buildIPv4(TCP, tcpWithOptions()),
+		withExtensionHeaders(buildIPv6(TCP, tcpWithOptions())),
+	} {
+		SetTCPSeqWithChecksum(packet, 0xdeadbeef)
+		SetTCPAckWithChecksum(packet, 0xcafebabe)
+		SetTCPFlagsWithChecksum(packet, TCPFlagFIN|TCPFlagECE|TCPFlagCWR)
+		SetTCPWindowWithChecksum(packet, 1234)
+		if !SetTCPMSSWithChecksum(packet, 1200) {
+			t.Fatal("MSS not set")
+		}
+		if TCPSeq(packet) != 0xdeadbeef || TCPAck(packet) != 0xcafebabe ||
+			TCPFlags(packet) != TCPFlagFIN|TCPFlagECE|TCPFlagCWR || TCPWindow(packet) != 1234 {
+			t.Error("fields not set")
+		}
+		if mss, ok := TCPMSS(packet); !ok || mss != 1200 {
+			t.Errorf("MSS = %d, %v", mss, ok)
+		}
+		checkTransportChecksum(t, packet)
+	}
+}
+
+func TestTCPUnalignedOption(t *testing.T) {
+	tcp := tcpHeader()
+	// A NOP followed by an MSS option starts the value at an odd offset.
+	tcp = slices.Insert(tcp, 20, 1, 2, 4, 0x05, 0xb4, 0, 0, 0)
+	tcp[12] = 0x70
+	packet := buildIPv4(TCP, tcp)
+	if !SetTCPMSSWithChecksum(packet, 536) {
+		t.Fatal("MSS not set")
+	}
+	if mss, _ := TCPMSS(packet); mss != 536 {
+		t.Errorf("MSS = %d", mss)
+	}
+	checkTransportChecksum(t, packet)
+}
+
+func TestTCPInvalid(t *testing.T) {
+	if err := ValidateTCP(buildIPv4(UDP, udpHeader())); err != ErrUnsupportedProtocol {
+		t.Errorf("UDP: %v", err)
+	}
+	tcp := tcpHeader()
+	tcp[12] = 0xf0
+	packet := buildIPv4(TCP, tcp)
+	if err := ValidateTCP(packet); err != ErrTruncated {
+		t.Errorf("truncated options: %v", err)
+	}
+	orig := slices.Clone(packet)
+	SetTCPSeqWithChecksum(packet, 1)
+	if SetTCPMSSWithChecksum(packet, 1) || !slices.Equal(packet, orig) {
+		t.Error("invalid packet modified")
+	}
+	SetTCPSeqWithChecksum(nil, 1)
+
+	// Options with a length running past the header.
+	var kinds []byte
+	for opt := range ParseTCPOptions([]byte{1, 4, 2, 3, 9, 0}) {
+		kinds = append(kinds, opt.Kind())
+	}
+	if !slices.Equal(kinds, []byte{4}) {
+		t.Errorf("option kinds = %v", kinds)
+	}
+}
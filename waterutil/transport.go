@@ -0,0 +1,136 @@
+package waterutil
+
+import (
+	"encoding/binary"
+	"slices"
+)
+
+// Transport returns the upper-layer protocol of an IPv4 or IPv6 packet and
+// its header and payload, trimmed to the IP length. IPv6 extension headers
+// are skipped. For a non-first fragment, the protocol is returned together
+// with ErrFragmented.
+func Transport(packet []byte) (IPProtocol, []byte, error) {
+	version, err := ParseIPVersion(packet)
+	if err != nil {
+		return 0, nil, err
+	}
+	if version == 6 {
+		protocol, offset, err := ParseIPv6UpperLayer(packet)
+		if err != nil {
+			return 0, nil, err
+		}
+		if isNonFirstFragment(packet) {
+			return protocol, nil, ErrFragmented
+		}
+		return protocol, packet[offset : 40+int(IPv6PayloadLength(packet))], nil
+	}
+
+	p, err := NewIPv4Packet(packet)
+	if err != nil {
+		return 0, nil, err
+	}
+	if p.FragmentOffset() != 0 {
+		return p.Protocol(), nil, ErrFragmented
+	}
+	return p.Protocol(), p.Payload(), nil
+}
+
+// The accessors below take a whole IPv4 or IPv6 packet and locate the header
+// with Transport. Unlike IPv4SourcePort and friends, they check the packet and
+// return zero if it does not carry a complete header of the expected
+// protocol.
+
+// transport returns the upper-layer header of packet if its protocol is one
+// of protocols and it is at least minLen bytes long. ICMP is only accepted in
+// IPv4 packets and IPv6_ICMP only in IPv6 packets; any other protocol returns
+// ErrUnsupportedProtocol.
+func transport(packet []byte, minLen int, protocols ...IPProtocol) ([]byte, error) {
+	protocol, hdr, err := Transport(packet)
+	if err != nil {
+		return nil, err
+	}
+	if (protocol == ICMP && IPVersion(packet) != 4) || (protocol == IPv6_ICMP && IPVersion(packet) != 6) ||
+		!slices.Contains(protocols, protocol) {
+		return nil, ErrUnsupportedProtocol
+	}
+	if len(hdr) < minLen {
+		return nil, ErrTruncated
+	}
+	return hdr, nil
+}
+
+// SourcePort returns the source port of a TCP, UDP, DCCP or SCTP packet.
+func SourcePort(packet []byte) uint16 {
+	if hdr, err := transport(packet, 4, TCP, UDP, DCCP, SCTP); err == nil {
+		return binary.BigEndian.Uint16(hdr[0:2])
+	}
+	return 0
+}
+
+// DestinationPort returns the destination port of a TCP, UDP, DCCP or SCTP
+// packet.
+func DestinationPort(packet []byte) uint16 {
+	if hdr, err := transport(packet, 4, TCP, UDP, DCCP, SCTP); err == nil {
+		return binary.BigEndian.Uint16(hdr[2:4])
+	}
+	return 0
+}
+
+// UDPLength returns the length field of a UDP packet, which includes the 8
+// byte UDP header.
+func UDPLength(packet []byte) uint16 {
+	if hdr, err := transport(packet, 8, UDP); err == nil {
+		return binary.BigEndian.Uint16(hdr[4:6])
+	}
+	return 0
+}
+
+// UDPChecksum returns the checksum field of a UDP packet. Zero means that the
+// sender did not compute a checksum, which is only allowed for IPv4.
+func UDPChecksum(packet []byte) uint16 {
+	if hdr, err := transport(packet, 8, UDP); err == nil {
+		return binary.BigEndian.Uint16(hdr[6:8])
+	}
+	return 0
+}
+
+// ICMPType returns the type of an ICMPv4 or ICMPv6 packet. Compare it with the
+// ICMPv4 or ICMPv6 constants depending on the IP version.
+func ICMPType(packet []byte) byte {
+	if hdr, err := transport(packet, 4, ICMP, IPv6_ICMP); err == nil {
+		return hdr[0]
+	}
+	return 0
+}
+
+// ICMPCode returns the code of an ICMPv4 or ICMPv6 packet.
+func ICMPCode(packet []byte) byte {
+	if hdr, err := transport(packet, 4, ICMP, IPv6_ICMP); err == nil {
+		return hdr[1]
+	}
+	return 0
+}
+
+// ICMPIdentifier returns the identifier of an ICMPv4 or ICMPv6 echo request
+// or reply. For other message types, the first two bytes of the rest of the
+// header are returned.
+func ICMPIdentifier(packet []byte) uint16 {
+	if hdr, err := transport(packet, 8, ICMP, IPv6_ICMP); err == nil {
+		return binary.BigEndian.Uint16(hdr[4:6])
+	}
+	return 0
+}
+
+// SetICMPIdentifierWithChecksum sets the identifier of an ICMPv4 or ICMPv6
+// echo request or reply and updates its checksum. Packets that are not ICMP
+// are left untouched.
+func SetICMPIdentifierWithChecksum(packet []byte, id uint16) {
+	hdr, err := transport(packet, 8, ICMP, IPv6_ICMP)
+	if err != nil {
+		return
+	}
+	var old [2]byte
+	copy(old[:], hdr[4:6])
+	binary.BigEndian.PutUint16(hdr[4:], id)
+	updateTransportChecksum(packet, old[:], hdr[4:6], false)
+}
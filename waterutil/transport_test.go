@@ -0,0 +1,96 @@
+package waterutil
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestTransport(t *testing.T) {
+	udp4 := buildIPv4(UDP, udpHeader())
+	udp4 = append(udp4, 0, 0, 0) // Ethernet padding
+	udp6 := withExtensionHeaders(buildIPv6(UDP, udpHeader()))
+	for _, packet := range [][]byte{udp4, udp6} {
+		protocol, hdr, err := Transport(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if protocol != UDP || len(hdr) != len(udpHeader()) {
+			t.Errorf("Transport = %v, %d bytes", protocol, len(hdr))
+		}
+		if SourcePort(packet) != 1234 || DestinationPort(packet) != 53 {
+			t.Errorf("ports = %d, %d", SourcePort(packet), DestinationPort(packet))
+		}
+		if UDPLength(packet) != 11 {
+			t.Errorf("UDP length = %d", UDPLength(packet))
+		}
+		if want, _ := ComputeTransportChecksum(packet); UDPChecksum(packet) != want {
+			t.Errorf("UDP checksum = %#04x, want %#04x", UDPChecksum(packet), want)
+		}
+		if ICMPType(packet) != 0 || ICMPIdentifier(packet) != 0 {
+			t.Error("UDP packet has ICMP fields")
+		}
+	}
+
+	tcp6 := buildIPv6(TCP, tcpHeader())
+	if SourcePort(tcp6) != 1234 || DestinationPort(tcp6) != 80 || UDPLength(tcp6) != 0 {
+		t.Error("TCP over IPv6 fields")
+	}
+}
+
+func TestTransportICMP(t *testing.T) {
+	for _, tt := range []struct {
+		src, dst netip.Addr
+		typ      byte
+	}{
+		{netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2"), ICMPv4EchoRequest},
+		{netip.MustParseAddr("fd00::1"), netip.MustParseAddr("fd00::2"), ICMPv6EchoRequest},
+	} {
+		packet := BuildEchoRequest(tt.src, tt.dst, 0x1234, 1, []byte("ping"))
+		if ICMPType(packet) != tt.typ || ICMPCode(packet) != 0 || ICMPIdentifier(packet) != 0x1234 {
+			t.Errorf("%v: type %d, code %d, id %#x", tt.src, ICMPType(packet), ICMPCode(packet), ICMPIdentifier(packet))
+		}
+		if SourcePort(packet) != 0 {
+			t.Errorf("%v: ICMP packet has ports", tt.src)
+		}
+		SetICMPIdentifierWithChecksum(packet, 0xbeef)
+		if ICMPIdentifier(packet) != 0xbeef {
+			t.Errorf("%v: identifier not updated", tt.src)
+		}
+		checkValid(t, packet)
+	}
+
+	// ICMPv4 in IPv6 and ICMPv6 in IPv4 are not ICMP.
+	echo := []byte{ICMPv4EchoRequest, 0, 0, 0, 0x12, 0x34, 0, 1}
+	for _, packet := range [][]byte{buildIPv6(ICMP, echo), buildIPv4(IPv6_ICMP, echo)} {
+		if _, err := transport(packet, 8, ICMP, IPv6_ICMP); err != ErrUnsupportedProtocol {
+			t.Errorf("IPv%d: expected ErrUnsupportedProtocol, got %v", IPVersion(packet), err)
+		}
+		if ICMPType(packet) != 0 || ICMPIdentifier(packet) != 0 {
+			t.Errorf("IPv%d: ICMP header read from the wrong protocol", IPVersion(packet))
+		}
+	}
+}
+
+func TestTransportInvalid(t *testing.T) {
+	packet := buildIPv4(UDP, udpHeader())
+	for i := range packet[:20] {
+		if _, _, err := Transport(packet[:i]); err == nil {
+			t.Errorf("truncated to %d bytes: no error", i)
+		}
+		if SourcePort(packet[:i]) != 0 {
+			t.Errorf("truncated to %d bytes: port read", i)
+		}
+	}
+	if SourcePort(packet[:22]) != 0 {
+		t.Error("truncated UDP header: port read")
+	}
+
+	packet[7] = 1 // fragment offset 8
+	FixIPv4Checksum(packet)
+	if protocol, _, err := Transport(packet); protocol != UDP || err != ErrFragmented {
+		t.Errorf("fragment: %v, %v", protocol, err)
+	}
+	if SourcePort(packet) != 0 {
+		t.Error("fragment: port read")
+	}
+}
@@ -27,3 +27,29 @@ func IPDestination(packet []byte) net.IP {
 		return nil
 	}
 }
+
+// IPTransportProtocol returns the upper-layer protocol of an IPv4 or IPv6
+// packet. IPv6 extension headers are skipped; see IPv6Protocol.
+func IPTransportProtocol(packet []byte) IPProtocol {
+	switch IPVersion(packet) {
+	case 4:
+		return IPv4Protocol(packet)
+	case 6:
+		return IPv6Protocol(packet)
+	default:
+		return IPv6_NoNxt
+	}
+}
+
+// IPPayload returns the upper-layer header and payload of an IPv4 or IPv6
+// packet. IPv6 extension headers are skipped; see IPv6Payload.
+func IPPayload(packet []byte) []byte {
+	switch IPVersion(packet) {
+	case 4:
+		return IPv4Payload(packet)
+	case 6:
+		return IPv6Payload(packet)
+	default:
+		return nil
+	}
+}
@@ -3,6 +3,7 @@ package waterutil
 import (
 	"encoding/binary"
 	"net"
+	"net/netip"
 )
 
 func IPv4DSCP(packet []byte) byte {
@@ -21,6 +22,30 @@ func IPv4Identification(packet []byte) [2]byte {
 	return [2]byte{packet[4], packet[5]}
 }
 
+// IPv4Flags returns the three flag bits: reserved, Don't Fragment and More
+// Fragments, from most to least significant.
+func IPv4Flags(packet []byte) byte {
+	return packet[6] >> 5
+}
+
+func IPv4DontFragment(packet []byte) bool {
+	return packet[6]&0x40 != 0
+}
+
+func IPv4MoreFragments(packet []byte) bool {
+	return packet[6]&0x20 != 0
+}
+
+// IPv4IsFragment reports whether packet is a fragment of a larger datagram.
+func IPv4IsFragment(packet []byte) bool {
+	return IPv4MoreFragments(packet) || IPv4FragmentOffset(packet) != 0
+}
+
+// IPv4FragmentOffset returns the fragment offset in units of 8 bytes.
+func IPv4FragmentOffset(packet []byte) uint16 {
+	return binary.BigEndian.Uint16(packet[6:8]) & 0x1FFF
+}
+
 func IPv4TTL(packet []byte) byte {
 	return packet[8]
 }
@@ -71,3 +96,21 @@ func SetIPv4DestinationPort(packet []byte, port uint16) {
 	payload[2] = byte(port >> 8)
 	payload[3] = byte(port & 0xFF)
 }
+
+// DefaultTTL is the TTL or hop limit of packets built by this package.
+const DefaultTTL = 64
+
+// AppendIPv4Header appends a 20 byte IPv4 header without options and with a
+// valid checksum to b and returns the extended buffer. payloadLen is the
+// length of the payload that follows.
+func AppendIPv4Header(b []byte, protocol IPProtocol, ttl byte, src, dst netip.Addr, payloadLen int) []byte {
+	s, d := src.As4(), dst.As4()
+	start := len(b)
+	b = append(b, 0x45, 0)
+	b = binary.BigEndian.AppendUint16(b, uint16(20+payloadLen)) // #nosec G115 -- caller provides a valid length
+	b = append(b, 0, 0, 0, 0, ttl, byte(protocol), 0, 0)
+	b = append(b, s[:]...)
+	b = append(b, d[:]...)
+	FixIPv4Checksum(b[start:])
+	return b
+}
@@ -1,6 +1,53 @@
 package waterutil
 
-import "net"
+import (
+	"encoding/binary"
+	"iter"
+	"net"
+	"net/netip"
+)
+
+func IPv6TrafficClass(packet []byte) byte {
+	return byte(binary.BigEndian.Uint16(packet[0:2]) >> 4)
+}
+
+func SetIPv6TrafficClass(packet []byte, tc byte) {
+	binary.BigEndian.PutUint16(packet[0:2], (binary.BigEndian.Uint16(packet[0:2])&0xF00F)|(uint16(tc)<<4))
+}
+
+func IPv6FlowLabel(packet []byte) uint32 {
+	return binary.BigEndian.Uint32(packet[0:4]) & 0x000FFFFF
+}
+
+func SetIPv6FlowLabel(packet []byte, label uint32) {
+	binary.BigEndian.PutUint32(packet[0:4], (binary.BigEndian.Uint32(packet[0:4])&0xFFF00000)|(label&0x000FFFFF))
+}
+
+func IPv6PayloadLength(packet []byte) uint16 {
+	return binary.BigEndian.Uint16(packet[4:6])
+}
+
+func SetIPv6PayloadLength(packet []byte, length uint16) {
+	binary.BigEndian.PutUint16(packet[4:6], length)
+}
+
+// IPv6NextHeader returns the Next Header field of the fixed header. This is
+// either an extension header or the upper-layer protocol; see IPv6Protocol.
+func IPv6NextHeader(packet []byte) IPProtocol {
+	return IPProtocol(packet[6])
+}
+
+func SetIPv6NextHeader(packet []byte, next IPProtocol) {
+	packet[6] = byte(next)
+}
+
+func IPv6HopLimit(packet []byte) byte {
+	return packet[7]
+}
+
+func SetIPv6HopLimit(packet []byte, hopLimit byte) {
+	packet[7] = hopLimit
+}
 
 func IPv6Source(packet []byte) net.IP {
 	return net.IP(packet[8:24])
@@ -17,3 +64,145 @@ func IPv6Destination(packet []byte) net.IP {
 func SetIPv6Destination(packet []byte, dest net.IP) {
 	copy(packet[24:40], dest.To16())
 }
+
+// IsIPv6ExtensionHeader reports whether protocol is an IPv6 extension header
+// that can be skipped to reach the upper-layer header. ESP is not included,
+// as everything following it is encrypted.
+func IsIPv6ExtensionHeader(protocol IPProtocol) bool {
+	switch protocol {
+	case HOPOPT, IPv6_Route, IPv6_Frag, IPv6_Opts, AH, Mobility_Header, HIP, Shim6:
+		return true
+	default:
+		return false
+	}
+}
+
+// ipv6ExtensionHeaderLength returns the length of the extension header at the
+// start of hdr, which must be at least 2 bytes long.
+func ipv6ExtensionHeaderLength(protocol IPProtocol, hdr []byte) int {
+	switch protocol {
+	case IPv6_Frag:
+		return 8
+	case AH:
+		return (int(hdr[1]) + 2) * 4
+	default:
+		return (int(hdr[1]) + 1) * 8
+	}
+}
+
+// ipv6FragmentOffset returns the fragment offset of a Fragment header in units
+// of 8 bytes.
+func ipv6FragmentOffset(hdr []byte) uint16 {
+	return binary.BigEndian.Uint16(hdr[2:4]) >> 3
+}
+
+// IPv6ExtensionHeaders iterates over the extension headers of an IPv6 packet,
+// yielding the type and the raw bytes of each header. Iteration stops at the
+// upper-layer header, at a truncated header, or after the Fragment header of
+// a non-first fragment.
+func IPv6ExtensionHeaders(packet []byte) iter.Seq2[IPProtocol, []byte] {
+	return func(yield func(IPProtocol, []byte) bool) {
+		if len(packet) < 40 {
+			return
+		}
+		next := IPv6NextHeader(packet)
+		offset := 40
+		for IsIPv6ExtensionHeader(next) {
+			if len(packet) < offset+2 {
+				return
+			}
+			length := ipv6ExtensionHeaderLength(next, packet[offset:])
+			if len(packet) < offset+length {
+				return
+			}
+			hdr := packet[offset : offset+length]
+			if !yield(next, hdr) {
+				return
+			}
+			if next == IPv6_Frag && ipv6FragmentOffset(hdr) != 0 {
+				return
+			}
+			next = IPProtocol(hdr[0])
+			offset += length
+		}
+	}
+}
+
+// ParseIPv6UpperLayer walks the extension header chain of an IPv6 packet and
+// returns the upper-layer protocol and the offset of its header. For a
+// non-first fragment, the offset points to the fragment data following the
+// Fragment header; see IPv6FragmentHeader. For ESP, the offset of the ESP
+// header is returned. Bytes beyond the payload length are ignored.
+func ParseIPv6UpperLayer(packet []byte) (IPProtocol, int, error) {
+	if err := ValidateIPv6(packet); err != nil {
+		return 0, 0, err
+	}
+	packet = packet[:40+int(IPv6PayloadLength(packet))]
+	next := IPv6NextHeader(packet)
+	offset := 40
+	for hdrType, hdr := range IPv6ExtensionHeaders(packet) {
+		next = IPProtocol(hdr[0])
+		offset += len(hdr)
+		if hdrType == IPv6_Frag && ipv6FragmentOffset(hdr) != 0 {
+			return next, offset, nil
+		}
+	}
+	if IsIPv6ExtensionHeader(next) {
+		return 0, 0, ErrTruncated
+	}
+	return next, offset, nil
+}
+
+// IPv6Protocol returns the upper-layer protocol of an IPv6 packet, skipping
+// extension headers. If the chain cannot be walked, IPv6_NoNxt is returned.
+func IPv6Protocol(packet []byte) IPProtocol {
+	protocol, _, err := ParseIPv6UpperLayer(packet)
+	if err != nil {
+		return IPv6_NoNxt
+	}
+	return protocol
+}
+
+// IPv6Payload returns the upper-layer header and payload of an IPv6 packet,
+// skipping extension headers and trimmed to the payload length. It returns nil
+// if the chain cannot be walked.
+func IPv6Payload(packet []byte) []byte {
+	_, offset, err := ParseIPv6UpperLayer(packet)
+	if err != nil {
+		return nil
+	}
+	return packet[offset : 40+int(IPv6PayloadLength(packet))]
+}
+
+// IPv6FragmentHeader returns the Fragment extension header of an IPv6 packet,
+// or nil if there is none. See IPv6FragmentInfo for its fields.
+func IPv6FragmentHeader(packet []byte) []byte {
+	for hdrType, hdr := range IPv6ExtensionHeaders(packet) {
+		if hdrType == IPv6_Frag {
+			return hdr
+		}
+	}
+	return nil
+}
+
+// AppendIPv6Header appends a 40 byte IPv6 header to b and returns the
+// extended buffer. payloadLen is the length of the payload that follows.
+func AppendIPv6Header(b []byte, protocol IPProtocol, hopLimit byte, src, dst netip.Addr, payloadLen int) []byte {
+	s, d := src.As16(), dst.As16()
+	b = append(b, 0x60, 0, 0, 0)
+	b = binary.BigEndian.AppendUint16(b, uint16(payloadLen)) // #nosec G115 -- caller provides a valid length
+	b = append(b, byte(protocol), hopLimit)
+	b = append(b, s[:]...)
+	return append(b, d[:]...)
+}
+
+// IPv6FragmentInfo returns the fragment offset in units of 8 bytes, the More
+// Fragments flag and the identification of the Fragment header of an IPv6
+// packet. ok is false if there is no Fragment header.
+func IPv6FragmentInfo(packet []byte) (offset uint16, more bool, id uint32, ok bool) {
+	hdr := IPv6FragmentHeader(packet)
+	if hdr == nil {
+		return 0, false, 0, false
+	}
+	return ipv6FragmentOffset(hdr), hdr[3]&0x01 != 0, binary.BigEndian.Uint32(hdr[4:8]), true
+}
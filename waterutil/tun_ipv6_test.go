@@ -0,0 +1,121 @@
+package waterutil
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// withExtensionHeaders inserts a Hop-by-Hop Options, a Routing and a
+// Destination Options header between the fixed header and the upper-layer
+// header of an IPv6 packet built by buildIPv6.
+func withExtensionHeaders(packet []byte) []byte {
+	protocol := packet[6]
+	ext := []byte{
+		byte(IPv6_Route), 0, 1, 4, 0, 0, 0, 0, // Hop-by-Hop, PadN
+		byte(IPv6_Opts), 0, 0, 0, 0, 0, 0, 0, // Routing, no addresses
+		protocol, 1, 1, 12, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, // Destination Options, 16 bytes
+	}
+	out := make([]byte, 0, len(packet)+len(ext))
+	out = append(out, packet[:40]...)
+	out = append(out, ext...)
+	out = append(out, packet[40:]...)
+	out[6] = byte(HOPOPT)
+	binary.BigEndian.PutUint16(out[4:6], uint16(len(out)-40))
+	return out
+}
+
+func TestIPv6Fields(t *testing.T) {
+	packet := buildIPv6(UDP, udpHeader())
+	SetIPv6TrafficClass(packet, 0xb8)
+	SetIPv6FlowLabel(packet, 0x12345)
+	SetIPv6HopLimit(packet, 3)
+	if IPVersion(packet) != 6 {
+		t.Fatal("setting the traffic class must not change the version")
+	}
+	if IPv6TrafficClass(packet) != 0xb8 || IPv6FlowLabel(packet) != 0x12345 || IPv6HopLimit(packet) != 3 {
+		t.Fatalf("unexpected fields: %#x %#x %d", IPv6TrafficClass(packet), IPv6FlowLabel(packet), IPv6HopLimit(packet))
+	}
+	if IPv6PayloadLength(packet) != uint16(len(udpHeader())) || IPv6NextHeader(packet) != UDP {
+		t.Fatal("unexpected payload length or next header")
+	}
+}
+
+func TestIPv6ExtensionHeaders(t *testing.T) {
+	packet := withExtensionHeaders(buildIPv6(UDP, udpHeader()))
+	var types []IPProtocol
+	for hdrType := range IPv6ExtensionHeaders(packet) {
+		types = append(types, hdrType)
+	}
+	if len(types) != 3 || types[0] != HOPOPT || types[1] != IPv6_Route || types[2] != IPv6_Opts {
+		t.Fatalf("unexpected extension headers %v", types)
+	}
+
+	protocol, offset, err := ParseIPv6UpperLayer(packet)
+	if err != nil || protocol != UDP || offset != 40+32 {
+		t.Fatalf("expected UDP at offset 72, got %v at %d (%v)", protocol, offset, err)
+	}
+	if IPTransportProtocol(packet) != UDP || len(IPPayload(packet)) != len(udpHeader()) {
+		t.Fatal("unexpected upper-layer protocol or payload")
+	}
+	if err := FixTransportChecksum(packet); err != nil {
+		t.Fatal(err)
+	}
+	checkValid(t, packet)
+	SetSourcePortWithChecksum(packet, 4321)
+	checkValid(t, packet)
+
+	view, err := NewIPv6Packet(append(packet, 0, 0, 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if udp, err := view.UDP(); err != nil || udp.SourcePort() != 4321 {
+		t.Fatalf("expected UDP view with source port 4321, got %v", err)
+	}
+}
+
+func TestIPv6ExtensionHeadersTruncated(t *testing.T) {
+	packet := withExtensionHeaders(buildIPv6(UDP, udpHeader()))
+	packet = packet[:40+20]
+	binary.BigEndian.PutUint16(packet[4:6], 20)
+	if _, _, err := ParseIPv6UpperLayer(packet); err != ErrTruncated {
+		t.Fatalf("expected ErrTruncated, got %v", err)
+	}
+	if IPv6Protocol(packet) != IPv6_NoNxt || IPv6Payload(packet) != nil {
+		t.Fatal("a truncated chain must not yield an upper-layer protocol")
+	}
+}
+
+func TestIPv6Fragment(t *testing.T) {
+	packet := buildIPv6(UDP, udpHeader())
+	frag := []byte{byte(UDP), 0, 0, 0x11, 0, 0, 0, 42} // offset 2, more fragments
+	packet = append(packet[:40:40], append(frag, packet[40:]...)...)
+	packet[6] = byte(IPv6_Frag)
+	binary.BigEndian.PutUint16(packet[4:6], uint16(len(packet)-40))
+
+	if hdr := IPv6FragmentHeader(packet); len(hdr) != 8 || hdr[7] != 42 {
+		t.Fatalf("unexpected fragment header %v", hdr)
+	}
+	protocol, offset, err := ParseIPv6UpperLayer(packet)
+	if err != nil || protocol != UDP || offset != 48 {
+		t.Fatalf("expected UDP fragment data at offset 48, got %v at %d (%v)", protocol, offset, err)
+	}
+	if _, err := ComputeTransportChecksum(packet); err != ErrFragmented {
+		t.Fatalf("expected ErrFragmented, got %v", err)
+	}
+}
+
+func FuzzIPv6UpperLayer(f *testing.F) {
+	f.Add(withExtensionHeaders(buildIPv6(TCP, tcpHeader())))
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		protocol, offset, err := ParseIPv6UpperLayer(packet)
+		if err != nil {
+			return
+		}
+		if IsIPv6ExtensionHeader(protocol) && IPv6FragmentHeader(packet) == nil {
+			t.Fatalf("upper-layer protocol %v is an extension header", protocol)
+		}
+		if offset > len(packet) || len(IPPayload(packet)) > len(packet)-offset {
+			t.Fatalf("offset %d beyond packet of length %d", offset, len(packet))
+		}
+	})
+}
@@ -0,0 +1,203 @@
+package waterutil
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// The functions in this file check the length and consistency of frames and
+// packets before interpreting them and return an error instead of panicking.
+// Once ValidateMACFrame or ValidateIP succeeded, the unchecked header getters
+// of the corresponding layer are safe to use on the same slice.
+
+// ValidateMACFrame checks that frame holds a complete Ethernet header,
+// including any VLAN tags.
+func ValidateMACFrame(frame []byte) error {
+	if len(frame) < 14 || len(frame) < 14+int(MACTagging(frame)) {
+		return ErrTruncated
+	}
+	return nil
+}
+
+// ValidateIPv4 checks the version, header length and total length of an IPv4
+// packet. Trailing bytes beyond the total length, e.g. Ethernet padding, are
+// allowed.
+func ValidateIPv4(packet []byte) error {
+	if len(packet) < 20 {
+		return ErrTruncated
+	}
+	if IPVersion(packet) != 4 {
+		return ErrInvalidVersion
+	}
+	ihl := int(packet[0]&0x0F) * 4
+	if ihl < 20 {
+		return ErrInvalidIHL
+	}
+	if len(packet) < ihl {
+		return ErrTruncated
+	}
+	total := int(IPv4TotalLength(packet))
+	if total < ihl {
+		return ErrInvalidTotalLength
+	}
+	if len(packet) < total {
+		return ErrTruncated
+	}
+	return nil
+}
+
+// ValidateIPv6 checks the version and payload length of an IPv6 packet.
+// Trailing bytes beyond the payload length are allowed.
+func ValidateIPv6(packet []byte) error {
+	if len(packet) < 40 {
+		return ErrTruncated
+	}
+	if IPVersion(packet) != 6 {
+		return ErrInvalidVersion
+	}
+	if len(packet) < 40+int(binary.BigEndian.Uint16(packet[4:6])) {
+		return ErrInvalidPayloadLen
+	}
+	return nil
+}
+
+// ValidateIP checks an IPv4 or IPv6 packet.
+func ValidateIP(packet []byte) error {
+	version, err := ParseIPVersion(packet)
+	if err != nil {
+		return err
+	}
+	if version == 4 {
+		return ValidateIPv4(packet)
+	}
+	return ValidateIPv6(packet)
+}
+
+// ParseIPVersion returns the IP version of packet, which is either 4 or 6.
+func ParseIPVersion(packet []byte) (byte, error) {
+	if len(packet) == 0 {
+		return 0, ErrTruncated
+	}
+	switch version := IPVersion(packet); version {
+	case 4, 6:
+		return version, nil
+	default:
+		return 0, ErrInvalidVersion
+	}
+}
+
+// ParseMACEthertype is the checked variant of MACEthertype.
+func ParseMACEthertype(frame []byte) (Ethertype, error) {
+	if err := ValidateMACFrame(frame); err != nil {
+		return Ethertype{}, err
+	}
+	return MACEthertype(frame), nil
+}
+
+// ParseMACPayload is the checked variant of MACPayload.
+func ParseMACPayload(frame []byte) ([]byte, error) {
+	if err := ValidateMACFrame(frame); err != nil {
+		return nil, err
+	}
+	return MACPayload(frame), nil
+}
+
+// ParseIPSource is the checked variant of IPSource.
+func ParseIPSource(packet []byte) (net.IP, error) {
+	if err := ValidateIP(packet); err != nil {
+		return nil, err
+	}
+	return IPSource(packet), nil
+}
+
+// ParseIPDestination is the checked variant of IPDestination.
+func ParseIPDestination(packet []byte) (net.IP, error) {
+	if err := ValidateIP(packet); err != nil {
+		return nil, err
+	}
+	return IPDestination(packet), nil
+}
+
+// ParseIPv4Payload is the checked variant of IPv4Payload. The payload is
+// trimmed to the total length of the packet.
+func ParseIPv4Payload(packet []byte) ([]byte, error) {
+	if err := ValidateIPv4(packet); err != nil {
+		return nil, err
+	}
+	return packet[int(packet[0]&0x0F)*4 : IPv4TotalLength(packet)], nil
+}
+
+// ParseIPv6Payload returns the payload following the fixed IPv6 header,
+// trimmed to the payload length of the packet.
+func ParseIPv6Payload(packet []byte) ([]byte, error) {
+	if err := ValidateIPv6(packet); err != nil {
+		return nil, err
+	}
+	return packet[40 : 40+int(binary.BigEndian.Uint16(packet[4:6]))], nil
+}
+
+// hasPorts reports whether the header of protocol starts with 16-bit source
+// and destination ports.
+func hasPorts(protocol IPProtocol) bool {
+	switch protocol {
+	case TCP, UDP, SCTP, DCCP:
+		return true
+	default:
+		return false
+	}
+}
+
+func parseIPv4Ports(packet []byte) ([]byte, error) {
+	payload, err := ParseIPv4Payload(packet)
+	if err != nil {
+		return nil, err
+	}
+	if !hasPorts(IPv4Protocol(packet)) {
+		return nil, ErrUnsupportedProtocol
+	}
+	if IPv4FragmentOffset(packet) != 0 {
+		return nil, ErrFragmented
+	}
+	if len(payload) < 4 {
+		return nil, ErrTruncated
+	}
+	return payload, nil
+}
+
+// ParseIPv4SourcePort is the checked variant of IPv4SourcePort. It fails for
+// protocols without ports and for non-first fragments.
+func ParseIPv4SourcePort(packet []byte) (uint16, error) {
+	payload, err := parseIPv4Ports(packet)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(payload[0:2]), nil
+}
+
+// ParseIPv4DestinationPort is the checked variant of IPv4DestinationPort. It
+// fails for protocols without ports and for non-first fragments.
+func ParseIPv4DestinationPort(packet []byte) (uint16, error) {
+	payload, err := parseIPv4Ports(packet)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(payload[2:4]), nil
+}
+
+// ValidateTCP checks that an IPv4 or IPv6 packet carries a complete TCP
+// header, including options. Once it succeeded, the TCP getters are safe to
+// use on the same slice.
+func ValidateTCP(packet []byte) error {
+	if err := ValidateIP(packet); err != nil {
+		return err
+	}
+	protocol, hdr := transportHeader(packet)
+	switch {
+	case protocol != TCP:
+		return ErrUnsupportedProtocol
+	case isNonFirstFragment(packet):
+		return ErrFragmented
+	}
+	_, err := NewTCPSegment(hdr)
+	return err
+}
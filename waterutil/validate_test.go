@@ -0,0 +1,111 @@
+package waterutil
+
+import (
+	"testing"
+)
+
+func TestValidateIPv4(t *testing.T) {
+	packet := buildIPv4(UDP, udpHeader())
+	if err := ValidateIP(packet); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		mutate func([]byte) []byte
+		err    error
+	}{
+		{"empty", func(p []byte) []byte { return p[:0] }, ErrTruncated},
+		{"short", func(p []byte) []byte { return p[:19] }, ErrTruncated},
+		{"version", func(p []byte) []byte { p[0] = 0x55; return p }, ErrInvalidVersion},
+		{"ihl", func(p []byte) []byte { p[0] = 0x44; return p }, ErrInvalidIHL},
+		{"ihl beyond packet", func(p []byte) []byte { p[0] = 0x4f; return p }, ErrTruncated},
+		{"total length", func(p []byte) []byte { p[2], p[3] = 0, 10; return p }, ErrInvalidTotalLength},
+		{"truncated payload", func(p []byte) []byte { return p[:25] }, ErrTruncated},
+	}
+	for _, c := range cases {
+		p := c.mutate(append([]byte(nil), packet...))
+		if err := ValidateIP(p); err != c.err {
+			t.Errorf("%s: expected %v, got %v", c.name, c.err, err)
+		}
+	}
+}
+
+func TestParseIPv4Ports(t *testing.T) {
+	packet := buildIPv4(UDP, udpHeader())
+	if port, err := ParseIPv4SourcePort(packet); err != nil || port != 1234 {
+		t.Fatalf("unexpected source port %d, %v", port, err)
+	}
+	if port, err := ParseIPv4DestinationPort(packet); err != nil || port != 53 {
+		t.Fatalf("unexpected destination port %d, %v", port, err)
+	}
+
+	packet = buildIPv4(ICMP, []byte{8, 0, 0, 0})
+	if _, err := ParseIPv4SourcePort(packet); err != ErrUnsupportedProtocol {
+		t.Fatalf("expected ErrUnsupportedProtocol, got %v", err)
+	}
+
+	packet = buildIPv4(UDP, udpHeader()[:2])
+	if _, err := ParseIPv4SourcePort(packet); err != ErrTruncated {
+		t.Fatalf("expected ErrTruncated, got %v", err)
+	}
+}
+
+func TestValidateMACFrame(t *testing.T) {
+	frame := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 2, 0, 0, 0, 0, 1, 0x81, 0x00, 0, 1}
+	if _, err := ParseMACEthertype(frame); err != ErrTruncated {
+		t.Fatalf("expected ErrTruncated for truncated VLAN tag, got %v", err)
+	}
+	if _, err := ParseMACPayload(frame[:13]); err != ErrTruncated {
+		t.Fatalf("expected ErrTruncated, got %v", err)
+	}
+}
+
+func FuzzParseIP(f *testing.F) {
+	f.Add(buildIPv4(TCP, tcpHeader()))
+	f.Add(buildIPv4(UDP, udpHeader()))
+	f.Add(buildIPv6(TCP, tcpHeader()))
+	f.Add(buildIPv6(IPv6_ICMP, []byte{128, 0, 0, 0, 0x12, 0x34, 0, 1}))
+	f.Add([]byte{0x4f})
+
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		_, _ = ParseIPSource(packet)
+		_, _ = ParseIPDestination(packet)
+		_, _ = ParseIPv4Payload(packet)
+		_, _ = ParseIPv6Payload(packet)
+		_, _ = ParseIPv4SourcePort(packet)
+		_, _ = ParseIPv4DestinationPort(packet)
+		_, _ = ComputeTransportChecksum(packet)
+
+		if ValidateIP(packet) != nil {
+			return
+		}
+		// Everything below must be safe on a validated packet.
+		_ = IPSource(packet)
+		_ = IPDestination(packet)
+		_ = FixChecksums(packet)
+		if IPVersion(packet) == 4 {
+			_ = IPv4Payload(packet)
+			_ = IPv4Protocol(packet)
+			_ = IPv4TTL(packet)
+		}
+	})
+}
+
+func FuzzParseMACFrame(f *testing.F) {
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 2, 0, 0, 0, 0, 1, 0x08, 0x00, 0x45})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 2, 0, 0, 0, 0, 1, 0x88, 0xa8, 0, 1, 0x81, 0x00, 0, 2, 0x86, 0xdd})
+
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		_, _ = ParseMACEthertype(frame)
+		_, _ = ParseMACPayload(frame)
+
+		if ValidateMACFrame(frame) != nil {
+			return
+		}
+		_ = MACDestination(frame)
+		_ = MACSource(frame)
+		_ = MACEthertype(frame)
+		_ = MACPayload(frame)
+	})
+}
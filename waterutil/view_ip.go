@@ -0,0 +1,331 @@
+package waterutil
+
+import (
+	"encoding/binary"
+	"iter"
+	"net/netip"
+)
+
+// IPv4Packet is a zero-copy view of an IPv4 packet. Create it with
+// NewIPv4Packet, which validates the header so that all methods are safe to
+// call. Setters modify the underlying buffer in place and do not update any
+// checksum; call FixChecksum afterwards.
+type IPv4Packet []byte
+
+// NewIPv4Packet validates b and returns a view of it, trimmed to the total
+// length of the packet.
+func NewIPv4Packet(b []byte) (IPv4Packet, error) {
+	if err := ValidateIPv4(b); err != nil {
+		return nil, err
+	}
+	return IPv4Packet(b[:IPv4TotalLength(b)]), nil
+}
+
+func (p IPv4Packet) Version() byte {
+	return p[0] >> 4
+}
+
+// HeaderLength returns the length of the header in bytes.
+func (p IPv4Packet) HeaderLength() int {
+	return int(p[0]&0x0F) * 4
+}
+
+func (p IPv4Packet) DSCP() byte {
+	return p[1] >> 2
+}
+
+func (p IPv4Packet) SetDSCP(dscp byte) {
+	p[1] = (dscp << 2) | (p[1] & 0x03)
+}
+
+func (p IPv4Packet) ECN() byte {
+	return p[1] & 0x03
+}
+
+func (p IPv4Packet) SetECN(ecn byte) {
+	p[1] = (p[1] &^ 0x03) | (ecn & 0x03)
+}
+
+func (p IPv4Packet) TotalLength() uint16 {
+	return binary.BigEndian.Uint16(p[2:4])
+}
+
+func (p IPv4Packet) SetTotalLength(length uint16) {
+	binary.BigEndian.PutUint16(p[2:4], length)
+}
+
+func (p IPv4Packet) Identification() uint16 {
+	return binary.BigEndian.Uint16(p[4:6])
+}
+
+func (p IPv4Packet) SetIdentification(id uint16) {
+	binary.BigEndian.PutUint16(p[4:6], id)
+}
+
+// Flags returns the three flag bits: reserved, Don't Fragment and More
+// Fragments, from most to least significant.
+func (p IPv4Packet) Flags() byte {
+	return p[6] >> 5
+}
+
+func (p IPv4Packet) SetFlags(flags byte) {
+	p[6] = (flags << 5) | (p[6] & 0x1F)
+}
+
+func (p IPv4Packet) DontFragment() bool {
+	return p[6]&0x40 != 0
+}
+
+func (p IPv4Packet) MoreFragments() bool {
+	return p[6]&0x20 != 0
+}
+
+// FragmentOffset returns the fragment offset in units of 8 bytes.
+func (p IPv4Packet) FragmentOffset() uint16 {
+	return binary.BigEndian.Uint16(p[6:8]) & 0x1FFF
+}
+
+func (p IPv4Packet) SetFragmentOffset(offset uint16) {
+	binary.BigEndian.PutUint16(p[6:8], (binary.BigEndian.Uint16(p[6:8])&0xE000)|(offset&0x1FFF))
+}
+
+func (p IPv4Packet) TTL() byte {
+	return p[8]
+}
+
+func (p IPv4Packet) SetTTL(ttl byte) {
+	p[8] = ttl
+}
+
+func (p IPv4Packet) Protocol() IPProtocol {
+	return IPProtocol(p[9])
+}
+
+func (p IPv4Packet) SetProtocol(protocol IPProtocol) {
+	p[9] = byte(protocol)
+}
+
+func (p IPv4Packet) Checksum() uint16 {
+	return binary.BigEndian.Uint16(p[10:12])
+}
+
+func (p IPv4Packet) SetChecksum(checksum uint16) {
+	binary.BigEndian.PutUint16(p[10:12], checksum)
+}
+
+func (p IPv4Packet) Source() netip.Addr {
+	return netip.AddrFrom4([4]byte(p[12:16]))
+}
+
+// SetSource sets the source address. addr must be an IPv4 or IPv4-mapped
+// IPv6 address.
+func (p IPv4Packet) SetSource(addr netip.Addr) {
+	a := addr.As4()
+	copy(p[12:16], a[:])
+}
+
+func (p IPv4Packet) Destination() netip.Addr {
+	return netip.AddrFrom4([4]byte(p[16:20]))
+}
+
+// SetDestination sets the destination address. addr must be an IPv4 or
+// IPv4-mapped IPv6 address.
+func (p IPv4Packet) SetDestination(addr netip.Addr) {
+	a := addr.As4()
+	copy(p[16:20], a[:])
+}
+
+// Options returns the header options, if any.
+func (p IPv4Packet) Options() []byte {
+	return p[20:p.HeaderLength()]
+}
+
+func (p IPv4Packet) Payload() []byte {
+	return p[p.HeaderLength():]
+}
+
+// ComputeChecksum computes the header checksum, treating the checksum field
+// as zero.
+func (p IPv4Packet) ComputeChecksum() uint16 {
+	return ComputeIPv4Checksum(p)
+}
+
+// FixChecksum recomputes and stores the header checksum.
+func (p IPv4Packet) FixChecksum() {
+	FixIPv4Checksum(p)
+}
+
+func (p IPv4Packet) transport(protocol IPProtocol) ([]byte, error) {
+	if p.Protocol() != protocol {
+		return nil, ErrUnsupportedProtocol
+	}
+	if p.FragmentOffset() != 0 {
+		return nil, ErrFragmented
+	}
+	return p.Payload(), nil
+}
+
+// TCP returns a view of the TCP segment carried by p.
+func (p IPv4Packet) TCP() (TCPSegment, error) {
+	b, err := p.transport(TCP)
+	if err != nil {
+		return nil, err
+	}
+	return NewTCPSegment(b)
+}
+
+// UDP returns a view of the UDP datagram carried by p.
+func (p IPv4Packet) UDP() (UDPDatagram, error) {
+	b, err := p.transport(UDP)
+	if err != nil {
+		return nil, err
+	}
+	return NewUDPDatagram(b)
+}
+
+// ICMP returns a view of the ICMP message carried by p.
+func (p IPv4Packet) ICMP() (ICMPMessage, error) {
+	b, err := p.transport(ICMP)
+	if err != nil {
+		return nil, err
+	}
+	return NewICMPMessage(b)
+}
+
+// IPv6Packet is a zero-copy view of an IPv6 packet. Create it with
+// NewIPv6Packet, which validates the header so that all methods are safe to
+// call. Setters modify the underlying buffer in place and do not update any
+// checksum.
+type IPv6Packet []byte
+
+// NewIPv6Packet validates b and returns a view of it, trimmed to the payload
+// length of the packet.
+func NewIPv6Packet(b []byte) (IPv6Packet, error) {
+	if err := ValidateIPv6(b); err != nil {
+		return nil, err
+	}
+	return IPv6Packet(b[:40+int(binary.BigEndian.Uint16(b[4:6]))]), nil
+}
+
+func (p IPv6Packet) Version() byte {
+	return p[0] >> 4
+}
+
+func (p IPv6Packet) TrafficClass() byte {
+	return byte(binary.BigEndian.Uint16(p[0:2]) >> 4)
+}
+
+func (p IPv6Packet) SetTrafficClass(tc byte) {
+	binary.BigEndian.PutUint16(p[0:2], (binary.BigEndian.Uint16(p[0:2])&0xF00F)|(uint16(tc)<<4))
+}
+
+func (p IPv6Packet) FlowLabel() uint32 {
+	return binary.BigEndian.Uint32(p[0:4]) & 0x000FFFFF
+}
+
+func (p IPv6Packet) SetFlowLabel(label uint32) {
+	binary.BigEndian.PutUint32(p[0:4], (binary.BigEndian.Uint32(p[0:4])&0xFFF00000)|(label&0x000FFFFF))
+}
+
+func (p IPv6Packet) PayloadLength() uint16 {
+	return binary.BigEndian.Uint16(p[4:6])
+}
+
+func (p IPv6Packet) SetPayloadLength(length uint16) {
+	binary.BigEndian.PutUint16(p[4:6], length)
+}
+
+// NextHeader returns the Next Header field of the fixed header. See
+// Protocol for the upper-layer protocol.
+func (p IPv6Packet) NextHeader() IPProtocol {
+	return IPProtocol(p[6])
+}
+
+func (p IPv6Packet) SetNextHeader(next IPProtocol) {
+	p[6] = byte(next)
+}
+
+func (p IPv6Packet) HopLimit() byte {
+	return p[7]
+}
+
+func (p IPv6Packet) SetHopLimit(hopLimit byte) {
+	p[7] = hopLimit
+}
+
+func (p IPv6Packet) Source() netip.Addr {
+	return netip.AddrFrom16([16]byte(p[8:24]))
+}
+
+func (p IPv6Packet) SetSource(addr netip.Addr) {
+	a := addr.As16()
+	copy(p[8:24], a[:])
+}
+
+func (p IPv6Packet) Destination() netip.Addr {
+	return netip.AddrFrom16([16]byte(p[24:40]))
+}
+
+func (p IPv6Packet) SetDestination(addr netip.Addr) {
+	a := addr.As16()
+	copy(p[24:40], a[:])
+}
+
+// Protocol returns the upper-layer protocol, skipping extension headers. It
+// returns IPv6_NoNxt if the extension header chain is truncated.
+func (p IPv6Packet) Protocol() IPProtocol {
+	return IPv6Protocol(p)
+}
+
+// ExtensionHeaders iterates over the extension headers. See
+// IPv6ExtensionHeaders.
+func (p IPv6Packet) ExtensionHeaders() iter.Seq2[IPProtocol, []byte] {
+	return IPv6ExtensionHeaders(p)
+}
+
+// Payload returns the upper-layer header and payload, skipping extension
+// headers. It returns nil if the extension header chain is truncated.
+func (p IPv6Packet) Payload() []byte {
+	return IPv6Payload(p)
+}
+
+func (p IPv6Packet) transport(protocol IPProtocol) ([]byte, error) {
+	next, offset, err := ParseIPv6UpperLayer(p)
+	if err != nil {
+		return nil, err
+	}
+	if next != protocol {
+		return nil, ErrUnsupportedProtocol
+	}
+	if isNonFirstFragment(p) {
+		return nil, ErrFragmented
+	}
+	return p[offset:], nil
+}
+
+// TCP returns a view of the TCP segment carried by p.
+func (p IPv6Packet) TCP() (TCPSegment, error) {
+	b, err := p.transport(TCP)
+	if err != nil {
+		return nil, err
+	}
+	return NewTCPSegment(b)
+}
+
+// UDP returns a view of the UDP datagram carried by p.
+func (p IPv6Packet) UDP() (UDPDatagram, error) {
+	b, err := p.transport(UDP)
+	if err != nil {
+		return nil, err
+	}
+	return NewUDPDatagram(b)
+}
+
+// ICMP returns a view of the ICMPv6 message carried by p.
+func (p IPv6Packet) ICMP() (ICMPMessage, error) {
+	b, err := p.transport(IPv6_ICMP)
+	if err != nil {
+		return nil, err
+	}
+	return NewICMPMessage(b)
+}
@@ -0,0 +1,133 @@
+package waterutil
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestIPv4PacketView(t *testing.T) {
+	raw := append(buildIPv4(TCP, tcpHeader()), 0, 0, 0) // Ethernet padding
+	p, err := NewIPv4Packet(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p) != len(raw)-3 {
+		t.Fatalf("view was not trimmed to total length: %d", len(p))
+	}
+	if p.Source() != netip.MustParseAddr("192.168.0.1") || p.Destination() != netip.MustParseAddr("192.168.0.199") {
+		t.Fatalf("unexpected addresses %s -> %s", p.Source(), p.Destination())
+	}
+	if !p.DontFragment() || p.MoreFragments() || p.TTL() != 64 || p.Protocol() != TCP {
+		t.Fatal("unexpected header fields")
+	}
+
+	p.SetSource(netip.MustParseAddr("10.0.0.1"))
+	p.SetTTL(63)
+	p.SetDSCP(46)
+	p.SetECN(1)
+	p.FixChecksum()
+	if p.DSCP() != 46 || p.ECN() != 1 || p.ComputeChecksum() != p.Checksum() {
+		t.Fatal("setters corrupted the header")
+	}
+
+	seg, err := p.TCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seg.SourcePort() != 1234 || seg.DestinationPort() != 80 || seg.Seq() != 1 || seg.Flags() != 0x02 {
+		t.Fatal("unexpected TCP header fields")
+	}
+	seg.SetDestinationPort(443)
+	seg.FixChecksum(p.Source(), p.Destination())
+	checkValid(t, raw[:len(p)])
+
+	if _, err := p.UDP(); err != ErrUnsupportedProtocol {
+		t.Fatalf("expected ErrUnsupportedProtocol, got %v", err)
+	}
+}
+
+func TestIPv6PacketView(t *testing.T) {
+	p, err := NewIPv6Packet(buildIPv6(UDP, udpHeader()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetTrafficClass(0xb8)
+	p.SetFlowLabel(0x12345)
+	if p.TrafficClass() != 0xb8 || p.FlowLabel() != 0x12345 || p.Version() != 6 {
+		t.Fatal("traffic class and flow label interfere")
+	}
+
+	udp, err := p.UDP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(udp.Payload()) != "abc" {
+		t.Fatalf("unexpected UDP payload %q", udp.Payload())
+	}
+	p.SetDestination(netip.MustParseAddr("2001:db8::53"))
+	udp.FixChecksum(p.Source(), p.Destination())
+	checkValid(t, p)
+}
+
+func TestICMPMessageView(t *testing.T) {
+	p, _ := NewIPv6Packet(buildIPv6(IPv6_ICMP, []byte{128, 0, 0, 0, 0x12, 0x34, 0, 1}))
+	m, err := p.ICMP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Type() != 128 || m.Identifier() != 0x1234 || m.Sequence() != 1 {
+		t.Fatal("unexpected ICMPv6 header fields")
+	}
+	m.SetType(129)
+	m.FixChecksum(p.Source(), p.Destination())
+	checkValid(t, p)
+
+	// An IPv4-mapped source is still an IPv6 address.
+	copy(p[8:24], netip.MustParseAddr("::ffff:10.0.0.1").AsSlice())
+	m.FixChecksum(p.Source(), p.Destination())
+	checkValid(t, p)
+
+	p4, _ := NewIPv4Packet(buildIPv4(ICMP, []byte{8, 0, 0, 0, 0, 1, 0, 2}))
+	m, _ = p4.ICMP()
+	m.SetType(0)
+	m.FixChecksum(netip.Addr{}, netip.Addr{})
+	checkValid(t, p4)
+
+	// ICMPv4 ignores the addresses.
+	m.SetSequence(3)
+	m.FixChecksum(p4.Source(), p4.Destination())
+	checkValid(t, p4)
+}
+
+func TestViewsDoNotAllocate(t *testing.T) {
+	p4, _ := NewIPv4Packet(buildIPv4(TCP, tcpHeader()))
+	p6, _ := NewIPv6Packet(buildIPv6(TCP, tcpHeader()))
+	allocs := testing.AllocsPerRun(100, func() {
+		_ = p4.Source()
+		_ = p4.Destination()
+		_ = p6.Source()
+		_ = p6.Destination()
+		seg, _ := p6.TCP()
+		seg.FixChecksum(p6.Source(), p6.Destination())
+	})
+	if allocs != 0 {
+		t.Fatalf("expected no allocations, got %v", allocs)
+	}
+}
+
+func TestViewValidation(t *testing.T) {
+	if _, err := NewTCPSegment(make([]byte, 19)); err != ErrTruncated {
+		t.Fatalf("expected ErrTruncated, got %v", err)
+	}
+	seg := make([]byte, 20)
+	seg[12] = 0x40
+	if _, err := NewTCPSegment(seg); err != ErrInvalidDataOffset {
+		t.Fatalf("expected ErrInvalidDataOffset, got %v", err)
+	}
+	if _, err := NewUDPDatagram([]byte{0, 1, 0, 2, 0, 4, 0, 0}); err != ErrInvalidUDPLength {
+		t.Fatalf("expected ErrInvalidUDPLength, got %v", err)
+	}
+	if _, err := NewICMPMessage([]byte{8, 0, 0, 0}); err != ErrTruncated {
+		t.Fatalf("expected ErrTruncated, got %v", err)
+	}
+}
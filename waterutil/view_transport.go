@@ -0,0 +1,298 @@
+package waterutil
+
+import (
+	"encoding/binary"
+	"net/netip"
+)
+
+// transportChecksum computes the checksum of an upper-layer header and
+// payload whose checksum field is at off, treating that field as zero. If src
+// is valid, the pseudo-header of src and dst is included.
+func transportChecksum(b []byte, off int, protocol IPProtocol, src, dst netip.Addr) uint16 {
+	var sum uint32
+	switch {
+	case src.Is4():
+		s, d := src.As4(), dst.As4()
+		sum = PseudoHeaderChecksum(s[:], d[:], protocol, len(b))
+	case src.IsValid():
+		s, d := src.As16(), dst.As16()
+		sum = PseudoHeaderChecksum(s[:], d[:], protocol, len(b))
+	}
+	sum = ChecksumAdd(sum, b[:off])
+	sum = ChecksumAdd(sum, b[off+2:])
+	return ChecksumFold(sum)
+}
+
+// TCPSegment is a zero-copy view of a TCP header and its payload. Create it
+// with NewTCPSegment. Setters do not update the checksum; call FixChecksum
+// afterwards.
+type TCPSegment []byte
+
+// NewTCPSegment validates b and returns a view of it.
+func NewTCPSegment(b []byte) (TCPSegment, error) {
+	if len(b) < 20 {
+		return nil, ErrTruncated
+	}
+	off := int(b[12]>>4) * 4
+	if off < 20 {
+		return nil, ErrInvalidDataOffset
+	}
+	if len(b) < off {
+		return nil, ErrTruncated
+	}
+	return TCPSegment(b), nil
+}
+
+func (s TCPSegment) SourcePort() uint16 {
+	return binary.BigEndian.Uint16(s[0:2])
+}
+
+func (s TCPSegment) SetSourcePort(port uint16) {
+	binary.BigEndian.PutUint16(s[0:2], port)
+}
+
+func (s TCPSegment) DestinationPort() uint16 {
+	return binary.BigEndian.Uint16(s[2:4])
+}
+
+func (s TCPSegment) SetDestinationPort(port uint16) {
+	binary.BigEndian.PutUint16(s[2:4], port)
+}
+
+func (s TCPSegment) Seq() uint32 {
+	return binary.BigEndian.Uint32(s[4:8])
+}
+
+func (s TCPSegment) SetSeq(seq uint32) {
+	binary.BigEndian.PutUint32(s[4:8], seq)
+}
+
+func (s TCPSegment) Ack() uint32 {
+	return binary.BigEndian.Uint32(s[8:12])
+}
+
+func (s TCPSegment) SetAck(ack uint32) {
+	binary.BigEndian.PutUint32(s[8:12], ack)
+}
+
+// DataOffset returns the length of the header, including options, in bytes.
+func (s TCPSegment) DataOffset() int {
+	return int(s[12]>>4) * 4
+}
+
+// SetDataOffset sets the length of the header in bytes. It must be a multiple
+// of 4 between 20 and 60.
+func (s TCPSegment) SetDataOffset(offset int) {
+	s[12] = byte(offset/4)<<4 | (s[12] & 0x0F)
+}
+
+// Flags returns the 8 flag bits CWR, ECE, URG, ACK, PSH, RST, SYN and FIN, from
+// most to least significant.
+func (s TCPSegment) Flags() byte {
+	return s[13]
+}
+
+func (s TCPSegment) SetFlags(flags byte) {
+	s[13] = flags
+}
+
+func (s TCPSegment) Window() uint16 {
+	return binary.BigEndian.Uint16(s[14:16])
+}
+
+func (s TCPSegment) SetWindow(window uint16) {
+	binary.BigEndian.PutUint16(s[14:16], window)
+}
+
+func (s TCPSegment) Checksum() uint16 {
+	return binary.BigEndian.Uint16(s[16:18])
+}
+
+func (s TCPSegment) SetChecksum(checksum uint16) {
+	binary.BigEndian.PutUint16(s[16:18], checksum)
+}
+
+func (s TCPSegment) UrgentPointer() uint16 {
+	return binary.BigEndian.Uint16(s[18:20])
+}
+
+func (s TCPSegment) SetUrgentPointer(urgent uint16) {
+	binary.BigEndian.PutUint16(s[18:20], urgent)
+}
+
+// Options returns the raw header options, if any.
+func (s TCPSegment) Options() []byte {
+	return s[20:s.DataOffset()]
+}
+
+func (s TCPSegment) Payload() []byte {
+	return s[s.DataOffset():]
+}
+
+// ComputeChecksum computes the checksum for a segment sent from src to dst,
+// treating the checksum field as zero.
+func (s TCPSegment) ComputeChecksum(src, dst netip.Addr) uint16 {
+	return transportChecksum(s, 16, TCP, src, dst)
+}
+
+// FixChecksum recomputes and stores the checksum for a segment sent from src
+// to dst.
+func (s TCPSegment) FixChecksum(src, dst netip.Addr) {
+	s.SetChecksum(s.ComputeChecksum(src, dst))
+}
+
+// UDPDatagram is a zero-copy view of a UDP header and its payload. Create it
+// with NewUDPDatagram. Setters do not update the checksum; call FixChecksum
+// afterwards.
+type UDPDatagram []byte
+
+// NewUDPDatagram validates b and returns a view of it, trimmed to the UDP
+// length.
+func NewUDPDatagram(b []byte) (UDPDatagram, error) {
+	if len(b) < 8 {
+		return nil, ErrTruncated
+	}
+	length := int(binary.BigEndian.Uint16(b[4:6]))
+	if length < 8 {
+		return nil, ErrInvalidUDPLength
+	}
+	if len(b) < length {
+		return nil, ErrTruncated
+	}
+	return UDPDatagram(b[:length]), nil
+}
+
+func (d UDPDatagram) SourcePort() uint16 {
+	return binary.BigEndian.Uint16(d[0:2])
+}
+
+func (d UDPDatagram) SetSourcePort(port uint16) {
+	binary.BigEndian.PutUint16(d[0:2], port)
+}
+
+func (d UDPDatagram) DestinationPort() uint16 {
+	return binary.BigEndian.Uint16(d[2:4])
+}
+
+func (d UDPDatagram) SetDestinationPort(port uint16) {
+	binary.BigEndian.PutUint16(d[2:4], port)
+}
+
+func (d UDPDatagram) Length() uint16 {
+	return binary.BigEndian.Uint16(d[4:6])
+}
+
+func (d UDPDatagram) SetLength(length uint16) {
+	binary.BigEndian.PutUint16(d[4:6], length)
+}
+
+func (d UDPDatagram) Checksum() uint16 {
+	return binary.BigEndian.Uint16(d[6:8])
+}
+
+func (d UDPDatagram) SetChecksum(checksum uint16) {
+	binary.BigEndian.PutUint16(d[6:8], checksum)
+}
+
+func (d UDPDatagram) Payload() []byte {
+	return d[8:]
+}
+
+// ComputeChecksum computes the checksum for a datagram sent from src to dst,
+// treating the checksum field as zero. A result of zero is returned as
+// 0xFFFF, as zero means that no checksum is present.
+func (d UDPDatagram) ComputeChecksum(src, dst netip.Addr) uint16 {
+	checksum := transportChecksum(d, 6, UDP, src, dst)
+	if checksum == 0 {
+		checksum = 0xFFFF
+	}
+	return checksum
+}
+
+// FixChecksum recomputes and stores the checksum for a datagram sent from
+// src to dst.
+func (d UDPDatagram) FixChecksum(src, dst netip.Addr) {
+	d.SetChecksum(d.ComputeChecksum(src, dst))
+}
+
+// ICMPMessage is a zero-copy view of an ICMPv4 or ICMPv6 message. Both share
+// the same header layout. Create it with NewICMPMessage. Setters do not update
+// the checksum; call FixChecksum afterwards.
+type ICMPMessage []byte
+
+// NewICMPMessage validates b and returns a view of it.
+func NewICMPMessage(b []byte) (ICMPMessage, error) {
+	if len(b) < 8 {
+		return nil, ErrTruncated
+	}
+	return ICMPMessage(b), nil
+}
+
+func (m ICMPMessage) Type() byte {
+	return m[0]
+}
+
+func (m ICMPMessage) SetType(t byte) {
+	m[0] = t
+}
+
+func (m ICMPMessage) Code() byte {
+	return m[1]
+}
+
+func (m ICMPMessage) SetCode(code byte) {
+	m[1] = code
+}
+
+func (m ICMPMessage) Checksum() uint16 {
+	return binary.BigEndian.Uint16(m[2:4])
+}
+
+func (m ICMPMessage) SetChecksum(checksum uint16) {
+	binary.BigEndian.PutUint16(m[2:4], checksum)
+}
+
+// RestOfHeader returns the 4 type-specific header bytes.
+func (m ICMPMessage) RestOfHeader() []byte {
+	return m[4:8]
+}
+
+// Identifier returns the identifier of an echo request or reply.
+func (m ICMPMessage) Identifier() uint16 {
+	return binary.BigEndian.Uint16(m[4:6])
+}
+
+func (m ICMPMessage) SetIdentifier(id uint16) {
+	binary.BigEndian.PutUint16(m[4:6], id)
+}
+
+// Sequence returns the sequence number of an echo request or reply.
+func (m ICMPMessage) Sequence() uint16 {
+	return binary.BigEndian.Uint16(m[6:8])
+}
+
+func (m ICMPMessage) SetSequence(seq uint16) {
+	binary.BigEndian.PutUint16(m[6:8], seq)
+}
+
+// Body returns the data following the header, e.g. the echo payload or the
+// quoted packet of an error message.
+func (m ICMPMessage) Body() []byte {
+	return m[8:]
+}
+
+// ComputeChecksum computes the checksum, treating the checksum field as zero.
+// The message is ICMPv6, which includes the pseudo-header of src and dst, if
+// src is an IPv6 address, including an IPv4-mapped one, and ICMPv4, which has
+// none, if src is an IPv4 or the zero address.
+func (m ICMPMessage) ComputeChecksum(src, dst netip.Addr) uint16 {
+	if !src.Is6() {
+		return transportChecksum(m, 2, ICMP, netip.Addr{}, netip.Addr{})
+	}
+	return transportChecksum(m, 2, IPv6_ICMP, src, dst)
+}
+
+// FixChecksum recomputes and stores the checksum. See ComputeChecksum.
+func (m ICMPMessage) FixChecksum(src, dst netip.Addr) {
+	m.SetChecksum(m.ComputeChecksum(src, dst))
+}
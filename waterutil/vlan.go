@@ -0,0 +1,145 @@
+package waterutil
+
+import (
+	"encoding/binary"
+	"iter"
+)
+
+// IsVLANTPID reports whether t is a VLAN tag protocol identifier: 802.1Q
+// (0x8100), 802.1ad (0x88A8) or the pre-standard QinQ value 0x9100.
+func IsVLANTPID(t Ethertype) bool {
+	return t == IEEE802_1Q || t == IEEE802_1ad || t == QinQ
+}
+
+// VLANTag is a zero-copy view of a 4 byte VLAN tag within a MAC frame: the tag
+// protocol identifier followed by the tag control information (TCI).
+type VLANTag []byte
+
+func (t VLANTag) TPID() Ethertype {
+	return Ethertype{t[0], t[1]}
+}
+
+func (t VLANTag) SetTPID(tpid Ethertype) {
+	copy(t[0:2], tpid[:])
+}
+
+func (t VLANTag) TCI() uint16 {
+	return binary.BigEndian.Uint16(t[2:4])
+}
+
+func (t VLANTag) SetTCI(tci uint16) {
+	binary.BigEndian.PutUint16(t[2:4], tci)
+}
+
+// PCP returns the 3 bit priority code point.
+func (t VLANTag) PCP() byte {
+	return t[2] >> 5
+}
+
+func (t VLANTag) SetPCP(pcp byte) {
+	t[2] = (pcp << 5) | (t[2] & 0x1F)
+}
+
+// DEI returns the drop eligible indicator.
+func (t VLANTag) DEI() bool {
+	return t[2]&0x10 != 0
+}
+
+func (t VLANTag) SetDEI(dei bool) {
+	if dei {
+		t[2] |= 0x10
+	} else {
+		t[2] &^= 0x10
+	}
+}
+
+// VID returns the 12 bit VLAN identifier.
+func (t VLANTag) VID() uint16 {
+	return t.TCI() & 0x0FFF
+}
+
+func (t VLANTag) SetVID(vid uint16) {
+	t.SetTCI((t.TCI() & 0xF000) | (vid & 0x0FFF))
+}
+
+// VLANTCI builds tag control information from its fields.
+func VLANTCI(pcp byte, dei bool, vid uint16) uint16 {
+	tci := uint16(pcp&0x07)<<13 | vid&0x0FFF
+	if dei {
+		tci |= 0x1000
+	}
+	return tci
+}
+
+// MACVLANTags iterates over the VLAN tags of macFrame, from the outermost to
+// the innermost. The yielded tags alias macFrame and may be modified in place.
+func MACVLANTags(macFrame []byte) iter.Seq[VLANTag] {
+	return func(yield func(VLANTag) bool) {
+		for off := 12; len(macFrame) >= off+4 && IsVLANTPID(Ethertype(macFrame[off:off+2])); off += 4 {
+			if !yield(VLANTag(macFrame[off : off+4])) {
+				return
+			}
+		}
+	}
+}
+
+// PushVLANTag inserts a new outermost VLAN tag into macFrame and returns the
+// resulting frame. Like append, the frame is modified in place if it has at
+// least 4 bytes of spare capacity; otherwise a new buffer is allocated.
+func PushVLANTag(macFrame []byte, tpid Ethertype, tci uint16) ([]byte, error) {
+	if len(macFrame) < 14 {
+		return nil, ErrTruncated
+	}
+	macFrame = append(macFrame, 0, 0, 0, 0)
+	copy(macFrame[16:], macFrame[12:len(macFrame)-4])
+	tag := VLANTag(macFrame[12:16])
+	tag.SetTPID(tpid)
+	tag.SetTCI(tci)
+	return macFrame, nil
+}
+
+// AppendPushVLANTag appends macFrame with a new outermost VLAN tag to dst and
+// returns the extended buffer. macFrame is not modified.
+func AppendPushVLANTag(dst, macFrame []byte, tpid Ethertype, tci uint16) ([]byte, error) {
+	if len(macFrame) < 14 {
+		return dst, ErrTruncated
+	}
+	dst = append(dst, macFrame[:12]...)
+	dst = append(dst, tpid[0], tpid[1])
+	dst = binary.BigEndian.AppendUint16(dst, tci)
+	return append(dst, macFrame[12:]...), nil
+}
+
+// PopVLANTag removes the outermost VLAN tag of macFrame in place by moving the
+// MAC addresses forward. The returned frame aliases macFrame, starting 4 bytes
+// into it. Read the tag with MACVLANTags before popping it.
+func PopVLANTag(macFrame []byte) ([]byte, error) {
+	if err := checkVLANTagged(macFrame); err != nil {
+		return nil, err
+	}
+	copy(macFrame[4:16], macFrame[0:12])
+	return macFrame[4:], nil
+}
+
+// AppendPopVLANTag appends macFrame without its outermost VLAN tag to dst and
+// returns the extended buffer. macFrame is not modified.
+func AppendPopVLANTag(dst, macFrame []byte) ([]byte, error) {
+	if err := checkVLANTagged(macFrame); err != nil {
+		return dst, err
+	}
+	dst = append(dst, macFrame[:12]...)
+	return append(dst, macFrame[16:]...), nil
+}
+
+func checkVLANTagged(macFrame []byte) error {
+	if len(macFrame) < 14 {
+		return ErrTruncated
+	}
+	if !IsVLANTPID(Ethertype(macFrame[12:14])) {
+		return ErrNotVLANTagged
+	}
+	if len(macFrame) < 16 {
+		return ErrTruncated
+	}
+	return nil
+}
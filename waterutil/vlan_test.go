@@ -0,0 +1,112 @@
+package waterutil
+
+import (
+	"bytes"
+	"testing"
+)
+
+func untaggedFrame() []byte {
+	frame := []byte{
+		0x02, 0, 0, 0, 0, 1, 0x02, 0, 0, 0, 0, 2, 0x08, 0x00,
+	}
+	return append(frame, buildIPv4(UDP, udpHeader())...)
+}
+
+func TestVLANPushPop(t *testing.T) {
+	orig := untaggedFrame()
+	frame, err := PushVLANTag(append([]byte(nil), orig...), IEEE802_1Q, VLANTCI(5, false, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame, err = PushVLANTag(frame, IEEE802_1ad, VLANTCI(0, true, 200)); err != nil {
+		t.Fatal(err)
+	}
+	if frame, err = AppendPushVLANTag(nil, frame, QinQ, VLANTCI(7, false, 4095)); err != nil {
+		t.Fatal(err)
+	}
+
+	if MACTagging(frame) != 12 {
+		t.Fatalf("expected 12 bytes of tagging, got %d", MACTagging(frame))
+	}
+	if MACEthertype(frame) != IPv4 || !bytes.Equal(MACPayload(frame), MACPayload(orig)) {
+		t.Fatal("tagging must not change the ethertype or payload")
+	}
+	if !bytes.Equal(MACSource(frame), MACSource(orig)) || !bytes.Equal(MACDestination(frame), MACDestination(orig)) {
+		t.Fatal("tagging must not change the MAC addresses")
+	}
+
+	type tag struct {
+		tpid Ethertype
+		pcp  byte
+		dei  bool
+		vid  uint16
+	}
+	want := []tag{{QinQ, 7, false, 4095}, {IEEE802_1ad, 0, true, 200}, {IEEE802_1Q, 5, false, 100}}
+	var got []tag
+	for vt := range MACVLANTags(frame) {
+		got = append(got, tag{vt.TPID(), vt.PCP(), vt.DEI(), vt.VID()})
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d tags, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("tag %d: expected %+v, got %+v", i, want[i], got[i])
+		}
+	}
+
+	if frame, err = AppendPopVLANTag(nil, frame); err != nil {
+		t.Fatal(err)
+	}
+	if frame, err = PopVLANTag(frame); err != nil {
+		t.Fatal(err)
+	}
+	if frame, err = PopVLANTag(frame); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(frame, orig) {
+		t.Fatal("popping all tags must restore the original frame")
+	}
+	if _, err := PopVLANTag(frame); err != ErrNotVLANTagged {
+		t.Fatalf("expected ErrNotVLANTagged, got %v", err)
+	}
+	if _, err := PushVLANTag(frame[:13], IEEE802_1Q, 0); err != ErrTruncated {
+		t.Fatalf("expected ErrTruncated, got %v", err)
+	}
+	if _, err := AppendPushVLANTag(nil, frame[:13], IEEE802_1Q, 0); err != ErrTruncated {
+		t.Fatalf("expected ErrTruncated, got %v", err)
+	}
+}
+
+func TestVLANSetters(t *testing.T) {
+	frame, err := PushVLANTag(untaggedFrame(), IEEE802_1Q, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for vt := range MACVLANTags(frame) {
+		vt.SetPCP(3)
+		vt.SetDEI(true)
+		vt.SetVID(42)
+		if vt.TCI() != VLANTCI(3, true, 42) {
+			t.Fatalf("unexpected TCI %#04x", vt.TCI())
+		}
+		vt.SetDEI(false)
+		if vt.DEI() || vt.PCP() != 3 || vt.VID() != 42 {
+			t.Fatal("clearing DEI must not change PCP or VID")
+		}
+	}
+}
+
+func TestMACTaggingOuterOnly(t *testing.T) {
+	// An 802.1ad tag directly followed by IPv4 is single tagged.
+	frame, err := PushVLANTag(untaggedFrame(), IEEE802_1ad, VLANTCI(0, false, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if MACTagging(frame) != Tagged || MACEthertype(frame) != IPv4 {
+		t.Fatalf("expected a single tag, got %d bytes of tagging", MACTagging(frame))
+	}
+	if err := ValidateMACFrame(frame[:17]); err != ErrTruncated {
+		t.Fatalf("expected ErrTruncated, got %v", err)
+	}
+}
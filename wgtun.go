@@ -0,0 +1,357 @@
+package water
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// Defaults of TUNDeviceConfig.
+const (
+	DefaultTUNDeviceMTU       = 1420
+	DefaultTUNDeviceBatchSize = 128
+	DefaultLinkPollInterval   = time.Second
+)
+
+// TUNDeviceConfig defines parameters of the tun.Device returned by
+// NewTUNDevice. A zero-value TUNDeviceConfig is valid.
+type TUNDeviceConfig struct {
+	// MTU is reported when the MTU cannot be queried from the interface,
+	// e.g. for interfaces created with NewFromReadWriteCloser. Defaults to
+	// DefaultTUNDeviceMTU.
+	MTU int
+
+	// BatchSize is the number of packets read and written at once. Defaults
+	// to DefaultTUNDeviceBatchSize if the interface supports native vector
+	// reads, and is always 1 otherwise.
+	BatchSize int
+
+	// LinkPollInterval is the interval at which the link state and MTU of
+	// the OS network interface are checked to generate events. Defaults to
+	// DefaultLinkPollInterval. A negative value disables polling.
+	LinkPollInterval time.Duration
+}
+
+type tunDevice struct {
+	ifce      *Interface
+	mtu       int
+	batchSize int
+
+	events    chan tun.Event
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+var _ tun.Device = (*tunDevice)(nil)
+
+// NewTUNDevice exposes a TUN interface as a wireguard-go tun.Device, e.g. for
+// device.NewDevice. The device sends tun.EventUp once it is created and, for
+// interfaces backed by an OS network interface, link and MTU change events.
+// Closing the device closes ifce.
+func NewTUNDevice(ifce *Interface, config TUNDeviceConfig) (tun.Device, error) {
+	if !ifce.IsTUN() {
+		return nil, errors.New("interface is not a TUN interface")
+	}
+	if config.MTU <= 0 {
+		config.MTU = DefaultTUNDeviceMTU
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = DefaultTUNDeviceBatchSize
+	}
+	if !ifce.IsVectorNative() {
+		config.BatchSize = 1
+	}
+	if config.LinkPollInterval == 0 {
+		config.LinkPollInterval = DefaultLinkPollInterval
+	}
+
+	d := &tunDevice{
+		ifce:      ifce,
+		mtu:       config.MTU,
+		batchSize: config.BatchSize,
+		events:    make(chan tun.Event, 10),
+		done:      make(chan struct{}),
+	}
+	d.wg.Add(1)
+	go d.monitor(config.LinkPollInterval)
+	return d, nil
+}
+
+// File returns the file descriptor of the interface, or nil if it is not
+// backed by one.
+func (d *tunDevice) File() *os.File {
+	switch rwc := d.ifce.ReadWriteCloser.(type) {
+	case *os.File:
+		return rwc
+	case interface{ File() *os.File }:
+		return rwc.File()
+	default:
+		return nil
+	}
+}
+
+func (d *tunDevice) Read(bufs [][]byte, sizes []int, offset int) (int, error) {
+	return d.ifce.ReadOffset(bufs, sizes, offset)
+}
+
+func (d *tunDevice) Write(bufs [][]byte, offset int) (int, error) {
+	return d.ifce.WriteOffset(bufs, offset)
+}
+
+func (d *tunDevice) MTU() (int, error) {
+	if mtu, err := d.ifce.MTU(); err == nil {
+		return mtu, nil
+	}
+	return d.mtu, nil
+}
+
+func (d *tunDevice) Name() (string, error) {
+	return d.ifce.Name(), nil
+}
+
+func (d *tunDevice) Events() <-chan tun.Event {
+	return d.events
+}
+
+func (d *tunDevice) BatchSize() int {
+	return d.batchSize
+}
+
+// Close stops generating events, closes the events channel and closes the
+// interface.
+func (d *tunDevice) Close() error {
+	var err error
+	d.closeOnce.Do(func() {
+		close(d.done)
+		d.wg.Wait()
+		err = d.ifce.Close()
+	})
+	return err
+}
+
+// linkState returns whether the OS network interface is up and its MTU. ok is
+// false if there is no such interface.
+func (d *tunDevice) linkState() (up bool, mtu int, ok bool) {
+	iface, err := net.InterfaceByName(d.ifce.Name())
+	if err != nil {
+		return false, 0, false
+	}
+	return iface.Flags&net.FlagUp != 0, iface.MTU, true
+}
+
+func (d *tunDevice) monitor(interval time.Duration) {
+	defer d.wg.Done()
+	defer close(d.events)
+
+	send := func(event tun.Event) bool {
+		select {
+		case d.events <- event:
+			return true
+		case <-d.done:
+			return false
+		}
+	}
+
+	up, mtu, ok := d.linkState()
+	if !ok {
+		// A userspace interface is always up.
+		send(tun.EventUp)
+		<-d.done
+		return
+	}
+	if up && !send(tun.EventUp) {
+		return
+	}
+	if interval < 0 {
+		<-d.done
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+		}
+		newUp, newMTU, ok := d.linkState()
+		if !ok {
+			newUp, newMTU = false, mtu
+		}
+		if newUp != up {
+			var event tun.Event = tun.EventDown
+			if newUp {
+				event = tun.EventUp
+			}
+			if !send(event) {
+				return
+			}
+			up = newUp
+		}
+		if newMTU != mtu {
+			if !send(tun.EventMTUUpdate) {
+				return
+			}
+			mtu = newMTU
+		}
+	}
+}
+
+// tunDeviceOffset is the headroom in front of packets written to a tun.Device.
+// The Linux tun.Device with offloads enabled needs room for a virtio-net
+// header, and wireguard-go itself uses 16 bytes.
+const tunDeviceOffset = 16
+
+type tunDeviceRWC struct {
+	dev  tun.Device
+	pool *BufferPool
+	// zeroCopy passes written packets to dev as they are, without headroom.
+	// It is only safe for devices that neither need an offset nor modify
+	// the packets, such as the Windows wintun device.
+	zeroCopy bool
+
+	rmu     sync.Mutex
+	rbufs   [][]byte
+	rsizes  []int
+	pending [][]byte
+
+	wmu   sync.Mutex
+	wpkts []*PacketBuffer
+	wbufs [][]byte
+}
+
+// NewFromTUNDevice wraps a wireguard-go tun.Device, such as the one returned
+// by tun.CreateTUN or netstack.CreateNetTUN, as a TUN Interface with native
+// vector reads and writes. Vector reads should pass at least
+// dev.BatchSize() buffers, as devices with segmentation offload may return
+// that many packets at once. Closing the returned Interface closes dev.
+func NewFromTUNDevice(dev tun.Device) (*Interface, error) {
+	name, err := dev.Name()
+	if err != nil {
+		return nil, err
+	}
+	return NewFromReadWriteCloser(newTUNDeviceRWC(dev, false), TUN, name)
+}
+
+func newTUNDeviceRWC(dev tun.Device, zeroCopy bool) *tunDeviceRWC {
+	rwc := &tunDeviceRWC{
+		dev:      dev,
+		pool:     NewBufferPool(BufferConfig{Headroom: tunDeviceOffset}),
+		zeroCopy: zeroCopy,
+	}
+	// Nobody else consumes the events, and some devices block until they do.
+	go func() {
+		for range dev.Events() {
+		}
+	}()
+	return rwc
+}
+
+func (w *tunDeviceRWC) ReadVector(bufs [][]byte, sizes []int) (int, error) {
+	w.rmu.Lock()
+	defer w.rmu.Unlock()
+
+	if len(w.pending) > 0 {
+		n := 0
+		for ; n < len(bufs) && len(w.pending) > 0; n++ {
+			sizes[n] = copy(bufs[n], w.pending[0])
+			w.pending = w.pending[1:]
+		}
+		return n, nil
+	}
+	return w.dev.Read(bufs, sizes, 0)
+}
+
+func (w *tunDeviceRWC) WriteVector(bufs [][]byte) (int, error) {
+	w.wmu.Lock()
+	defer w.wmu.Unlock()
+
+	if w.zeroCopy {
+		return w.dev.Write(bufs, 0)
+	}
+
+	// Packets are copied behind the headroom the device needs. Devices with
+	// offloads also coalesce packets in place, which must not modify the
+	// caller's buffers.
+	defer w.releaseWrites()
+	for _, b := range bufs {
+		pb := w.pool.Get()
+		w.wpkts = append(w.wpkts, pb)
+		if len(b) > pb.Tailroom() {
+			return 0, errBufferRoom
+		}
+		copy(pb.Put(len(b)), b)
+		w.wbufs = append(w.wbufs, pb.buf[:pb.end])
+	}
+	n, err := w.dev.Write(w.wbufs, tunDeviceOffset)
+	if err != nil {
+		return min(n, len(bufs)), err
+	}
+	return len(bufs), nil
+}
+
+func (w *tunDeviceRWC) releaseWrites() {
+	for _, pb := range w.wpkts {
+		pb.Release()
+	}
+	w.wpkts = w.wpkts[:0]
+	w.wbufs = w.wbufs[:0]
+}
+
+// Read returns a single packet. The device may return several packets at
+// once, which are queued for the following reads.
+func (w *tunDeviceRWC) Read(b []byte) (int, error) {
+	w.rmu.Lock()
+	defer w.rmu.Unlock()
+
+	if len(w.pending) == 0 {
+		if w.rbufs == nil {
+			w.rbufs = make([][]byte, max(w.dev.BatchSize(), 1))
+			for i := range w.rbufs {
+				w.rbufs[i] = make([]byte, DefaultBufferSize)
+			}
+			w.rsizes = make([]int, len(w.rbufs))
+		}
+		n, err := w.dev.Read(w.rbufs, w.rsizes, 0)
+		for i := range n {
+			w.pending = append(w.pending, w.rbufs[i][:w.rsizes[i]])
+		}
+		if len(w.pending) == 0 {
+			return 0, err
+		}
+	}
+	n := copy(b, w.pending[0])
+	w.pending = w.pending[1:]
+	return n, nil
+}
+
+func (w *tunDeviceRWC) Write(b []byte) (int, error) {
+	if _, err := w.WriteVector([][]byte{b}); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (w *tunDeviceRWC) Close() error {
+	return w.dev.Close()
+}
+
+func (w *tunDeviceRWC) IsVectorNative() bool {
+	return true
+}
+
+// MTU returns the MTU of the device. See Interface.MTU.
+func (w *tunDeviceRWC) MTU() (int, error) {
+	return w.dev.MTU()
+}
+
+// File returns the file descriptor of the device.
+func (w *tunDeviceRWC) File() *os.File {
+	return w.dev.File()
+}
@@ -0,0 +1,186 @@
+package water
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/tun"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestTUNDevice(t *testing.T) {
+	q := &queueDevice{in: [][]byte{[]byte("packet")}}
+	ifce, err := NewFromReadWriteCloser(q, TUN, "water-test-none")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev, err := NewTUNDevice(ifce, TUNDeviceConfig{MTU: 1280})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case ev := <-dev.Events():
+		if ev != tun.EventUp {
+			t.Errorf("first event = %v, want EventUp", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no EventUp")
+	}
+	if mtu, err := dev.MTU(); err != nil || mtu != 1280 {
+		t.Errorf("MTU = %d, %v", mtu, err)
+	}
+	if name, _ := dev.Name(); name != "water-test-none" {
+		t.Errorf("Name = %q", name)
+	}
+	if dev.BatchSize() != 1 {
+		t.Errorf("BatchSize = %d for a non-vector interface", dev.BatchSize())
+	}
+	if dev.File() != nil {
+		t.Error("File is not nil for a userspace interface")
+	}
+
+	bufs := [][]byte{make([]byte, 64)}
+	sizes := []int{0}
+	if n, err := dev.Read(bufs, sizes, 16); err != nil || n != 1 || string(bufs[0][16:16+sizes[0]]) != "packet" {
+		t.Fatalf("Read = %d, %v, %q", n, err, bufs[0][16:16+sizes[0]])
+	}
+	if n, err := dev.Write([][]byte{[]byte("0123456789abcdefreply")}, 16); err != nil || n != 1 {
+		t.Fatalf("Write = %d, %v", n, err)
+	}
+	if string(q.out[0]) != "reply" {
+		t.Errorf("written %q", q.out[0])
+	}
+
+	if err := dev.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-dev.Events(); ok {
+		t.Error("events channel not closed")
+	}
+	if err := dev.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+}
+
+func TestTUNDeviceRejectsTAP(t *testing.T) {
+	ifce, err := NewFromReadWriteCloser(&queueDevice{}, TAP, "tap0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewTUNDevice(ifce, TUNDeviceConfig{}); err == nil {
+		t.Error("expected error for TAP interface")
+	}
+}
+
+type mtuDevice struct {
+	queueDevice
+}
+
+func (*mtuDevice) MTU() (int, error) {
+	return 9000, nil
+}
+
+func TestInterfaceMTU(t *testing.T) {
+	ifce, err := NewFromReadWriteCloser(&mtuDevice{}, TUN, "water-test-none")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mtu, err := ifce.MTU(); err != nil || mtu != 9000 {
+		t.Errorf("MTU = %d, %v", mtu, err)
+	}
+	ifce, err = NewFromReadWriteCloser(&queueDevice{}, TUN, "water-test-none")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ifce.MTU(); err == nil {
+		t.Error("expected error without an OS interface")
+	}
+}
+
+func TestFromTUNDevice(t *testing.T) {
+	ch := tuntest.NewChannelTUN()
+	ifce, err := NewFromTUNDevice(ch.TUN())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ifce.IsTUN() || !ifce.IsVectorNative() {
+		t.Error("not a vector-native TUN interface")
+	}
+	if mtu, err := ifce.MTU(); err != nil || mtu != tuntest.DefaultMTU {
+		t.Errorf("MTU = %d, %v", mtu, err)
+	}
+
+	ping := tuntest.Ping(netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("10.0.0.1"))
+	go func() { ch.Outbound <- ping }()
+	buf := make([]byte, 1500)
+	n, err := ifce.Read(buf)
+	if err != nil || !bytes.Equal(buf[:n], ping) {
+		t.Fatalf("Read = %d, %v", n, err)
+	}
+
+	packet := bytes.Clone(ping)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := ifce.Write(packet)
+		errc <- err
+	}()
+	select {
+	case got := <-ch.Inbound:
+		if !bytes.Equal(got, ping) {
+			t.Errorf("written % x", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("packet not written")
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(packet, ping) {
+		t.Error("Write modified the caller's buffer")
+	}
+
+	// Both adapters compose.
+	dev, err := NewTUNDevice(ifce, TUNDeviceConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mtu, _ := dev.MTU(); mtu != tuntest.DefaultMTU {
+		t.Errorf("device MTU = %d", mtu)
+	}
+	go func() { ch.Outbound <- ping }()
+	bufs := [][]byte{make([]byte, 1500)}
+	sizes := []int{0}
+	if n, err := dev.Read(bufs, sizes, 16); err != nil || n != 1 || !bytes.Equal(bufs[0][16:16+sizes[0]], ping) {
+		t.Fatalf("device Read = %d, %v", n, err)
+	}
+	if err := dev.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTUNDeviceRWCZeroCopy(t *testing.T) {
+	ch := tuntest.NewChannelTUN()
+	rwc := newTUNDeviceRWC(ch.TUN(), true)
+	defer rwc.Close()
+
+	ping := tuntest.Ping(netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("10.0.0.1"))
+	errc := make(chan error, 1)
+	go func() {
+		_, err := rwc.WriteVector([][]byte{ping})
+		errc <- err
+	}()
+	select {
+	case got := <-ch.Inbound:
+		if !bytes.Equal(got, ping) {
+			t.Errorf("written % x", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("packet not written")
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}